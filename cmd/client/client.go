@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -12,20 +18,42 @@ import (
 	"github.com/soerenschneider/dyndns/internal/client"
 	"github.com/soerenschneider/dyndns/internal/client/dispatchers"
 	"github.com/soerenschneider/dyndns/internal/client/resolvers"
+	"github.com/soerenschneider/dyndns/internal/common"
 	"github.com/soerenschneider/dyndns/internal/conf"
 	"github.com/soerenschneider/dyndns/internal/events/mqtt"
 	sink "github.com/soerenschneider/dyndns/internal/events/nats"
 	"github.com/soerenschneider/dyndns/internal/metrics"
 	"github.com/soerenschneider/dyndns/internal/notification"
 	"github.com/soerenschneider/dyndns/internal/util"
+	"github.com/soerenschneider/dyndns/internal/vault"
 	"github.com/soerenschneider/dyndns/internal/verification"
 	"github.com/soerenschneider/dyndns/internal/verification/key_provider"
 	"go.uber.org/multierr"
 )
 
+const (
+	// sharedResolverMaxAge defines how long resolved addresses are shared between hosts
+	sharedResolverMaxAge = 10 * time.Second
+	// shutdownTimeout is the maximum time to flush pending update requests and close the dispatchers after a signal
+	// has been received
+	shutdownTimeout = 15 * time.Second
+	// defaultOnceTimeout is the default deadline of a single run
+	defaultOnceTimeout = 5 * time.Minute
+)
+
+// exit codes of a single run, see client.OnceResult
+const (
+	exitUnchanged             = 0
+	exitFailed                = 1
+	exitUpdatedConfirmed      = 10
+	exitDispatchedUnconfirmed = 11
+)
+
 var (
 	configPath      string
 	once            bool
+	onceTimeout     time.Duration
+	onceWait        bool
 	forceSendUpdate bool
 	debug           bool
 	cmdVersion      bool
@@ -51,18 +79,19 @@ func main() {
 
 	config, err := conf.ReadClientConfig(configPath)
 	dieOnError(err, "couldn't read config file")
-	fmt.Println(config)
 
 	err = conf.ParseClientConfEnv(config)
 	dieOnError(err, "could not parse env variables")
 
+	// supply once flag value
+	config.Once = once
+	config.OnceTimeout = onceTimeout
+	config.OnceWait = onceWait
+
 	err = conf.ValidateConfig(config)
 	dieOnError(err, "Verification of config failed")
 
-	metrics.MqttBrokersConfiguredTotal.Set(float64(len(config.Brokers)))
-
-	// supply once flag value
-	config.Once = once
+	metrics.MqttBrokersConfiguredTotal.Set(float64(len(config.GetBrokers())))
 
 	conf.PrintFields(config, conf.SensitiveFields...)
 	RunClient(config)
@@ -71,6 +100,8 @@ func main() {
 func parseFlags() {
 	flag.StringVar(&configPath, "config", "", "Path to the config file")
 	flag.BoolVar(&once, "once", false, "Do not run as a daemon")
+	flag.DurationVar(&onceTimeout, "once-timeout", defaultOnceTimeout, "Deadline for delivering the update request and verifying the DNS record when running with -once")
+	flag.BoolVar(&onceWait, "once-wait", false, "Wait for the DNS record to be verified when running with -once")
 	flag.BoolVar(&forceSendUpdate, "force", false, "Force sending an update request at start")
 	flag.BoolVar(&cmdVersion, "version", false, "Print version and exit")
 	flag.BoolVar(&cmdGenKeypair, "gen-keypair", false, "Generate keypair")
@@ -84,19 +115,46 @@ func dieOnError(err error, msg string) {
 	}
 }
 
+func buildMqttNotifier(config *conf.ClientConf, broker conf.MqttBrokerConfig) (client.EventDispatch, error) {
+	tlsConfig, err := broker.TlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []mqtt.MqttClientOpts{mqtt.WithPublishQos(config.Qos), mqtt.WithRetain(config.Retain)}
+	if len(broker.Username) > 0 {
+		opts = append(opts, mqtt.WithClientCredentials(broker.Username, broker.Password))
+	}
+	if config.HomeAssistant.Enabled {
+		opts = append(opts, mqtt.WithWill(mqtt.HomeAssistantAvailabilityTopic(config.ClientId), []byte(mqtt.HomeAssistantPayloadOffline)))
+	}
+
+	if !config.UsesProtocolV5() {
+		return mqtt.NewMqttClient(broker.Url, config.ClientId, tlsConfig, config.PayloadFormat, opts...)
+	}
+
+	if config.MessageExpiry > 0 {
+		opts = append(opts, mqtt.WithMessageExpiry(config.MessageExpiry))
+	}
+	if config.AwaitResponse {
+		opts = append(opts, mqtt.WithAwaitResponse())
+	}
+	return mqtt.NewMqttV5Client(broker.Url, config.ClientId, tlsConfig, config.PayloadFormat, opts...)
+}
+
 // nolint cyclop
 func buildNotifiers(config *conf.ClientConf) (map[string]client.EventDispatch, error) {
 	disp := map[string]client.EventDispatch{}
 
 	var errs error
-	if len(config.Brokers) > 0 {
+	if brokers := config.GetBrokers(); len(brokers) > 0 {
 		log.Info().Str("component", "client").Msg("Building MQTT notifier(s)")
-		for _, broker := range config.Brokers {
-			dispatcher, err := mqtt.NewMqttClient(broker, config.ClientId, fmt.Sprintf("dyndns/%s", config.Host), config.TlsConfig())
+		for _, broker := range brokers {
+			dispatcher, err := buildMqttNotifier(config, broker)
 			if err != nil {
 				errs = multierr.Append(errs, err)
 			} else {
-				disp[broker] = dispatcher
+				disp[broker.Url] = dispatcher
 			}
 		}
 	}
@@ -107,7 +165,7 @@ func buildNotifiers(config *conf.ClientConf) (map[string]client.EventDispatch, e
 		if err != nil {
 			errs = multierr.Append(errs, err)
 		} else {
-			dispatcher, err := sink.NewNatsDyndnsClient(&config.NatsConfig, js)
+			dispatcher, err := sink.NewNatsDyndnsClient(&config.NatsConfig, js, config.PayloadFormat)
 			if err != nil {
 				errs = multierr.Append(errs, err)
 			} else {
@@ -116,10 +174,25 @@ func buildNotifiers(config *conf.ClientConf) (map[string]client.EventDispatch, e
 		}
 	}
 
+	if config.IsConfiguredForRequestReply() {
+		log.Info().Msg("Building NATS request-reply notifier")
+		js, err := sink.Connect(config.NatsConfig)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+		} else {
+			dispatcher, err := sink.NewNatsRequestReplyClient(&config.NatsConfig, js, config.PayloadFormat)
+			if err != nil {
+				errs = multierr.Append(errs, err)
+			} else {
+				disp[config.Url+"/"+config.RequestReplySubject] = dispatcher
+			}
+		}
+	}
+
 	if len(config.HttpDispatcherConf) > 0 {
 		log.Info().Str("component", "client").Msg("Building HTTP notifier")
 		for _, dispatcher := range config.HttpDispatcherConf {
-			httpDispatcher, err := dispatchers.NewHttpDispatcher(dispatcher.Url)
+			httpDispatcher, err := dispatchers.NewHttpDispatcher(dispatcher.Url, config.PayloadFormat)
 			if err != nil {
 				errs = multierr.Append(errs, err)
 			} else {
@@ -130,11 +203,16 @@ func buildNotifiers(config *conf.ClientConf) (map[string]client.EventDispatch, e
 
 	if len(config.SqsQueue) > 0 {
 		log.Info().Str("component", "client").Msg("Building AWS SQS notifier")
-		sqs, err := dispatchers.NewSqsDispatcher(config.SqsConfig, nil)
+		provider, err := vault.NewAwsCredentialsProvider(&config.VaultConfig)
 		if err != nil {
 			errs = multierr.Append(errs, err)
 		} else {
-			disp["sqs"] = sqs
+			sqs, err := dispatchers.NewSqsDispatcher(config.SqsConfig, provider, config.PayloadFormat)
+			if err != nil {
+				errs = multierr.Append(errs, err)
+			} else {
+				disp["sqs"] = sqs
+			}
 		}
 	}
 
@@ -145,18 +223,12 @@ func RunClient(config *conf.ClientConf) {
 	metrics.Version.WithLabelValues(internal.BuildVersion, internal.CommitHash, internal.GoVersion).Set(1)
 	metrics.ProcessStartTime.SetToCurrentTime()
 
-	provider, err := buildKeyProvider(config)
-	dieOnError(err, "can not build key key_provider")
-
-	keypair, err := getKeypair(provider)
-	dieOnError(err, "can not get keypair")
+	hosts, err := config.GetHosts()
+	dieOnError(err, "invalid hosts configuration")
 
 	notificationImpl, err := buildNotificationImpl(config)
 	dieOnError(err, "Can't build email notification")
 
-	resolver, err := buildResolver(config)
-	dieOnError(err, "could not build ip resolver")
-
 	dispatchers, err := buildNotifiers(config)
 	if len(dispatchers) == 0 {
 		log.Fatal().Str("component", "client").Err(err).Msg("no dispatchers built")
@@ -165,38 +237,338 @@ func RunClient(config *conf.ClientConf) {
 		log.Error().Str("component", "client").Err(err).Msg("could not build all dispatchers")
 	}
 
-	reconciler, err := client.NewReconciler(dispatchers, true)
+	var reconcilerOpts []client.ReconcilerOpts
+	var store *client.StateStore
+	if len(config.StateFile) > 0 {
+		store, err = client.NewStateStore(config.StateFile)
+		dieOnError(err, "could not build state store")
+		reconcilerOpts = append(reconcilerOpts, client.WithReconcilerStateStore(store))
+	}
+
+	reconciler, err := client.NewReconciler(dispatchers, config.Outbox, reconcilerOpts...)
 	dieOnError(err, "could not build reconciler")
 
+	var verifier util.RecordVerifier
+	var recordStore *sink.NatsRecordStore
+	if len(config.RecordsBucket) > 0 {
+		recordStore, err = buildRecordStore(config)
+		dieOnError(err, "could not build nats record store")
+		verifier = recordStore
+	} else {
+		verifier, err = util.NewRecordVerifier(config.DnsVerification)
+		dieOnError(err, "could not build dns verifier")
+	}
+
 	opts := []client.Opts{
 		client.WithInterval(15 * time.Second),
+		client.WithStateMachineConfig(config.StateMachine),
+		client.WithRecordVerifier(verifier),
 	}
 
 	if forceSendUpdate {
 		opts = append(opts, client.WithForceSendUpdate())
 	}
 
-	client, err := client.NewClient(resolver, keypair, reconciler, notificationImpl, opts...)
+	if store != nil {
+		opts = append(opts, client.WithStateStore(store))
+	}
+
+	homeAssistant, err := buildHomeAssistant(config, dispatchers)
+	dieOnError(err, "could not build home assistant publisher")
+	for _, publisher := range homeAssistant {
+		opts = append(opts, client.WithStatusListener(publisher))
+	}
+
+	clients, err := buildClients(config, hosts, reconciler, notificationImpl, opts)
 	dieOnError(err, "could not build client")
 
-	go reconciler.Run()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	if config.Once {
-		_, err := client.Resolve(nil)
-		dieOnError(err, "error resolving ip")
-	} else {
-		go metrics.StartMetricsServer(config.MetricsListener)
-		client.Run()
+		exitCode := runOnce(ctx, config, reconciler, clients)
+		stop()
+		os.Exit(exitCode)
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		reconciler.Run(ctx)
+	}()
+
+	var handlers map[string]http.Handler
+	if config.ApiEnabled {
+		api, err := client.NewApi(reconciler, config.ApiToken, clients...)
+		dieOnError(err, "could not build api")
+		handlers = api.Handlers()
 	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		metrics.StartMetricsServer(ctx, config.MetricsListener, handlers)
+	}()
+
+	for _, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Run(ctx)
+		}()
+	}
+
+	if recordStore != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchAppliedRecords(ctx, recordStore, clients)
+		}()
+	}
+
+	for _, publisher := range homeAssistant {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			publisher.Run(ctx)
+		}()
+	}
+
+	<-ctx.Done()
+	log.Info().Str("component", "client").Msg("Shutting down, waiting for components to stop")
+	wg.Wait()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := reconciler.Shutdown(shutdownCtx); err != nil {
+		log.Error().Err(err).Str("component", "client").Msg("could not gracefully shutdown reconciler")
+	}
+	log.Info().Str("component", "client").Msg("Shutdown complete")
 }
 
-func buildResolver(conf *conf.ClientConf) (resolvers.IpResolver, error) {
-	if len(conf.NetworkInterface) > 0 {
-		log.Info().Str("component", "client").Msgf("Building new resolver for interface %s", conf.NetworkInterface)
-		return resolvers.NewInterfaceResolver(conf.NetworkInterface, conf.Host)
+// buildHomeAssistant builds a Home Assistant publisher for each MQTT broker
+func buildHomeAssistant(config *conf.ClientConf, dispatchers map[string]client.EventDispatch) ([]*mqtt.HomeAssistant, error) {
+	if !config.HomeAssistant.Enabled {
+		return nil, nil
+	}
+
+	var publishers []*mqtt.HomeAssistant
+	for _, broker := range config.GetBrokers() {
+		bus, ok := dispatchers[broker.Url].(mqtt.HomeAssistantBus)
+		if !ok {
+			continue
+		}
+		publisher, err := mqtt.NewHomeAssistant(bus, config.ClientId, config.HomeAssistant.DiscoveryPrefix)
+		if err != nil {
+			return nil, err
+		}
+		publishers = append(publishers, publisher)
+	}
+
+	if len(publishers) == 0 {
+		return nil, errors.New("home assistant integration requires a MQTT broker")
+	}
+	return publishers, nil
+}
+
+func buildRecordStore(config *conf.ClientConf) (*sink.NatsRecordStore, error) {
+	log.Info().Str("component", "client").Str("bucket", config.RecordsBucket).Msg("Verifying records using NATS KV")
+	js, err := sink.Connect(config.NatsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return sink.NewNatsRecordStore(ctx, js, config.RecordsBucket)
+}
+
+// watchAppliedRecords lets clients re-evaluate their state as soon as a server applied their record
+func watchAppliedRecords(ctx context.Context, store *sink.NatsRecordStore, clients []*client.Client) {
+	clientsByHost := make(map[string]*client.Client, len(clients))
+	hosts := make([]string, 0, len(clients))
+	for _, c := range clients {
+		clientsByHost[c.Host()] = c
+		hosts = append(hosts, c.Host())
+	}
+
+	for {
+		err := store.Watch(ctx, hosts, func(record common.DnsRecord) {
+			log.Info().Str("component", "client").Str("host", record.Host).Msg("Server applied record")
+			if c, ok := clientsByHost[record.Host]; ok {
+				c.Reevaluate()
+			}
+		})
+		if err == nil {
+			return
+		}
+
+		log.Error().Err(err).Str("component", "client").Msg("Watching applied records failed, retrying")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// runOnce runs a single cycle for all clients concurrently and returns the exit code of the most severe result
+func runOnce(ctx context.Context, config *conf.ClientConf, reconciler *client.Reconciler, clients []*client.Client) int {
+	ctx, cancel := context.WithTimeout(ctx, config.OnceTimeout)
+	defer cancel()
+
+	results := make([]client.OnceResult, len(clients))
+	wg := sync.WaitGroup{}
+	for index, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := c.RunOnce(ctx, config.OnceWait)
+			if err != nil {
+				log.Error().Err(err).Str("component", "client").Str("host", c.Host()).Msg("error while running once")
+			}
+			log.Info().Str("component", "client").Str("host", c.Host()).Str("result", result.String()).Msg("Finished run")
+			results[index] = result
+		}()
+	}
+	wg.Wait()
+
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer closeCancel()
+	if err := reconciler.Close(closeCtx); err != nil {
+		log.Error().Err(err).Str("component", "client").Msg("could not close dispatchers")
+	}
+
+	result := client.OnceUnchanged
+	for _, r := range results {
+		result = max(result, r)
+	}
+
+	switch result {
+	case client.OnceUnchanged:
+		return exitUnchanged
+	case client.OnceUpdatedConfirmed:
+		return exitUpdatedConfirmed
+	case client.OnceDispatchedUnconfirmed:
+		return exitDispatchedUnconfirmed
+	default:
+		return exitFailed
+	}
+}
+
+// buildClients builds a client with its own state machine and keypair for each host. Hosts without a resolver
+// override share the results of a single resolver.
+func buildClients(config *conf.ClientConf, hosts []conf.HostConfig, reconciler *client.Reconciler, notificationImpl notification.Notification, opts []client.Opts) ([]*client.Client, error) {
+	var sharedResolver *resolvers.SharedResolver
+	clients := make([]*client.Client, 0, len(hosts))
+	for _, host := range hosts {
+		provider, err := buildKeyProvider(host)
+		if err != nil {
+			return nil, fmt.Errorf("can not build key key_provider for host %s: %w", host.Host, err)
+		}
+
+		keypair, err := getKeypair(provider)
+		if err != nil {
+			return nil, fmt.Errorf("can not get keypair for host %s: %w", host.Host, err)
+		}
+
+		var resolver resolvers.IpResolver
+		if host.HasResolverOverride() {
+			resolver, err = buildChainResolver(config, host.Host, host.AddrFamilies, host.Resolvers)
+		} else {
+			if sharedResolver == nil {
+				sharedResolver, err = buildSharedResolver(config, hosts)
+				if err != nil {
+					return nil, fmt.Errorf("could not build ip resolver: %w", err)
+				}
+			}
+			resolver = sharedResolver.ForHost(host.Host)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not build ip resolver for host %s: %w", host.Host, err)
+		}
+
+		client, err := client.NewClient(resolver, keypair, reconciler, notificationImpl, opts...)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+func buildSharedResolver(config *conf.ClientConf, hosts []conf.HostConfig) (*resolvers.SharedResolver, error) {
+	var sharingHosts []string
+	for _, host := range hosts {
+		if !host.HasResolverOverride() {
+			sharingHosts = append(sharingHosts, host.Host)
+		}
+	}
+
+	// the host is only used for labelling metrics of the underlying resolver
+	host := sharingHosts[0]
+	if len(sharingHosts) > 1 {
+		host = "shared"
+	}
+
+	resolver, err := buildResolver(config, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return resolvers.NewSharedResolver(resolver, sharedResolverMaxAge)
+}
+
+func buildResolver(config *conf.ClientConf, host string) (resolvers.IpResolver, error) {
+	if len(config.Resolvers) > 0 {
+		return buildChainResolver(config, host, config.AddrFamilies, config.Resolvers)
+	}
+
+	if len(config.NetworkInterface) > 0 {
+		log.Info().Str("component", "client").Msgf("Building new resolver for interface %s", config.NetworkInterface)
+		return resolvers.NewInterfaceResolver(config.NetworkInterface, host, config.AddrFamilies)
 	}
 
 	log.Info().Str("component", "client").Msg("Building HTTP resolver")
-	return resolvers.NewHttpResolver(conf.Host, conf.PreferredUrls, conf.FallbackUrls, conf.AddrFamilies)
+	return resolvers.NewHttpResolver(host, config.PreferredUrls, config.FallbackUrls, config.AddrFamilies)
+}
+
+func buildChainResolver(config *conf.ClientConf, host string, chainAddressFamilies []string, resolverConfs []conf.ResolverConfig) (resolvers.IpResolver, error) {
+	links := make([]resolvers.ChainLink, 0, len(resolverConfs))
+	for _, resolverConf := range resolverConfs {
+		addressFamilies := resolverConf.AddrFamilies
+		if len(addressFamilies) == 0 {
+			addressFamilies = chainAddressFamilies
+		}
+
+		var resolver resolvers.IpResolver
+		var err error
+		switch resolverConf.Type {
+		case conf.ResolverTypeInterface:
+			resolver, err = resolvers.NewInterfaceResolver(resolverConf.Interface, host, addressFamilies)
+		case conf.ResolverTypeNatPmp:
+			resolver, err = resolvers.NewNatPmpResolver(resolverConf.Gateway, host)
+		case conf.ResolverTypeDns:
+			resolver, err = resolvers.NewDnsResolver(host, resolverConf.QueryName, resolverConf.Nameservers, addressFamilies)
+		case conf.ResolverTypeHttp:
+			resolver, err = resolvers.NewHttpResolver(host, config.PreferredUrls, config.FallbackUrls, addressFamilies)
+		default:
+			err = fmt.Errorf("unknown resolver type '%s'", resolverConf.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		log.Info().Str("component", "client").Str("resolver", resolver.Name()).Strs("address_families", addressFamilies).Msg("Adding resolver to chain")
+		links = append(links, resolvers.ChainLink{
+			Resolver:        resolver,
+			AddressFamilies: addressFamilies,
+		})
+	}
+
+	return resolvers.NewChainResolver(host, chainAddressFamilies, links...)
 }
 
 func buildNotificationImpl(config *conf.ClientConf) (notification.Notification, error) {
@@ -215,12 +587,12 @@ func buildNotificationImpl(config *conf.ClientConf) (notification.Notification,
 	return &notification.DummyNotification{}, nil
 }
 
-func buildKeyProvider(config *conf.ClientConf) (key_provider.KeyProvider, error) {
-	if len(config.KeyPair) > 0 {
-		return key_provider.NewEnvProvider(config.KeyPair)
+func buildKeyProvider(host conf.HostConfig) (key_provider.KeyProvider, error) {
+	if len(host.KeyPair) > 0 {
+		return key_provider.NewEnvProvider(host.KeyPair)
 	}
 
-	return key_provider.NewFileProvider(config.KeyPairPath)
+	return key_provider.NewFileProvider(host.KeyPairPath)
 }
 
 func getKeypair(provider key_provider.KeyProvider) (verification.SignatureKeypair, error) {
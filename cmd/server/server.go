@@ -11,11 +11,8 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/hashicorp/vault/api"
-	"github.com/hashicorp/vault/api/auth/approle"
 	"github.com/rs/zerolog/log"
 	"github.com/soerenschneider/dyndns/internal"
 	"github.com/soerenschneider/dyndns/internal/common"
@@ -27,9 +24,10 @@ import (
 	"github.com/soerenschneider/dyndns/internal/metrics"
 	"github.com/soerenschneider/dyndns/internal/notification"
 	"github.com/soerenschneider/dyndns/internal/server"
+	"github.com/soerenschneider/dyndns/internal/server/dedup"
 	"github.com/soerenschneider/dyndns/internal/server/dns"
-	"github.com/soerenschneider/dyndns/internal/server/vault"
 	"github.com/soerenschneider/dyndns/internal/util"
+	"github.com/soerenschneider/dyndns/internal/vault"
 	"go.uber.org/multierr"
 )
 
@@ -80,7 +78,7 @@ func main() {
 }
 
 func RunServer(config *conf.ServerConf) {
-	metrics.MqttBrokersConfiguredTotal.Set(float64(len(config.Brokers)))
+	metrics.MqttBrokersConfiguredTotal.Set(float64(len(config.GetBrokers())))
 	conf.PrintFields(config, conf.SensitiveFields...)
 
 	notificationImpl, err := buildNotificationImpl(*config)
@@ -89,7 +87,7 @@ func RunServer(config *conf.ServerConf) {
 	var requestsChannel = make(chan common.UpdateRecordRequest)
 	ctx, cancel := context.WithCancel(context.Background())
 
-	go metrics.StartMetricsServer(config.MetricsListener)
+	go metrics.StartMetricsServer(ctx, config.MetricsListener, nil)
 	go metrics.StartHeartbeat(ctx)
 
 	// set hash of known hosts
@@ -99,10 +97,19 @@ func RunServer(config *conf.ServerConf) {
 		metrics.KnownHostsHash.Set(float64(hash))
 	}
 
-	provider, err := buildAwsCredentialsProvider(config)
+	provider, err := vault.NewAwsCredentialsProvider(&config.VaultConfig)
 	dieOnError(err, "could not build credentials provider")
 
-	listeners, err := buildListeners(*config, requestsChannel, provider)
+	serverOpts, lease, err := buildDedup(ctx, *config)
+	dieOnError(err, "could not build de-duplication")
+
+	// listeners leave the update requests to the leader, so they are not dropped by followers
+	var leader common.Leader
+	if lease != nil {
+		leader = lease
+	}
+
+	listeners, err := buildListeners(*config, requestsChannel, provider, leader)
 	if err != nil {
 		log.Error().Err(err).Msg("could not build all listeners")
 	}
@@ -113,7 +120,23 @@ func RunServer(config *conf.ServerConf) {
 	propagator, err := dns.NewRoute53Propagator(config.HostedZoneId, provider)
 	dieOnError(err, "Could not build dns propagation implementation")
 
-	dyndnsServer, err := server.NewServer(*config, propagator, requestsChannel, notificationImpl)
+	if len(config.RecordsBucket) > 0 {
+		recordStore, err := buildRecordStore(ctx, *config)
+		dieOnError(err, "could not build nats record store")
+		serverOpts = append(serverOpts, server.WithRecordStore(recordStore))
+	}
+
+	// the lease is released before the listeners close the shared nats connection on shutdown
+	leaseCtx, leaseCancel := context.WithCancel(ctx)
+	leaseDone := make(chan struct{})
+	go func() {
+		defer close(leaseDone)
+		if lease != nil {
+			lease.Run(leaseCtx)
+		}
+	}()
+
+	dyndnsServer, err := server.NewServer(*config, propagator, requestsChannel, notificationImpl, serverOpts...)
 	dieOnError(err, "could not build dyndns server")
 
 	log.Info().Str("component", "server").Msg("Ready, listening for incoming requests")
@@ -133,66 +156,170 @@ func RunServer(config *conf.ServerConf) {
 	signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
 	<-term
 	log.Info().Str("component", "server").Msg("Caught signal, cancelling context")
+	leaseCancel()
+	<-leaseDone
 	cancel()
 	wg.Wait()
 	close(requestsChannel)
 }
 
-func buildSqs(config conf.ServerConf, requests chan common.UpdateRecordRequest, credProvider credentials.Provider) (*client.SqsListener, error) {
-	return client.NewSqsConsumer(config.SqsConfig, credProvider, requests)
+func buildSqs(config conf.ServerConf, requests chan common.UpdateRecordRequest, credProvider credentials.Provider, leader common.Leader) (*client.SqsListener, error) {
+	var opts []client.SqsOpts
+	if leader != nil {
+		opts = append(opts, client.WithLeader(leader))
+	}
+
+	return client.NewSqsConsumer(config.SqsConfig, credProvider, requests, opts...)
 }
 
-func buildMqtt(config conf.ServerConf, requests chan common.UpdateRecordRequest) ([]*mqtt.MqttBus, error) {
-	var servers []*mqtt.MqttBus
-	for _, broker := range config.Brokers {
-		mqttServer, err := mqtt.NewMqttServer(broker, config.ClientId, notificationTopic, config.TlsConfig(), requests)
+func buildMqtt(config conf.ServerConf, requests chan common.UpdateRecordRequest, leader common.Leader) ([]Listener, error) {
+	var servers []Listener
+	var errs error
+	for _, broker := range config.GetBrokers() {
+		mqttServer, err := buildMqttServer(config, broker, requests, leader)
 		if err != nil {
-			log.Error().Err(err).Str("component", "server").Msg("could not connect to mqtt")
+			log.Error().Err(err).Str("component", "server").Str("broker", broker.Url).Msg("could not build mqtt listener")
+			errs = multierr.Append(errs, err)
 		} else {
 			servers = append(servers, mqttServer)
 		}
 	}
 
-	return servers, nil
+	return servers, errs
 }
 
-func buildNats(config conf.ServerConf, requests chan common.UpdateRecordRequest) (*sink.NatsDyndnsServer, error) {
+func buildMqttServer(config conf.ServerConf, broker conf.MqttBrokerConfig, requests chan common.UpdateRecordRequest, leader common.Leader) (Listener, error) {
+	tlsConfig, err := broker.TlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []mqtt.MqttServerOpts{mqtt.WithSubscribeQos(config.Qos)}
+	if len(config.SharedSubscriptionGroup) > 0 {
+		opts = append(opts, mqtt.WithSharedSubscription(config.SharedSubscriptionGroup))
+	}
+	if len(broker.Username) > 0 {
+		opts = append(opts, mqtt.WithServerCredentials(broker.Username, broker.Password))
+	}
+	if leader != nil {
+		opts = append(opts, mqtt.WithLeader(leader))
+	}
+
+	if config.UsesProtocolV5() {
+		return mqtt.NewMqttV5Server(broker.Url, config.ClientId, notificationTopic, tlsConfig, requests, opts...)
+	}
+	return mqtt.NewMqttServer(broker.Url, config.ClientId, notificationTopic, tlsConfig, requests, opts...)
+}
+
+func buildNats(config conf.ServerConf, requests chan common.UpdateRecordRequest, leader common.Leader) (*sink.NatsDyndnsServer, error) {
 	log.Info().Msg("Building NATS notifier")
 	js, err := sink.Connect(config.NatsConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	return sink.NewNatsDyndnsServer(&config.NatsConfig, js, requests)
+	var opts []sink.NatsDyndnsServerOpts
+	if leader != nil {
+		opts = append(opts, sink.WithLeader(leader))
+	}
+
+	return sink.NewNatsDyndnsServer(&config.NatsConfig, js, requests, opts...)
+}
+
+// buildDedup builds the options to de-duplicate update requests between multiple servers and the optional leader lease
+func buildDedup(ctx context.Context, config conf.ServerConf) ([]server.ServerOpts, *dedup.NatsLease, error) {
+	if !config.Dedup.RequiresNats() {
+		return nil, nil, nil
+	}
+
+	if len(config.NatsConfig.Url) == 0 {
+		return nil, nil, errors.New("nats url must be configured to use the nats dedup store or the leader lease")
+	}
+
+	js, err := sink.Connect(config.NatsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var opts []server.ServerOpts
+	if config.Dedup.Store == conf.DedupStoreNats {
+		log.Info().Str("component", "server").Str("bucket", config.Dedup.Bucket).Msg("Building NATS KV dedup store")
+		store, err := dedup.NewNatsKvStore(ctx, js, config.Dedup.Bucket, config.Dedup.Ttl)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, server.WithDedupStore(store))
+	}
+
+	if !config.Dedup.LeaderLease {
+		return opts, nil, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not determine hostname for leader lease: %w", err)
+	}
+
+	id := fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	log.Info().Str("component", "server").Str("bucket", config.Dedup.LeaseBucket).Str("id", id).Msg("Building leader lease")
+	lease, err := dedup.NewNatsLease(ctx, js, config.Dedup.LeaseBucket, config.Dedup.LeaseTtl, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append(opts, server.WithLeader(lease)), lease, nil
+}
+
+func buildRecordStore(ctx context.Context, config conf.ServerConf) (*sink.NatsRecordStore, error) {
+	log.Info().Str("component", "server").Str("bucket", config.RecordsBucket).Msg("Building NATS KV record store")
+	js, err := sink.Connect(config.NatsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return sink.NewNatsRecordStore(ctx, js, config.RecordsBucket)
 }
 
-func buildListeners(config conf.ServerConf, requests chan common.UpdateRecordRequest, creds credentials.Provider) ([]Listener, error) {
+func buildListeners(config conf.ServerConf, requests chan common.UpdateRecordRequest, creds credentials.Provider, leader common.Leader) ([]Listener, error) {
 	var listeners []Listener
 	var errs error
 
-	if len(config.MqttConfig.Brokers) > 0 {
+	if len(config.GetBrokers()) > 0 {
 		log.Info().Str("component", "server").Msg("Building MQTT listener(s)...")
-		mqttListeners, err := buildMqtt(config, requests)
+		mqttListeners, err := buildMqtt(config, requests, leader)
 		if err != nil {
 			errs = multierr.Append(errs, err)
 		}
-		for _, listener := range mqttListeners {
-			listener := listener
-			listeners = append(listeners, listener)
+		listeners = append(listeners, mqttListeners...)
+	}
+
+	if config.NatsConfig.IsConfiguredAsListener() {
+		nats, err := buildNats(config, requests, leader)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+		} else {
+			listeners = append(listeners, nats)
 		}
 	}
 
-	if config.NatsConfig.IsConfiguredForUpdates() {
-		nats, err := buildNats(config, requests)
+	if config.NatsConfig.IsConfiguredForRequestReply() {
+		log.Info().Str("component", "server").Msg("Building NATS request-reply listener...")
+		js, err := sink.Connect(config.NatsConfig)
 		if err != nil {
 			errs = multierr.Append(errs, err)
+		} else {
+			listener, err := sink.NewNatsRequestReplyServer(&config.NatsConfig, js, requests)
+			if err != nil {
+				errs = multierr.Append(errs, err)
+			} else {
+				listeners = append(listeners, listener)
+			}
 		}
-		listeners = append(listeners, nats)
 	}
 
 	if len(config.SqsQueue) > 0 {
 		log.Info().Str("component", "server").Msg("Building AWS SQS listener...")
-		sqs, err := buildSqs(config, requests, creds)
+		sqs, err := buildSqs(config, requests, creds, leader)
 		if err != nil {
 			errs = multierr.Append(errs, err)
 		} else {
@@ -202,7 +329,7 @@ func buildListeners(config conf.ServerConf, requests chan common.UpdateRecordReq
 
 	if len(config.HttpConfig.ListenAddr) > 0 {
 		log.Info().Str("component", "server").Msg("Building HTTP listener...")
-		httpServer, err := buildHttpServer(config, requests)
+		httpServer, err := buildHttpServer(config, requests, leader)
 		if err != nil {
 			errs = multierr.Append(errs, err)
 		} else {
@@ -213,33 +340,13 @@ func buildListeners(config conf.ServerConf, requests chan common.UpdateRecordReq
 	return listeners, errs
 }
 
-func buildAwsCredentialsProvider(config *conf.ServerConf) (credentials.Provider, error) {
-	if !config.UseVaultCredentialsProvider() {
-		return nil, nil
+func buildHttpServer(conf conf.ServerConf, req chan common.UpdateRecordRequest, leader common.Leader) (*http.HttpServer, error) {
+	var opts []http.WebhookOpts
+	if leader != nil {
+		opts = append(opts, http.WithLeader(leader))
 	}
 
-	client, err := buildVaultClient(config.VaultConfig)
-	if err != nil {
-		return nil, err
-	}
-	auth, err := buildVaultAuth(config.VaultConfig)
-	if err != nil {
-		return nil, err
-	}
-
-	return buildAwsVaultCredentialProvider(&config.VaultConfig, client, auth)
-}
-
-func buildVaultClient(conf conf.VaultConfig) (*api.Client, error) {
-	config := api.DefaultConfig()
-	config.Address = conf.VaultAddr
-	config.Timeout = 30 * time.Second
-
-	return api.NewClient(config)
-}
-
-func buildHttpServer(conf conf.ServerConf, req chan common.UpdateRecordRequest) (*http.HttpServer, error) {
-	http, err := http.New(conf.HttpConfig.ListenAddr, req)
+	http, err := http.New(conf.HttpConfig.ListenAddr, req, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -247,43 +354,6 @@ func buildHttpServer(conf conf.ServerConf, req chan common.UpdateRecordRequest)
 	return http, nil
 }
 
-// buildAwsVaultCredentialProvider returns the vault credentials provider, but only if it succeeds to login at vault
-// otherwise the default credentials provider by AWS is used, trying to be resilient
-func buildAwsVaultCredentialProvider(config *conf.VaultConfig, client *api.Client, auth vault.Auth) (credentials.Provider, error) {
-	if config == nil {
-		return nil, errors.New("nil config provided")
-	}
-
-	provider, err := vault.NewVaultCredentialProvider(client, auth, config)
-	if err != nil {
-		return nil, err
-	}
-
-	log.Info().Str("component", "server").Msg("Testing authentication against vault")
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-
-	_, err = client.Auth().Login(ctx, auth)
-	if err != nil {
-		return nil, fmt.Errorf("could not authenticate against vault: %w", err)
-	}
-
-	return provider, nil
-}
-
-func buildVaultAuth(config conf.VaultConfig) (vault.Auth, error) {
-	switch config.AuthStrategy {
-	case conf.VaultAuthStrategyToken:
-		return vault.NewTokenAuth(config.VaultToken)
-	case conf.VaultAuthStrategyApprole:
-		secretId := &approle.SecretID{
-			FromString: config.AppRoleSecretId,
-		}
-		return approle.NewAppRoleAuth(config.AppRoleId, secretId)
-	default:
-		return nil, errors.New("can't build vault auth")
-	}
-}
 func buildNotificationImpl(config conf.ServerConf) (notification.Notification, error) {
 	if config.EmailConfig.IsConfigured() {
 		err := config.EmailConfig.Validate()
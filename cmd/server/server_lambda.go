@@ -40,8 +40,8 @@ func init() {
 
 func handleSQSEvent(_ context.Context, event events.SQSEvent) error {
 	for _, message := range event.Records {
-		payload := common.UpdateRecordRequest{}
-		if err := json.Unmarshal([]byte(message.Body), &payload); err != nil {
+		payload, err := common.DecodeUpdateRecordRequest([]byte(message.Body))
+		if err != nil {
 			return err
 		}
 
@@ -53,8 +53,8 @@ func handleSQSEvent(_ context.Context, event events.SQSEvent) error {
 }
 
 func handleAPIGatewayRequest(_ context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	payload := common.UpdateRecordRequest{}
-	if err := json.Unmarshal([]byte(request.Body), &payload); err != nil {
+	payload, err := common.DecodeUpdateRecordRequest([]byte(request.Body))
+	if err != nil {
 		return events.APIGatewayProxyResponse{
 			Body:       "could not parse json",
 			StatusCode: 400,
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Status describes the status of all hosts managed by the client and the reconciler
+type Status struct {
+	Hosts      []HostStatus     `json:"hosts"`
+	Reconciler ReconcilerStatus `json:"reconciler"`
+}
+
+// Api offers a local HTTP API to inspect the status of the clients and to control them. Requests that change the
+// state of the clients need to present the token as bearer token.
+type Api struct {
+	clients    []*Client
+	reconciler *Reconciler
+	token      string
+}
+
+func NewApi(reconciler *Reconciler, token string, clients ...*Client) (*Api, error) {
+	if reconciler == nil {
+		return nil, errors.New("no reconciler provided")
+	}
+
+	if len(token) == 0 {
+		return nil, errors.New("empty token provided")
+	}
+
+	if len(clients) == 0 {
+		return nil, errors.New("no clients provided")
+	}
+
+	return &Api{
+		clients:    clients,
+		reconciler: reconciler,
+		token:      token,
+	}, nil
+}
+
+// Handlers returns the handlers of the api, keyed by their patterns
+func (a *Api) Handlers() map[string]http.Handler {
+	return map[string]http.Handler{
+		"GET /api/v1/status":  http.HandlerFunc(a.status),
+		"POST /api/v1/update": a.authorized(a.forceUpdate),
+		"POST /api/v1/pause":  a.authorized(a.pause),
+		"POST /api/v1/resume": a.authorized(a.resume),
+	}
+}
+
+// authorized only invokes the handler if the request carries the api's token. Browsers can not attach the
+// Authorization header to cross-site requests without a CORS preflight, so this also prevents cross-site requests.
+func (a *Api) authorized(handler http.HandlerFunc) http.Handler {
+	expected := []byte("Bearer " + a.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJson(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func (a *Api) Status() Status {
+	status := Status{
+		Hosts:      make([]HostStatus, 0, len(a.clients)),
+		Reconciler: a.reconciler.Status(),
+	}
+
+	for _, client := range a.clients {
+		status.Hosts = append(status.Hosts, client.Status())
+	}
+
+	return status
+}
+
+func (a *Api) status(w http.ResponseWriter, _ *http.Request) {
+	writeJson(w, http.StatusOK, a.Status())
+}
+
+func (a *Api) forceUpdate(w http.ResponseWriter, r *http.Request) {
+	clients, ok := a.selectClients(w, r)
+	if !ok {
+		return
+	}
+
+	for _, client := range clients {
+		client.ForceUpdate()
+	}
+	writeJson(w, http.StatusAccepted, a.Status())
+}
+
+func (a *Api) pause(w http.ResponseWriter, r *http.Request) {
+	a.setPaused(w, r, true)
+}
+
+func (a *Api) resume(w http.ResponseWriter, r *http.Request) {
+	a.setPaused(w, r, false)
+}
+
+func (a *Api) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	clients, ok := a.selectClients(w, r)
+	if !ok {
+		return
+	}
+
+	for _, client := range clients {
+		client.SetPaused(paused)
+	}
+
+	// the reconciler is shared by all hosts, so it's only paused if all hosts are affected
+	if len(clients) == len(a.clients) {
+		a.reconciler.SetPaused(paused)
+	}
+
+	writeJson(w, http.StatusOK, a.Status())
+}
+
+// selectClients returns the client for the host given by the query parameter 'host' or all clients, if no host
+// has been specified.
+func (a *Api) selectClients(w http.ResponseWriter, r *http.Request) ([]*Client, bool) {
+	host := r.URL.Query().Get("host")
+	if len(host) == 0 {
+		return a.clients, true
+	}
+
+	for _, client := range a.clients {
+		if client.Host() == host {
+			return []*Client{client}, true
+		}
+	}
+
+	writeJson(w, http.StatusNotFound, map[string]string{"error": "unknown host"})
+	return nil, false
+}
+
+func writeJson(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Error().Err(err).Str("component", "api").Msg("could not write response")
+	}
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/verification"
+)
+
+const testApiToken = "s3cr3t-t0k3n"
+
+type staticResolver struct {
+	host string
+}
+
+func (r *staticResolver) Resolve() (*common.DnsRecord, error) {
+	return common.NewResolvedIp(r.host), nil
+}
+
+func (r *staticResolver) Name() string {
+	return "static"
+}
+
+func (r *staticResolver) Host() string {
+	return r.host
+}
+
+type nopDispatcher struct{}
+
+func (d *nopDispatcher) Notify(_ context.Context, msg *common.UpdateRecordRequest) error {
+	return nil
+}
+
+func (d *nopDispatcher) Close(_ context.Context) error {
+	return nil
+}
+
+func buildTestApi(t *testing.T, hosts ...string) (*Api, []*Client) {
+	reconciler, err := NewReconciler(map[string]EventDispatch{"nop": &nopDispatcher{}}, conf.DefaultOutboxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keypair, err := verification.NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clients []*Client
+	for _, host := range hosts {
+		client, err := NewClient(&staticResolver{host: host}, keypair, reconciler, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+	}
+
+	api, err := NewApi(reconciler, testApiToken, clients...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api, clients
+}
+
+func serve(api *Api, method, target string) *httptest.ResponseRecorder {
+	return serveWithAuthorization(api, method, target, "Bearer "+testApiToken)
+}
+
+func serveWithAuthorization(api *Api, method, target, authorization string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	for pattern, handler := range api.Handlers() {
+		mux.Handle(pattern, handler)
+	}
+
+	req := httptest.NewRequest(method, target, nil)
+	if len(authorization) > 0 {
+		req.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestApi_Status(t *testing.T) {
+	api, _ := buildTestApi(t, "home.example.com", "vpn.example.com")
+
+	resp := serve(api, http.MethodGet, "/api/v1/status")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.Code)
+	}
+
+	var status Status
+	if err := json.Unmarshal(resp.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(status.Hosts) != 2 || status.Hosts[0].Host != "home.example.com" || status.Hosts[0].State != "initialState" {
+		t.Errorf("unexpected status %v", status)
+	}
+}
+
+func TestApi_PauseResume(t *testing.T) {
+	api, clients := buildTestApi(t, "home.example.com", "vpn.example.com")
+
+	resp := serve(api, http.MethodPost, "/api/v1/pause?host=vpn.example.com")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.Code)
+	}
+	if clients[0].Status().Paused || !clients[1].Status().Paused || api.reconciler.Status().Paused {
+		t.Fatalf("expected only vpn.example.com to be paused")
+	}
+
+	serve(api, http.MethodPost, "/api/v1/pause")
+	if !clients[0].Status().Paused || !api.reconciler.Status().Paused {
+		t.Fatalf("expected all hosts and reconciler to be paused")
+	}
+
+	serve(api, http.MethodPost, "/api/v1/resume")
+	if clients[0].Status().Paused || clients[1].Status().Paused || api.reconciler.Status().Paused {
+		t.Fatalf("expected all hosts and reconciler to be resumed")
+	}
+}
+
+func TestApi_ForceUpdate(t *testing.T) {
+	api, clients := buildTestApi(t, "home.example.com")
+
+	resp := serve(api, http.MethodPost, "/api/v1/update")
+	if resp.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", resp.Code)
+	}
+
+	select {
+	case <-clients[0].forceUpdate:
+	default:
+		t.Fatal("expected update to be triggered")
+	}
+}
+
+func TestApi_UnknownHost(t *testing.T) {
+	api, _ := buildTestApi(t, "home.example.com")
+
+	resp := serve(api, http.MethodPost, "/api/v1/update?host=unknown.example.com")
+	if resp.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", resp.Code)
+	}
+}
+
+func TestApi_MethodNotAllowed(t *testing.T) {
+	api, _ := buildTestApi(t, "home.example.com")
+
+	resp := serve(api, http.MethodGet, "/api/v1/pause")
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status 405, got %d", resp.Code)
+	}
+}
+
+func TestApi_Unauthorized(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+	}{
+		{
+			name: "missing token",
+		},
+		{
+			name:          "wrong token",
+			authorization: "Bearer wrong",
+		},
+		{
+			name:          "token without scheme",
+			authorization: testApiToken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, clients := buildTestApi(t, "home.example.com")
+
+			for _, path := range []string{"/api/v1/update", "/api/v1/pause", "/api/v1/resume"} {
+				resp := serveWithAuthorization(api, http.MethodPost, path, tt.authorization)
+				if resp.Code != http.StatusUnauthorized {
+					t.Fatalf("expected status 401 for %s, got %d", path, resp.Code)
+				}
+			}
+
+			if clients[0].Status().Paused {
+				t.Fatal("expected host not to be paused")
+			}
+			select {
+			case <-clients[0].forceUpdate:
+				t.Fatal("expected no update to be triggered")
+			default:
+			}
+
+			resp := serveWithAuthorization(api, http.MethodGet, "/api/v1/status", tt.authorization)
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status endpoint to be accessible without token, got %d", resp.Code)
+			}
+		})
+	}
+}
@@ -1,16 +1,21 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/soerenschneider/dyndns/internal/client/resolvers"
 	"github.com/soerenschneider/dyndns/internal/client/states"
 	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
 	"github.com/soerenschneider/dyndns/internal/metrics"
 	"github.com/soerenschneider/dyndns/internal/notification"
+	"github.com/soerenschneider/dyndns/internal/util"
 	"github.com/soerenschneider/dyndns/internal/verification"
 	"go.uber.org/multierr"
 )
@@ -18,7 +23,10 @@ import (
 const DefaultResolveInterval = 45 * time.Second
 
 type EventDispatch interface {
-	Notify(msg *common.UpdateRecordRequest) error
+	// Notify delivers the update request, implementations must return once the context is done
+	Notify(ctx context.Context, msg *common.UpdateRecordRequest) error
+	// Close flushes outstanding messages and releases the dispatcher's connections
+	Close(ctx context.Context) error
 }
 
 type Client struct {
@@ -30,6 +38,46 @@ type Client struct {
 	notificationImpl notification.Notification
 	resolveInterval  time.Duration
 	forceSendUpdate  bool
+	stateConf        conf.StateMachineConfig
+	verifier         util.RecordVerifier
+	store            *StateStore
+	statusListeners  []StatusListener
+
+	// mutex guards the fields that are read by the status api
+	mutex        sync.RWMutex
+	lastResolved *common.DnsRecord
+	lastError    *ErrorStatus
+	paused       atomic.Bool
+	forceUpdate  chan struct{}
+	reevaluate   chan struct{}
+}
+
+// ErrorStatus describes the last error that occurred
+type ErrorStatus struct {
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func newErrorStatus(err error) *ErrorStatus {
+	return &ErrorStatus{
+		Message:   err.Error(),
+		Timestamp: time.Now(),
+	}
+}
+
+// HostStatus describes the current status of a client
+type HostStatus struct {
+	Host            string            `json:"host"`
+	State           string            `json:"state"`
+	LastStateChange time.Time         `json:"last_state_change"`
+	LastResolved    *common.DnsRecord `json:"last_resolved,omitempty"`
+	LastError       *ErrorStatus      `json:"last_error,omitempty"`
+	Paused          bool              `json:"paused"`
+}
+
+// StatusListener is notified whenever the state of the client or its resolved ips change
+type StatusListener interface {
+	StatusChanged(status HostStatus)
 }
 
 type Opts func(c *Client) error
@@ -52,6 +100,10 @@ func NewClient(resolver resolvers.IpResolver, signature verification.SignatureKe
 		signature:        signature,
 		lastStateChange:  time.Now(),
 		notificationImpl: notifyImpl,
+		forceUpdate:      make(chan struct{}, 1),
+		reevaluate:       make(chan struct{}, 1),
+		stateConf:        conf.DefaultStateMachineConfig(),
+		verifier:         &util.SystemVerifier{},
 	}
 
 	var errs error
@@ -61,32 +113,102 @@ func NewClient(resolver resolvers.IpResolver, signature verification.SignatureKe
 		}
 	}
 
-	c.state = states.NewInitialState(c.forceSendUpdate)
+	var persisted *states.PersistedRecords
+	if c.store != nil {
+		persisted = c.store.Host(resolver.Host())
+	}
+	c.state = states.NewInitialState(c.forceSendUpdate, c.stateConf, persisted)
 
 	return c, errs
 }
 
-func (client *Client) Run() {
-	ticker := time.NewTicker(client.resolveInterval)
+// Run periodically resolves the ip and evaluates the state machine until the context is cancelled
+func (client *Client) Run(ctx context.Context) {
+	interval := client.resolveInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	var resolvedIp *common.DnsRecord
 	tick := func() {
 		var err error
-		resolvedIp, err = client.Resolve(resolvedIp)
+		resolvedIp, err = client.Resolve(ctx, resolvedIp)
 		if err != nil {
 			log.Info().Err(err).Str("component", "client").Msg("error while iterating")
 		}
 
-		if client.resolveInterval != client.state.WaitInterval() {
-			ticker.Reset(client.state.WaitInterval())
+		if waitInterval := client.GetState().WaitInterval(); waitInterval != interval {
+			interval = waitInterval
+			ticker.Reset(interval)
 		}
 	}
 
 	tick()
-	for range ticker.C {
-		tick()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Str("component", "client").Str("host", client.resolver.Host()).Msg("Stopping client")
+			return
+		case <-ticker.C:
+			tick()
+		case <-client.forceUpdate:
+			log.Info().Str("component", "client").Str("host", client.resolver.Host()).Msg("Forcing update")
+			client.SetState(states.NewInitialState(true, client.stateConf, nil))
+			tick()
+		case <-client.reevaluate:
+			tick()
+		}
 	}
 }
 
+// ForceUpdate triggers an immediate resolve and sends an update request regardless of the current state
+func (client *Client) ForceUpdate() {
+	select {
+	case client.forceUpdate <- struct{}{}:
+	default:
+		// an update is already pending
+	}
+}
+
+// Reevaluate triggers an immediate resolve and evaluation of the current state, e.g. after a server reported that the
+// record has been applied
+func (client *Client) Reevaluate() {
+	select {
+	case client.reevaluate <- struct{}{}:
+	default:
+		// an evaluation is already pending
+	}
+}
+
+// SetPaused pauses or resumes evaluating the state machine and therefore sending update requests
+func (client *Client) SetPaused(paused bool) {
+	if client.paused.Swap(paused) != paused {
+		log.Info().Str("component", "client").Str("host", client.resolver.Host()).Bool("paused", paused).Msg("Changed pause status")
+	}
+}
+
+func (client *Client) Host() string {
+	return client.resolver.Host()
+}
+
+func (client *Client) Status() HostStatus {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
+
+	return HostStatus{
+		Host:            client.resolver.Host(),
+		State:           client.state.Name(),
+		LastStateChange: client.lastStateChange,
+		LastResolved:    client.lastResolved,
+		LastError:       client.lastError,
+		Paused:          client.paused.Load(),
+	}
+}
+
+func (client *Client) setLastError(err error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.lastError = newErrorStatus(err)
+}
+
 func (client *Client) resolveIp() (*common.DnsRecord, error) {
 	resolvedIp, err := client.resolver.Resolve()
 	metrics.LastCheck.WithLabelValues(client.resolver.Host(), client.resolver.Name()).SetToCurrentTime()
@@ -103,25 +225,76 @@ func (client *Client) resolveIp() (*common.DnsRecord, error) {
 	return resolvedIp, err
 }
 
-func (client *Client) Resolve(prev *common.DnsRecord) (*common.DnsRecord, error) {
+func (client *Client) Resolve(ctx context.Context, prev *common.DnsRecord) (*common.DnsRecord, error) {
 	resolvedIp, err := client.resolveIp()
 	if err != nil {
+		client.setLastError(err)
 		return prev, err
 	}
 
+	client.mutex.Lock()
+	changed := !client.lastResolved.Equals(resolvedIp)
+	client.lastResolved = resolvedIp
+	client.mutex.Unlock()
+	if changed {
+		client.notifyStatusListeners()
+	}
+
+	if client.paused.Load() {
+		log.Debug().Str("component", "client").Str("host", resolvedIp.Host).Msg("Updates are paused, not evaluating state")
+		return resolvedIp, nil
+	}
+
 	var errs error
-	if client.state.EvaluateState(client, resolvedIp) {
+	sendUpdate := client.GetState().EvaluateState(client, resolvedIp)
+	if sendUpdate {
 		signature := client.signature.Sign(*resolvedIp)
 		req := &common.UpdateRecordRequest{
 			PublicIp:  *resolvedIp,
 			Signature: signature,
 		}
-		errs = client.reconciler.RegisterUpdate(req)
+		errs = client.reconciler.RegisterUpdate(ctx, req)
+		if errs != nil {
+			client.setLastError(errs)
+		}
 	}
+	client.persist(resolvedIp, sendUpdate)
 
 	return resolvedIp, errs
 }
 
+// persist writes the last resolved and confirmed records to the state store if they have changed
+func (client *Client) persist(resolvedIp *common.DnsRecord, updateSent bool) {
+	if client.store == nil {
+		return
+	}
+
+	records := client.store.Host(resolvedIp.Host)
+	if records == nil {
+		records = &states.PersistedRecords{}
+	}
+
+	changed := false
+	if updateSent && !records.Resolved.Equals(resolvedIp) {
+		records.Resolved = resolvedIp
+		changed = true
+	}
+
+	if confirmed, ok := client.GetState().(states.ConfirmedState); ok && !records.Confirmed.Equals(confirmed.ConfirmedRecord()) {
+		records.Confirmed = confirmed.ConfirmedRecord()
+		records.ConfirmedAt = time.Now()
+		changed = true
+	}
+
+	if !changed {
+		return
+	}
+
+	if err := client.store.SetHost(resolvedIp.Host, *records); err != nil {
+		log.Error().Err(err).Str("component", "client").Str("host", resolvedIp.Host).Msg("Could not persist state")
+	}
+}
+
 func (client *Client) NotifyUpdatedIpDetected(resolved *common.DnsRecord) error {
 	if client.notificationImpl == nil {
 		return nil
@@ -129,15 +302,38 @@ func (client *Client) NotifyUpdatedIpDetected(resolved *common.DnsRecord) error
 	return client.notificationImpl.NotifyUpdatedIpDetected(resolved)
 }
 
+func (client *Client) NotifyUpdatedIpUnconfirmable(resolved *common.DnsRecord) error {
+	if client.notificationImpl == nil {
+		return nil
+	}
+	return client.notificationImpl.NotifyUpdatedIpUnconfirmable(resolved)
+}
+
+func (client *Client) Verifier() util.RecordVerifier {
+	return client.verifier
+}
+
 func (client *Client) GetState() states.State {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
 	return client.state
 }
 
 func (client *Client) GetLastStateChange() time.Time {
+	client.mutex.RLock()
+	defer client.mutex.RUnlock()
 	return client.lastStateChange
 }
 
 func (client *Client) SetState(state states.State) {
+	client.setState(state)
+	client.notifyStatusListeners()
+}
+
+func (client *Client) setState(state states.State) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
 	stateChangeTime := time.Now()
 	oldState := client.state
 	log.Info().Str("component", "client").Str("old_state", oldState.Name()).Str("new_state", state.Name()).Float64("duration_s", stateChangeTime.Sub(client.lastStateChange).Seconds()).Msgf("State changed")
@@ -148,3 +344,14 @@ func (client *Client) SetState(state states.State) {
 	client.state = state
 	client.lastStateChange = stateChangeTime
 }
+
+func (client *Client) notifyStatusListeners() {
+	if len(client.statusListeners) == 0 {
+		return
+	}
+
+	status := client.Status()
+	for _, listener := range client.statusListeners {
+		listener.StatusChanged(status)
+	}
+}
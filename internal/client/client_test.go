@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/verification"
+)
+
+func TestClient_RunStopsOnCancel(t *testing.T) {
+	_, clients := buildTestApi(t, "home.example.com")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		clients[0].Run(ctx)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not stop after context has been cancelled")
+	}
+}
+
+type recordingListener struct {
+	mutex    sync.Mutex
+	statuses []HostStatus
+}
+
+func (l *recordingListener) StatusChanged(status HostStatus) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.statuses = append(l.statuses, status)
+}
+
+func (l *recordingListener) count() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.statuses)
+}
+
+func TestClient_StatusListener(t *testing.T) {
+	reconciler, err := NewReconciler(map[string]EventDispatch{"nop": &nopDispatcher{}}, conf.DefaultOutboxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keypair, err := verification.NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := &recordingListener{}
+	client, err := NewClient(&publicIpResolver{host: "home.example.com"}, keypair, reconciler, nil, WithStatusListener(listener))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err := client.Resolve(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listener.count() == 0 {
+		t.Fatal("expected listener to be notified about the resolved ip")
+	}
+	if got := listener.statuses[0].LastResolved; got == nil || got.IpV4 != onceTestIp {
+		t.Fatalf("expected resolved ip %s, got %v", onceTestIp, got)
+	}
+
+	// resolving the same ip again does not change the status unless the state machine transitions
+	notified := listener.count()
+	state := client.GetState().Name()
+	if _, err := client.Resolve(context.Background(), resolved); err != nil {
+		t.Fatal(err)
+	}
+	if client.GetState().Name() == state && listener.count() != notified {
+		t.Fatalf("expected no notification for unchanged status, got %d", listener.count()-notified)
+	}
+}
@@ -2,7 +2,7 @@ package dispatchers
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
 	"time"
@@ -15,9 +15,10 @@ import (
 type HttpDispatch struct {
 	client *http.Client
 	url    string
+	format string
 }
 
-func NewHttpDispatcher(url string) (*HttpDispatch, error) {
+func NewHttpDispatcher(url string, format string) (*HttpDispatch, error) {
 	client := retryablehttp.NewClient()
 	client.RetryMax = 3
 	client.HTTPClient.Timeout = 5 * time.Second
@@ -25,16 +26,33 @@ func NewHttpDispatcher(url string) (*HttpDispatch, error) {
 	return &HttpDispatch{
 		client: client.HTTPClient,
 		url:    url,
+		format: format,
 	}, nil
 }
 
-func (h *HttpDispatch) Notify(msg *common.UpdateRecordRequest) error {
-	data, err := json.Marshal(msg)
+func (h *HttpDispatch) Close(_ context.Context) error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+func (h *HttpDispatch) Notify(ctx context.Context, msg *common.UpdateRecordRequest) error {
+	data, err := common.EncodeUpdateRecordRequest(msg, h.format)
 	if err != nil {
 		return err
 	}
 
-	response, err := h.client.Post(h.url, "application/json", bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+
+	contentType := "application/json"
+	if h.format == common.PayloadFormatCloudEvents {
+		contentType = "application/cloudevents+json"
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	response, err := h.client.Do(req)
 	if err != nil {
 		return err
 	}
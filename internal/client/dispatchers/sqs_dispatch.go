@@ -2,7 +2,7 @@ package dispatchers
 
 import (
 	"context"
-	"encoding/json"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -14,15 +14,23 @@ import (
 	"github.com/soerenschneider/dyndns/internal/metrics"
 )
 
+// fifoQueueSuffix is the mandatory suffix of the names of FIFO queues
+const fifoQueueSuffix = ".fifo"
+
 type SqsDispatch struct {
 	client   *sqs.SQS
 	queueUrl string
+	format   string
+	fifo     bool
 }
 
-func NewSqsDispatcher(sqsConf conf.SqsConfig, provider credentials.Provider) (*SqsDispatch, error) {
+func NewSqsDispatcher(sqsConf conf.SqsConfig, provider credentials.Provider, format string) (*SqsDispatch, error) {
 	awsConf := &aws.Config{
 		Region: aws.String(sqsConf.Region),
 	}
+	if len(sqsConf.Endpoint) > 0 {
+		awsConf.Endpoint = aws.String(sqsConf.Endpoint)
+	}
 	if provider != nil {
 		log.Info().Str("component", "sqs").Msg("Building AWS client using given credentials provider")
 		awsConf.Credentials = credentials.NewCredentials(provider)
@@ -31,26 +39,50 @@ func NewSqsDispatcher(sqsConf conf.SqsConfig, provider credentials.Provider) (*S
 
 	ret := &SqsDispatch{
 		queueUrl: sqsConf.SqsQueue,
+		format:   format,
+		fifo:     strings.HasSuffix(sqsConf.SqsQueue, fifoQueueSuffix),
 	}
 	ret.client = sqs.New(awsSession)
 	return ret, nil
 }
 
-func (h *SqsDispatch) Notify(msg *common.UpdateRecordRequest) error {
-	data, err := json.Marshal(msg)
+// Close is a no-op, as messages are sent synchronously and the SQS client does not hold persistent connections
+func (h *SqsDispatch) Close(_ context.Context) error {
+	return nil
+}
+
+// Notify sends the update request along with its host and schema version as message attributes. Update requests sent
+// to FIFO queues are ordered per host and deduplicated by SQS using the hash of their signature.
+func (h *SqsDispatch) Notify(ctx context.Context, msg *common.UpdateRecordRequest) error {
+	data, err := common.EncodeUpdateRecordRequest(msg, h.format)
 	if err != nil {
 		return err
 	}
 
-	// TODO: change interface signature
-	ctx := context.Background()
-	metrics.SqsApiCalls.WithLabelValues("send_message").Inc()
-	result, err := h.client.SendMessageWithContext(ctx, &sqs.SendMessageInput{
-		MessageBody:  aws.String(string(data)),
-		QueueUrl:     aws.String(h.queueUrl),
-		DelaySeconds: aws.Int64(0),
-	})
+	input := &sqs.SendMessageInput{
+		MessageBody: aws.String(string(data)),
+		QueueUrl:    aws.String(h.queueUrl),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			common.MetadataHost: {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(msg.PublicIp.Host),
+			},
+			common.MetadataSchemaVersion: {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(common.UpdateRecordRequestSchemaVersion),
+			},
+		},
+	}
+	if h.fifo {
+		input.MessageGroupId = aws.String(msg.PublicIp.Host)
+		input.MessageDeduplicationId = aws.String(msg.Hash())
+	} else {
+		// FIFO queues only support delays on the queue level
+		input.DelaySeconds = aws.Int64(0)
+	}
 
+	metrics.SqsApiCalls.WithLabelValues("send_message").Inc()
+	result, err := h.client.SendMessageWithContext(ctx, input)
 	if err == nil {
 		log.Info().Str("component", "sqs").Str("message_id", *result.MessageId).Msg("Successfully dispatched message")
 	}
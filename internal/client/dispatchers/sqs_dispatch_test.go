@@ -0,0 +1,75 @@
+package dispatchers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/testutil"
+)
+
+func TestSqsDispatch_Notify(t *testing.T) {
+	req := &common.UpdateRecordRequest{
+		PublicIp:  common.DnsRecord{Host: "home.example.com", IpV4: "198.51.100.1", Timestamp: time.Now()},
+		Signature: "signature",
+	}
+
+	tests := []struct {
+		name         string
+		queue        func(t testing.TB) *testutil.Sqs
+		wantMessages int
+		wantGroupId  string
+		wantDedupId  string
+	}{
+		{
+			name:         "standard queue",
+			queue:        testutil.NewSqs,
+			wantMessages: 2,
+		},
+		{
+			name:         "fifo queue",
+			queue:        testutil.NewFifoSqs,
+			wantMessages: 1,
+			wantGroupId:  "home.example.com",
+			wantDedupId:  req.Hash(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := tt.queue(t)
+			config := conf.SqsConfig{SqsQueue: queue.QueueUrl, Region: "us-east-1", Endpoint: queue.Endpoint}
+			dispatcher, err := NewSqsDispatcher(config, testutil.SqsCredentials, common.PayloadFormatPlain)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the same update request is dispatched twice, e.g. after a retry
+			for range 2 {
+				if err := dispatcher.Notify(context.Background(), req); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			messages := queue.Messages()
+			if len(messages) != tt.wantMessages {
+				t.Fatalf("expected %d messages, got %d", tt.wantMessages, len(messages))
+			}
+
+			message := messages[0]
+			if message.GroupId != tt.wantGroupId {
+				t.Errorf("expected group id %q, got %q", tt.wantGroupId, message.GroupId)
+			}
+			if message.DeduplicationId != tt.wantDedupId {
+				t.Errorf("expected deduplication id %q, got %q", tt.wantDedupId, message.DeduplicationId)
+			}
+			if got := message.Attributes[common.MetadataHost].StringValue; got != "home.example.com" {
+				t.Errorf("expected host attribute home.example.com, got %q", got)
+			}
+			if got := message.Attributes[common.MetadataSchemaVersion].StringValue; got != common.UpdateRecordRequestSchemaVersion {
+				t.Errorf("expected schema version attribute %s, got %q", common.UpdateRecordRequestSchemaVersion, got)
+			}
+		})
+	}
+}
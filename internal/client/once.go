@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/client/states"
+	"github.com/soerenschneider/dyndns/internal/common"
+)
+
+// OnceResult is the outcome of a single run of the client. Results are ordered by severity, so the result of
+// multiple clients is the maximum of their results.
+type OnceResult int
+
+const (
+	// OnceUnchanged indicates that the DNS record already contains the resolved ips
+	OnceUnchanged OnceResult = iota
+	// OnceUpdatedConfirmed indicates that an update request has been delivered and the DNS record has been verified
+	OnceUpdatedConfirmed
+	// OnceDispatchedUnconfirmed indicates that an update request has been delivered, but the DNS record has not been
+	// verified (yet)
+	OnceDispatchedUnconfirmed
+	// OnceFailed indicates that the ip could not be resolved or the update request could not be delivered
+	OnceFailed
+)
+
+func (r OnceResult) String() string {
+	switch r {
+	case OnceUnchanged:
+		return "unchanged"
+	case OnceUpdatedConfirmed:
+		return "updated_confirmed"
+	case OnceDispatchedUnconfirmed:
+		return "dispatched_unconfirmed"
+	default:
+		return "failed"
+	}
+}
+
+// RunOnce runs a single cycle: the ip is resolved and, if the DNS record differs, an update request is delivered,
+// retrying failed deliveries until the context is done. If waitForConfirmation is set, the DNS record is verified
+// until it contains the resolved ips, the state machine gives up or the context is done.
+func (client *Client) RunOnce(ctx context.Context, waitForConfirmation bool) (OnceResult, error) {
+	host := client.resolver.Host()
+	resolvedIp, err := client.Resolve(ctx, nil)
+	if resolvedIp == nil {
+		return OnceFailed, err
+	}
+
+	if _, ok := client.GetState().(states.ConfirmedState); ok {
+		return OnceUnchanged, nil
+	}
+
+	if err := client.reconciler.AwaitDelivery(ctx, host); err != nil {
+		return OnceFailed, err
+	}
+
+	if !waitForConfirmation {
+		return OnceDispatchedUnconfirmed, nil
+	}
+
+	return client.awaitConfirmation(ctx, resolvedIp)
+}
+
+// awaitConfirmation evaluates the state machine until the DNS record has been verified, re-sending update requests
+// according to the state machine's backoff
+func (client *Client) awaitConfirmation(ctx context.Context, resolvedIp *common.DnsRecord) (OnceResult, error) {
+	host := client.resolver.Host()
+	timer := time.NewTimer(client.GetState().WaitInterval())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Warn().Str("component", "client").Str("host", host).Msg("DNS record not verified before the deadline")
+			return OnceDispatchedUnconfirmed, nil
+		case <-timer.C:
+		}
+
+		var err error
+		resolvedIp, err = client.Resolve(ctx, resolvedIp)
+		if err != nil {
+			log.Warn().Err(err).Str("component", "client").Str("host", host).Msg("error while waiting for confirmation")
+		}
+
+		switch client.GetState().(type) {
+		case states.ConfirmedState:
+			return OnceUpdatedConfirmed, nil
+		case states.UnconfirmableState:
+			return OnceDispatchedUnconfirmed, nil
+		}
+
+		// deliver update requests that have been re-sent
+		if err := client.reconciler.AwaitDelivery(ctx, host); err != nil {
+			return OnceFailed, err
+		}
+
+		timer.Reset(client.GetState().WaitInterval())
+	}
+}
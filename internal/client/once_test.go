@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/client/states"
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/verification"
+)
+
+const onceTestIp = "198.51.100.1"
+
+type publicIpResolver struct {
+	host string
+}
+
+func (r *publicIpResolver) Resolve() (*common.DnsRecord, error) {
+	record := common.NewResolvedIp(r.host)
+	record.IpV4 = onceTestIp
+	return record, nil
+}
+
+func (r *publicIpResolver) Name() string {
+	return "public"
+}
+
+func (r *publicIpResolver) Host() string {
+	return r.host
+}
+
+// switchableVerifier returns the resolved ip as soon as it's switched on
+type switchableVerifier struct {
+	matches atomic.Bool
+}
+
+func (v *switchableVerifier) Lookup(_, addressFamily string) ([]string, error) {
+	if v.matches.Load() && addressFamily == conf.AddrFamilyIpv4 {
+		return []string{onceTestIp}, nil
+	}
+	return nil, nil
+}
+
+// confirmingDispatcher switches on the verifier after the update request has been delivered
+type confirmingDispatcher struct {
+	verifier *switchableVerifier
+}
+
+func (d *confirmingDispatcher) Notify(_ context.Context, _ *common.UpdateRecordRequest) error {
+	d.verifier.matches.Store(true)
+	return nil
+}
+
+func (d *confirmingDispatcher) Close(_ context.Context) error {
+	return nil
+}
+
+func buildOnceClient(t *testing.T, dispatcher EventDispatch, verifier *switchableVerifier) *Client {
+	reconciler, err := NewReconciler(map[string]EventDispatch{"a": dispatcher}, conf.DefaultOutboxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keypair, err := verification.NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(&publicIpResolver{host: "home.example.com"}, keypair, reconciler, nil, WithRecordVerifier(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// intervals below the validated minimum keep the test fast
+	stateConf := conf.DefaultStateMachineConfig()
+	stateConf.NotConfirmedInterval = 10 * time.Millisecond
+	client.stateConf = stateConf
+	client.state = states.NewInitialState(false, stateConf, nil)
+	return client
+}
+
+func TestClient_RunOnce(t *testing.T) {
+	tests := []struct {
+		name                string
+		matches             bool
+		dispatcher          func(verifier *switchableVerifier) EventDispatch
+		waitForConfirmation bool
+		want                OnceResult
+	}{
+		{
+			name:    "unchanged",
+			matches: true,
+			dispatcher: func(_ *switchableVerifier) EventDispatch {
+				return newFakeDispatcher(nil)
+			},
+			want: OnceUnchanged,
+		},
+		{
+			name: "dispatched without waiting",
+			dispatcher: func(verifier *switchableVerifier) EventDispatch {
+				return &confirmingDispatcher{verifier: verifier}
+			},
+			want: OnceDispatchedUnconfirmed,
+		},
+		{
+			name: "updated and confirmed",
+			dispatcher: func(verifier *switchableVerifier) EventDispatch {
+				return &confirmingDispatcher{verifier: verifier}
+			},
+			waitForConfirmation: true,
+			want:                OnceUpdatedConfirmed,
+		},
+		{
+			name: "dispatched but not confirmed before deadline",
+			dispatcher: func(_ *switchableVerifier) EventDispatch {
+				return newFakeDispatcher(nil)
+			},
+			waitForConfirmation: true,
+			want:                OnceDispatchedUnconfirmed,
+		},
+		{
+			name: "delivery failed",
+			dispatcher: func(_ *switchableVerifier) EventDispatch {
+				return newFakeDispatcher(errors.New("broker unreachable"))
+			},
+			want: OnceFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := &switchableVerifier{}
+			verifier.matches.Store(tt.matches)
+			client := buildOnceClient(t, tt.dispatcher(verifier), verifier)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			got, err := client.RunOnce(ctx, tt.waitForConfirmation)
+			if got != tt.want {
+				t.Errorf("RunOnce() got = %v, want %v (err: %v)", got, tt.want, err)
+			}
+		})
+	}
+}
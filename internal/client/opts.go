@@ -3,6 +3,9 @@ package client
 import (
 	"errors"
 	"time"
+
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/util"
 )
 
 func WithInterval(interval time.Duration) func(c *Client) error {
@@ -26,3 +29,59 @@ func WithForceSendUpdate() func(c *Client) error {
 		return nil
 	}
 }
+
+func WithStateMachineConfig(stateConf conf.StateMachineConfig) func(c *Client) error {
+	return func(c *Client) error {
+		if err := conf.ValidateConfig(stateConf); err != nil {
+			return err
+		}
+
+		c.stateConf = stateConf
+		return nil
+	}
+}
+
+func WithRecordVerifier(verifier util.RecordVerifier) func(c *Client) error {
+	return func(c *Client) error {
+		if verifier == nil {
+			return errors.New("nil verifier provided")
+		}
+
+		c.verifier = verifier
+		return nil
+	}
+}
+
+func WithStateStore(store *StateStore) func(c *Client) error {
+	return func(c *Client) error {
+		if store == nil {
+			return errors.New("nil state store provided")
+		}
+
+		c.store = store
+		return nil
+	}
+}
+
+// WithStatusListener notifies the listener about status changes, listeners must not block
+func WithStatusListener(listener StatusListener) func(c *Client) error {
+	return func(c *Client) error {
+		if listener == nil {
+			return errors.New("nil status listener provided")
+		}
+
+		c.statusListeners = append(c.statusListeners, listener)
+		return nil
+	}
+}
+
+func WithReconcilerStateStore(store *StateStore) ReconcilerOpts {
+	return func(r *Reconciler) error {
+		if store == nil {
+			return errors.New("nil state store provided")
+		}
+
+		r.store = store
+		return nil
+	}
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/util"
+)
+
+// outboxEntry is an update request and its delivery status for each dispatcher
+type outboxEntry struct {
+	Request    *common.UpdateRecordRequest `json:"request"`
+	CreatedAt  time.Time                   `json:"created_at"`
+	Deliveries map[string]*delivery        `json:"deliveries"`
+}
+
+// delivery is the delivery status of an update request for a single dispatcher
+type delivery struct {
+	Delivered   bool      `json:"delivered"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	// inFlight is set while the dispatcher is delivering the update request
+	inFlight bool
+}
+
+func newOutboxEntry(req *common.UpdateRecordRequest, dispatchers []string) *outboxEntry {
+	entry := &outboxEntry{
+		Request:    req,
+		CreatedAt:  time.Now(),
+		Deliveries: make(map[string]*delivery, len(dispatchers)),
+	}
+
+	for _, dispatcher := range dispatchers {
+		entry.Deliveries[dispatcher] = &delivery{}
+	}
+
+	return entry
+}
+
+// claimDue returns the sorted names of the dispatchers whose delivery is due and marks them as in flight. If
+// ignoreBackoff is set, all pending deliveries are considered due.
+func (e *outboxEntry) claimDue(now time.Time, ignoreBackoff bool) []string {
+	var ret []string
+	for dispatcher, delivery := range e.Deliveries {
+		if !delivery.Delivered && !delivery.inFlight && (ignoreBackoff || !now.Before(delivery.NextAttempt)) {
+			delivery.inFlight = true
+			ret = append(ret, dispatcher)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// pending returns the sorted names of the dispatchers that have not delivered the update request yet
+func (e *outboxEntry) pending() []string {
+	ret := make([]string, 0, len(e.Deliveries))
+	for dispatcher, delivery := range e.Deliveries {
+		if !delivery.Delivered {
+			ret = append(ret, dispatcher)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (e *outboxEntry) delivered() int {
+	delivered := 0
+	for _, delivery := range e.Deliveries {
+		if delivery.Delivered {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+func (e *outboxEntry) isExpired(now time.Time, maxAge time.Duration) bool {
+	return now.Sub(e.CreatedAt) > maxAge
+}
+
+// recordAttempt updates the delivery status of the dispatcher after an attempt to deliver the update request
+func (e *outboxEntry) recordAttempt(dispatcher string, err error, now time.Time, backoff conf.BackoffConfig) {
+	delivery, ok := e.Deliveries[dispatcher]
+	if !ok {
+		return
+	}
+
+	delivery.inFlight = false
+	delivery.Attempts++
+	delivery.LastAttempt = now
+	if err == nil {
+		delivery.Delivered = true
+		delivery.LastError = ""
+		return
+	}
+
+	delivery.LastError = err.Error()
+	delivery.NextAttempt = now.Add(util.BackoffDelay(backoff, delivery.Attempts))
+}
+
+// deliveryPolicy decides whether an update request has been delivered successfully
+type deliveryPolicy struct {
+	name     string
+	required int
+}
+
+func newDeliveryPolicy(outboxConf conf.OutboxConfig, dispatchers int) (deliveryPolicy, error) {
+	switch outboxConf.Policy {
+	case conf.DeliveryPolicyAny:
+		return deliveryPolicy{name: outboxConf.Policy, required: 1}, nil
+	case conf.DeliveryPolicyAll:
+		return deliveryPolicy{name: outboxConf.Policy, required: dispatchers}, nil
+	case conf.DeliveryPolicyQuorum:
+		required := outboxConf.Quorum
+		if required == 0 {
+			required = dispatchers/2 + 1
+		}
+		if required > dispatchers {
+			return deliveryPolicy{}, fmt.Errorf("quorum of %d can not be reached with %d dispatchers", required, dispatchers)
+		}
+		return deliveryPolicy{name: outboxConf.Policy, required: required}, nil
+	default:
+		return deliveryPolicy{}, fmt.Errorf("unknown delivery policy '%s'", outboxConf.Policy)
+	}
+}
+
+// isSatisfied returns whether enough dispatchers have delivered the update request
+func (p deliveryPolicy) isSatisfied(entry *outboxEntry) bool {
+	return entry.delivered() >= p.required
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -9,106 +10,401 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
 	"github.com/soerenschneider/dyndns/internal/metrics"
 	"go.uber.org/multierr"
 )
 
+const (
+	// outboxCheckInterval is the interval to check for due deliveries, the delay between delivery attempts of a
+	// single dispatcher is defined by the configured backoff.
+	outboxCheckInterval = 5 * time.Second
+	// dispatchGracePeriod is the time dispatchers are granted to return after their context has been cancelled
+	dispatchGracePeriod = 1 * time.Second
+	// awaitDeliveryInterval is the interval to check for due deliveries while awaiting the delivery of an update request
+	awaitDeliveryInterval = 1 * time.Second
+)
+
 type Reconciler struct {
-	env         *common.UpdateRecordRequest
 	dispatchers map[string]EventDispatch
 	mutex       sync.Mutex
 
-	stopAfterFirstSuccess bool
-	pendingChanges        map[string]EventDispatch
+	conf   conf.OutboxConfig
+	policy deliveryPolicy
+	// outbox holds the pending update request per host
+	outbox    map[string]*outboxEntry
+	lastError *ErrorStatus
+	paused    atomic.Bool
+	store     *StateStore
+}
+
+type ReconcilerOpts func(r *Reconciler) error
+
+// ReconcilerStatus describes the pending dispatchers per host
+type ReconcilerStatus struct {
+	Pending   map[string][]string `json:"pending"`
+	Policy    string              `json:"policy"`
+	LastError *ErrorStatus        `json:"last_error,omitempty"`
+	Paused    bool                `json:"paused"`
+}
+
+type dispatchResult struct {
+	dispatcher string
+	err        error
 }
 
-func NewReconciler(dispatchers map[string]EventDispatch, stopAfterFirstSuccess bool) (*Reconciler, error) {
+func NewReconciler(dispatchers map[string]EventDispatch, outboxConf conf.OutboxConfig, opts ...ReconcilerOpts) (*Reconciler, error) {
 	if len(dispatchers) < 1 {
 		return nil, errors.New("no dispatchers supplied")
 	}
 
-	return &Reconciler{
-		dispatchers:           dispatchers,
-		mutex:                 sync.Mutex{},
-		stopAfterFirstSuccess: stopAfterFirstSuccess,
-	}, nil
+	policy, err := newDeliveryPolicy(outboxConf, len(dispatchers))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reconciler{
+		dispatchers: dispatchers,
+		mutex:       sync.Mutex{},
+		conf:        outboxConf,
+		policy:      policy,
+		outbox:      map[string]*outboxEntry{},
+	}
+
+	var errs error
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			errs = multierr.Append(errs, err)
+		}
+	}
+
+	if r.store != nil {
+		r.restoreOutbox()
+	}
+
+	return r, errs
 }
 
-func (r *Reconciler) RegisterUpdate(env *common.UpdateRecordRequest) error {
+// restoreOutbox restores the pending update requests that have been persisted before the client has been restarted
+func (r *Reconciler) restoreOutbox() {
+	for host, entry := range r.store.Outbox() {
+		if entry.Request == nil {
+			continue
+		}
+
+		for dispatcher := range entry.Deliveries {
+			if _, ok := r.dispatchers[dispatcher]; !ok {
+				delete(entry.Deliveries, dispatcher)
+			}
+		}
+
+		log.Info().Str("component", "reconciler").Str("host", host).Strs("pending", entry.pending()).Msg("Restored pending update")
+		r.outbox[host] = entry
+		metrics.ReconcilersActive.WithLabelValues(host).Set(float64(len(entry.pending())))
+	}
+}
+
+// persistOutbox writes the outbox to the state store, the caller must hold the mutex
+func (r *Reconciler) persistOutbox() {
+	if r.store == nil {
+		return
+	}
+
+	if err := r.store.SetOutbox(r.outbox); err != nil {
+		log.Error().Err(err).Str("component", "reconciler").Msg("Could not persist outbox")
+	}
+}
+
+func (r *Reconciler) RegisterUpdate(ctx context.Context, env *common.UpdateRecordRequest) error {
 	if env == nil {
 		return errors.New("nil env supplied")
 	}
 
 	r.mutex.Lock()
-	r.env = env
+	dispatchers := make([]string, 0, len(r.dispatchers))
+	for key := range r.dispatchers {
+		dispatchers = append(dispatchers, key)
+	}
 
-	r.pendingChanges = make(map[string]EventDispatch, len(r.dispatchers))
-	for i, dispatcher := range r.dispatchers {
-		r.pendingChanges[i] = dispatcher
+	host := env.PublicIp.Host
+	entry := newOutboxEntry(env, dispatchers)
+	r.outbox[host] = entry
+	metrics.ReconcilersActive.WithLabelValues(host).Set(float64(len(dispatchers)))
+	r.persistOutbox()
+
+	if r.paused.Load() {
+		r.mutex.Unlock()
+		log.Info().Str("component", "reconciler").Str("host", host).Msg("Reconciler is paused, not dispatching update")
+		return nil
 	}
-	metrics.ReconcilersActive.WithLabelValues(env.PublicIp.Host).Set(float64(len(r.pendingChanges)))
 
+	now := time.Now()
+	due := entry.claimDue(now, false)
 	r.mutex.Unlock()
-	return r.dispatch()
+
+	results := r.notify(ctx, entry.Request, due)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	err := r.applyResults(entry, results, now)
+	r.persistOutbox()
+	if err != nil {
+		r.lastError = newErrorStatus(err)
+	}
+	return err
+}
+
+// SetPaused pauses or resumes dispatching pending updates
+func (r *Reconciler) SetPaused(paused bool) {
+	if r.paused.Swap(paused) != paused {
+		log.Info().Str("component", "reconciler").Bool("paused", paused).Msg("Changed pause status")
+	}
 }
 
-func (r *Reconciler) dispatch() error {
+func (r *Reconciler) Status() ReconcilerStatus {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if len(r.pendingChanges) == 0 {
-		return nil
+	pending := make(map[string][]string, len(r.outbox))
+	for host, entry := range r.outbox {
+		pending[host] = entry.pending()
 	}
 
-	metrics.ReconcilerTimestamp.WithLabelValues(r.env.PublicIp.Host).SetToCurrentTime()
-	log.Info().Str("component", "reconciler").Int("num_dispatchers", len(r.pendingChanges)).Msg("Reconciling dispatchers")
+	return ReconcilerStatus{
+		Pending:   pending,
+		Policy:    r.policy.name,
+		LastError: r.lastError,
+		Paused:    r.paused.Load(),
+	}
+}
 
-	timeStart := time.Now()
-	wg := sync.WaitGroup{}
-	wg.Add(len(r.pendingChanges))
-	errLock := &sync.Mutex{}
+func (r *Reconciler) dispatch(ctx context.Context) error {
+	return r.deliverPending(ctx, false)
+}
+
+// Shutdown makes a final attempt to deliver all pending update requests, regardless of their backoff, and closes
+// the dispatchers afterwards. It must only be called after Run has returned.
+func (r *Reconciler) Shutdown(ctx context.Context) error {
+	var errs error
+	if err := r.deliverPending(ctx, true); err != nil {
+		errs = multierr.Append(errs, fmt.Errorf("could not flush outbox: %w", err))
+	}
+
+	return multierr.Append(errs, r.Close(ctx))
+}
+
+// Close closes the dispatchers without attempting to deliver pending update requests
+func (r *Reconciler) Close(ctx context.Context) error {
 	var errs error
-	var successFullDispatches atomic.Int32
-	for key, dispatcher := range r.pendingChanges {
-		var disp = dispatcher
-		go func(key string) {
-			err := disp.Notify(r.env)
-			if err == nil {
-				successFullDispatches.Add(1)
-				r.pendingChanges[key] = nil
-				delete(r.pendingChanges, key)
-				metrics.UpdatesDispatched.Inc()
-				log.Info().Str("component", "reconciler").Str("dispatcher", key).Msg("Reconciliation successful")
-			} else {
-				errLock.Lock()
-				metrics.UpdateDispatchErrors.WithLabelValues(key).Inc()
-				errs = multierr.Append(errs, fmt.Errorf("reconciliation for dispatcher %s failed: %w", key, err))
-				errLock.Unlock()
+	for key, dispatcher := range r.dispatchers {
+		if err := dispatcher.Close(ctx); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("could not close dispatcher %s: %w", key, err))
+		}
+	}
+
+	return errs
+}
+
+// AwaitDelivery delivers the pending update request of the host, respecting the retry backoff, until the delivery
+// policy is satisfied or the context is done. It returns immediately if no update request is pending for the host.
+func (r *Reconciler) AwaitDelivery(ctx context.Context, host string) error {
+	r.mutex.Lock()
+	entry, ok := r.outbox[host]
+	r.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	// return before the update request expires, as an expired request is dropped without being delivered
+	ctx, cancel := context.WithDeadline(ctx, entry.CreatedAt.Add(r.conf.MaxAge))
+	defer cancel()
+
+	ticker := time.NewTicker(awaitDeliveryInterval)
+	defer ticker.Stop()
+
+	for {
+		r.mutex.Lock()
+		entry, ok = r.outbox[host]
+		var pending []string
+		if ok {
+			pending = entry.pending()
+		}
+		r.mutex.Unlock()
+		if !ok {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("update request for host %s not delivered by %v: %w", host, pending, ctx.Err())
+		case <-ticker.C:
+			if err := r.deliverPending(ctx, false); err != nil {
+				log.Warn().Err(err).Str("component", "reconciler").Str("host", host).Msg("Delivering update request failed")
 			}
-			wg.Done()
-		}(key)
+		}
+	}
+}
+
+// deliverPending drops expired update requests and delivers the pending update requests whose delivery is due
+func (r *Reconciler) deliverPending(ctx context.Context, ignoreBackoff bool) error {
+	type claimed struct {
+		entry *outboxEntry
+		due   []string
+	}
+
+	r.mutex.Lock()
+	if r.paused.Load() || len(r.outbox) == 0 {
+		r.mutex.Unlock()
+		return nil
 	}
 
+	var errs error
+	var pending []claimed
+	now := time.Now()
+	for host, entry := range r.outbox {
+		if entry.isExpired(now, r.conf.MaxAge) {
+			log.Error().Str("component", "reconciler").Str("host", host).Strs("pending", entry.pending()).Time("created_at", entry.CreatedAt).Msg("Dropping expired update request")
+			metrics.OutboxExpired.WithLabelValues(host).Inc()
+			r.removeEntry(host)
+			errs = multierr.Append(errs, fmt.Errorf("update request for host %s expired before it could be delivered", host))
+			continue
+		}
+
+		if due := entry.claimDue(now, ignoreBackoff); len(due) > 0 {
+			pending = append(pending, claimed{entry: entry, due: due})
+		}
+	}
+	r.mutex.Unlock()
+
+	results := make([][]dispatchResult, len(pending))
+	wg := sync.WaitGroup{}
+	for index, claimed := range pending {
+		wg.Add(1)
+		go func(index int, entry *outboxEntry, due []string) {
+			defer wg.Done()
+			results[index] = r.notify(ctx, entry.Request, due)
+		}(index, claimed.entry, claimed.due)
+	}
 	wg.Wait()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for index, claimed := range pending {
+		if err := r.applyResults(claimed.entry, results[index], now); err != nil {
+			errs = multierr.Append(errs, err)
+		}
+	}
+	r.persistOutbox()
+
+	if errs != nil {
+		r.lastError = newErrorStatus(errs)
+	}
+	return errs
+}
+
+// notify delivers the update request using the given dispatchers concurrently. Each dispatcher is given at most the
+// configured dispatch timeout, dispatchers that do not return in time are reported as failed.
+func (r *Reconciler) notify(ctx context.Context, req *common.UpdateRecordRequest, due []string) []dispatchResult {
+	if len(due) == 0 {
+		return nil
+	}
+
+	host := req.PublicIp.Host
+	metrics.ReconcilerTimestamp.WithLabelValues(host).SetToCurrentTime()
+	log.Info().Str("component", "reconciler").Str("host", host).Int("num_dispatchers", len(due)).Msg("Reconciling dispatchers")
+
+	ctx, cancel := context.WithTimeout(ctx, r.conf.DispatchTimeout)
+	defer cancel()
+
+	timeStart := time.Now()
+	resultsChan := make(chan dispatchResult, len(due))
+	for _, key := range due {
+		go func(key string, dispatcher EventDispatch) {
+			resultsChan <- dispatchResult{
+				dispatcher: key,
+				err:        dispatcher.Notify(ctx, req),
+			}
+		}(key, r.dispatchers[key])
+	}
+
+	results := make([]dispatchResult, 0, len(due))
+	returned := make(map[string]bool, len(due))
+	// grant dispatchers a short grace period to return after the context has been cancelled
+	grace := time.NewTimer(r.conf.DispatchTimeout + dispatchGracePeriod)
+	defer grace.Stop()
+collect:
+	for len(results) < len(due) {
+		select {
+		case result := <-resultsChan:
+			results = append(results, result)
+			returned[result.dispatcher] = true
+		case <-grace.C:
+			break collect
+		}
+	}
+
+	for _, key := range due {
+		if !returned[key] {
+			results = append(results, dispatchResult{dispatcher: key, err: errors.New("dispatcher did not return in time")})
+		}
+	}
+
 	timeSpent := time.Since(timeStart)
+	log.Info().Str("component", "reconciler").Str("host", host).Float64("seconds", timeSpent.Seconds()).Int("num_dispatchers", len(due)).Msgf("Spent %v on reconciliation", timeSpent)
+	return results
+}
 
-	if r.stopAfterFirstSuccess && successFullDispatches.Load() > 0 && len(r.pendingChanges) > 0 {
-		log.Info().Str("component", "reconciler").Int("pending", len(r.pendingChanges)).Int32("successful_dispatches", successFullDispatches.Load()).Msg("Stopping reconciliation due to successful dispatches")
-		r.pendingChanges = nil
+// applyResults records the results of the delivery attempts and removes the entry from the outbox if the delivery
+// policy is satisfied. The caller must hold the mutex.
+func (r *Reconciler) applyResults(entry *outboxEntry, results []dispatchResult, now time.Time) error {
+	host := entry.Request.PublicIp.Host
+
+	var errs error
+	for _, result := range results {
+		entry.recordAttempt(result.dispatcher, result.err, now, r.conf.RetryBackoff)
+		if result.err == nil {
+			metrics.UpdatesDispatched.Inc()
+			log.Info().Str("component", "reconciler").Str("host", host).Str("dispatcher", result.dispatcher).Msg("Reconciliation successful")
+		} else {
+			metrics.UpdateDispatchErrors.WithLabelValues(result.dispatcher).Inc()
+			errs = multierr.Append(errs, fmt.Errorf("reconciliation for dispatcher %s failed: %w", result.dispatcher, result.err))
+		}
 	}
 
-	log.Info().Str("component", "reconciler").Float64("seconds", timeSpent.Seconds()).Int("num_dispatchers", len(r.dispatchers)).Msgf("Spent %v on reconciliation", timeSpent)
-	metrics.ReconcilersActive.WithLabelValues(r.env.PublicIp.Host).Set(float64(len(r.pendingChanges)))
+	// the entry may have been superseded by a newer update request in the meantime
+	if r.outbox[host] != entry {
+		return errs
+	}
+
+	if r.policy.isSatisfied(entry) {
+		log.Info().Str("component", "reconciler").Str("host", host).Str("policy", r.policy.name).Int("delivered", entry.delivered()).Strs("pending", entry.pending()).Msg("Update request delivered")
+		r.removeEntry(host)
+		return nil
+	}
+
+	metrics.ReconcilersActive.WithLabelValues(host).Set(float64(len(entry.pending())))
 	return errs
 }
 
-func (r *Reconciler) Run() {
-	interval := 1 * time.Minute
-	ticker := time.NewTicker(interval)
+func (r *Reconciler) removeEntry(host string) {
+	delete(r.outbox, host)
+	metrics.ReconcilersActive.WithLabelValues(host).Set(0)
+}
+
+// Run periodically delivers pending update requests until the context is cancelled
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(outboxCheckInterval)
+	defer ticker.Stop()
 
-	for range ticker.C {
-		if err := r.dispatch(); err != nil {
-			log.Error().Err(err).Msg("running reconciler produced errors")
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Str("component", "reconciler").Msg("Stopping reconciler")
+			return
+		case <-ticker.C:
+			if err := r.dispatch(ctx); err != nil {
+				log.Error().Err(err).Msg("running reconciler produced errors")
+			}
 		}
 	}
 }
@@ -0,0 +1,286 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+type fakeDispatcher struct {
+	err    atomic.Value
+	calls  atomic.Int32
+	closed atomic.Bool
+}
+
+func newFakeDispatcher(err error) *fakeDispatcher {
+	dispatcher := &fakeDispatcher{}
+	dispatcher.setErr(err)
+	return dispatcher
+}
+
+func (d *fakeDispatcher) setErr(err error) {
+	d.err.Store(&err)
+}
+
+func (d *fakeDispatcher) Notify(_ context.Context, _ *common.UpdateRecordRequest) error {
+	d.calls.Add(1)
+	return *d.err.Load().(*error)
+}
+
+func (d *fakeDispatcher) Close(_ context.Context) error {
+	d.closed.Store(true)
+	return nil
+}
+
+func updateRequest(host string) *common.UpdateRecordRequest {
+	return &common.UpdateRecordRequest{
+		PublicIp:  common.DnsRecord{Host: host, IpV4: "192.0.2.1", Timestamp: time.Now()},
+		Signature: "sig",
+	}
+}
+
+func TestReconciler_DeliveryPolicies(t *testing.T) {
+	failure := errors.New("broker unreachable")
+
+	tests := []struct {
+		policy      string
+		quorum      int
+		errs        map[string]error
+		wantPending []string
+	}{
+		{
+			policy:      conf.DeliveryPolicyAny,
+			errs:        map[string]error{"a": nil, "b": failure, "c": failure},
+			wantPending: nil,
+		},
+		{
+			policy:      conf.DeliveryPolicyAll,
+			errs:        map[string]error{"a": nil, "b": failure, "c": nil},
+			wantPending: []string{"b"},
+		},
+		{
+			policy:      conf.DeliveryPolicyQuorum,
+			errs:        map[string]error{"a": nil, "b": failure, "c": nil},
+			wantPending: nil,
+		},
+		{
+			policy:      conf.DeliveryPolicyQuorum,
+			quorum:      3,
+			errs:        map[string]error{"a": nil, "b": failure, "c": nil},
+			wantPending: []string{"b"},
+		},
+		{
+			policy:      conf.DeliveryPolicyQuorum,
+			errs:        map[string]error{"a": nil, "b": failure, "c": failure},
+			wantPending: []string{"b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			dispatchers := map[string]EventDispatch{}
+			for key, err := range tt.errs {
+				dispatchers[key] = newFakeDispatcher(err)
+			}
+
+			outboxConf := conf.DefaultOutboxConfig()
+			outboxConf.Policy = tt.policy
+			outboxConf.Quorum = tt.quorum
+			reconciler, err := NewReconciler(dispatchers, outboxConf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_ = reconciler.RegisterUpdate(context.Background(), updateRequest("home.example.com"))
+			if got := reconciler.Status().Pending["home.example.com"]; !reflect.DeepEqual(got, tt.wantPending) {
+				t.Errorf("expected pending %v, got %v", tt.wantPending, got)
+			}
+		})
+	}
+}
+
+func TestReconciler_RetryBackoff(t *testing.T) {
+	dispatcher := newFakeDispatcher(errors.New("broker unreachable"))
+	reconciler, err := NewReconciler(map[string]EventDispatch{"a": dispatcher}, conf.DefaultOutboxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reconciler.RegisterUpdate(context.Background(), updateRequest("home.example.com")); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// the delivery is not due yet
+	if err := reconciler.dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dispatcher.calls.Load() != 1 {
+		t.Fatalf("expected 1 call, got %d", dispatcher.calls.Load())
+	}
+
+	dispatcher.setErr(nil)
+	reconciler.outbox["home.example.com"].Deliveries["a"].NextAttempt = time.Now().Add(-time.Second)
+	if err := reconciler.dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dispatcher.calls.Load() != 2 || len(reconciler.Status().Pending) != 0 {
+		t.Fatalf("expected update to be delivered on second attempt")
+	}
+}
+
+func TestReconciler_MaxAge(t *testing.T) {
+	dispatcher := newFakeDispatcher(errors.New("broker unreachable"))
+	reconciler, err := NewReconciler(map[string]EventDispatch{"a": dispatcher}, conf.DefaultOutboxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = reconciler.RegisterUpdate(context.Background(), updateRequest("home.example.com"))
+	reconciler.outbox["home.example.com"].CreatedAt = time.Now().Add(-13 * time.Hour)
+
+	if err := reconciler.dispatch(context.Background()); err == nil {
+		t.Fatal("expected error for expired update request")
+	}
+	if len(reconciler.Status().Pending) != 0 {
+		t.Fatal("expected expired update request to be dropped")
+	}
+}
+
+func TestNewReconciler_UnreachableQuorum(t *testing.T) {
+	outboxConf := conf.DefaultOutboxConfig()
+	outboxConf.Policy = conf.DeliveryPolicyQuorum
+	outboxConf.Quorum = 2
+
+	if _, err := NewReconciler(map[string]EventDispatch{"a": &nopDispatcher{}}, outboxConf); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// blockingDispatcher blocks until its context is done or it is released
+type blockingDispatcher struct {
+	release chan struct{}
+}
+
+func (d *blockingDispatcher) Notify(ctx context.Context, _ *common.UpdateRecordRequest) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.release:
+		return nil
+	}
+}
+
+func (d *blockingDispatcher) Close(_ context.Context) error {
+	return nil
+}
+
+func TestReconciler_DispatchTimeout(t *testing.T) {
+	outboxConf := conf.DefaultOutboxConfig()
+	outboxConf.DispatchTimeout = 50 * time.Millisecond
+
+	fast := newFakeDispatcher(nil)
+	reconciler, err := NewReconciler(map[string]EventDispatch{
+		"fast": fast,
+		"slow": &blockingDispatcher{release: make(chan struct{})},
+	}, outboxConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_ = reconciler.RegisterUpdate(context.Background(), updateRequest("home.example.com"))
+	if took := time.Since(start); took > outboxConf.DispatchTimeout+dispatchGracePeriod {
+		t.Fatalf("dispatching took %v", took)
+	}
+
+	// the 'any' policy is satisfied by the fast dispatcher
+	if fast.calls.Load() != 1 || len(reconciler.Status().Pending) != 0 {
+		t.Fatalf("expected update to be delivered by fast dispatcher")
+	}
+}
+
+func TestReconciler_ConcurrentAccess(t *testing.T) {
+	outboxConf := conf.DefaultOutboxConfig()
+	outboxConf.Policy = conf.DeliveryPolicyAll
+	dispatcher := newFakeDispatcher(errors.New("broker unreachable"))
+	reconciler, err := NewReconciler(map[string]EventDispatch{"a": dispatcher, "b": newFakeDispatcher(nil)}, outboxConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			_ = reconciler.RegisterUpdate(ctx, updateRequest("home.example.com"))
+		}()
+		go func() {
+			defer wg.Done()
+			_ = reconciler.dispatch(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			reconciler.SetPaused(i%2 == 0)
+			_ = reconciler.Status()
+		}()
+	}
+	wg.Wait()
+
+	// the last update request may have been registered while the reconciler was paused
+	reconciler.SetPaused(false)
+	_ = reconciler.dispatch(ctx)
+	if got := reconciler.Status().Pending["home.example.com"]; !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("expected pending [a], got %v", got)
+	}
+}
+
+func TestReconciler_RunStopsOnCancel(t *testing.T) {
+	reconciler, err := NewReconciler(map[string]EventDispatch{"a": &nopDispatcher{}}, conf.DefaultOutboxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		reconciler.Run(ctx)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reconciler did not stop after context has been cancelled")
+	}
+}
+
+func TestReconciler_Shutdown(t *testing.T) {
+	dispatcher := newFakeDispatcher(errors.New("broker unreachable"))
+	reconciler, err := NewReconciler(map[string]EventDispatch{"a": dispatcher}, conf.DefaultOutboxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = reconciler.RegisterUpdate(context.Background(), updateRequest("home.example.com"))
+
+	// the pending delivery is flushed regardless of its backoff
+	dispatcher.setErr(nil)
+	if err := reconciler.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dispatcher.calls.Load() != 2 || len(reconciler.Status().Pending) != 0 {
+		t.Fatal("expected pending update request to be flushed")
+	}
+	if !dispatcher.closed.Load() {
+		t.Fatal("expected dispatcher to be closed")
+	}
+}
@@ -0,0 +1,156 @@
+package resolvers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/metrics"
+	"go.uber.org/multierr"
+)
+
+// ChainLink is a single resolver of a ChainResolver that is used for the given address families.
+type ChainLink struct {
+	Resolver        IpResolver
+	AddressFamilies []string
+}
+
+func (l *ChainLink) supports(addressFamily string) bool {
+	for _, family := range l.AddressFamilies {
+		if family == addressFamily {
+			return true
+		}
+	}
+	return false
+}
+
+// ChainResolver tries an ordered list of resolvers per address family and merges the results into a single record.
+type ChainResolver struct {
+	host            string
+	links           []ChainLink
+	addressFamilies []string
+}
+
+func NewChainResolver(host string, addressFamilies []string, links ...ChainLink) (*ChainResolver, error) {
+	if len(links) == 0 {
+		return nil, errors.New("no resolvers provided")
+	}
+
+	if len(addressFamilies) == 0 {
+		return nil, errors.New("empty addressFamily slice provided")
+	}
+
+	for index, link := range links {
+		if link.Resolver == nil {
+			return nil, fmt.Errorf("nil resolver provided at position %d", index)
+		}
+		if len(link.AddressFamilies) == 0 {
+			links[index].AddressFamilies = addressFamilies
+		}
+	}
+
+	return &ChainResolver{
+		host:            host,
+		links:           links,
+		addressFamilies: addressFamilies,
+	}, nil
+}
+
+func (resolver *ChainResolver) Name() string {
+	return "ChainResolver"
+}
+
+func (resolver *ChainResolver) Host() string {
+	return resolver.host
+}
+
+func (resolver *ChainResolver) Resolve() (*common.DnsRecord, error) {
+	resolved := &common.DnsRecord{
+		Host:      resolver.host,
+		Timestamp: time.Now(),
+	}
+
+	// cache the answers so each resolver is invoked at most once per run
+	answers := make(map[int]*common.DnsRecord, len(resolver.links))
+	var errs error
+	for _, addressFamily := range resolver.addressFamilies {
+		found := false
+		for index, link := range resolver.links {
+			if !link.supports(addressFamily) {
+				continue
+			}
+
+			answer, ok := answers[index]
+			if !ok {
+				var err error
+				answer, err = link.Resolver.Resolve()
+				if err != nil {
+					errs = multierr.Append(errs, fmt.Errorf("%s: %w", link.Resolver.Name(), err))
+					log.Warn().Err(err).Str("component", "chain_resolver").Str("resolver", link.Resolver.Name()).Msg("Resolver failed, trying next resolver")
+				}
+				answers[index] = answer
+			}
+
+			ip := getAddress(answer, addressFamily)
+			if !isPublicAddr(ip, addressFamily) {
+				continue
+			}
+
+			setAddress(resolved, addressFamily, ip)
+			metrics.ChainResolverAnswers.WithLabelValues(resolver.host, link.Resolver.Name(), addressFamily).Inc()
+			log.Debug().Str("component", "chain_resolver").Str("resolver", link.Resolver.Name()).Str("address_family", addressFamily).Str("ip", ip).Msg("Resolved address")
+			found = true
+			break
+		}
+
+		if !found {
+			errs = multierr.Append(errs, fmt.Errorf("no resolver returned a public %s address", addressFamily))
+		}
+	}
+
+	if !resolved.HasIpV4() && !resolved.HasIpV6() {
+		return nil, errs
+	}
+
+	if errs != nil {
+		log.Warn().Err(errs).Str("component", "chain_resolver").Msg("Could not resolve all address families")
+	}
+
+	return resolved, nil
+}
+
+func getAddress(record *common.DnsRecord, addressFamily string) string {
+	if record == nil {
+		return ""
+	}
+
+	if addressFamily == conf.AddrFamilyIpv6 {
+		return record.IpV6
+	}
+	return record.IpV4
+}
+
+func setAddress(record *common.DnsRecord, addressFamily string, ip string) {
+	if addressFamily == conf.AddrFamilyIpv6 {
+		record.IpV6 = ip
+	} else {
+		record.IpV4 = ip
+	}
+}
+
+// sharedAddressSpace is used for carrier-grade NAT (RFC 6598) and is not publicly routable
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicAddr checks whether the given ip belongs to the address family and is a publicly routable address
+func isPublicAddr(ip string, addressFamily string) bool {
+	if !isAddrFamily(ip, addressFamily) {
+		return false
+	}
+
+	addr := net.ParseIP(ip)
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
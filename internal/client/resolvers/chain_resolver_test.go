@@ -0,0 +1,150 @@
+package resolvers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+type fakeResolver struct {
+	name   string
+	record *common.DnsRecord
+	err    error
+	calls  int
+}
+
+func (f *fakeResolver) Resolve() (*common.DnsRecord, error) {
+	f.calls++
+	return f.record, f.err
+}
+
+func (f *fakeResolver) Name() string {
+	return f.name
+}
+
+func (f *fakeResolver) Host() string {
+	return "my.host.tld"
+}
+
+func TestChainResolver_Resolve(t *testing.T) {
+	both := []string{conf.AddrFamilyIpv4, conf.AddrFamilyIpv6}
+
+	tests := []struct {
+		name            string
+		addressFamilies []string
+		links           func() []ChainLink
+		wantIpV4        string
+		wantIpV6        string
+		wantErr         bool
+	}{
+		{
+			name:            "first resolver answers",
+			addressFamilies: []string{conf.AddrFamilyIpv4},
+			links: func() []ChainLink {
+				return []ChainLink{
+					{Resolver: &fakeResolver{name: "a", record: &common.DnsRecord{IpV4: "1.1.1.1"}}},
+					{Resolver: &fakeResolver{name: "b", record: &common.DnsRecord{IpV4: "2.2.2.2"}}},
+				}
+			},
+			wantIpV4: "1.1.1.1",
+		},
+		{
+			name:            "fallback on error",
+			addressFamilies: []string{conf.AddrFamilyIpv4},
+			links: func() []ChainLink {
+				return []ChainLink{
+					{Resolver: &fakeResolver{name: "a", err: errors.New("broken")}},
+					{Resolver: &fakeResolver{name: "b", record: &common.DnsRecord{IpV4: "2.2.2.2"}}},
+				}
+			},
+			wantIpV4: "2.2.2.2",
+		},
+		{
+			name:            "fallback on private address",
+			addressFamilies: []string{conf.AddrFamilyIpv4},
+			links: func() []ChainLink {
+				return []ChainLink{
+					{Resolver: &fakeResolver{name: "interface", record: &common.DnsRecord{IpV4: "192.168.1.2"}}},
+					{Resolver: &fakeResolver{name: "cgnat", record: &common.DnsRecord{IpV4: "100.64.1.2"}}},
+					{Resolver: &fakeResolver{name: "http", record: &common.DnsRecord{IpV4: "2.2.2.2"}}},
+				}
+			},
+			wantIpV4: "2.2.2.2",
+		},
+		{
+			name:            "per family sourcing",
+			addressFamilies: both,
+			links: func() []ChainLink {
+				return []ChainLink{
+					{Resolver: &fakeResolver{name: "interface", record: &common.DnsRecord{IpV4: "1.1.1.1", IpV6: "2001:4860::1"}}, AddressFamilies: []string{conf.AddrFamilyIpv6}},
+					{Resolver: &fakeResolver{name: "http", record: &common.DnsRecord{IpV4: "2.2.2.2", IpV6: "2001:4860::2"}}, AddressFamilies: []string{conf.AddrFamilyIpv4}},
+				}
+			},
+			wantIpV4: "2.2.2.2",
+			wantIpV6: "2001:4860::1",
+		},
+		{
+			name:            "partial result",
+			addressFamilies: both,
+			links: func() []ChainLink {
+				return []ChainLink{
+					{Resolver: &fakeResolver{name: "a", record: &common.DnsRecord{IpV4: "1.1.1.1"}}},
+				}
+			},
+			wantIpV4: "1.1.1.1",
+		},
+		{
+			name:            "no resolver answers",
+			addressFamilies: both,
+			links: func() []ChainLink {
+				return []ChainLink{
+					{Resolver: &fakeResolver{name: "a", err: errors.New("broken")}},
+					{Resolver: &fakeResolver{name: "b", record: &common.DnsRecord{IpV4: "10.0.0.1"}}},
+				}
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := NewChainResolver("my.host.tld", tt.addressFamilies, tt.links()...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := resolver.Resolve()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.IpV4 != tt.wantIpV4 || got.IpV6 != tt.wantIpV6 {
+				t.Errorf("Resolve() got = %v, want %s / %s", got, tt.wantIpV4, tt.wantIpV6)
+			}
+			if got.Host != "my.host.tld" {
+				t.Errorf("Resolve() host = %s", got.Host)
+			}
+		})
+	}
+}
+
+func TestChainResolver_Resolve_InvokesResolverOnce(t *testing.T) {
+	failing := &fakeResolver{name: "a", err: errors.New("broken")}
+	working := &fakeResolver{name: "b", record: &common.DnsRecord{IpV4: "1.1.1.1", IpV6: "2001:4860::1"}}
+
+	resolver, err := NewChainResolver("my.host.tld", []string{conf.AddrFamilyIpv4, conf.AddrFamilyIpv6}, ChainLink{Resolver: failing}, ChainLink{Resolver: working})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := resolver.Resolve(); err != nil {
+		t.Fatal(err)
+	}
+
+	if failing.calls != 1 || working.calls != 1 {
+		t.Errorf("expected resolvers to be called once, got %d and %d", failing.calls, working.calls)
+	}
+}
@@ -0,0 +1,145 @@
+package resolvers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"go.uber.org/multierr"
+)
+
+const (
+	defaultDnsQueryName = "myip.opendns.com"
+	dnsResolveTimeout   = 5 * time.Second
+)
+
+var defaultDnsNameservers = []string{
+	"208.67.222.222:53",
+	"[2620:119:35::35]:53",
+}
+
+// DnsResolver detects the public ip by querying special records that nameservers answer with the address the query
+// originates from, e.g. OpenDNS's myip.opendns.com.
+type DnsResolver struct {
+	host            string
+	queryName       string
+	nameservers     map[string]string
+	addressFamilies []string
+}
+
+func NewDnsResolver(host, queryName string, nameservers []string, addressFamilies []string) (*DnsResolver, error) {
+	if len(addressFamilies) == 0 {
+		return nil, errors.New("empty addressFamily slice provided")
+	}
+
+	if len(queryName) == 0 {
+		queryName = defaultDnsQueryName
+	}
+
+	if len(nameservers) == 0 {
+		nameservers = defaultDnsNameservers
+	}
+
+	resolver := &DnsResolver{
+		host:            host,
+		queryName:       queryName,
+		nameservers:     map[string]string{},
+		addressFamilies: addressFamilies,
+	}
+
+	for _, nameserver := range nameservers {
+		host, _, err := net.SplitHostPort(nameserver)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nameserver '%s': %w", nameserver, err)
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("nameserver '%s' is not an ip address", nameserver)
+		}
+
+		addressFamily := conf.AddrFamilyIpv6
+		if ip.To4() != nil {
+			addressFamily = conf.AddrFamilyIpv4
+		}
+		if _, found := resolver.nameservers[addressFamily]; !found {
+			resolver.nameservers[addressFamily] = nameserver
+		}
+	}
+
+	return resolver, nil
+}
+
+func (resolver *DnsResolver) Name() string {
+	return "DnsResolver"
+}
+
+func (resolver *DnsResolver) Host() string {
+	return resolver.host
+}
+
+func (resolver *DnsResolver) Resolve() (*common.DnsRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsResolveTimeout)
+	defer cancel()
+
+	resolved := &common.DnsRecord{
+		Host:      resolver.host,
+		Timestamp: time.Now(),
+	}
+
+	var errs error
+	for _, addressFamily := range resolver.addressFamilies {
+		ip, err := resolver.lookup(ctx, addressFamily)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+
+		if addressFamily == conf.AddrFamilyIpv6 {
+			resolved.IpV6 = ip
+		} else {
+			resolved.IpV4 = ip
+		}
+	}
+
+	if !resolved.HasIpV4() && !resolved.HasIpV6() {
+		return nil, fmt.Errorf("could not resolve ip via dns: %w", errs)
+	}
+
+	return resolved, nil
+}
+
+func (resolver *DnsResolver) lookup(ctx context.Context, addressFamily string) (string, error) {
+	nameserver, found := resolver.nameservers[addressFamily]
+	if !found {
+		return "", fmt.Errorf("no nameserver for address family %s configured", addressFamily)
+	}
+
+	network := "udp4"
+	if addressFamily == conf.AddrFamilyIpv6 {
+		network = "udp6"
+	}
+
+	dnsResolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			dialer := net.Dialer{}
+			return dialer.DialContext(ctx, network, nameserver)
+		},
+	}
+
+	ips, err := dnsResolver.LookupIP(ctx, addressFamily, resolver.queryName)
+	if err != nil {
+		return "", fmt.Errorf("could not lookup %s: %w", resolver.queryName, err)
+	}
+
+	if len(ips) == 0 {
+		return "", fmt.Errorf("empty answer for %s", resolver.queryName)
+	}
+
+	return ips[0].String(), nil
+}
@@ -1,6 +1,7 @@
 package resolvers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
@@ -15,72 +17,98 @@ import (
 	"github.com/soerenschneider/dyndns/internal/common"
 	"github.com/soerenschneider/dyndns/internal/conf"
 	"github.com/soerenschneider/dyndns/internal/metrics"
+	"go.uber.org/multierr"
 )
 
 const (
-	retries = 3
-	timeout = 2 * time.Second
+	retries               = 3
+	timeout               = 2 * time.Second
+	defaultResolveTimeout = 15 * time.Second
+	parallelQueries       = 3
 )
 
-var (
-	serverAddresses = map[string]string{
-		conf.AddrFamilyIpv4: "8.8.8.8:53",
-		conf.AddrFamilyIpv6: "[2001:4860:4860::8888]:53",
-	}
-)
+var dialNetworks = map[string]string{
+	conf.AddrFamilyIpv4: "tcp4",
+	conf.AddrFamilyIpv6: "tcp6",
+}
 
 type HttpResolver struct {
-	client             *http.Client
+	clients            map[string]*http.Client
 	host               string
-	preferredProviders []string
-	backupProviders    []string
-	providers          []string
-	addressFamilies    []string
-	random             *rand.Rand
+	preferredProviders []*httpProvider
+	backupProviders    []*httpProvider
+	resolveTimeout     time.Duration
 }
 
-func NewHttpResolver(domain string, preferredUrls []string, fallbackUrls []string, addressFamilies []string) (*HttpResolver, error) {
-	retryClient := retryablehttp.NewClient()
-	retryClient.RetryMax = retries
+func NewHttpResolver(domain string, preferredUrls []conf.HttpResolverProvider, fallbackUrls []conf.HttpResolverProvider, addressFamilies []string) (*HttpResolver, error) {
+	if len(preferredUrls)+len(fallbackUrls) == 0 {
+		return nil, errors.New("neither preferred- nor fallback-urls provided")
+	}
 
-	standardClient := retryClient.StandardClient()
-	standardClient.Timeout = timeout
+	if len(addressFamilies) == 0 {
+		return nil, errors.New("empty addressFamily slice provided")
+	}
 
-	if fallbackUrls == nil {
-		fallbackUrls = make([]string, 0)
+	preferredProviders, err := buildHttpProviders(preferredUrls)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(preferredUrls)+len(fallbackUrls) == 0 {
-		return nil, errors.New("neither preferred- nor fallback-urls provided")
+	backupProviders, err := buildHttpProviders(fallbackUrls)
+	if err != nil {
+		return nil, err
 	}
 
-	if addressFamilies == nil {
-		return nil, errors.New("empty addressFamily slice provided")
+	clients := make(map[string]*http.Client, len(addressFamilies))
+	for _, addressFamily := range addressFamilies {
+		network, ok := dialNetworks[addressFamily]
+		if !ok {
+			return nil, fmt.Errorf("unknown address family '%s'", addressFamily)
+		}
+		clients[addressFamily] = buildHttpClient(network)
 	}
 
-	resolver := &HttpResolver{
+	return &HttpResolver{
 		host:               domain,
-		client:             standardClient,
-		preferredProviders: preferredUrls,
-		backupProviders:    fallbackUrls,
-		addressFamilies:    addressFamilies,
+		clients:            clients,
+		preferredProviders: preferredProviders,
+		backupProviders:    backupProviders,
+		resolveTimeout:     defaultResolveTimeout,
+	}, nil
+}
+
+// buildHttpClient returns a http client that only dials connections using the given network, e.g. "tcp4" or "tcp6".
+func buildHttpClient(network string) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
 	}
-	resolver.providers = make([]string, len(preferredUrls)+len(fallbackUrls))
-	return resolver, nil
+
+	retryClient := retryablehttp.NewClient()
+	retryClient.RetryMax = retries
+	retryClient.HTTPClient.Timeout = timeout
+	retryClient.HTTPClient.Transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     30 * time.Second,
+	}
+
+	return retryClient.StandardClient()
 }
 
-func getLocalAddress(serverAddr string) (net.Addr, error) {
-	conn, err := net.Dial("tcp", serverAddr)
-	if err != nil {
-		if conn != nil {
-			conn.Close()
+func buildHttpProviders(providers []conf.HttpResolverProvider) ([]*httpProvider, error) {
+	ret := make([]*httpProvider, 0, len(providers))
+	for _, provider := range providers {
+		built, err := newHttpProvider(provider)
+		if err != nil {
+			return nil, err
 		}
-		return nil, err
+		ret = append(ret, built)
 	}
-	defer conn.Close()
-
-	localAddr := conn.LocalAddr().(*net.TCPAddr)
-	return &net.TCPAddr{IP: localAddr.IP, Port: 0, Zone: ""}, nil
+	return ret, nil
 }
 
 func (resolver *HttpResolver) Host() string {
@@ -92,90 +120,200 @@ func (resolver *HttpResolver) Name() string {
 }
 
 func (resolver *HttpResolver) Resolve() (*common.DnsRecord, error) {
-	resolver.shuffleProviders()
+	ctx, cancel := context.WithTimeout(context.Background(), resolver.resolveTimeout)
+	defer cancel()
+
 	detectedIps := &common.DnsRecord{
 		Host:      resolver.host,
 		Timestamp: time.Now(),
 	}
 
-	for _, addressFamily := range resolver.addressFamilies {
-		serverAddress, ok := serverAddresses[addressFamily]
-		if !ok {
-			// TODO: add metric?
-			log.Warn().Str("component", "http_resolver").Str("address_family", addressFamily).Msg("unknown address family, check your configuration")
+	wg := sync.WaitGroup{}
+	mutex := sync.Mutex{}
+	var errs error
+	for addressFamily, client := range resolver.clients {
+		wg.Add(1)
+		go func(addressFamily string, client *http.Client) {
+			defer wg.Done()
+			detectedIp, err := resolver.resolveAddrFamily(ctx, client, addressFamily)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				errs = multierr.Append(errs, fmt.Errorf("could not resolve %s address: %w", addressFamily, err))
+				return
+			}
+
+			if addressFamily == conf.AddrFamilyIpv6 {
+				detectedIps.IpV6 = detectedIp
+			} else {
+				detectedIps.IpV4 = detectedIp
+			}
+		}(addressFamily, client)
+	}
+	wg.Wait()
+
+	if !detectedIps.HasIpV4() && !detectedIps.HasIpV6() {
+		return nil, errs
+	}
+
+	if errs != nil {
+		log.Warn().Err(errs).Str("component", "http_resolver").Msg("Could not resolve all address families")
+	}
+
+	return detectedIps, nil
+}
+
+// resolveAddrFamily returns the first valid address of the preferred providers. The fallback providers are only
+// queried after all preferred providers have failed.
+func (resolver *HttpResolver) resolveAddrFamily(ctx context.Context, client *http.Client, addressFamily string) (string, error) {
+	preferred, backup := resolver.getProviders(addressFamily)
+	if len(preferred)+len(backup) == 0 {
+		return "", errors.New("no providers available")
+	}
+
+	var errs error
+	for _, providers := range [][]*httpProvider{preferred, backup} {
+		if len(providers) == 0 {
 			continue
 		}
 
-		localAddr, err := getLocalAddress(serverAddress)
-		if err != nil {
-			// system has no support for addressFamily apparently, continue
-			continue
+		detectedIp, err := resolver.queryProviders(ctx, client, providers, addressFamily)
+		if err == nil {
+			return detectedIp, nil
 		}
-		transport := &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				LocalAddr: localAddr,
-			}).DialContext,
+		if ctx.Err() != nil {
+			return "", ctx.Err()
 		}
+		errs = multierr.Append(errs, err)
+	}
 
-		resolver.client.Transport = transport
-		for index, url := range resolver.providers {
-			detectedIp, err := resolveSingle(url, resolver.client)
-			if err == nil {
-				// Check if the resolved IP is actually a valid IP
-				if net.ParseIP(detectedIp) == nil {
-					log.Error().Str("component", "http_resolver").Str("detected_ip", detectedIp).Msg("could not parse detected IP address")
-					metrics.InvalidResolvedIps.WithLabelValues(resolver.Host(), resolver.Name(), url).Inc()
-					continue
-				}
+	return "", errs
+}
 
-				// Set the correct address family and stop iterating backupProviders
-				if addressFamily == conf.AddrFamilyIpv6 {
-					detectedIps.IpV6 = detectedIp
-				} else {
-					detectedIps.IpV4 = detectedIp
-				}
-				metrics.IpsResolved.WithLabelValues(resolver.host, resolver.Name(), url).Inc()
-				break
-			} else {
-				metrics.IpResolveErrors.WithLabelValues(resolver.host, resolver.Name(), url).Inc()
-				log.Error().Err(err).Str("component", "http_resolver").Msg("Error while resolving IP")
-				if index == len(resolver.preferredProviders)-1 {
-					log.Warn().Str("component", "http_resolver").Msgf("Exhausted list of preferred providers")
-				}
+// queryProviders queries the providers concurrently and returns the first valid address. At most parallelQueries
+// providers are queried at the same time.
+func (resolver *HttpResolver) queryProviders(ctx context.Context, client *http.Client, providers []*httpProvider, addressFamily string) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan string, len(providers))
+	go func() {
+		wg := sync.WaitGroup{}
+		sem := make(chan struct{}, parallelQueries)
+	loop:
+		for _, provider := range providers {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				break loop
 			}
+
+			wg.Add(1)
+			go func(provider *httpProvider) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				detectedIp, err := resolver.query(ctx, client, provider, addressFamily)
+				if err == nil {
+					results <- detectedIp
+				}
+			}(provider)
 		}
+		wg.Wait()
+		close(results)
+	}()
+
+	select {
+	case detectedIp, ok := <-results:
+		if !ok {
+			return "", errors.New("all providers failed")
+		}
+		return detectedIp, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
 	}
+}
 
-	return detectedIps, nil
+func (resolver *HttpResolver) query(ctx context.Context, client *http.Client, provider *httpProvider, addressFamily string) (string, error) {
+	detectedIp, err := resolveSingle(ctx, provider, client)
+	if err != nil {
+		// do not count errors caused by cancelled queries after another provider already succeeded
+		if ctx.Err() == nil {
+			metrics.IpResolveErrors.WithLabelValues(resolver.host, resolver.Name(), provider.url).Inc()
+			log.Error().Err(err).Str("component", "http_resolver").Str("address_family", addressFamily).Msg("Error while resolving IP")
+		}
+		return "", err
+	}
+
+	// Check if the resolved IP is actually a valid IP of the expected address family
+	if !isAddrFamily(detectedIp, addressFamily) {
+		log.Error().Str("component", "http_resolver").Str("detected_ip", detectedIp).Str("address_family", addressFamily).Msg("could not parse detected IP address")
+		metrics.InvalidResolvedIps.WithLabelValues(resolver.Host(), resolver.Name(), provider.url).Inc()
+		return "", fmt.Errorf("invalid address '%s' received from '%s'", detectedIp, provider.url)
+	}
+
+	metrics.IpsResolved.WithLabelValues(resolver.host, resolver.Name(), provider.url).Inc()
+	return detectedIp, nil
 }
 
-func (resolver *HttpResolver) shuffleProviders() {
-	resolver.random = rand.New(rand.NewSource(time.Now().UnixNano())) // #nosec G404
-	resolver.random.Shuffle(len(resolver.preferredProviders), func(i, j int) {
-		resolver.preferredProviders[i], resolver.preferredProviders[j] = resolver.preferredProviders[j], resolver.preferredProviders[i]
+// getProviders returns the shuffled preferred providers and the shuffled backup providers that support the given
+// address family.
+func (resolver *HttpResolver) getProviders(addressFamily string) ([]*httpProvider, []*httpProvider) {
+	preferred := filterProviders(resolver.preferredProviders, addressFamily)
+	backup := filterProviders(resolver.backupProviders, addressFamily)
+
+	// #nosec G404
+	rand.Shuffle(len(preferred), func(i, j int) {
+		preferred[i], preferred[j] = preferred[j], preferred[i]
 	})
-	resolver.random.Shuffle(len(resolver.backupProviders), func(i, j int) {
-		resolver.backupProviders[i], resolver.backupProviders[j] = resolver.backupProviders[j], resolver.backupProviders[i]
+	// #nosec G404
+	rand.Shuffle(len(backup), func(i, j int) {
+		backup[i], backup[j] = backup[j], backup[i]
 	})
 
-	for i := 0; i < len(resolver.providers); i++ {
-		if i < len(resolver.preferredProviders) {
-			resolver.providers[i] = resolver.preferredProviders[i]
-		} else {
-			resolver.providers[i] = resolver.backupProviders[i-len(resolver.preferredProviders)]
+	return preferred, backup
+}
+
+func filterProviders(providers []*httpProvider, addressFamily string) []*httpProvider {
+	ret := make([]*httpProvider, 0, len(providers))
+	for _, provider := range providers {
+		if provider.supports(addressFamily) {
+			ret = append(ret, provider)
 		}
 	}
+	return ret
 }
 
-func resolveSingle(url string, client *http.Client) (string, error) {
+func isAddrFamily(ip string, addressFamily string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	if addressFamily == conf.AddrFamilyIpv6 {
+		return addr.To4() == nil
+	}
+	return addr.To4() != nil
+}
+
+func resolveSingle(ctx context.Context, provider *httpProvider, client *http.Client) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.url, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not build request for '%s': %v", provider.url, err)
+	}
+	for key, val := range provider.headers {
+		req.Header.Set(key, val)
+	}
+
 	start := time.Now()
-	resp, err := client.Get(url)
+	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("error talking to '%s': %v", url, err)
+		return "", fmt.Errorf("error talking to '%s': %v", provider.url, err)
 	}
 	timeTaken := time.Since(start)
-	metrics.ResponseTime.WithLabelValues(url).Observe(timeTaken.Seconds())
+	metrics.ResponseTime.WithLabelValues(provider.url).Observe(timeTaken.Seconds())
 
 	defer func() {
 		_ = resp.Body.Close()
@@ -184,7 +322,10 @@ func resolveSingle(url string, client *http.Client) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("couldn't read response: %v", err)
 	}
-	detectedIp := repair(string(body))
+	detectedIp, err := provider.parse(body)
+	if err != nil {
+		return "", fmt.Errorf("couldn't parse response of '%s': %v", provider.url, err)
+	}
 	return detectedIp, nil
 }
 
@@ -0,0 +1,127 @@
+package resolvers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+// responseParser extracts the IP address from the body of a provider's response
+type responseParser func(body []byte) (string, error)
+
+type httpProvider struct {
+	url        string
+	headers    map[string]string
+	addrFamily string
+	parse      responseParser
+}
+
+func newHttpProvider(provider conf.HttpResolverProvider) (*httpProvider, error) {
+	if len(provider.Url) == 0 {
+		return nil, errors.New("empty url provided")
+	}
+
+	parser, err := newResponseParser(provider)
+	if err != nil {
+		return nil, fmt.Errorf("could not build response parser for '%s': %w", provider.Url, err)
+	}
+
+	return &httpProvider{
+		url:        provider.Url,
+		headers:    provider.Headers,
+		addrFamily: provider.AddrFamily,
+		parse:      parser,
+	}, nil
+}
+
+// supports returns whether the provider can be used to detect an address of the given address family
+func (p *httpProvider) supports(addrFamily string) bool {
+	return len(p.addrFamily) == 0 || p.addrFamily == addrFamily
+}
+
+func newResponseParser(provider conf.HttpResolverProvider) (responseParser, error) {
+	switch provider.Format {
+	case "", conf.HttpResolverFormatPlain:
+		return parsePlain, nil
+	case conf.HttpResolverFormatJson:
+		return newJsonParser(provider.JsonPath)
+	case conf.HttpResolverFormatRegex:
+		return newRegexParser(provider.Regex)
+	default:
+		return nil, fmt.Errorf("unknown response format '%s'", provider.Format)
+	}
+}
+
+func parsePlain(body []byte) (string, error) {
+	return repair(string(body)), nil
+}
+
+// newJsonParser returns a parser that extracts the value of a dot-separated path, e.g. "data.ip" or "addresses.0".
+func newJsonParser(path string) (responseParser, error) {
+	if len(path) == 0 {
+		return nil, errors.New("empty json path")
+	}
+
+	keys := strings.Split(path, ".")
+	return func(body []byte) (string, error) {
+		var data any
+		if err := json.Unmarshal(body, &data); err != nil {
+			return "", fmt.Errorf("could not parse json response: %w", err)
+		}
+
+		for _, key := range keys {
+			switch node := data.(type) {
+			case map[string]any:
+				val, ok := node[key]
+				if !ok {
+					return "", fmt.Errorf("key '%s' not found in json response", key)
+				}
+				data = val
+			case []any:
+				index, err := strconv.Atoi(key)
+				if err != nil || index < 0 || index >= len(node) {
+					return "", fmt.Errorf("invalid index '%s' for json array", key)
+				}
+				data = node[index]
+			default:
+				return "", fmt.Errorf("can not descend into key '%s'", key)
+			}
+		}
+
+		value, ok := data.(string)
+		if !ok {
+			return "", fmt.Errorf("value at json path '%s' is not a string", path)
+		}
+		return repair(value), nil
+	}, nil
+}
+
+// newRegexParser returns a parser that extracts the first capturing group of the expression. If the expression does
+// not contain a capturing group, the whole match is returned.
+func newRegexParser(expr string) (responseParser, error) {
+	if len(expr) == 0 {
+		return nil, errors.New("empty regex")
+	}
+
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex: %w", err)
+	}
+
+	return func(body []byte) (string, error) {
+		matches := regex.FindSubmatch(body)
+		if matches == nil {
+			return "", errors.New("regex did not match response")
+		}
+
+		if len(matches) > 1 {
+			return repair(string(matches[1])), nil
+		}
+		return repair(string(matches[0])), nil
+	}, nil
+}
@@ -0,0 +1,161 @@
+package resolvers
+
+import (
+	"testing"
+
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+func Test_newResponseParser(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider conf.HttpResolverProvider
+		body     string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "plain",
+			provider: conf.HttpResolverProvider{},
+			body:     "1.2.3.4\n",
+			want:     "1.2.3.4",
+		},
+		{
+			name: "json",
+			provider: conf.HttpResolverProvider{
+				Format:   conf.HttpResolverFormatJson,
+				JsonPath: "ip",
+			},
+			body: `{"ip":"1.2.3.4","city":"Berlin"}`,
+			want: "1.2.3.4",
+		},
+		{
+			name: "json nested with array",
+			provider: conf.HttpResolverProvider{
+				Format:   conf.HttpResolverFormatJson,
+				JsonPath: "data.addresses.1",
+			},
+			body: `{"data":{"addresses":["1.2.3.4","5.6.7.8"]}}`,
+			want: "5.6.7.8",
+		},
+		{
+			name: "json missing key",
+			provider: conf.HttpResolverProvider{
+				Format:   conf.HttpResolverFormatJson,
+				JsonPath: "address",
+			},
+			body:    `{"ip":"1.2.3.4"}`,
+			wantErr: true,
+		},
+		{
+			name: "json no string",
+			provider: conf.HttpResolverProvider{
+				Format:   conf.HttpResolverFormatJson,
+				JsonPath: "ip",
+			},
+			body:    `{"ip":1234}`,
+			wantErr: true,
+		},
+		{
+			name: "json invalid body",
+			provider: conf.HttpResolverProvider{
+				Format:   conf.HttpResolverFormatJson,
+				JsonPath: "ip",
+			},
+			body:    `1.2.3.4`,
+			wantErr: true,
+		},
+		{
+			name: "regex with capturing group",
+			provider: conf.HttpResolverProvider{
+				Format: conf.HttpResolverFormatRegex,
+				Regex:  `WAN IP: <b>([0-9.]+)</b>`,
+			},
+			body: `<html><body>WAN IP: <b>1.2.3.4</b></body></html>`,
+			want: "1.2.3.4",
+		},
+		{
+			name: "regex without capturing group",
+			provider: conf.HttpResolverProvider{
+				Format: conf.HttpResolverFormatRegex,
+				Regex:  `\d+\.\d+\.\d+\.\d+`,
+			},
+			body: `Current IP Address: 1.2.3.4`,
+			want: "1.2.3.4",
+		},
+		{
+			name: "regex no match",
+			provider: conf.HttpResolverProvider{
+				Format: conf.HttpResolverFormatRegex,
+				Regex:  `\d+\.\d+\.\d+\.\d+`,
+			},
+			body:    `no ip here`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser, err := newResponseParser(tt.provider)
+			if err != nil {
+				t.Fatalf("newResponseParser() error = %v", err)
+			}
+
+			got, err := parser([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parse() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parse() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newResponseParser_invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider conf.HttpResolverProvider
+	}{
+		{
+			name:     "unknown format",
+			provider: conf.HttpResolverProvider{Format: "xml"},
+		},
+		{
+			name:     "json without path",
+			provider: conf.HttpResolverProvider{Format: conf.HttpResolverFormatJson},
+		},
+		{
+			name:     "invalid regex",
+			provider: conf.HttpResolverProvider{Format: conf.HttpResolverFormatRegex, Regex: "(["},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newResponseParser(tt.provider); err == nil {
+				t.Errorf("newResponseParser() expected error")
+			}
+		})
+	}
+}
+
+func Test_isAddrFamily(t *testing.T) {
+	tests := []struct {
+		ip     string
+		family string
+		want   bool
+	}{
+		{"1.2.3.4", conf.AddrFamilyIpv4, true},
+		{"1.2.3.4", conf.AddrFamilyIpv6, false},
+		{"2001:db8::1", conf.AddrFamilyIpv6, true},
+		{"2001:db8::1", conf.AddrFamilyIpv4, false},
+		{"garbage", conf.AddrFamilyIpv4, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip+"_"+tt.family, func(t *testing.T) {
+			if got := isAddrFamily(tt.ip, tt.family); got != tt.want {
+				t.Errorf("isAddrFamily() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
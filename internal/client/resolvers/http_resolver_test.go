@@ -1,6 +1,13 @@
 package resolvers
 
-import "testing"
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
 
 func Test_repair(t *testing.T) {
 	type args struct {
@@ -48,3 +55,137 @@ func Test_repair(t *testing.T) {
 		})
 	}
 }
+
+func newTestProvider(t *testing.T, handler http.HandlerFunc) conf.HttpResolverProvider {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return conf.HttpResolverProvider{Url: server.URL}
+}
+
+func respondWith(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+func TestHttpResolver_Resolve(t *testing.T) {
+	invalid := newTestProvider(t, respondWith("garbage"))
+	valid := newTestProvider(t, respondWith("1.2.3.4\n"))
+	ipv6 := newTestProvider(t, respondWith("2001:db8::1"))
+
+	tests := []struct {
+		name            string
+		preferred       []conf.HttpResolverProvider
+		fallback        []conf.HttpResolverProvider
+		addressFamilies []string
+		want            string
+		wantErr         bool
+	}{
+		{
+			name:            "preferred provider",
+			preferred:       []conf.HttpResolverProvider{valid},
+			fallback:        []conf.HttpResolverProvider{invalid},
+			addressFamilies: []string{conf.AddrFamilyIpv4},
+			want:            "1.2.3.4",
+		},
+		{
+			name:            "use fallback",
+			preferred:       []conf.HttpResolverProvider{invalid, invalid, invalid, invalid},
+			fallback:        []conf.HttpResolverProvider{valid},
+			addressFamilies: []string{conf.AddrFamilyIpv4},
+			want:            "1.2.3.4",
+		},
+		{
+			name:            "all providers fail",
+			preferred:       []conf.HttpResolverProvider{invalid},
+			fallback:        []conf.HttpResolverProvider{invalid},
+			addressFamilies: []string{conf.AddrFamilyIpv4},
+			wantErr:         true,
+		},
+		{
+			name:            "address of wrong family",
+			preferred:       []conf.HttpResolverProvider{ipv6},
+			addressFamilies: []string{conf.AddrFamilyIpv4},
+			wantErr:         true,
+		},
+		{
+			name:            "ipv6 can not dial ipv4 only provider",
+			preferred:       []conf.HttpResolverProvider{valid},
+			addressFamilies: []string{conf.AddrFamilyIpv6},
+			wantErr:         true,
+		},
+		{
+			name:            "partial success",
+			preferred:       []conf.HttpResolverProvider{valid},
+			addressFamilies: []string{conf.AddrFamilyIpv4, conf.AddrFamilyIpv6},
+			want:            "1.2.3.4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, err := NewHttpResolver("my.host.tld", tt.preferred, tt.fallback, tt.addressFamilies)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resolver.resolveTimeout = 1 * time.Second
+
+			got, err := resolver.Resolve()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.IpV4 != tt.want {
+				t.Errorf("Resolve() got = %v, want %v", got.IpV4, tt.want)
+			}
+		})
+	}
+}
+
+func TestHttpResolver_Resolve_PreferredBeforeFallback(t *testing.T) {
+	slow := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("1.2.3.4"))
+	})
+	fast := newTestProvider(t, respondWith("5.6.7.8"))
+	invalid := newTestProvider(t, respondWith("garbage"))
+
+	preferred := []conf.HttpResolverProvider{invalid, slow}
+	resolver, err := NewHttpResolver("my.host.tld", preferred, []conf.HttpResolverProvider{fast}, []string{conf.AddrFamilyIpv4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := resolver.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.IpV4 != "1.2.3.4" {
+		t.Errorf("expected address of preferred provider, got %s", got.IpV4)
+	}
+}
+
+func TestHttpResolver_Resolve_Deadline(t *testing.T) {
+	slow := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		_, _ = w.Write([]byte("1.2.3.4"))
+	})
+
+	resolver, err := NewHttpResolver("my.host.tld", []conf.HttpResolverProvider{slow}, nil, []string{conf.AddrFamilyIpv4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.resolveTimeout = 200 * time.Millisecond
+
+	start := time.Now()
+	if _, err := resolver.Resolve(); err == nil {
+		t.Fatal("expected error")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("deadline has not been respected")
+	}
+}
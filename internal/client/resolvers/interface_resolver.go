@@ -1,22 +1,31 @@
 package resolvers
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"time"
 
 	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"go.uber.org/multierr"
 )
 
 type InterfaceResolver struct {
 	watchedInterface string
 	host             string
+	addressFamilies  []string
 }
 
-func NewInterfaceResolver(watchedInterface, host string) (*InterfaceResolver, error) {
+func NewInterfaceResolver(watchedInterface, host string, addressFamilies []string) (*InterfaceResolver, error) {
+	if len(addressFamilies) == 0 {
+		return nil, errors.New("empty addressFamily slice provided")
+	}
+
 	return &InterfaceResolver{
 		watchedInterface: watchedInterface,
 		host:             host,
+		addressFamilies:  addressFamilies,
 	}, nil
 }
 
@@ -29,16 +38,28 @@ func (resolver *InterfaceResolver) Host() string {
 }
 
 func (resolver *InterfaceResolver) Resolve() (*common.DnsRecord, error) {
-	ipv4, err := GetInterfaceIpv4Addr(resolver.watchedInterface)
-	if err != nil {
-		return nil, fmt.Errorf("could not resolve ip for interface: %v", err)
-	}
-
-	return &common.DnsRecord{
-		IpV4:      ipv4,
+	resolved := &common.DnsRecord{
 		Host:      resolver.host,
 		Timestamp: time.Now(),
-	}, nil
+	}
+
+	var errs error
+	for _, addressFamily := range resolver.addressFamilies {
+		var err error
+		switch addressFamily {
+		case conf.AddrFamilyIpv4:
+			resolved.IpV4, err = GetInterfaceIpv4Addr(resolver.watchedInterface)
+		case conf.AddrFamilyIpv6:
+			resolved.IpV6, err = GetInterfaceIpv6Addr(resolver.watchedInterface)
+		}
+		errs = multierr.Append(errs, err)
+	}
+
+	if !resolved.HasIpV4() && !resolved.HasIpV6() {
+		return nil, fmt.Errorf("could not resolve ip for interface: %v", errs)
+	}
+
+	return resolved, nil
 }
 
 func GetInterfaceIpv4Addr(interfaceName string) (addr string, err error) {
@@ -64,3 +85,29 @@ func GetInterfaceIpv4Addr(interfaceName string) (addr string, err error) {
 
 	return "", fmt.Errorf("interface %s doesn't have an ipv4 address", interfaceName)
 }
+
+// GetInterfaceIpv6Addr returns the first global unicast ipv6 address of the interface, link-local and unique local
+// addresses are ignored.
+func GetInterfaceIpv6Addr(interfaceName string) (addr string, err error) {
+	var (
+		ief       *net.Interface
+		addresses []net.Addr
+	)
+
+	if ief, err = net.InterfaceByName(interfaceName); err != nil { // get interface
+		return
+	}
+
+	if addresses, err = ief.Addrs(); err != nil { // get addresses
+		return
+	}
+
+	for _, addr := range addresses { // get ipv6 address
+		ip := addr.(*net.IPNet).IP
+		if ip.To4() == nil && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			return ip.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("interface %s doesn't have a global ipv6 address", interfaceName)
+}
@@ -0,0 +1,117 @@
+package resolvers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/common"
+)
+
+const (
+	natPmpDefaultPort   = "5351"
+	natPmpRetries       = 4
+	natPmpInitialWait   = 250 * time.Millisecond
+	natPmpResponseLen   = 12
+	natPmpOpExternalIp  = 0
+	natPmpResultSuccess = 0
+)
+
+// NatPmpResolver asks the gateway for its external ipv4 address using NAT-PMP (RFC 6886).
+type NatPmpResolver struct {
+	gateway string
+	host    string
+}
+
+func NewNatPmpResolver(gateway, host string) (*NatPmpResolver, error) {
+	if len(gateway) == 0 {
+		return nil, errors.New("empty gateway provided")
+	}
+
+	if _, _, err := net.SplitHostPort(gateway); err != nil {
+		gateway = net.JoinHostPort(gateway, natPmpDefaultPort)
+	}
+
+	return &NatPmpResolver{
+		gateway: gateway,
+		host:    host,
+	}, nil
+}
+
+func (resolver *NatPmpResolver) Name() string {
+	return "NatPmpResolver"
+}
+
+func (resolver *NatPmpResolver) Host() string {
+	return resolver.host
+}
+
+func (resolver *NatPmpResolver) Resolve() (*common.DnsRecord, error) {
+	ipv4, err := resolver.externalAddress()
+	if err != nil {
+		return nil, fmt.Errorf("could not get external address from gateway %s: %w", resolver.gateway, err)
+	}
+
+	return &common.DnsRecord{
+		IpV4:      ipv4,
+		Host:      resolver.host,
+		Timestamp: time.Now(),
+	}, nil
+}
+
+func (resolver *NatPmpResolver) externalAddress() (string, error) {
+	conn, err := net.Dial("udp4", resolver.gateway)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	request := []byte{0, natPmpOpExternalIp}
+	response := make([]byte, 16)
+
+	// RFC 6886 requires retransmitting the request with an exponentially increasing interval
+	wait := natPmpInitialWait
+	for attempt := 0; attempt < natPmpRetries; attempt++ {
+		if _, err = conn.Write(request); err != nil {
+			return "", err
+		}
+
+		if err = conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+			return "", err
+		}
+
+		var n int
+		n, err = conn.Read(response)
+		if err == nil {
+			return parseNatPmpResponse(response[:n])
+		}
+
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return "", err
+		}
+		wait *= 2
+	}
+
+	return "", err
+}
+
+func parseNatPmpResponse(response []byte) (string, error) {
+	if len(response) < natPmpResponseLen {
+		return "", fmt.Errorf("invalid response length %d", len(response))
+	}
+
+	if response[0] != 0 || response[1] != 128+natPmpOpExternalIp {
+		return "", fmt.Errorf("unexpected response version %d or opcode %d", response[0], response[1])
+	}
+
+	if result := binary.BigEndian.Uint16(response[2:4]); result != natPmpResultSuccess {
+		return "", fmt.Errorf("gateway returned result code %d", result)
+	}
+
+	return net.IP(response[8:12]).String(), nil
+}
@@ -0,0 +1,89 @@
+package resolvers
+
+import (
+	"net"
+	"testing"
+)
+
+func startFakeGateway(t *testing.T, response []byte) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n != 2 || buf[0] != 0 || buf[1] != 0 {
+				continue
+			}
+			_, _ = conn.WriteTo(response, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestNatPmpResolver_Resolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "happy path",
+			response: []byte{0, 128, 0, 0, 0, 0, 0, 1, 1, 2, 3, 4},
+			want:     "1.2.3.4",
+		},
+		{
+			name:     "error result code",
+			response: []byte{0, 128, 0, 3, 0, 0, 0, 1, 0, 0, 0, 0},
+			wantErr:  true,
+		},
+		{
+			name:     "wrong opcode",
+			response: []byte{0, 129, 0, 0, 0, 0, 0, 1, 1, 2, 3, 4},
+			wantErr:  true,
+		},
+		{
+			name:     "short response",
+			response: []byte{0, 128, 0, 0},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway := startFakeGateway(t, tt.response)
+			resolver, err := NewNatPmpResolver(gateway, "my.host.tld")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := resolver.Resolve()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.IpV4 != tt.want {
+				t.Errorf("Resolve() got = %v, want %v", got.IpV4, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewNatPmpResolver_DefaultPort(t *testing.T) {
+	resolver, err := NewNatPmpResolver("192.168.1.1", "my.host.tld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolver.gateway != "192.168.1.1:5351" {
+		t.Errorf("expected default port, got %s", resolver.gateway)
+	}
+}
@@ -0,0 +1,81 @@
+package resolvers
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/common"
+)
+
+// SharedResolver shares the results of a single resolver between multiple hosts. Successful results are cached for
+// maxAge, so hosts resolving within that window do not trigger additional lookups.
+type SharedResolver struct {
+	resolver IpResolver
+	maxAge   time.Duration
+
+	mutex        sync.Mutex
+	lastResolved *common.DnsRecord
+	lastResolve  time.Time
+}
+
+func NewSharedResolver(resolver IpResolver, maxAge time.Duration) (*SharedResolver, error) {
+	if resolver == nil {
+		return nil, errors.New("nil resolver provided")
+	}
+
+	return &SharedResolver{
+		resolver: resolver,
+		maxAge:   maxAge,
+	}, nil
+}
+
+// ForHost returns a resolver that returns the shared results for the given host.
+func (s *SharedResolver) ForHost(host string) IpResolver {
+	return &hostResolver{
+		shared: s,
+		host:   host,
+	}
+}
+
+func (s *SharedResolver) resolve() (*common.DnsRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.lastResolved != nil && time.Since(s.lastResolve) < s.maxAge {
+		return s.lastResolved, nil
+	}
+
+	resolved, err := s.resolver.Resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	s.lastResolved = resolved
+	s.lastResolve = time.Now()
+	return resolved, nil
+}
+
+type hostResolver struct {
+	shared *SharedResolver
+	host   string
+}
+
+func (r *hostResolver) Name() string {
+	return r.shared.resolver.Name()
+}
+
+func (r *hostResolver) Host() string {
+	return r.host
+}
+
+func (r *hostResolver) Resolve() (*common.DnsRecord, error) {
+	resolved, err := r.shared.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := *resolved
+	ret.Host = r.host
+	return &ret, nil
+}
@@ -0,0 +1,72 @@
+package resolvers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/common"
+)
+
+func TestSharedResolver_ForHost(t *testing.T) {
+	fake := &fakeResolver{name: "fake", record: &common.DnsRecord{IpV4: "1.1.1.1", Host: "ignored", Timestamp: time.Now()}}
+	shared, err := NewSharedResolver(fake, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := shared.ForHost("home.example.com").Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := shared.ForHost("vpn.example.com").Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fake.calls != 1 {
+		t.Errorf("expected resolver to be called once, got %d", fake.calls)
+	}
+	if first.Host != "home.example.com" || second.Host != "vpn.example.com" {
+		t.Errorf("unexpected hosts %s, %s", first.Host, second.Host)
+	}
+	if first.IpV4 != "1.1.1.1" || second.IpV4 != "1.1.1.1" || !first.Timestamp.Equal(second.Timestamp) {
+		t.Errorf("expected shared result, got %v and %v", first, second)
+	}
+	if fake.record.Host != "ignored" {
+		t.Errorf("shared record has been modified")
+	}
+}
+
+func TestSharedResolver_Expiry(t *testing.T) {
+	fake := &fakeResolver{name: "fake", record: &common.DnsRecord{IpV4: "1.1.1.1"}}
+	shared, err := NewSharedResolver(fake, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = shared.ForHost("a").Resolve()
+	_, _ = shared.ForHost("b").Resolve()
+	if fake.calls != 2 {
+		t.Errorf("expected resolver to be called twice, got %d", fake.calls)
+	}
+}
+
+func TestSharedResolver_ErrorsAreNotCached(t *testing.T) {
+	fake := &fakeResolver{name: "fake", err: errors.New("broken")}
+	shared, err := NewSharedResolver(fake, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := shared.ForHost("a").Resolve(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	fake.err = nil
+	fake.record = &common.DnsRecord{IpV4: "1.1.1.1"}
+	got, err := shared.ForHost("a").Resolve()
+	if err != nil || got.IpV4 != "1.1.1.1" {
+		t.Fatalf("expected successful resolve, got %v, %v", got, err)
+	}
+}
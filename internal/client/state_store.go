@@ -0,0 +1,151 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/client/states"
+)
+
+// persistedState is the content of the state file
+type persistedState struct {
+	Hosts map[string]*states.PersistedRecords `json:"hosts,omitempty"`
+	// Outbox holds the marshalled outbox of the reconciler, so it's decoupled from later modifications
+	Outbox json.RawMessage `json:"outbox,omitempty"`
+}
+
+// StateStore persists the state of the clients and the outbox of the reconciler to a file, so the client
+// can resume after a restart.
+type StateStore struct {
+	path  string
+	mutex sync.Mutex
+	state persistedState
+}
+
+func NewStateStore(path string) (*StateStore, error) {
+	if len(path) == 0 {
+		return nil, errors.New("empty path provided")
+	}
+
+	store := &StateStore{
+		path: path,
+		state: persistedState{
+			Hosts: map[string]*states.PersistedRecords{},
+		},
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("could not read state file: %w", err)
+	}
+
+	if err := json.Unmarshal(content, &store.state); err != nil {
+		// a corrupt state file must not prevent the client from starting, it's rewritten on the next change
+		log.Warn().Err(err).Str("component", "state_store").Str("path", path).Msg("Could not parse state file, ignoring it")
+		return store, nil
+	}
+
+	if store.state.Hosts == nil {
+		store.state.Hosts = map[string]*states.PersistedRecords{}
+	}
+
+	return store, nil
+}
+
+// Host returns a copy of the persisted records of the host or nil if nothing has been persisted
+func (s *StateStore) Host(host string) *states.PersistedRecords {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	records, ok := s.state.Hosts[host]
+	if !ok {
+		return nil
+	}
+
+	ret := *records
+	return &ret
+}
+
+// SetHost persists the records of the host
+func (s *StateStore) SetHost(host string, records states.PersistedRecords) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state.Hosts[host] = &records
+	return s.save()
+}
+
+// Outbox returns the persisted outbox of the reconciler, keyed by host
+func (s *StateStore) Outbox() map[string]*outboxEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ret := map[string]*outboxEntry{}
+	if len(s.state.Outbox) == 0 {
+		return ret
+	}
+
+	if err := json.Unmarshal(s.state.Outbox, &ret); err != nil {
+		log.Warn().Err(err).Str("component", "state_store").Msg("Could not parse persisted outbox, ignoring it")
+		return map[string]*outboxEntry{}
+	}
+	return ret
+}
+
+// SetOutbox persists the outbox of the reconciler, keyed by host
+func (s *StateStore) SetOutbox(outbox map[string]*outboxEntry) error {
+	content, err := json.Marshal(outbox)
+	if err != nil {
+		return fmt.Errorf("could not marshal outbox: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state.Outbox = content
+	return s.save()
+}
+
+// save atomically writes the state to disk by writing to a temporary file that replaces the state file
+func (s *StateStore) save() error {
+	content, err := json.Marshal(s.state)
+	if err != nil {
+		return fmt.Errorf("could not marshal state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not create temporary state file: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("could not write temporary state file: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("could not sync temporary state file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not close temporary state file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("could not replace state file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/client/states"
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+func TestStateStore_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	store, err := NewStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Host("home.example.com") != nil {
+		t.Fatal("expected no persisted records")
+	}
+
+	record := &common.DnsRecord{Host: "home.example.com", IpV4: "192.0.2.1", Timestamp: time.Now().UTC().Truncate(time.Second)}
+	records := states.PersistedRecords{
+		Resolved:    record,
+		Confirmed:   record,
+		ConfirmedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if err := store.SetHost("home.example.com", records); err != nil {
+		t.Fatal(err)
+	}
+
+	outbox := map[string]*outboxEntry{
+		"home.example.com": newOutboxEntry(&common.UpdateRecordRequest{PublicIp: *record, Signature: "sig"}, []string{"a", "b"}),
+	}
+	outbox["home.example.com"].CreatedAt = time.Now().UTC().Truncate(time.Second)
+	outbox["home.example.com"].Deliveries["a"].Delivered = true
+	if err := store.SetOutbox(outbox); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := reopened.Host("home.example.com"); !reflect.DeepEqual(*got, records) {
+		t.Errorf("expected %v, got %v", records, *got)
+	}
+	if got := reopened.Outbox(); !reflect.DeepEqual(got, outbox) {
+		t.Errorf("expected %v, got %v", outbox, got)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected temporary files to be removed, got %d files", len(entries))
+	}
+}
+
+func TestStateStore_CorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("{garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SetHost("home.example.com", states.PersistedRecords{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconciler_RestoreOutbox(t *testing.T) {
+	store, err := NewStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := common.DnsRecord{Host: "home.example.com", IpV4: "192.0.2.1"}
+	err = store.SetOutbox(map[string]*outboxEntry{
+		"home.example.com": newOutboxEntry(&common.UpdateRecordRequest{PublicIp: record, Signature: "sig"}, []string{"nop", "removed"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reconciler, err := NewReconciler(map[string]EventDispatch{"nop": &nopDispatcher{}}, conf.DefaultOutboxConfig(), WithReconcilerStateStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{"home.example.com": {"nop"}}
+	if got := reconciler.Status().Pending; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	if err := reconciler.dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.Outbox(); len(got) != 0 {
+		t.Fatalf("expected empty outbox to be persisted, got %v", got)
+	}
+}
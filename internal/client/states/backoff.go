@@ -0,0 +1,27 @@
+package states
+
+import (
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/util"
+)
+
+// backoff calculates exponentially growing delays with jitter
+type backoff struct {
+	conf     conf.BackoffConfig
+	attempts int
+}
+
+func newBackoff(conf conf.BackoffConfig) *backoff {
+	return &backoff{
+		conf: conf,
+	}
+}
+
+// Next returns the next delay. The delay starts at the initial value and is multiplied after each invocation until
+// the maximum value is reached.
+func (b *backoff) Next() time.Duration {
+	b.attempts++
+	return util.BackoffDelay(b.conf, b.attempts)
+}
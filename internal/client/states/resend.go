@@ -0,0 +1,47 @@
+package states
+
+import (
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+// resendSchedule decides when to re-send update requests while the dns record has not been (fully) verified
+type resendSchedule struct {
+	conf       conf.StateMachineConfig
+	backoff    *backoff
+	since      time.Time
+	nextResend time.Time
+	checks     int64
+}
+
+// newResendSchedule returns a new resendSchedule. If updateSent is true, the next update request is only due after
+// the initial backoff delay, otherwise it is due immediately.
+func newResendSchedule(conf conf.StateMachineConfig, updateSent bool) *resendSchedule {
+	schedule := &resendSchedule{
+		conf:    conf,
+		backoff: newBackoff(conf.ResendBackoff),
+		since:   time.Now(),
+	}
+
+	if updateSent {
+		schedule.nextResend = schedule.since.Add(schedule.backoff.Next())
+	}
+
+	return schedule
+}
+
+// exceeded returns whether the configured maximum duration to wait for the verification has been exceeded
+func (s *resendSchedule) exceeded(now time.Time) bool {
+	return s.conf.MaxUnconfirmedDuration > 0 && now.Sub(s.since) >= s.conf.MaxUnconfirmedDuration
+}
+
+// due returns whether an update request should be re-sent and schedules the next one if so
+func (s *resendSchedule) due(now time.Time) bool {
+	if now.Before(s.nextResend) {
+		return false
+	}
+
+	s.nextResend = now.Add(s.backoff.Next())
+	return true
+}
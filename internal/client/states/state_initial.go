@@ -5,15 +5,23 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/metrics"
 )
 
 type initialState struct {
 	forceSendUpdate bool
+	conf            conf.StateMachineConfig
+	persisted       *PersistedRecords
 }
 
-func NewInitialState(forceSendUpdate bool) *initialState {
+// NewInitialState returns the state the client starts with. If records have been persisted before the client has
+// been restarted, they are used to resume the previous state.
+func NewInitialState(forceSendUpdate bool, conf conf.StateMachineConfig, persisted *PersistedRecords) *initialState {
 	return &initialState{
 		forceSendUpdate: forceSendUpdate,
+		conf:            conf,
+		persisted:       persisted,
 	}
 }
 
@@ -27,14 +35,43 @@ func (state *initialState) Name() string {
 
 func (state *initialState) EvaluateState(context Client, resolved *common.DnsRecord) bool {
 	// This is just a dummy state, we'll immediately set the next state and invoke it
-	context.SetState(NewIpNotConfirmedState())
 	if state.forceSendUpdate {
 		log.Info().Str("component", "state_machine").Str("state", state.Name()).Msg("forceSendUpdate is set, sending update")
+		context.SetState(NewIpNotConfirmedState(state.conf, true))
 		return true
 	}
+
+	if state.persisted != nil {
+		return state.resume(context, resolved)
+	}
+
+	context.SetState(NewIpNotConfirmedState(state.conf, false))
 	return context.GetState().EvaluateState(context, resolved)
 }
 
+// resume continues with the state before the client has been restarted
+func (state *initialState) resume(context Client, resolved *common.DnsRecord) bool {
+	if state.persisted.Confirmed.Equals(resolved) {
+		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Time("confirmed_at", state.persisted.ConfirmedAt).Msg("Resolved IP matches persisted confirmed record")
+		context.SetState(NewIpConfirmedState(resolved, state.conf))
+		return false
+	}
+
+	if state.persisted.Resolved.Equals(resolved) {
+		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Msg("Resuming verification of persisted record")
+		context.SetState(NewIpNotConfirmedState(state.conf, true))
+		return context.GetState().EvaluateState(context, resolved)
+	}
+
+	log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("ipv4", resolved.IpV4).Str("ipv6", resolved.IpV6).Str("host", resolved.Host).Msg("New IP detected since last run")
+	context.SetState(NewIpNotConfirmedState(state.conf, true))
+	if err := context.NotifyUpdatedIpDetected(resolved); err != nil {
+		log.Error().Err(err).Msg("could not send notification")
+		metrics.NotificationErrors.Inc()
+	}
+	return true
+}
+
 func (state *initialState) WaitInterval() time.Duration {
-	return 45 * time.Second
+	return state.conf.InitialInterval
 }
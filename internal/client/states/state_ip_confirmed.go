@@ -6,18 +6,20 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
 	"github.com/soerenschneider/dyndns/internal/metrics"
-	"github.com/soerenschneider/dyndns/internal/util"
 )
 
 // ipConfirmedState is set after the dns record has been verified successfully
 type ipConfirmedState struct {
 	previouslyResolvedIp *common.DnsRecord
+	conf                 conf.StateMachineConfig
 }
 
-func NewIpConfirmedState(prev *common.DnsRecord) State {
+func NewIpConfirmedState(prev *common.DnsRecord, conf conf.StateMachineConfig) State {
 	return &ipConfirmedState{
 		previouslyResolvedIp: prev,
+		conf:                 conf,
 	}
 }
 
@@ -35,32 +37,28 @@ func (state *ipConfirmedState) EvaluateState(context Client, resolved *common.Dn
 
 	if hasIpChanged {
 		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("ipv4", resolved.IpV4).Str("ipv6", resolved.IpV6).Str("host", resolved.Host).Msg("New IP detected")
-		context.SetState(NewIpNotConfirmedState())
+		context.SetState(NewIpNotConfirmedState(state.conf, true))
 
 		if err := context.NotifyUpdatedIpDetected(resolved); err != nil {
 			log.Error().Err(err).Msg("could not send notification")
 			metrics.NotificationErrors.Inc()
 		}
+		return true
 	}
 
-	ips, err := util.LookupDns(resolved.Host)
-	if err == nil {
-		found := false
-		for _, hostIp := range ips {
-			if hostIp == resolved.IpV4 || hostIp == resolved.IpV6 {
-				found = true
-				break
-			}
-		}
-		if !found {
-			log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("ipv4", resolved.IpV4).Str("ipv6", resolved.IpV6).Str("host", resolved.Host).Msg("Detected changed DNS record")
-			context.SetState(NewIpNotConfirmedState())
-		}
+	result, err := verifyRecord(context.Verifier(), resolved)
+	if err == nil && !result.isConfirmed() {
+		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("ipv4", resolved.IpV4).Str("ipv6", resolved.IpV6).Str("host", resolved.Host).Msg("Detected changed DNS record")
+		context.SetState(NewIpNotConfirmedState(state.conf, false))
 	}
 
-	return hasIpChanged
+	return false
+}
+
+func (state *ipConfirmedState) ConfirmedRecord() *common.DnsRecord {
+	return state.previouslyResolvedIp
 }
 
 func (state *ipConfirmedState) WaitInterval() time.Duration {
-	return 45 * time.Second
+	return state.conf.ConfirmedInterval
 }
@@ -6,25 +6,30 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"github.com/soerenschneider/dyndns/internal/common"
-	"github.com/soerenschneider/dyndns/internal/util"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/metrics"
 )
 
 // ipNotConfirmedState is the state after we detect an ip update. we stay in this state until the dns record has been
-// verified to contain our resolved ips
+// verified to contain our resolved ips, re-sending the update request using an exponential backoff.
 type ipNotConfirmedState struct {
-	checks       int64
-	waitInterval time.Duration
+	conf     conf.StateMachineConfig
+	schedule *resendSchedule
+	// lastResolved is the ip that has been evaluated last
+	lastResolved *common.DnsRecord
 }
 
-func NewIpNotConfirmedState() State {
+// NewIpNotConfirmedState returns a new ipNotConfirmedState. If updateSent is true, the next update request is only
+// re-sent after the initial backoff delay, otherwise it is sent on the first evaluation.
+func NewIpNotConfirmedState(conf conf.StateMachineConfig, updateSent bool) State {
 	return &ipNotConfirmedState{
-		checks:       0,
-		waitInterval: 30 * time.Second,
+		conf:     conf,
+		schedule: newResendSchedule(conf, updateSent),
 	}
 }
 
 func (state *ipNotConfirmedState) String() string {
-	return fmt.Sprintf("ipNotConfirmedState (%d checks)", state.checks)
+	return fmt.Sprintf("ipNotConfirmedState (%d checks)", state.schedule.checks)
 }
 
 func (state *ipNotConfirmedState) Name() string {
@@ -32,30 +37,58 @@ func (state *ipNotConfirmedState) Name() string {
 }
 
 func (state *ipNotConfirmedState) EvaluateState(context Client, resolved *common.DnsRecord) bool {
-	ips, err := util.LookupDns(resolved.Host)
-	if err != nil {
+	state.schedule.checks++
+	if state.lastResolved != nil && !state.lastResolved.Equals(resolved) {
+		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("ipv4", resolved.IpV4).Str("ipv6", resolved.IpV6).Str("host", resolved.Host).Msg("New IP detected while waiting for propagation")
+		state.schedule = newResendSchedule(state.conf, false)
+	}
+	state.lastResolved = resolved
+
+	result, err := verifyRecord(context.Verifier(), resolved)
+	switch {
+	case err != nil:
 		log.Warn().Err(err).Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Msg("Error looking up dns record")
-		return true
+	case result.isConfirmed():
+		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Msg("DNS record verified")
+		context.SetState(NewIpConfirmedState(resolved, state.conf))
+		return false
+	case result.isPartiallyConfirmed():
+		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Strs("confirmed", result.confirmed).Strs("unconfirmed", result.unconfirmed).Msg("DNS record partially verified")
+		partiallyConfirmed := newIpPartiallyConfirmedState(state.conf, state.schedule, resolved, result)
+		context.SetState(partiallyConfirmed)
+		return resend(context, partiallyConfirmed, state.schedule, resolved)
+	default:
+		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Str("ipv4", resolved.IpV4).Str("ipv6", resolved.IpV6).Msg("DNS entry differs to new IP")
 	}
 
-	for _, hostIp := range ips {
-		if hostIp == resolved.IpV4 || hostIp == resolved.IpV6 {
-			log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Msg("DNS record verified")
-			context.SetState(NewIpConfirmedState(resolved))
-			return false
+	return resend(context, state, state.schedule, resolved)
+}
+
+func (state *ipNotConfirmedState) WaitInterval() time.Duration {
+	return state.conf.NotConfirmedInterval
+}
+
+// resend returns whether the update request should be re-sent according to the schedule. If the maximum duration to
+// wait for the verification has been exceeded, the state is changed to ipUnconfirmableState and a notification is
+// sent.
+func resend(context Client, state State, schedule *resendSchedule, resolved *common.DnsRecord) bool {
+	now := time.Now()
+	since := now.Sub(schedule.since)
+	if schedule.exceeded(now) {
+		log.Error().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Str("since", since.String()).Int64("checks", schedule.checks).Msg("DNS record could not be verified, giving up re-sending update requests")
+		context.SetState(NewIpUnconfirmableState(resolved, schedule.conf))
+
+		if err := context.NotifyUpdatedIpUnconfirmable(resolved); err != nil {
+			log.Error().Err(err).Msg("could not send notification")
+			metrics.NotificationErrors.Inc()
 		}
+		return false
 	}
 
-	log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Str("ipv4", resolved.IpV4).Str("ipv6", resolved.IpV6).Msg("DNS entry differs to new IP")
-	if state.checks%10 == 0 {
-		since := time.Since(context.GetLastStateChange())
-		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Str("since", since.String()).Msg("Re-sending update request, propagation has not happened, yet")
-		return true
+	if !schedule.due(now) {
+		return false
 	}
 
-	return false
-}
-
-func (state *ipNotConfirmedState) WaitInterval() time.Duration {
-	return state.waitInterval
+	log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Str("since", since.String()).Time("next_resend", schedule.nextResend).Msg("Re-sending update request, propagation has not happened, yet")
+	return true
 }
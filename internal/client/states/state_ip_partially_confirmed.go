@@ -0,0 +1,78 @@
+package states
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/metrics"
+)
+
+// ipPartiallyConfirmedState is set if the dns record has been verified for some, but not all address families, e.g.
+// the A record has been updated but the AAAA record is stale. Update requests are re-sent using the schedule of the
+// previous state until all address families are verified.
+type ipPartiallyConfirmedState struct {
+	conf        conf.StateMachineConfig
+	schedule    *resendSchedule
+	resolved    *common.DnsRecord
+	unconfirmed []string
+}
+
+func newIpPartiallyConfirmedState(conf conf.StateMachineConfig, schedule *resendSchedule, resolved *common.DnsRecord, result verification) *ipPartiallyConfirmedState {
+	for _, addressFamily := range result.unconfirmed {
+		metrics.PartiallyConfirmedRecords.WithLabelValues(resolved.Host, addressFamily).Inc()
+	}
+
+	return &ipPartiallyConfirmedState{
+		conf:        conf,
+		schedule:    schedule,
+		resolved:    resolved,
+		unconfirmed: result.unconfirmed,
+	}
+}
+
+func (state *ipPartiallyConfirmedState) String() string {
+	return fmt.Sprintf("ipPartiallyConfirmedState (unconfirmed: %s, %d checks)", strings.Join(state.unconfirmed, ", "), state.schedule.checks)
+}
+
+func (state *ipPartiallyConfirmedState) Name() string {
+	return "ipPartiallyConfirmedState"
+}
+
+func (state *ipPartiallyConfirmedState) EvaluateState(context Client, resolved *common.DnsRecord) bool {
+	if !state.resolved.Equals(resolved) {
+		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("ipv4", resolved.IpV4).Str("ipv6", resolved.IpV6).Str("host", resolved.Host).Msg("New IP detected while waiting for propagation")
+		context.SetState(NewIpNotConfirmedState(state.conf, true))
+		return true
+	}
+
+	state.schedule.checks++
+	result, err := verifyRecord(context.Verifier(), resolved)
+	switch {
+	case err != nil:
+		log.Warn().Err(err).Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Msg("Error looking up dns record")
+	case result.isConfirmed():
+		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Msg("DNS record verified")
+		context.SetState(NewIpConfirmedState(resolved, state.conf))
+		return false
+	case result.isPartiallyConfirmed():
+		state.unconfirmed = result.unconfirmed
+		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Strs("unconfirmed", result.unconfirmed).Msg("DNS record still partially verified")
+	default:
+		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Msg("DNS record no longer verified for any address family")
+		context.SetState(&ipNotConfirmedState{
+			conf:         state.conf,
+			schedule:     state.schedule,
+			lastResolved: resolved,
+		})
+	}
+
+	return resend(context, state, state.schedule, resolved)
+}
+
+func (state *ipPartiallyConfirmedState) WaitInterval() time.Duration {
+	return state.conf.NotConfirmedInterval
+}
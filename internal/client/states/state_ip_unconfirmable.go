@@ -0,0 +1,70 @@
+package states
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/metrics"
+)
+
+// ipUnconfirmableState is set after the dns record could not be verified for the configured maximum duration. No
+// more update requests are sent until either the dns record is verified or a new ip is detected.
+type ipUnconfirmableState struct {
+	unconfirmedIp *common.DnsRecord
+	conf          conf.StateMachineConfig
+}
+
+func NewIpUnconfirmableState(unconfirmed *common.DnsRecord, conf conf.StateMachineConfig) State {
+	return &ipUnconfirmableState{
+		unconfirmedIp: unconfirmed,
+		conf:          conf,
+	}
+}
+
+func (state *ipUnconfirmableState) String() string {
+	return fmt.Sprintf("ipUnconfirmableState (%s)", state.unconfirmedIp)
+}
+
+func (state *ipUnconfirmableState) Name() string {
+	return "ipUnconfirmableState"
+}
+
+func (state *ipUnconfirmableState) EvaluateState(context Client, resolved *common.DnsRecord) bool {
+	if !state.unconfirmedIp.Equals(resolved) {
+		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("ipv4", resolved.IpV4).Str("ipv6", resolved.IpV6).Str("host", resolved.Host).Msg("New IP detected")
+		context.SetState(NewIpNotConfirmedState(state.conf, true))
+
+		if err := context.NotifyUpdatedIpDetected(resolved); err != nil {
+			log.Error().Err(err).Msg("could not send notification")
+			metrics.NotificationErrors.Inc()
+		}
+		return true
+	}
+
+	result, err := verifyRecord(context.Verifier(), resolved)
+	if err != nil {
+		log.Warn().Err(err).Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Msg("Error looking up dns record")
+		return false
+	}
+
+	if result.isConfirmed() {
+		log.Info().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Msg("DNS record verified")
+		context.SetState(NewIpConfirmedState(resolved, state.conf))
+		return false
+	}
+
+	since := time.Since(context.GetLastStateChange())
+	log.Error().Str("component", "state_machine").Str("state", state.Name()).Str("host", resolved.Host).Str("since", since.String()).Msg("DNS record still not verified, update requests are not re-sent")
+	return false
+}
+
+func (state *ipUnconfirmableState) UnconfirmedRecord() *common.DnsRecord {
+	return state.unconfirmedIp
+}
+
+func (state *ipUnconfirmableState) WaitInterval() time.Duration {
+	return state.conf.UnconfirmableInterval
+}
@@ -1,9 +1,14 @@
 package states
 
 import (
+	"slices"
 	"time"
 
 	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/metrics"
+	"github.com/soerenschneider/dyndns/internal/util"
+	"go.uber.org/multierr"
 )
 
 type State interface {
@@ -20,4 +25,82 @@ type Client interface {
 	GetState() State
 	GetLastStateChange() time.Time
 	NotifyUpdatedIpDetected(resolved *common.DnsRecord) error
+	// NotifyUpdatedIpUnconfirmable notifies that the dns record could not be verified and update requests are not
+	// re-sent anymore
+	NotifyUpdatedIpUnconfirmable(resolved *common.DnsRecord) error
+	// Verifier returns the verifier that is used to check whether the DNS record contains the resolved ips
+	Verifier() util.RecordVerifier
+}
+
+// PersistedRecords holds the records of a host that have been persisted before the client has been restarted
+type PersistedRecords struct {
+	// Resolved is the last record an update request has been sent for
+	Resolved *common.DnsRecord `json:"resolved,omitempty"`
+	// Confirmed is the last record that has been verified
+	Confirmed   *common.DnsRecord `json:"confirmed,omitempty"`
+	ConfirmedAt time.Time         `json:"confirmed_at,omitempty"`
+}
+
+// ConfirmedState is implemented by states in which the dns record has been verified to contain the resolved ips
+type ConfirmedState interface {
+	ConfirmedRecord() *common.DnsRecord
+}
+
+// UnconfirmableState is implemented by states in which the client has given up waiting for the dns record to be
+// verified
+type UnconfirmableState interface {
+	UnconfirmedRecord() *common.DnsRecord
+}
+
+// verification holds the address families whose dns record has been verified to contain the resolved ip and those
+// whose record differs
+type verification struct {
+	confirmed   []string
+	unconfirmed []string
+}
+
+// isConfirmed returns whether the records of all resolved address families have been verified
+func (v verification) isConfirmed() bool {
+	return len(v.confirmed) > 0 && len(v.unconfirmed) == 0
+}
+
+// isPartiallyConfirmed returns whether the records of some, but not all resolved address families have been verified
+func (v verification) isPartiallyConfirmed() bool {
+	return len(v.confirmed) > 0 && len(v.unconfirmed) > 0
+}
+
+// verifyRecord checks the dns record of each address family of the resolved ip against the matching record type
+func verifyRecord(verifier util.RecordVerifier, resolved *common.DnsRecord) (verification, error) {
+	expected := []struct {
+		addressFamily string
+		ip            string
+	}{
+		{addressFamily: conf.AddrFamilyIpv4, ip: resolved.IpV4},
+		{addressFamily: conf.AddrFamilyIpv6, ip: resolved.IpV6},
+	}
+
+	var result verification
+	var errs error
+	for _, family := range expected {
+		if len(family.ip) == 0 {
+			continue
+		}
+
+		ips, err := verifier.Lookup(resolved.Host, family.addressFamily)
+		if err != nil {
+			metrics.RecordVerifications.WithLabelValues(resolved.Host, family.addressFamily, "error").Inc()
+			errs = multierr.Append(errs, err)
+			continue
+		}
+
+		if slices.Contains(ips, family.ip) {
+			metrics.RecordVerifications.WithLabelValues(resolved.Host, family.addressFamily, "confirmed").Inc()
+			result.confirmed = append(result.confirmed, family.addressFamily)
+		} else {
+			metrics.RecordVerifications.WithLabelValues(resolved.Host, family.addressFamily, "unconfirmed").Inc()
+			result.unconfirmed = append(result.unconfirmed, family.addressFamily)
+		}
+	}
+
+	return result, errs
 }
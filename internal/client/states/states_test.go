@@ -0,0 +1,244 @@
+package states
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/util"
+)
+
+type fakeVerifier struct {
+	records map[string][]string
+	err     error
+}
+
+func (v *fakeVerifier) Lookup(_ string, addressFamily string) ([]string, error) {
+	return v.records[addressFamily], v.err
+}
+
+type fakeClient struct {
+	state           State
+	lastStateChange time.Time
+	notifications   int
+	unconfirmable   int
+	verifier        *fakeVerifier
+}
+
+func (c *fakeClient) SetState(newState State) {
+	c.state = newState
+	c.lastStateChange = time.Now()
+}
+
+func (c *fakeClient) GetState() State {
+	return c.state
+}
+
+func (c *fakeClient) GetLastStateChange() time.Time {
+	return c.lastStateChange
+}
+
+func (c *fakeClient) NotifyUpdatedIpDetected(_ *common.DnsRecord) error {
+	c.notifications++
+	return nil
+}
+
+func (c *fakeClient) NotifyUpdatedIpUnconfirmable(_ *common.DnsRecord) error {
+	c.unconfirmable++
+	return nil
+}
+
+func (c *fakeClient) Verifier() util.RecordVerifier {
+	return c.verifier
+}
+
+func verifier(ipv4 ...string) *fakeVerifier {
+	return &fakeVerifier{
+		records: map[string][]string{conf.AddrFamilyIpv4: ipv4},
+	}
+}
+
+func record(ipv4 string) *common.DnsRecord {
+	return &common.DnsRecord{Host: "my.host.tld", IpV4: ipv4}
+}
+
+func TestIpNotConfirmedState_Backoff(t *testing.T) {
+	stateConf := conf.DefaultStateMachineConfig()
+	stateConf.ResendBackoff.Jitter = 0
+	state := NewIpNotConfirmedState(stateConf, false).(*ipNotConfirmedState)
+	client := &fakeClient{state: state, verifier: verifier("192.0.2.1")}
+
+	if !state.EvaluateState(client, record("198.51.100.1")) {
+		t.Fatal("expected update to be sent on first evaluation")
+	}
+	if state.EvaluateState(client, record("198.51.100.1")) {
+		t.Fatal("expected update not to be re-sent before backoff elapsed")
+	}
+	if state.schedule.checks != 2 {
+		t.Fatalf("expected 2 checks, got %d", state.schedule.checks)
+	}
+
+	state.schedule.nextResend = time.Now().Add(-time.Second)
+	if !state.EvaluateState(client, record("198.51.100.1")) {
+		t.Fatal("expected update to be re-sent after backoff elapsed")
+	}
+	if delay := time.Until(state.schedule.nextResend); delay <= stateConf.ResendBackoff.Initial || delay > 2*stateConf.ResendBackoff.Initial {
+		t.Fatalf("expected backoff to be doubled, got %v", delay)
+	}
+
+	if !state.EvaluateState(client, record("198.51.100.2")) {
+		t.Fatal("expected update to be sent immediately for new ip")
+	}
+}
+
+func TestIpNotConfirmedState_Confirmed(t *testing.T) {
+	state := NewIpNotConfirmedState(conf.DefaultStateMachineConfig(), true)
+	client := &fakeClient{state: state, verifier: verifier("198.51.100.1")}
+
+	if state.EvaluateState(client, record("198.51.100.1")) {
+		t.Fatal("expected no update to be sent")
+	}
+	if client.state.Name() != "ipConfirmedState" {
+		t.Fatalf("expected ipConfirmedState, got %s", client.state.Name())
+	}
+}
+
+func TestIpNotConfirmedState_Unconfirmable(t *testing.T) {
+	state := NewIpNotConfirmedState(conf.DefaultStateMachineConfig(), true).(*ipNotConfirmedState)
+	state.schedule.since = time.Now().Add(-state.conf.MaxUnconfirmedDuration)
+	client := &fakeClient{state: state, verifier: verifier("192.0.2.1")}
+
+	if state.EvaluateState(client, record("198.51.100.1")) {
+		t.Fatal("expected no update to be sent")
+	}
+	if client.state.Name() != "ipUnconfirmableState" || client.unconfirmable != 1 {
+		t.Fatalf("expected ipUnconfirmableState and a notification, got %s", client.state.Name())
+	}
+
+	if client.state.EvaluateState(client, record("198.51.100.1")) {
+		t.Fatal("expected no update to be sent for unconfirmable ip")
+	}
+	if client.unconfirmable != 1 {
+		t.Fatalf("expected a single notification, got %d", client.unconfirmable)
+	}
+	if !client.state.EvaluateState(client, record("198.51.100.2")) {
+		t.Fatal("expected update to be sent for new ip")
+	}
+	if client.state.Name() != "ipNotConfirmedState" || client.notifications != 1 {
+		t.Fatalf("expected ipNotConfirmedState and a notification, got %s", client.state.Name())
+	}
+}
+
+func TestIpNotConfirmedState_LookupError(t *testing.T) {
+	stateConf := conf.DefaultStateMachineConfig()
+	state := NewIpNotConfirmedState(stateConf, true)
+	client := &fakeClient{state: state, verifier: &fakeVerifier{err: errors.New("timeout")}}
+
+	if state.EvaluateState(client, record("198.51.100.1")) {
+		t.Fatal("expected update not to be re-sent on lookup errors before backoff elapsed")
+	}
+	if client.state != state {
+		t.Fatalf("expected state not to change, got %s", client.state.Name())
+	}
+}
+
+func TestIpNotConfirmedState_PartiallyConfirmed(t *testing.T) {
+	resolved := &common.DnsRecord{Host: "my.host.tld", IpV4: "198.51.100.1", IpV6: "2001:db8::1"}
+	fake := &fakeVerifier{
+		records: map[string][]string{
+			conf.AddrFamilyIpv4: {"198.51.100.1"},
+			conf.AddrFamilyIpv6: {"2001:db8::ffff"},
+		},
+	}
+
+	state := NewIpNotConfirmedState(conf.DefaultStateMachineConfig(), true)
+	client := &fakeClient{state: state, verifier: fake}
+
+	if state.EvaluateState(client, resolved) {
+		t.Fatal("expected update not to be re-sent before backoff elapsed")
+	}
+	partiallyConfirmed, ok := client.state.(*ipPartiallyConfirmedState)
+	if !ok {
+		t.Fatalf("expected ipPartiallyConfirmedState, got %s", client.state.Name())
+	}
+	if !reflect.DeepEqual(partiallyConfirmed.unconfirmed, []string{conf.AddrFamilyIpv6}) {
+		t.Fatalf("expected ip6 to be unconfirmed, got %v", partiallyConfirmed.unconfirmed)
+	}
+
+	partiallyConfirmed.schedule.nextResend = time.Now().Add(-time.Second)
+	if !client.state.EvaluateState(client, resolved) {
+		t.Fatal("expected update to be re-sent after backoff elapsed")
+	}
+
+	fake.records[conf.AddrFamilyIpv6] = []string{"2001:db8::1"}
+	if client.state.EvaluateState(client, resolved) {
+		t.Fatal("expected no update to be sent")
+	}
+	if client.state.Name() != "ipConfirmedState" {
+		t.Fatalf("expected ipConfirmedState, got %s", client.state.Name())
+	}
+}
+
+func TestIpConfirmedState_StaleRecord(t *testing.T) {
+	resolved := &common.DnsRecord{Host: "my.host.tld", IpV4: "198.51.100.1", IpV6: "2001:db8::1"}
+	fake := &fakeVerifier{
+		records: map[string][]string{
+			conf.AddrFamilyIpv4: {"198.51.100.1"},
+			conf.AddrFamilyIpv6: {"2001:db8::ffff"},
+		},
+	}
+
+	state := NewIpConfirmedState(resolved, conf.DefaultStateMachineConfig())
+	client := &fakeClient{state: state, verifier: fake}
+
+	if state.EvaluateState(client, resolved) {
+		t.Fatal("expected no update to be sent")
+	}
+	if client.state.Name() != "ipNotConfirmedState" {
+		t.Fatalf("expected ipNotConfirmedState, got %s", client.state.Name())
+	}
+}
+
+func TestInitialState_Resume(t *testing.T) {
+	resolved := record("198.51.100.1")
+
+	tests := []struct {
+		name      string
+		persisted *PersistedRecords
+		wantSend  bool
+		wantState string
+	}{
+		{
+			name:      "confirmed record unchanged",
+			persisted: &PersistedRecords{Resolved: resolved, Confirmed: resolved},
+			wantState: "ipConfirmedState",
+		},
+		{
+			name:      "pending record unchanged",
+			persisted: &PersistedRecords{Resolved: resolved, Confirmed: record("198.51.100.2")},
+			wantState: "ipNotConfirmedState",
+		},
+		{
+			name:      "ip changed since last run",
+			persisted: &PersistedRecords{Resolved: record("198.51.100.2"), Confirmed: record("198.51.100.2")},
+			wantSend:  true,
+			wantState: "ipNotConfirmedState",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := NewInitialState(false, conf.DefaultStateMachineConfig(), tt.persisted)
+			client := &fakeClient{state: state, verifier: verifier("192.0.2.1")}
+
+			if got := state.EvaluateState(client, resolved); got != tt.wantSend {
+				t.Errorf("EvaluateState() = %v, want %v", got, tt.wantSend)
+			}
+			if client.state.Name() != tt.wantState {
+				t.Errorf("expected %s, got %s", tt.wantState, client.state.Name())
+			}
+		})
+	}
+}
@@ -11,6 +11,11 @@ import (
 type UpdateRecordRequest struct {
 	PublicIp  DnsRecord `json:"public_ip"`
 	Signature string    `json:"signature"`
+
+	// eventId is the id of the CloudEvent the update request has been received with
+	eventId string
+	// onDone reports the result of processing the update request to the listener that received it
+	onDone func(error)
 }
 
 func (r *UpdateRecordRequest) Validate() error {
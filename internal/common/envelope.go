@@ -0,0 +1,115 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+const (
+	// PayloadFormatPlain encodes update requests as plain json
+	PayloadFormatPlain = "plain"
+	// PayloadFormatCloudEvents wraps update requests in a structured CloudEvent
+	PayloadFormatCloudEvents = "cloudevents"
+
+	UpdateRecordRequestEventType = "cloud.soeren.dyndns.update_record_request"
+	updateRecordRequestSource    = "/dyndns/client/"
+
+	// UpdateRecordRequestSchemaVersion is the version of the update request's schema, which is sent as metadata by
+	// transports that support it, so servers can reject update requests they don't understand
+	UpdateRecordRequestSchemaVersion = "1"
+	// MetadataHost and MetadataSchemaVersion are the keys of the metadata that is sent along with update requests
+	MetadataHost          = "host"
+	MetadataSchemaVersion = "schema_version"
+)
+
+// EventId returns the id of the CloudEvent the update request has been received with. For update requests that have
+// not been wrapped in a CloudEvent, an id is derived that is stable for the update request, so deliveries of the same
+// request via multiple dispatchers or retries can be recognized as duplicates.
+func (r *UpdateRecordRequest) EventId() string {
+	if len(r.eventId) > 0 {
+		return r.eventId
+	}
+
+	return r.Hash()
+}
+
+// Hash returns a hash of the update request's signature, which covers the host, its ips and the timestamp
+func (r *UpdateRecordRequest) Hash() string {
+	hash := sha256.Sum256([]byte(r.Signature))
+	return hex.EncodeToString(hash[:16])
+}
+
+// EncodeUpdateRecordRequest marshals the update request using the given payload format
+func EncodeUpdateRecordRequest(req *UpdateRecordRequest, format string) ([]byte, error) {
+	if req == nil {
+		return nil, errors.New("nil request supplied")
+	}
+
+	switch format {
+	case "", PayloadFormatPlain:
+		return json.Marshal(req)
+	case PayloadFormatCloudEvents:
+		event, err := NewUpdateRecordRequestEvent(req)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(event)
+	default:
+		return nil, fmt.Errorf("unknown payload format '%s'", format)
+	}
+}
+
+// NewUpdateRecordRequestEvent wraps the update request in a CloudEvent
+func NewUpdateRecordRequestEvent(req *UpdateRecordRequest) (cloudevents.Event, error) {
+	event := cloudevents.NewEvent()
+	event.SetID(req.EventId())
+	event.SetType(UpdateRecordRequestEventType)
+	event.SetSource(updateRecordRequestSource + req.PublicIp.Host)
+	event.SetSubject(req.PublicIp.Host)
+	event.SetTime(req.PublicIp.Timestamp)
+	if err := event.SetData(cloudevents.ApplicationJSON, req); err != nil {
+		return event, fmt.Errorf("could not set event data: %w", err)
+	}
+
+	return event, event.Validate()
+}
+
+// DecodeUpdateRecordRequest parses an update request that is either encoded as plain json or wrapped in a structured
+// CloudEvent
+func DecodeUpdateRecordRequest(data []byte) (UpdateRecordRequest, error) {
+	var probe struct {
+		SpecVersion string `json:"specversion"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return UpdateRecordRequest{}, fmt.Errorf("could not parse payload: %w", err)
+	}
+
+	var req UpdateRecordRequest
+	if len(probe.SpecVersion) == 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			return UpdateRecordRequest{}, fmt.Errorf("could not parse update request: %w", err)
+		}
+		return req, nil
+	}
+
+	event := cloudevents.NewEvent()
+	if err := json.Unmarshal(data, &event); err != nil {
+		return UpdateRecordRequest{}, fmt.Errorf("could not parse cloudevent: %w", err)
+	}
+
+	if event.Type() != UpdateRecordRequestEventType {
+		return UpdateRecordRequest{}, fmt.Errorf("unexpected event type '%s'", event.Type())
+	}
+
+	if err := event.DataAs(&req); err != nil {
+		return UpdateRecordRequest{}, fmt.Errorf("could not parse event data: %w", err)
+	}
+
+	req.eventId = event.ID()
+	return req, nil
+}
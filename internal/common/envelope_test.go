@@ -0,0 +1,92 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func testRequest() *UpdateRecordRequest {
+	return &UpdateRecordRequest{
+		PublicIp: DnsRecord{
+			IpV4:      "198.51.100.1",
+			Host:      "home.example.com",
+			Timestamp: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		},
+		Signature: "signature",
+	}
+}
+
+func TestEncodeDecodeUpdateRecordRequest(t *testing.T) {
+	tests := []struct {
+		format  string
+		wantErr bool
+	}{
+		{format: ""},
+		{format: PayloadFormatPlain},
+		{format: PayloadFormatCloudEvents},
+		{format: "xml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			req := testRequest()
+			data, err := EncodeUpdateRecordRequest(req, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EncodeUpdateRecordRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got, err := DecodeUpdateRecordRequest(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.PublicIp.Equals(&req.PublicIp) || !got.PublicIp.Timestamp.Equal(req.PublicIp.Timestamp) || got.Signature != req.Signature {
+				t.Errorf("expected %v, got %v", req, got)
+			}
+			if got.EventId() != req.EventId() {
+				t.Errorf("expected event id %s, got %s", req.EventId(), got.EventId())
+			}
+		})
+	}
+}
+
+func TestDecodeUpdateRecordRequest_CloudEvent(t *testing.T) {
+	event, err := NewUpdateRecordRequestEvent(testRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event.SetID("custom-id")
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := DecodeUpdateRecordRequest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.EventId() != "custom-id" {
+		t.Errorf("expected event id of the cloudevent, got %s", got.EventId())
+	}
+
+	event.SetType("cloud.soeren.dyndns.other")
+	data, _ = json.Marshal(event)
+	if _, err := DecodeUpdateRecordRequest(data); err == nil {
+		t.Error("expected error for unexpected event type")
+	}
+}
+
+func TestUpdateRecordRequest_EventId(t *testing.T) {
+	a, b := testRequest(), testRequest()
+	if a.EventId() != b.EventId() {
+		t.Error("expected identical requests to share the event id")
+	}
+
+	b.Signature = "other"
+	if a.EventId() == b.EventId() {
+		t.Error("expected different requests to have different event ids")
+	}
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// leaderPollInterval is the interval listeners check whether this server became the leader
+const leaderPollInterval = 1 * time.Second
+
+// ErrNotLeader is the result of update requests that have not been processed because another server holds the leader
+// lease. It's not a failure of the update request, so listeners must neither count it as delivery attempt nor
+// dead-letter or reply to it.
+var ErrNotLeader = errors.New("not holding the leader lease")
+
+// Leader decides whether this server processes update requests, if multiple servers consume the same update requests
+type Leader interface {
+	IsLeader() bool
+}
+
+// WaitUntilLeader blocks until the leader holds the lease or the context is cancelled. Listeners that share a queue
+// with other servers use this to leave the update requests to the leader instead of consuming them.
+func WaitUntilLeader(ctx context.Context, leader Leader) error {
+	if leader == nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(leaderPollInterval)
+	defer ticker.Stop()
+	for !leader.IsLeader() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// WatchLeader calls onChange whenever the leader acquires or loses the lease, until the context is cancelled.
+// Listeners that can not share a queue with other servers use this to only subscribe while holding the lease.
+func WatchLeader(ctx context.Context, leader Leader, onChange func(isLeader bool)) {
+	if leader == nil {
+		return
+	}
+
+	ticker := time.NewTicker(leaderPollInterval)
+	defer ticker.Stop()
+	isLeader := leader.IsLeader()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if leader.IsLeader() != isLeader {
+				isLeader = !isLeader
+				onChange(isLeader)
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package common
+
+import "fmt"
+
+// UpdateRecordReply is the server's reply to an update request that has been sent by a transport that supports
+// replies, such as NATS request-reply or MQTT v5 response topics
+type UpdateRecordReply struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	// Permanent is set if the update request can never be processed successfully, e.g. due to an invalid signature
+	Permanent bool `json:"permanent,omitempty"`
+}
+
+// NewUpdateRecordReply builds the reply for the result of processing an update request
+func NewUpdateRecordReply(err error) UpdateRecordReply {
+	if err == nil {
+		return UpdateRecordReply{Success: true}
+	}
+
+	return UpdateRecordReply{
+		Error:     err.Error(),
+		Permanent: IsPermanent(err),
+	}
+}
+
+// Err returns the error the server reported, preserving whether it failed permanently
+func (r UpdateRecordReply) Err() error {
+	if r.Success {
+		return nil
+	}
+
+	err := fmt.Errorf("server could not process update request: %s", r.Error)
+	if r.Permanent {
+		return Permanent(err)
+	}
+	return err
+}
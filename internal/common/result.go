@@ -0,0 +1,74 @@
+package common
+
+import "errors"
+
+// permanentError marks an error of an update request that can never be processed successfully
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent wraps the error to signal that processing the update request again would fail as well, e.g. because its
+// signature can not be verified
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent returns whether processing the update request failed permanently, listeners should not redeliver it
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// unverifiedError marks an error of an update request whose sender could not be verified
+type unverifiedError struct {
+	err error
+}
+
+func (e *unverifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unverifiedError) Unwrap() error {
+	return e.err
+}
+
+// Unverified wraps the error to signal that the update request has been rejected before its signature has been
+// verified successfully. As anybody could have sent it, listeners must not act on behalf of the sender, e.g. by
+// publishing replies to a topic it has chosen.
+func Unverified(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &unverifiedError{err: err}
+}
+
+// IsUnverified returns whether the update request has been rejected before its sender has been verified
+func IsUnverified(err error) bool {
+	var unverified *unverifiedError
+	return errors.As(err, &unverified)
+}
+
+// WithResultHandler returns a copy of the update request that reports the result of processing it to the handler.
+// Listeners use this to acknowledge messages only after the update request has been processed.
+func (r UpdateRecordRequest) WithResultHandler(handler func(error)) UpdateRecordRequest {
+	r.onDone = handler
+	return r
+}
+
+// Done reports the result of processing the update request to the listener it has been received by
+func (r *UpdateRecordRequest) Done(err error) {
+	if r.onDone != nil {
+		r.onDone(err)
+	}
+}
@@ -4,20 +4,24 @@ package conf
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"os/user"
 	"path"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/common"
 	"github.com/soerenschneider/dyndns/internal/metrics"
 	"gopkg.in/yaml.v3"
 )
 
 var (
-	defaultHttpResolverUrls = []string{
+	defaultHttpResolverUrls = NewHttpResolverProviders(
 		"https://icanhazip.com",
 		"https://ifconfig.me",
 		"https://ident.me",
@@ -26,7 +30,7 @@ var (
 		"https://api.ipify.org",
 		"https://ipecho.net/plain",
 		"https://checkip.amazonaws.com",
-	}
+	)
 
 	configPathPreferences = []string{
 		"/etc/dyndns/client.yaml",
@@ -35,27 +39,100 @@ var (
 )
 
 type ClientConf struct {
-	Host             string   `yaml:"host,omitempty" env:"HOST" validate:"required"`
-	AddrFamilies     []string `yaml:"address_families" env:"ADDRESS_FAMILIES" envSeparator:";" validate:"omitempty,addrfamilies"`
-	KeyPairPath      string   `yaml:"keypair_path,omitempty" env:"KEYPAIR_PATH" validate:"required_if=KeyPair '',omitempty,filepath"`
-	KeyPair          string   `yaml:"keypair,omitempty" env:"KEYPAIR" validate:"required_if=KeyPairPath ''"`
-	MetricsListener  string   `yaml:"metrics_listen,omitempty" env:"METRICS_LISTEN"`
-	PreferredUrls    []string `yaml:"http_resolver_preferred_urls,omitempty" env:"HTTP_RESOLVER_PREFERRED_URLS" envSeparator:";"`
-	FallbackUrls     []string `yaml:"http_resolver_fallback_urls,omitempty" env:"HTTP_RESOLVER_FALLBACK_URLS" envSeparator:";"`
-	NetworkInterface string   `yaml:"interface,omitempty"`
-	Once             bool     // this is not parsed via json, it's an cli flag
+	Host             string                 `yaml:"host,omitempty" env:"HOST" validate:"required_without=Hosts"`
+	Hosts            []HostConfig           `yaml:"hosts,omitempty" env:"HOSTS" validate:"omitempty,dive"`
+	AddrFamilies     []string               `yaml:"address_families" env:"ADDRESS_FAMILIES" envSeparator:";" validate:"omitempty,addrfamilies"`
+	KeyPairPath      string                 `yaml:"keypair_path,omitempty" env:"KEYPAIR_PATH" validate:"required_without_all=KeyPair Hosts,omitempty,filepath"`
+	KeyPair          string                 `yaml:"keypair,omitempty" env:"KEYPAIR" validate:"required_without_all=KeyPairPath Hosts"`
+	MetricsListener  string                 `yaml:"metrics_listen,omitempty" env:"METRICS_LISTEN"`
+	ApiEnabled       bool                   `yaml:"api_enabled,omitempty" env:"API_ENABLED"`
+	ApiToken         string                 `yaml:"api_token,omitempty" env:"API_TOKEN" validate:"required_if=ApiEnabled true"`
+	StateFile        string                 `yaml:"state_file,omitempty" env:"STATE_FILE" validate:"omitempty,filepath"`
+	PreferredUrls    []HttpResolverProvider `yaml:"http_resolver_preferred_urls,omitempty" env:"HTTP_RESOLVER_PREFERRED_URLS" validate:"dive"`
+	FallbackUrls     []HttpResolverProvider `yaml:"http_resolver_fallback_urls,omitempty" env:"HTTP_RESOLVER_FALLBACK_URLS" validate:"dive"`
+	NetworkInterface string                 `yaml:"interface,omitempty"`
+	Resolvers        []ResolverConfig       `yaml:"resolvers,omitempty" env:"RESOLVERS" validate:"omitempty,dive"`
+	StateMachine     StateMachineConfig     `yaml:"state_machine" envPrefix:"STATE_MACHINE_"`
+	DnsVerification  DnsVerificationConfig  `yaml:"dns_verification" envPrefix:"DNS_VERIFICATION_"`
+	Outbox           OutboxConfig           `yaml:"outbox" envPrefix:"OUTBOX_"`
+	PayloadFormat    string                 `yaml:"payload_format" env:"PAYLOAD_FORMAT" validate:"omitempty,oneof=plain cloudevents"`
+	HomeAssistant    HomeAssistantConfig    `yaml:"home_assistant" envPrefix:"HOME_ASSISTANT_"`
+	Once             bool                   // this is not parsed via json, it's an cli flag
+	OnceTimeout      time.Duration          `yaml:"-" validate:"required_if=Once true,gte=0"` // cli flag, the deadline of a single run
+	OnceWait         bool                   `yaml:"-"`                                        // cli flag, wait for the dns record to be verified in a single run
 
 	HttpDispatcherConf []HttpDispatcherConfig `yaml:"http_dispatcher" env:"HTTP_DISPATCHER_CONF"`
 	SqsConfig          `yaml:"sqs" envPrefix:"SQS_"`
 	MqttConfig         `yaml:"mqtt"`
 	EmailConfig        `yaml:"notifications"`
 	NatsConfig         `yaml:"nats" envPrefix:"NATS_"`
+	VaultConfig        `yaml:"vault"`
 }
 
 type HttpDispatcherConfig struct {
 	Url string `yaml:"url"`
 }
 
+// HostConfig configures a single host that is managed by the client. Empty values are populated using the values of
+// the ClientConf.
+type HostConfig struct {
+	Host         string           `yaml:"host" json:"host" validate:"required"`
+	KeyPairPath  string           `yaml:"keypair_path,omitempty" json:"keypair_path,omitempty" validate:"omitempty,filepath"`
+	KeyPair      string           `yaml:"keypair,omitempty" json:"keypair,omitempty"`
+	AddrFamilies []string         `yaml:"address_families,omitempty" json:"address_families,omitempty" validate:"omitempty,addrfamilies"`
+	Resolvers    []ResolverConfig `yaml:"resolvers,omitempty" json:"resolvers,omitempty" validate:"omitempty,dive"`
+}
+
+func (h HostConfig) String() string {
+	keyPair := ""
+	if len(h.KeyPair) > 0 {
+		keyPair = "*** (redacted)"
+	}
+	return fmt.Sprintf("{Host: %s, KeyPairPath: %s, KeyPair: %s, AddrFamilies: %v, Resolvers: %v}", h.Host, h.KeyPairPath, keyPair, h.AddrFamilies, h.Resolvers)
+}
+
+// HasResolverOverride returns whether the host uses its own resolvers instead of sharing the client's resolver
+func (h HostConfig) HasResolverOverride() bool {
+	return len(h.Resolvers) > 0
+}
+
+// GetHosts returns all hosts managed by the client. The legacy single host configuration is returned as the first
+// host, values that are not defined for a host are taken from the ClientConf.
+func (conf *ClientConf) GetHosts() ([]HostConfig, error) {
+	hosts := make([]HostConfig, 0, len(conf.Hosts)+1)
+	if len(conf.Host) > 0 {
+		hosts = append(hosts, HostConfig{Host: conf.Host})
+	}
+	hosts = append(hosts, conf.Hosts...)
+
+	if len(hosts) == 0 {
+		return nil, errors.New("no hosts configured")
+	}
+
+	seen := make(map[string]bool, len(hosts))
+	for index := range hosts {
+		host := &hosts[index]
+		if seen[host.Host] {
+			return nil, fmt.Errorf("host '%s' is configured multiple times", host.Host)
+		}
+		seen[host.Host] = true
+
+		if len(host.KeyPair) == 0 && len(host.KeyPairPath) == 0 {
+			host.KeyPair = conf.KeyPair
+			host.KeyPairPath = conf.KeyPairPath
+		}
+		if len(host.KeyPair) == 0 && len(host.KeyPairPath) == 0 {
+			return nil, fmt.Errorf("no keypair configured for host '%s'", host.Host)
+		}
+
+		if len(host.AddrFamilies) == 0 {
+			host.AddrFamilies = conf.AddrFamilies
+		}
+	}
+
+	return hosts, nil
+}
+
 func ReadClientConfig(path string) (*ClientConf, error) {
 	conf := getDefaultClientConfig()
 	if path == "" {
@@ -82,6 +159,20 @@ func ParseClientConfEnv(clientConf *ClientConf) error {
 		return ret, json.Unmarshal([]byte(input), &ret)
 	}
 
+	funk[reflect.TypeOf([]HostConfig{})] = func(input string) (any, error) {
+		var ret []HostConfig
+		return ret, json.Unmarshal([]byte(input), &ret)
+	}
+
+	funk[reflect.TypeOf([]ResolverConfig{})] = func(input string) (any, error) {
+		var ret []ResolverConfig
+		return ret, json.Unmarshal([]byte(input), &ret)
+	}
+
+	funk[reflect.TypeOf([]HttpResolverProvider{})] = parseHttpResolverProviders
+
+	funk[reflect.TypeOf([]MqttBrokerConfig{})] = parseMqttBrokerConfigs
+
 	opts := env.Options{
 		Prefix: "DYNDNS_",
 	}
@@ -89,12 +180,30 @@ func ParseClientConfEnv(clientConf *ClientConf) error {
 	return env.ParseWithFuncs(clientConf, funk, opts)
 }
 
+// parseHttpResolverProviders parses providers from an environment variable. Providers are expected as JSON array, for
+// backwards compatibility a list of plain URLs separated by ';' is accepted as well.
+func parseHttpResolverProviders(input string) (any, error) {
+	if !strings.HasPrefix(strings.TrimSpace(input), "[") {
+		return NewHttpResolverProviders(strings.Split(input, ";")...), nil
+	}
+
+	var ret []HttpResolverProvider
+	return ret, json.Unmarshal([]byte(input), &ret)
+}
+
 func getDefaultClientConfig() *ClientConf {
 	return &ClientConf{
 		MetricsListener: metrics.DefaultListener,
 		SqsConfig:       DefaultSqsConfig(),
 		AddrFamilies:    []string{AddrFamilyIpv4},
 		PreferredUrls:   defaultHttpResolverUrls,
+		StateMachine:    DefaultStateMachineConfig(),
+		DnsVerification: DefaultDnsVerificationConfig(),
+		Outbox:          DefaultOutboxConfig(),
+		PayloadFormat:   common.PayloadFormatPlain,
+		MqttConfig:      DefaultMqttConfig(),
+		HomeAssistant:   DefaultHomeAssistantConfig(),
+		VaultConfig:     GetDefaultVaultConfig(),
 	}
 }
 
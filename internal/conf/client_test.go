@@ -1,9 +1,16 @@
 package conf
 
 import (
+	"bytes"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/common"
 )
 
 func TestReadClientConfig(t *testing.T) {
@@ -26,9 +33,18 @@ func TestReadClientConfig(t *testing.T) {
 				PreferredUrls:   defaultHttpResolverUrls,
 				MetricsListener: "0.0.0.0:9191",
 				SqsConfig:       DefaultSqsConfig(),
+				StateMachine:    DefaultStateMachineConfig(),
+				DnsVerification: DefaultDnsVerificationConfig(),
+				Outbox:          DefaultOutboxConfig(),
+				PayloadFormat:   common.PayloadFormatPlain,
+				HomeAssistant:   DefaultHomeAssistantConfig(),
+				VaultConfig:     GetDefaultVaultConfig(),
 				MqttConfig: MqttConfig{
-					Brokers:  []string{"ssl://mqtt.eclipseprojects.io:8883"},
-					ClientId: "my-client-id",
+					Brokers:         []string{"ssl://mqtt.eclipseprojects.io:8883"},
+					ClientId:        "my-client-id",
+					Qos:             1,
+					Retain:          true,
+					ProtocolVersion: 3,
 				},
 			},
 			wantErr: false,
@@ -43,9 +59,18 @@ func TestReadClientConfig(t *testing.T) {
 				PreferredUrls:   defaultHttpResolverUrls,
 				MetricsListener: "0.0.0.0:9191",
 				SqsConfig:       DefaultSqsConfig(),
+				StateMachine:    DefaultStateMachineConfig(),
+				DnsVerification: DefaultDnsVerificationConfig(),
+				Outbox:          DefaultOutboxConfig(),
+				PayloadFormat:   common.PayloadFormatPlain,
+				HomeAssistant:   DefaultHomeAssistantConfig(),
+				VaultConfig:     GetDefaultVaultConfig(),
 				MqttConfig: MqttConfig{
-					Brokers:  []string{"ssl://mqtt.eclipseprojects.io:8883"},
-					ClientId: "my-client-id",
+					Brokers:         []string{"ssl://mqtt.eclipseprojects.io:8883"},
+					ClientId:        "my-client-id",
+					Qos:             1,
+					Retain:          true,
+					ProtocolVersion: 3,
 				},
 			},
 			wantErr: false,
@@ -114,3 +139,230 @@ func TestParseClientConfEnv(t *testing.T) {
 		t.Fatalf("expected %v, got %v", expected, empty.HttpDispatcherConf)
 	}
 }
+
+func TestParseClientConfEnv_HttpResolverProviders(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []HttpResolverProvider
+	}{
+		{
+			name:  "plain urls",
+			input: "https://icanhazip.com;https://ifconfig.me",
+			want:  NewHttpResolverProviders("https://icanhazip.com", "https://ifconfig.me"),
+		},
+		{
+			name:  "json array",
+			input: `["https://icanhazip.com", {"url": "http://192.168.1.1/status", "format": "regex", "regex": "WAN;IP: ([0-9.]+)", "headers": {"Authorization": "Bearer a;b"}}]`,
+			want: []HttpResolverProvider{
+				{
+					Url: "https://icanhazip.com",
+				},
+				{
+					Url:     "http://192.168.1.1/status",
+					Format:  HttpResolverFormatRegex,
+					Regex:   "WAN;IP: ([0-9.]+)",
+					Headers: map[string]string{"Authorization": "Bearer a;b"},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNDNS_HTTP_RESOLVER_PREFERRED_URLS", tt.input)
+
+			empty := &ClientConf{}
+			if err := ParseClientConfEnv(empty); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(empty.PreferredUrls, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, empty.PreferredUrls)
+			}
+		})
+	}
+}
+
+func TestPrintFields_RedactsHttpResolverHeaders(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	defer func() {
+		log.Logger = logger
+	}()
+
+	config := &ClientConf{
+		PreferredUrls: []HttpResolverProvider{
+			{
+				Url:     "https://ipinfo.io/json",
+				Format:  HttpResolverFormatJson,
+				Headers: map[string]string{"Authorization": "Bearer very-secret"},
+			},
+		},
+	}
+	PrintFields(config, SensitiveFields...)
+
+	if strings.Contains(buf.String(), "very-secret") {
+		t.Fatalf("header value is not redacted: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "https://ipinfo.io/json") {
+		t.Fatalf("expected url to be printed: %s", buf.String())
+	}
+}
+
+func TestClientConf_GetHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    *ClientConf
+		want    []HostConfig
+		wantErr bool
+	}{
+		{
+			name: "legacy single host",
+			conf: &ClientConf{
+				Host:         "home.example.com",
+				KeyPairPath:  "/etc/dyndns/keypair.json",
+				AddrFamilies: []string{AddrFamilyIpv4},
+			},
+			want: []HostConfig{
+				{Host: "home.example.com", KeyPairPath: "/etc/dyndns/keypair.json", AddrFamilies: []string{AddrFamilyIpv4}},
+			},
+		},
+		{
+			name: "multiple hosts",
+			conf: &ClientConf{
+				Host:         "home.example.com",
+				KeyPairPath:  "/etc/dyndns/keypair.json",
+				AddrFamilies: []string{AddrFamilyIpv4},
+				Hosts: []HostConfig{
+					{Host: "vpn.example.com", KeyPairPath: "/etc/dyndns/vpn.json", AddrFamilies: []string{AddrFamilyIpv6}},
+					{Host: "www.example.com", KeyPair: "secret"},
+				},
+			},
+			want: []HostConfig{
+				{Host: "home.example.com", KeyPairPath: "/etc/dyndns/keypair.json", AddrFamilies: []string{AddrFamilyIpv4}},
+				{Host: "vpn.example.com", KeyPairPath: "/etc/dyndns/vpn.json", AddrFamilies: []string{AddrFamilyIpv6}},
+				{Host: "www.example.com", KeyPair: "secret", AddrFamilies: []string{AddrFamilyIpv4}},
+			},
+		},
+		{
+			name: "missing keypair",
+			conf: &ClientConf{
+				Hosts: []HostConfig{
+					{Host: "vpn.example.com"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate hosts",
+			conf: &ClientConf{
+				Host:        "home.example.com",
+				KeyPairPath: "/etc/dyndns/keypair.json",
+				Hosts: []HostConfig{
+					{Host: "home.example.com"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "no hosts",
+			conf:    &ClientConf{KeyPairPath: "/etc/dyndns/keypair.json"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.conf.GetHosts()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetHosts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetHosts() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostConfig_String(t *testing.T) {
+	host := HostConfig{Host: "home.example.com", KeyPair: "very-secret"}
+	if strings.Contains(host.String(), "very-secret") {
+		t.Fatalf("keypair is not redacted: %s", host.String())
+	}
+}
+
+func TestClientConf_ValidateApiToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiEnabled bool
+		apiToken   string
+		wantErr    bool
+	}{
+		{
+			name: "api disabled",
+		},
+		{
+			name:       "api enabled with token",
+			apiEnabled: true,
+			apiToken:   "s3cr3t",
+		},
+		{
+			name:       "api enabled without token",
+			apiEnabled: true,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := getDefaultClientConfig()
+			config.Host = "home.example.com"
+			config.KeyPair = "keypair"
+			config.ApiEnabled = tt.apiEnabled
+			config.ApiToken = tt.apiToken
+			if err := ValidateConfig(config); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientConf_ValidateOnceTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		once        bool
+		onceTimeout time.Duration
+		wantErr     bool
+	}{
+		{
+			name: "daemon",
+		},
+		{
+			name:        "once with timeout",
+			once:        true,
+			onceTimeout: 5 * time.Minute,
+		},
+		{
+			name:    "once without timeout",
+			once:    true,
+			wantErr: true,
+		},
+		{
+			name:        "once with negative timeout",
+			once:        true,
+			onceTimeout: -time.Second,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := getDefaultClientConfig()
+			config.Host = "home.example.com"
+			config.KeyPair = "keypair"
+			config.Once = tt.once
+			config.OnceTimeout = tt.onceTimeout
+			if err := ValidateConfig(config); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package conf
+
+import "time"
+
+const (
+	DedupStoreMemory = "memory"
+	DedupStoreNats   = "nats"
+)
+
+// DedupConfig configures the de-duplication of update requests that are received multiple times, either via
+// multiple listeners of a single server or by multiple servers
+type DedupConfig struct {
+	// Store is either 'memory' to de-duplicate update requests within a single server or 'nats' to share processed
+	// update requests between multiple servers using a NATS KV bucket.
+	Store string `yaml:"store" env:"STORE" validate:"oneof=memory nats"`
+	// Ttl is the duration processed update requests are remembered. The server rejects update requests that are
+	// older than 24h, so shorter durations may lead to duplicate updates.
+	Ttl time.Duration `yaml:"ttl" env:"TTL" validate:"gte=1m"`
+	// Bucket is the NATS KV bucket processed update requests are stored in when using the 'nats' store
+	Bucket string `yaml:"bucket" env:"BUCKET" validate:"required"`
+	// LeaderLease lets only the server holding the lease propagate changes. The lease is stored in a NATS KV bucket.
+	LeaderLease bool `yaml:"leader_lease" env:"LEADER_LEASE"`
+	// LeaseBucket is the NATS KV bucket the leader lease is stored in
+	LeaseBucket string `yaml:"lease_bucket" env:"LEASE_BUCKET" validate:"required"`
+	// LeaseTtl is the duration after which the lease of a server that stopped renewing it expires
+	LeaseTtl time.Duration `yaml:"lease_ttl" env:"LEASE_TTL" validate:"gte=5s,lte=5m"`
+}
+
+func DefaultDedupConfig() DedupConfig {
+	return DedupConfig{
+		Store:       DedupStoreMemory,
+		Ttl:         25 * time.Hour,
+		Bucket:      "dyndns-dedup",
+		LeaseBucket: "dyndns-leader",
+		LeaseTtl:    30 * time.Second,
+	}
+}
+
+// RequiresNats returns whether de-duplication or the leader lease depend on a NATS connection
+func (c DedupConfig) RequiresNats() bool {
+	return c.Store == DedupStoreNats || c.LeaderLease
+}
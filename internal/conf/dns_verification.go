@@ -0,0 +1,24 @@
+package conf
+
+const (
+	DnsVerificationSystem        = "system"
+	DnsVerificationAuthoritative = "authoritative"
+)
+
+// DnsVerificationConfig configures how DNS records are verified to contain the expected addresses
+type DnsVerificationConfig struct {
+	// Type is either 'authoritative' to query the authoritative nameservers of the record directly or 'system' to
+	// use the system's resolver, which may return cached answers.
+	Type string `yaml:"type" env:"TYPE" validate:"omitempty,oneof=system authoritative"`
+	// Nameservers overrides the nameservers that are queried when using the 'authoritative' type. If empty, the
+	// authoritative nameservers of the record's zone are looked up.
+	Nameservers []string `yaml:"nameservers,omitempty" env:"NAMESERVERS" envSeparator:";" validate:"omitempty,dive,hostname_port|hostname|ip"`
+	// RequireAll requires all nameservers to return the same addresses when using the 'authoritative' type
+	RequireAll bool `yaml:"require_all,omitempty" env:"REQUIRE_ALL"`
+}
+
+func DefaultDnsVerificationConfig() DnsVerificationConfig {
+	return DnsVerificationConfig{
+		Type: DnsVerificationSystem,
+	}
+}
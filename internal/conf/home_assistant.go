@@ -0,0 +1,17 @@
+package conf
+
+const defaultHomeAssistantDiscoveryPrefix = "homeassistant"
+
+// HomeAssistantConfig configures publishing the status of the client's hosts to Home Assistant using MQTT discovery.
+// The status is published to all configured MQTT brokers.
+type HomeAssistantConfig struct {
+	Enabled bool `yaml:"enabled" env:"ENABLED"`
+	// DiscoveryPrefix is the topic prefix Home Assistant subscribes to for discovery configs
+	DiscoveryPrefix string `yaml:"discovery_prefix" env:"DISCOVERY_PREFIX" validate:"required_if=Enabled true,excludesall=+#"`
+}
+
+func DefaultHomeAssistantConfig() HomeAssistantConfig {
+	return HomeAssistantConfig{
+		DiscoveryPrefix: defaultHomeAssistantDiscoveryPrefix,
+	}
+}
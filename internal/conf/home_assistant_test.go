@@ -0,0 +1,37 @@
+package conf
+
+import "testing"
+
+func TestHomeAssistantConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  HomeAssistantConfig
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			config: DefaultHomeAssistantConfig(),
+		},
+		{
+			name:   "enabled",
+			config: HomeAssistantConfig{Enabled: true, DiscoveryPrefix: "homeassistant"},
+		},
+		{
+			name:    "enabled without discovery prefix",
+			config:  HomeAssistantConfig{Enabled: true},
+			wantErr: true,
+		},
+		{
+			name:    "wildcard in discovery prefix",
+			config:  HomeAssistantConfig{Enabled: true, DiscoveryPrefix: "homeassistant/#"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateConfig(tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
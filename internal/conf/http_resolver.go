@@ -0,0 +1,77 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	HttpResolverFormatPlain = "plain"
+	HttpResolverFormatJson  = "json"
+	HttpResolverFormatRegex = "regex"
+)
+
+// HttpResolverProvider describes a single provider of the HTTP resolver. It can be configured either as a plain URL
+// string, which expects the response body to only contain the IP address, or as a structured object.
+type HttpResolverProvider struct {
+	Url        string            `yaml:"url" json:"url" validate:"required,url"`
+	Format     string            `yaml:"format,omitempty" json:"format,omitempty" validate:"omitempty,oneof=plain json regex"`
+	JsonPath   string            `yaml:"json_path,omitempty" json:"json_path,omitempty" validate:"required_if=Format json"`
+	Regex      string            `yaml:"regex,omitempty" json:"regex,omitempty" validate:"required_if=Format regex"`
+	AddrFamily string            `yaml:"address_family,omitempty" json:"address_family,omitempty" validate:"omitempty,oneof=ip4 ip6"`
+	Headers    map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+}
+
+func NewHttpResolverProviders(urls ...string) []HttpResolverProvider {
+	ret := make([]HttpResolverProvider, 0, len(urls))
+	for _, url := range urls {
+		ret = append(ret, HttpResolverProvider{Url: url})
+	}
+	return ret
+}
+
+// String returns the URL of the provider. Header values are redacted as they usually contain credentials.
+func (p HttpResolverProvider) String() string {
+	if len(p.Headers) == 0 {
+		return p.Url
+	}
+
+	headers := make([]string, 0, len(p.Headers))
+	for _, name := range slices.Sorted(maps.Keys(p.Headers)) {
+		headers = append(headers, fmt.Sprintf("%s: *** (redacted)", name))
+	}
+	return fmt.Sprintf("%s (headers: %s)", p.Url, strings.Join(headers, ", "))
+}
+
+// UnmarshalYAML allows providers to be defined as plain URL strings as well as structured objects.
+func (p *HttpResolverProvider) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*p = HttpResolverProvider{Url: value.Value}
+		return nil
+	}
+
+	type plain HttpResolverProvider
+	return value.Decode((*plain)(p))
+}
+
+// UnmarshalJSON is used when parsing providers from environment variables. Plain strings are interpreted as URL, JSON
+// objects are parsed as structured provider definitions.
+func (p *HttpResolverProvider) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		var url string
+		if err := json.Unmarshal(data, &url); err != nil {
+			return err
+		}
+		*p = HttpResolverProvider{Url: url}
+		return nil
+	}
+
+	type plain HttpResolverProvider
+	return json.Unmarshal(data, (*plain)(p))
+}
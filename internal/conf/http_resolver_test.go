@@ -0,0 +1,134 @@
+package conf
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestHttpResolverProvider_UnmarshalYAML(t *testing.T) {
+	input := `
+providers:
+  - https://icanhazip.com
+  - url: https://ipinfo.io/json
+    format: json
+    json_path: ip
+    address_family: ip4
+    headers:
+      Authorization: Bearer token
+  - url: http://192.168.1.1/status
+    format: regex
+    regex: 'WAN IP: ([0-9.]+)'
+`
+	var got struct {
+		Providers []HttpResolverProvider `yaml:"providers"`
+	}
+	if err := yaml.Unmarshal([]byte(input), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []HttpResolverProvider{
+		{
+			Url: "https://icanhazip.com",
+		},
+		{
+			Url:        "https://ipinfo.io/json",
+			Format:     HttpResolverFormatJson,
+			JsonPath:   "ip",
+			AddrFamily: AddrFamilyIpv4,
+			Headers:    map[string]string{"Authorization": "Bearer token"},
+		},
+		{
+			Url:    "http://192.168.1.1/status",
+			Format: HttpResolverFormatRegex,
+			Regex:  "WAN IP: ([0-9.]+)",
+		},
+	}
+
+	if !reflect.DeepEqual(got.Providers, expected) {
+		t.Fatalf("expected %v, got %v", expected, got.Providers)
+	}
+}
+
+func TestHttpResolverProvider_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    HttpResolverProvider
+		wantErr bool
+	}{
+		{
+			name:  "plain url",
+			input: `"https://icanhazip.com"`,
+			want:  HttpResolverProvider{Url: "https://icanhazip.com"},
+		},
+		{
+			name:  "json object",
+			input: `{"url": "https://api.ipify.org?format=json", "format": "json", "json_path": "ip"}`,
+			want: HttpResolverProvider{
+				Url:      "https://api.ipify.org?format=json",
+				Format:   HttpResolverFormatJson,
+				JsonPath: "ip",
+			},
+		},
+		{
+			name:    "broken json object",
+			input:   `{"url": `,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got HttpResolverProvider
+			err := json.Unmarshal([]byte(tt.input), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalJSON() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("UnmarshalJSON() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHttpResolverProvider_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider HttpResolverProvider
+		wantErr  bool
+	}{
+		{
+			name:     "plain",
+			provider: HttpResolverProvider{Url: "https://icanhazip.com"},
+		},
+		{
+			name:     "json without path",
+			provider: HttpResolverProvider{Url: "https://ipinfo.io/json", Format: HttpResolverFormatJson},
+			wantErr:  true,
+		},
+		{
+			name:     "regex without expression",
+			provider: HttpResolverProvider{Url: "https://ipinfo.io/json", Format: HttpResolverFormatRegex},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid address family",
+			provider: HttpResolverProvider{Url: "https://icanhazip.com", AddrFamily: "ipx"},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid url",
+			provider: HttpResolverProvider{Url: "icanhazip"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateConfig(tt.provider); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -3,56 +3,185 @@ package conf
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/go-playground/validator/v10"
 	"github.com/rs/zerolog/log"
 )
 
 type MqttConfig struct {
 	Brokers        []string `yaml:"brokers" env:"BROKERS" envSeparator:";" validate:"broker"`
-	ClientId       string   `yaml:"client_id" env:"CLIENT_ID" validate:"required_with=Brokers ''"`
+	ClientId       string   `yaml:"client_id" env:"CLIENT_ID" validate:"required_with=Brokers BrokerConfigs"`
 	CaCertFile     string   `yaml:"tls_ca_cert" env:"TLS_CA" validate:"omitempty,file"`
 	ClientCertFile string   `yaml:"tls_client_cert" env:"TLS_CERT" validate:"omitempty,required_unless=ClientKeyFile '',file"`
 	ClientKeyFile  string   `yaml:"tls_client_key" env:"TLS_KEY" validate:"omitempty,required_unless=ClientCertFile '',file"`
 	TlsInsecure    bool     `yaml:"tls_insecure" env:"TLS_INSECURE"`
+	// Qos is the quality of service level update requests are published and subscribed with
+	Qos byte `yaml:"qos" env:"QOS" validate:"lte=2"`
+	// Retain lets the broker keep the last update request of each host for servers that connect later on
+	Retain bool `yaml:"retain" env:"RETAIN"`
+	// SharedSubscriptionGroup lets the servers of a group share a subscription, so each update request is only
+	// received by a single server of the group
+	SharedSubscriptionGroup string `yaml:"shared_subscription_group" env:"SHARED_SUBSCRIPTION_GROUP" validate:"omitempty,excludesall=/+#"`
+
+	// ProtocolVersion is the MQTT protocol version to connect with, either 3 (3.1.1) or 5
+	ProtocolVersion uint   `yaml:"protocol_version" env:"PROTOCOL_VERSION" validate:"oneof=3 5"`
+	Username        string `yaml:"username" env:"USERNAME" validate:"required_with=Password"`
+	Password        string `yaml:"password" env:"PASSWORD" validate:"required_with=Username"`
+	// MessageExpiry lets the broker discard update requests that have not been delivered in time, requires MQTT v5
+	MessageExpiry time.Duration `yaml:"message_expiry" env:"MESSAGE_EXPIRY" validate:"excluded_unless=ProtocolVersion 5,omitempty,gte=1s,lte=24h"`
+	// AwaitResponse lets clients wait for a server to reply with the result of processing the update request on a
+	// response topic, requires MQTT v5
+	AwaitResponse bool `yaml:"await_response" env:"AWAIT_RESPONSE" validate:"excluded_unless=ProtocolVersion 5"`
+
+	// BrokerConfigs are brokers that use their own credentials and TLS settings instead of the global ones
+	BrokerConfigs []MqttBrokerConfig `yaml:"broker_configs" env:"BROKER_CONFIGS" validate:"dive"`
+}
+
+// MqttBrokerConfig configures the connection to a single broker
+type MqttBrokerConfig struct {
+	Url            string `yaml:"url" json:"url" validate:"required,mqtt_url"`
+	Username       string `yaml:"username" json:"username,omitempty" validate:"required_with=Password"`
+	Password       string `yaml:"password" json:"password,omitempty" validate:"required_with=Username"`
+	CaCertFile     string `yaml:"tls_ca_cert" json:"tls_ca_cert,omitempty" validate:"omitempty,file"`
+	ClientCertFile string `yaml:"tls_client_cert" json:"tls_client_cert,omitempty" validate:"required_with=ClientKeyFile,omitempty,file"`
+	ClientKeyFile  string `yaml:"tls_client_key" json:"tls_client_key,omitempty" validate:"required_with=ClientCertFile,omitempty,file"`
+	TlsInsecure    bool   `yaml:"tls_insecure" json:"tls_insecure,omitempty"`
+}
+
+func DefaultMqttConfig() MqttConfig {
+	return MqttConfig{
+		Qos:             1,
+		Retain:          true,
+		ProtocolVersion: 3,
+	}
+}
+
+// parseMqttBrokerConfigs parses the per-broker settings from an environment variable containing a JSON list
+func parseMqttBrokerConfigs(input string) (any, error) {
+	var ret []MqttBrokerConfig
+	return ret, json.Unmarshal([]byte(input), &ret)
 }
 
-func (conf *MqttConfig) UsesTlsClientCerts() bool {
-	return len(conf.CaCertFile) > 0 && len(conf.ClientCertFile) > 0 && len(conf.ClientKeyFile) > 0
+func (conf *MqttConfig) UsesProtocolV5() bool {
+	return conf.ProtocolVersion == 5
 }
 
-func (conf *MqttConfig) TlsConfig() *tls.Config {
-	log.Info().Str("component", "config").Msg("Building TLS config...")
+// GetBrokers returns the settings of all configured brokers. Brokers that are only configured by their url use the
+// global credentials and TLS settings.
+func (conf *MqttConfig) GetBrokers() []MqttBrokerConfig {
+	brokers := make([]MqttBrokerConfig, 0, len(conf.Brokers)+len(conf.BrokerConfigs))
+	for _, broker := range conf.Brokers {
+		brokers = append(brokers, MqttBrokerConfig{
+			Url:            broker,
+			Username:       conf.Username,
+			Password:       conf.Password,
+			CaCertFile:     conf.CaCertFile,
+			ClientCertFile: conf.ClientCertFile,
+			ClientKeyFile:  conf.ClientKeyFile,
+			TlsInsecure:    conf.TlsInsecure,
+		})
+	}
+
+	return append(brokers, conf.BrokerConfigs...)
+}
+
+// MqttConfigStructLevelValidation rejects brokers that are configured multiple times, as a single connection is built
+// for each broker url
+func MqttConfigStructLevelValidation(sl validator.StructLevel) {
+	config := sl.Current().Interface().(MqttConfig)
+
+	seen := map[string]bool{}
+	for _, broker := range config.GetBrokers() {
+		if seen[broker.Url] {
+			sl.ReportError(config.BrokerConfigs, "BrokerConfigs", "BrokerConfigs", "uniqueBrokers", broker.Url)
+		}
+		seen[broker.Url] = true
+	}
+}
 
+func (conf *MqttBrokerConfig) UsesTlsClientCerts() bool {
+	return len(conf.ClientCertFile) > 0 && len(conf.ClientKeyFile) > 0
+}
+
+// TlsConfig builds the TLS config for the broker. A configured CA is trusted in addition to the system's CAs.
+func (conf *MqttBrokerConfig) TlsConfig() (*tls.Config, error) {
 	certPool, err := x509.SystemCertPool()
 	if err != nil {
 		log.Warn().Err(err).Str("component", "config").Msg("Could not get system cert pool")
 		certPool = x509.NewCertPool()
 	}
 
-	if conf.UsesTlsClientCerts() {
+	if len(conf.CaCertFile) > 0 {
 		pemCerts, err := os.ReadFile(conf.CaCertFile)
 		if err != nil {
-			log.Error().Err(err).Str("component", "config").Msg("Could not read CA cert file")
-		} else {
-			certPool.AppendCertsFromPEM(pemCerts)
+			return nil, fmt.Errorf("could not read CA cert file: %w", err)
+		}
+		if !certPool.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no certificates found in CA cert file %s", conf.CaCertFile)
 		}
 	}
 
 	tlsConf := &tls.Config{
 		RootCAs:            certPool,
-		ClientAuth:         tls.RequestClientCert,
+		MinVersion:         tls.VersionTLS12,
 		InsecureSkipVerify: conf.TlsInsecure, // #nosec G402
 	}
 
-	clientCertDefined := len(conf.ClientCertFile) > 0
-	clientKeyDefined := len(conf.ClientKeyFile) > 0
-	if clientCertDefined && clientKeyDefined {
+	if conf.UsesTlsClientCerts() {
+		// the key pair is read for every handshake, so renewed certificates are picked up on reconnect
 		tlsConf.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
 			cert, err := tls.LoadX509KeyPair(conf.ClientCertFile, conf.ClientKeyFile)
 			return &cert, err
 		}
 	}
 
-	return tlsConf
+	return tlsConf, nil
+}
+
+func (conf *MqttBrokerConfig) String() string {
+	var sb strings.Builder
+
+	sb.WriteString("MqttBrokerConfig {")
+	appendIfNotEmpty(&sb, "Url", conf.Url)
+	appendIfNotEmpty(&sb, "Username", conf.Username)
+	// Note: We deliberately exclude Password from the output
+	appendIfNotEmpty(&sb, "CaCertFile", conf.CaCertFile)
+	appendIfNotEmpty(&sb, "ClientCertFile", conf.ClientCertFile)
+	appendIfNotEmpty(&sb, "ClientKeyFile", conf.ClientKeyFile)
+	sb.WriteString(fmt.Sprintf(" TlsInsecure: %t }", conf.TlsInsecure))
+
+	return sb.String()
+}
+
+func (conf *MqttConfig) String() string {
+	var sb strings.Builder
+
+	sb.WriteString("MqttConfig {")
+	if len(conf.Brokers) > 0 {
+		sb.WriteString(fmt.Sprintf(" Brokers: %v,", conf.Brokers))
+	}
+	appendIfNotEmpty(&sb, "ClientId", conf.ClientId)
+	appendIfNotEmpty(&sb, "CaCertFile", conf.CaCertFile)
+	appendIfNotEmpty(&sb, "ClientCertFile", conf.ClientCertFile)
+	appendIfNotEmpty(&sb, "ClientKeyFile", conf.ClientKeyFile)
+	sb.WriteString(fmt.Sprintf(" TlsInsecure: %t, Qos: %d, Retain: %t,", conf.TlsInsecure, conf.Qos, conf.Retain))
+	appendIfNotEmpty(&sb, "SharedSubscriptionGroup", conf.SharedSubscriptionGroup)
+	sb.WriteString(fmt.Sprintf(" ProtocolVersion: %d,", conf.ProtocolVersion))
+	appendIfNotEmpty(&sb, "Username", conf.Username)
+	// Note: We deliberately exclude Password from the output
+	if conf.MessageExpiry > 0 {
+		sb.WriteString(fmt.Sprintf(" MessageExpiry: %v,", conf.MessageExpiry))
+	}
+	sb.WriteString(fmt.Sprintf(" AwaitResponse: %t,", conf.AwaitResponse))
+	for _, broker := range conf.BrokerConfigs {
+		sb.WriteString(" " + broker.String() + ",")
+	}
+	sb.WriteString(" }")
+
+	return sb.String()
 }
@@ -0,0 +1,280 @@
+package conf
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/testutil"
+)
+
+func TestMqttConfig_Validate(t *testing.T) {
+	file := testutil.WriteFile(t, "ca.pem", []byte("content"))
+
+	tests := []struct {
+		name    string
+		config  func(config *MqttConfig)
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			config: func(config *MqttConfig) {},
+		},
+		{
+			name: "unknown protocol version",
+			config: func(config *MqttConfig) {
+				config.ProtocolVersion = 4
+			},
+			wantErr: true,
+		},
+		{
+			name: "username and password",
+			config: func(config *MqttConfig) {
+				config.Username = "user"
+				config.Password = "password"
+			},
+		},
+		{
+			name: "username without password",
+			config: func(config *MqttConfig) {
+				config.Username = "user"
+			},
+			wantErr: true,
+		},
+		{
+			name: "v5 features",
+			config: func(config *MqttConfig) {
+				config.ProtocolVersion = 5
+				config.MessageExpiry = time.Hour
+				config.AwaitResponse = true
+			},
+		},
+		{
+			name: "message expiry with v3",
+			config: func(config *MqttConfig) {
+				config.MessageExpiry = time.Hour
+			},
+			wantErr: true,
+		},
+		{
+			name: "message expiry too short",
+			config: func(config *MqttConfig) {
+				config.ProtocolVersion = 5
+				config.MessageExpiry = time.Millisecond
+			},
+			wantErr: true,
+		},
+		{
+			name: "await response with v3",
+			config: func(config *MqttConfig) {
+				config.AwaitResponse = true
+			},
+			wantErr: true,
+		},
+		{
+			name: "broker config",
+			config: func(config *MqttConfig) {
+				config.BrokerConfigs = []MqttBrokerConfig{
+					{Url: "ssl://broker.example.com:8883", Username: "user", Password: "password", CaCertFile: file},
+				}
+			},
+		},
+		{
+			name: "broker config without client id",
+			config: func(config *MqttConfig) {
+				config.Brokers = nil
+				config.ClientId = ""
+				config.BrokerConfigs = []MqttBrokerConfig{{Url: "ssl://broker.example.com:8883"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "broker config with invalid url",
+			config: func(config *MqttConfig) {
+				config.BrokerConfigs = []MqttBrokerConfig{{Url: "broker.example.com"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "broker config with client cert but without key",
+			config: func(config *MqttConfig) {
+				config.BrokerConfigs = []MqttBrokerConfig{{Url: "ssl://broker.example.com:8883", ClientCertFile: file}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate broker",
+			config: func(config *MqttConfig) {
+				config.Brokers = append(config.Brokers, config.Brokers[0])
+			},
+			wantErr: true,
+		},
+		{
+			name: "broker configured in brokers and broker configs",
+			config: func(config *MqttConfig) {
+				config.BrokerConfigs = []MqttBrokerConfig{{Url: config.Brokers[0], Username: "user", Password: "password"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "broker config with missing CA",
+			config: func(config *MqttConfig) {
+				config.BrokerConfigs = []MqttBrokerConfig{{Url: "ssl://broker.example.com:8883", CaCertFile: file + "-missing"}}
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultMqttConfig()
+			config.Brokers = []string{"tcp://mqtt.eclipseprojects.io:1883"}
+			config.ClientId = "my-client-id"
+			tt.config(&config)
+			if err := ValidateConfig(config); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMqttConfig_String(t *testing.T) {
+	config := MqttConfig{
+		Brokers:  []string{"tcp://mqtt.eclipseprojects.io:1883"},
+		Username: "user",
+		Password: "very-secret-password",
+		BrokerConfigs: []MqttBrokerConfig{
+			{Url: "ssl://broker.example.com:8883", Username: "user", Password: "very-secret-broker-password"},
+		},
+	}
+
+	if strings.Contains(config.String(), "very-secret") {
+		t.Fatalf("secrets are not redacted: %s", config.String())
+	}
+}
+
+func TestMqttConfig_GetBrokers(t *testing.T) {
+	config := MqttConfig{
+		Brokers:    []string{"tcp://a.example.com:1883"},
+		Username:   "global",
+		Password:   "global-password",
+		CaCertFile: "/etc/dyndns/ca.pem",
+		BrokerConfigs: []MqttBrokerConfig{
+			{Url: "ssl://b.example.com:8883", Username: "b"},
+		},
+	}
+
+	want := []MqttBrokerConfig{
+		{Url: "tcp://a.example.com:1883", Username: "global", Password: "global-password", CaCertFile: "/etc/dyndns/ca.pem"},
+		{Url: "ssl://b.example.com:8883", Username: "b"},
+	}
+	if got := config.GetBrokers(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetBrokers() = %v, want %v", got, want)
+	}
+}
+
+// runTlsBroker starts a TLS listener that stands in for a broker, confirming successful handshakes by writing a byte
+func runTlsBroker(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err == nil {
+					_, _ = conn.Write([]byte{1})
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func connect(addr string, config *tls.Config) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// with TLS 1.3, the server verifies the client certificate after the client finished its handshake
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	return err
+}
+
+func TestMqttBrokerConfig_TlsConfig(t *testing.T) {
+	certs := testutil.NewCertificates(t)
+	caFile := testutil.WriteFile(t, "ca.pem", certs.CaPem)
+	certFile := testutil.WriteFile(t, "client.pem", certs.ClientPem)
+	keyFile := testutil.WriteFile(t, "client-key.pem", certs.ClientKeyPem)
+
+	tlsBroker := runTlsBroker(t, certs.ServerTlsConfig(false))
+	mtlsBroker := runTlsBroker(t, certs.ServerTlsConfig(true))
+
+	tests := []struct {
+		name    string
+		broker  string
+		config  MqttBrokerConfig
+		wantErr bool
+	}{
+		{
+			name:    "untrusted CA",
+			broker:  tlsBroker,
+			wantErr: true,
+		},
+		{
+			name:   "insecure",
+			broker: tlsBroker,
+			config: MqttBrokerConfig{TlsInsecure: true},
+		},
+		{
+			name:   "CA only",
+			broker: tlsBroker,
+			config: MqttBrokerConfig{CaCertFile: caFile},
+		},
+		{
+			name:    "mTLS without client cert",
+			broker:  mtlsBroker,
+			config:  MqttBrokerConfig{CaCertFile: caFile},
+			wantErr: true,
+		},
+		{
+			name:   "mTLS",
+			broker: mtlsBroker,
+			config: MqttBrokerConfig{CaCertFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := tt.config.TlsConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := connect(tt.broker, tlsConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("connect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMqttBrokerConfig_TlsConfig_InvalidCa(t *testing.T) {
+	config := MqttBrokerConfig{CaCertFile: testutil.WriteFile(t, "ca.pem", []byte("no certificate"))}
+	if _, err := config.TlsConfig(); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -1,14 +1,55 @@
 package conf
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 type NatsConfig struct {
-	Url string `yaml:"url" env:"URL" validate:"required_with=EventsSubject DispatchUpdatesSubject ListenUpdatesSubjects,omitempty,nats_url"`
+	Url string `yaml:"url" env:"URL" validate:"required_with=EventsSubject DispatchUpdatesSubject RequestReplySubject RecordsBucket ListenUpdatesSubjects,omitempty,nats_url"`
 
 	EventsSubject          string `yaml:"events_subject" env:"EVENTS_SUBJECT" validate:"omitempty,nats_subject"`
 	DispatchUpdatesSubject string `yaml:"dispatch_updates_subject" env:"UPDATE_REQUEST_SUBJECT" validate:"omitempty,nats_subject"`
+	// RequestReplySubject is the subject update requests are sent to using request-reply, servers reply with the
+	// outcome of processing the update request
+	RequestReplySubject string `yaml:"request_reply_subject" env:"REQUEST_REPLY_SUBJECT" validate:"omitempty,nats_subject"`
+	// RecordsBucket is the KV bucket servers write applied records to. Clients verify their records using the bucket
+	// instead of querying DNS.
+	RecordsBucket string `yaml:"records_bucket" env:"RECORDS_BUCKET"`
 
 	StreamName            string   `yaml:"stream_name" env:"STREAM_NAME" validate:"required_with=ConsumerName"`
 	ListenUpdatesSubjects []string `yaml:"listen_updates_subjects" envSeparator:"," env:"STREAM_SUBJECTS" validate:"required_with=ConsumerName,omitempty,dive,nats_subject"`
 	ConsumerName          string   `yaml:"consumer_name" env:"CONSUMER_NAME" validate:"required_with=StreamName"`
+
+	// AckWait is the duration the server has to process a message before it's redelivered
+	AckWait time.Duration `yaml:"ack_wait" env:"ACK_WAIT" validate:"omitempty,gte=1s,lte=1h"`
+	// MaxDeliver is the number of delivery attempts of a message that can not be propagated, 0 is unlimited
+	MaxDeliver int `yaml:"max_deliver" env:"MAX_DELIVER" validate:"omitempty,gte=1"`
+	// RedeliveryDelay is the delay before a message is redelivered after propagating the change failed
+	RedeliveryDelay time.Duration `yaml:"redelivery_delay" env:"REDELIVERY_DELAY" validate:"omitempty,lte=1h"`
+	// DeadLetterSubject is the optional subject messages are published to that are invalid or exceeded MaxDeliver
+	DeadLetterSubject string `yaml:"dead_letter_subject" env:"DEAD_LETTER_SUBJECT" validate:"omitempty,nats_subject"`
+
+	// CredsFile is a user JWT .creds file used for decentralized authentication
+	CredsFile string `yaml:"creds_file" env:"CREDS_FILE" validate:"omitempty,file,excluded_with=NkeySeedFile Username Token"`
+	// NkeySeedFile is a file containing the user's NKey seed
+	NkeySeedFile string `yaml:"nkey_seed_file" env:"NKEY_SEED_FILE" validate:"omitempty,file,excluded_with=Username Token"`
+	Username     string `yaml:"username" env:"USERNAME" validate:"required_with=Password,excluded_with=Token"`
+	Password     string `yaml:"password" env:"PASSWORD" validate:"required_with=Username"`
+	Token        string `yaml:"token" env:"TOKEN"`
+
+	TlsCaCertFile     string `yaml:"tls_ca_cert" env:"TLS_CA" validate:"omitempty,file"`
+	TlsClientCertFile string `yaml:"tls_client_cert" env:"TLS_CERT" validate:"required_with=TlsClientKeyFile,omitempty,file"`
+	TlsClientKeyFile  string `yaml:"tls_client_key" env:"TLS_KEY" validate:"required_with=TlsClientCertFile,omitempty,file"`
+}
+
+func DefaultNatsConfig() NatsConfig {
+	return NatsConfig{
+		AckWait:         30 * time.Second,
+		MaxDeliver:      10,
+		RedeliveryDelay: 30 * time.Second,
+	}
 }
 
 func (n *NatsConfig) SupportsCloudeventsDispatch() bool {
@@ -19,6 +60,42 @@ func (n *NatsConfig) IsConfiguredForUpdates() bool {
 	return n.DispatchUpdatesSubject != ""
 }
 
+func (n *NatsConfig) IsConfiguredForRequestReply() bool {
+	return n.RequestReplySubject != ""
+}
+
 func (n *NatsConfig) IsConfiguredAsListener() bool {
 	return n.ConsumerName != "" && n.StreamName != "" && len(n.ListenUpdatesSubjects) > 0
 }
+
+// UsesTls returns whether a CA or a client certificate has been configured, which requires a TLS connection
+func (n *NatsConfig) UsesTls() bool {
+	return len(n.TlsCaCertFile) > 0 || len(n.TlsClientCertFile) > 0
+}
+
+func (n *NatsConfig) String() string {
+	var sb strings.Builder
+
+	sb.WriteString("NatsConfig {")
+	appendIfNotEmpty(&sb, "Url", n.Url)
+	appendIfNotEmpty(&sb, "EventsSubject", n.EventsSubject)
+	appendIfNotEmpty(&sb, "DispatchUpdatesSubject", n.DispatchUpdatesSubject)
+	appendIfNotEmpty(&sb, "RequestReplySubject", n.RequestReplySubject)
+	appendIfNotEmpty(&sb, "RecordsBucket", n.RecordsBucket)
+	appendIfNotEmpty(&sb, "StreamName", n.StreamName)
+	if len(n.ListenUpdatesSubjects) > 0 {
+		sb.WriteString(fmt.Sprintf(" ListenUpdatesSubjects: %v,", n.ListenUpdatesSubjects))
+	}
+	appendIfNotEmpty(&sb, "ConsumerName", n.ConsumerName)
+	appendIfNotEmpty(&sb, "DeadLetterSubject", n.DeadLetterSubject)
+	appendIfNotEmpty(&sb, "CredsFile", n.CredsFile)
+	appendIfNotEmpty(&sb, "NkeySeedFile", n.NkeySeedFile)
+	appendIfNotEmpty(&sb, "Username", n.Username)
+	// Note: We deliberately exclude Password and Token from the output
+	appendIfNotEmpty(&sb, "TlsCaCertFile", n.TlsCaCertFile)
+	appendIfNotEmpty(&sb, "TlsClientCertFile", n.TlsClientCertFile)
+	appendIfNotEmpty(&sb, "TlsClientKeyFile", n.TlsClientKeyFile)
+	sb.WriteString(" }")
+
+	return sb.String()
+}
@@ -0,0 +1,118 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNatsConfig_Validate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  NatsConfig
+		wantErr bool
+	}{
+		{
+			name: "no auth",
+			config: NatsConfig{
+				Url: "nats://nats.nats:4222",
+			},
+		},
+		{
+			name: "creds file",
+			config: NatsConfig{
+				Url:       "tls://nats.nats:4222",
+				CredsFile: file,
+			},
+		},
+		{
+			name: "creds file missing",
+			config: NatsConfig{
+				Url:       "nats://nats.nats:4222",
+				CredsFile: filepath.Join(dir, "missing"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "creds file and token",
+			config: NatsConfig{
+				Url:       "nats://nats.nats:4222",
+				CredsFile: file,
+				Token:     "token",
+			},
+			wantErr: true,
+		},
+		{
+			name: "nkey and username",
+			config: NatsConfig{
+				Url:          "nats://nats.nats:4222",
+				NkeySeedFile: file,
+				Username:     "user",
+				Password:     "password",
+			},
+			wantErr: true,
+		},
+		{
+			name: "username without password",
+			config: NatsConfig{
+				Url:      "nats://nats.nats:4222",
+				Username: "user",
+			},
+			wantErr: true,
+		},
+		{
+			name: "username and token",
+			config: NatsConfig{
+				Url:      "nats://nats.nats:4222",
+				Username: "user",
+				Password: "password",
+				Token:    "token",
+			},
+			wantErr: true,
+		},
+		{
+			name: "mtls",
+			config: NatsConfig{
+				Url:               "tls://nats.nats:4222",
+				TlsCaCertFile:     file,
+				TlsClientCertFile: file,
+				TlsClientKeyFile:  file,
+			},
+		},
+		{
+			name: "client cert without key",
+			config: NatsConfig{
+				Url:               "tls://nats.nats:4222",
+				TlsClientCertFile: file,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateConfig(tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNatsConfig_String(t *testing.T) {
+	config := NatsConfig{
+		Url:      "nats://nats.nats:4222",
+		Username: "user",
+		Password: "very-secret-password",
+		Token:    "very-secret-token",
+	}
+
+	if strings.Contains(config.String(), "very-secret") {
+		t.Fatalf("secrets are not redacted: %s", config.String())
+	}
+}
@@ -0,0 +1,40 @@
+package conf
+
+import "time"
+
+const (
+	DeliveryPolicyAny    = "any"
+	DeliveryPolicyAll    = "all"
+	DeliveryPolicyQuorum = "quorum"
+)
+
+// OutboxConfig configures how update requests are delivered by the client's dispatchers
+type OutboxConfig struct {
+	// Policy defines when an update request is delivered: 'any' requires a single dispatcher to succeed, 'all'
+	// requires all dispatchers to succeed and 'quorum' requires Quorum dispatchers to succeed.
+	Policy string `yaml:"policy" env:"POLICY" validate:"oneof=any all quorum"`
+	// Quorum is the number of dispatchers that need to succeed for the 'quorum' policy. Defaults to the majority of
+	// the dispatchers if not set.
+	Quorum int `yaml:"quorum,omitempty" env:"QUORUM" validate:"gte=0"`
+	// MaxAge is the maximum age of an update request, after which it's dropped. The server rejects requests that are
+	// older than 24h.
+	MaxAge time.Duration `yaml:"max_age" env:"MAX_AGE" validate:"gte=1m,lte=24h"`
+	// DispatchTimeout is the maximum duration of a single delivery attempt of a dispatcher
+	DispatchTimeout time.Duration `yaml:"dispatch_timeout" env:"DISPATCH_TIMEOUT" validate:"gte=1s,lte=5m"`
+	// RetryBackoff configures the delay between delivery attempts of a single dispatcher
+	RetryBackoff BackoffConfig `yaml:"retry_backoff" envPrefix:"RETRY_BACKOFF_"`
+}
+
+func DefaultOutboxConfig() OutboxConfig {
+	return OutboxConfig{
+		Policy:          DeliveryPolicyAny,
+		MaxAge:          12 * time.Hour,
+		DispatchTimeout: 30 * time.Second,
+		RetryBackoff: BackoffConfig{
+			Initial:    30 * time.Second,
+			Max:        15 * time.Minute,
+			Multiplier: 2,
+			Jitter:     0.2,
+		},
+	}
+}
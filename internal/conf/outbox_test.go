@@ -0,0 +1,42 @@
+package conf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(conf *OutboxConfig)
+		wantErr bool
+	}{
+		{
+			name:   "default",
+			mutate: func(conf *OutboxConfig) {},
+		},
+		{
+			name:   "quorum",
+			mutate: func(conf *OutboxConfig) { conf.Policy = DeliveryPolicyQuorum; conf.Quorum = 2 },
+		},
+		{
+			name:    "unknown policy",
+			mutate:  func(conf *OutboxConfig) { conf.Policy = "most" },
+			wantErr: true,
+		},
+		{
+			name:    "max age exceeds server grace period",
+			mutate:  func(conf *OutboxConfig) { conf.MaxAge = 48 * time.Hour },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := DefaultOutboxConfig()
+			tt.mutate(&conf)
+			if err := ValidateConfig(conf); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
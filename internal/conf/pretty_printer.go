@@ -8,7 +8,7 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-var SensitiveFields = []string{"KeyPair", "SmtpPassword"}
+var SensitiveFields = []string{"KeyPair", "SmtpPassword", "ApiToken"}
 
 func PrintFields(data any, ignoredKeys ...string) {
 	v := reflect.ValueOf(data)
@@ -0,0 +1,25 @@
+package conf
+
+const (
+	ResolverTypeHttp      = "http"
+	ResolverTypeInterface = "interface"
+	ResolverTypeNatPmp    = "natpmp"
+	ResolverTypeDns       = "dns"
+)
+
+// ResolverConfig configures a single resolver of the resolver chain. Resolvers are tried in the order they are
+// configured, for each address family the first resolver that returns a public address wins.
+type ResolverConfig struct {
+	Type         string   `yaml:"type" json:"type" validate:"required,oneof=http interface natpmp dns"`
+	AddrFamilies []string `yaml:"address_families,omitempty" json:"address_families,omitempty" validate:"omitempty,addrfamilies"`
+
+	// Interface is the network interface to read the address from, only used for type 'interface'
+	Interface string `yaml:"interface,omitempty" json:"interface,omitempty" validate:"required_if=Type interface"`
+
+	// Gateway is the address of the NAT-PMP gateway, only used for type 'natpmp'
+	Gateway string `yaml:"gateway,omitempty" json:"gateway,omitempty" validate:"required_if=Type natpmp,omitempty,hostname_port|ip"`
+
+	// QueryName and Nameservers are only used for type 'dns'
+	QueryName   string   `yaml:"query_name,omitempty" json:"query_name,omitempty" validate:"omitempty,fqdn"`
+	Nameservers []string `yaml:"nameservers,omitempty" json:"nameservers,omitempty" validate:"omitempty,dive,hostname_port"`
+}
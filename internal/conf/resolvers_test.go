@@ -0,0 +1,64 @@
+package conf
+
+import "testing"
+
+func TestResolverConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ResolverConfig
+		wantErr bool
+	}{
+		{
+			name:   "http",
+			config: ResolverConfig{Type: ResolverTypeHttp, AddrFamilies: []string{AddrFamilyIpv4}},
+		},
+		{
+			name:   "interface",
+			config: ResolverConfig{Type: ResolverTypeInterface, Interface: "eth0", AddrFamilies: []string{AddrFamilyIpv6}},
+		},
+		{
+			name:    "interface without name",
+			config:  ResolverConfig{Type: ResolverTypeInterface},
+			wantErr: true,
+		},
+		{
+			name:   "natpmp",
+			config: ResolverConfig{Type: ResolverTypeNatPmp, Gateway: "192.168.1.1"},
+		},
+		{
+			name:   "natpmp with port",
+			config: ResolverConfig{Type: ResolverTypeNatPmp, Gateway: "192.168.1.1:5351"},
+		},
+		{
+			name:    "natpmp without gateway",
+			config:  ResolverConfig{Type: ResolverTypeNatPmp},
+			wantErr: true,
+		},
+		{
+			name:   "dns",
+			config: ResolverConfig{Type: ResolverTypeDns, QueryName: "myip.opendns.com", Nameservers: []string{"208.67.222.222:53"}},
+		},
+		{
+			name:    "dns invalid nameserver",
+			config:  ResolverConfig{Type: ResolverTypeDns, Nameservers: []string{"208.67.222.222"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown type",
+			config:  ResolverConfig{Type: "upnp"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid address family",
+			config:  ResolverConfig{Type: ResolverTypeHttp, AddrFamilies: []string{"ip5"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateConfig(tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -17,9 +17,11 @@ import (
 )
 
 type ServerConf struct {
-	KnownHosts      map[string][]string `yaml:"known_hosts" env:"KNOWN_HOSTS" validate:"required"`
-	HostedZoneId    string              `yaml:"hosted_zone_id" env:"HOSTED_ZONE_ID" validate:"required"`
-	MetricsListener string              `yaml:"metrics_listen,omitempty" validate:"omitempty,tcp_addr"`
+	KnownHosts      map[string][]string   `yaml:"known_hosts" env:"KNOWN_HOSTS" validate:"required"`
+	HostedZoneId    string                `yaml:"hosted_zone_id" env:"HOSTED_ZONE_ID" validate:"required"`
+	MetricsListener string                `yaml:"metrics_listen,omitempty" validate:"omitempty,tcp_addr"`
+	DnsVerification DnsVerificationConfig `yaml:"dns_verification" envPrefix:"DNS_VERIFICATION_"`
+	Dedup           DedupConfig           `yaml:"dedup" envPrefix:"DEDUP_"`
 	SqsConfig       `yaml:"sqs"`
 	HttpConfig      `yaml:"http"`
 	MqttConfig      `yaml:"mqtt"`
@@ -29,13 +31,17 @@ type ServerConf struct {
 }
 
 func GetDefaultServerConfig() *ServerConf {
+	mqttConfig := DefaultMqttConfig()
+	mqttConfig.ClientId = "dyndns-server"
+
 	return &ServerConf{
 		MetricsListener: metrics.DefaultListener,
 		SqsConfig:       DefaultSqsConfig(),
-		MqttConfig: MqttConfig{
-			ClientId: "dyndns-server",
-		},
-		VaultConfig: GetDefaultVaultConfig(),
+		MqttConfig:      mqttConfig,
+		VaultConfig:     GetDefaultVaultConfig(),
+		DnsVerification: DefaultDnsVerificationConfig(),
+		Dedup:           DefaultDedupConfig(),
+		NatsConfig:      DefaultNatsConfig(),
 	}
 }
 
@@ -65,6 +71,8 @@ func ParseEnvVariables(serverConf *ServerConf) error {
 		return ret, json.Unmarshal([]byte(input), &ret)
 	}
 
+	funk[reflect.TypeOf([]MqttBrokerConfig{})] = parseMqttBrokerConfigs
+
 	opts := env.Options{
 		Prefix: "DYNDNS_",
 	}
@@ -26,9 +26,15 @@ func TestReadServerConfig(t *testing.T) {
 				SqsConfig:       DefaultSqsConfig(),
 				HostedZoneId:    "hosted-zone-id-x",
 				MetricsListener: ":6666",
+				DnsVerification: DefaultDnsVerificationConfig(),
+				Dedup:           DefaultDedupConfig(),
+				NatsConfig:      DefaultNatsConfig(),
 				MqttConfig: MqttConfig{
-					Brokers:  []string{"tcp://mqtt.eclipseprojects.io:1883"},
-					ClientId: "my-client-id",
+					Brokers:         []string{"tcp://mqtt.eclipseprojects.io:1883"},
+					ClientId:        "my-client-id",
+					Qos:             1,
+					Retain:          true,
+					ProtocolVersion: 3,
 				},
 				EmailConfig: EmailConfig{
 					From:         "from",
@@ -51,9 +57,15 @@ func TestReadServerConfig(t *testing.T) {
 				SqsConfig:       DefaultSqsConfig(),
 				HostedZoneId:    "hosted-zone-id-x",
 				MetricsListener: ":6666",
+				DnsVerification: DefaultDnsVerificationConfig(),
+				Dedup:           DefaultDedupConfig(),
+				NatsConfig:      DefaultNatsConfig(),
 				MqttConfig: MqttConfig{
-					Brokers:  []string{"tcp://mqtt.eclipseprojects.io:1883"},
-					ClientId: "my-client-id",
+					Brokers:         []string{"tcp://mqtt.eclipseprojects.io:1883"},
+					ClientId:        "my-client-id",
+					Qos:             1,
+					Retain:          true,
+					ProtocolVersion: 3,
 				},
 				EmailConfig: EmailConfig{
 					From:         "from",
@@ -103,6 +115,35 @@ func TestServerConf_ParseEnvVariables_KnownHosts(t *testing.T) {
 	}
 }
 
+func TestServerConf_ParseEnvVariables_Mqtt(t *testing.T) {
+	t.Setenv("DYNDNS_PROTOCOL_VERSION", "5")
+	t.Setenv("DYNDNS_USERNAME", "dyndns")
+	t.Setenv("DYNDNS_BROKER_CONFIGS", `[{"url": "ssl://mqtt.example.com:8883", "username": "broker", "password": "secret", "tls_ca_cert": "/etc/dyndns/ca.pem"}]`)
+
+	empty := &ServerConf{}
+	err := ParseEnvVariables(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := MqttConfig{
+		ProtocolVersion: 5,
+		Username:        "dyndns",
+		BrokerConfigs: []MqttBrokerConfig{
+			{
+				Url:        "ssl://mqtt.example.com:8883",
+				Username:   "broker",
+				Password:   "secret",
+				CaCertFile: "/etc/dyndns/ca.pem",
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(empty.MqttConfig, expected) {
+		t.Fatalf("expected %v, got %v", expected, empty.MqttConfig)
+	}
+}
+
 func TestServerConf_ParseEnvVariables_AuthStrategy(t *testing.T) {
 	envKey := "DYNDNS_VAULT_AUTH_STRATEGY"
 	os.Setenv(envKey, "approle")
@@ -3,6 +3,8 @@ package conf
 type SqsConfig struct {
 	SqsQueue string `yaml:"sqs_queue" env:"QUEUE"`
 	Region   string `yaml:"region" env:"REGION"`
+	// Endpoint overrides the SQS endpoint, e.g. to use a local SQS-compatible service such as ElasticMQ
+	Endpoint string `yaml:"endpoint,omitempty" env:"ENDPOINT" validate:"omitempty,url"`
 }
 
 func DefaultSqsConfig() SqsConfig {
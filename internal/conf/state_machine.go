@@ -0,0 +1,45 @@
+package conf
+
+import "time"
+
+// StateMachineConfig configures the timings of the client's state machine
+type StateMachineConfig struct {
+	// InitialInterval is the wait interval after the client has been started
+	InitialInterval time.Duration `yaml:"initial_interval" env:"INITIAL_INTERVAL" validate:"gte=10s,lte=1h"`
+	// ConfirmedInterval is the wait interval after the DNS record has been verified to contain the resolved IPs
+	ConfirmedInterval time.Duration `yaml:"confirmed_interval" env:"CONFIRMED_INTERVAL" validate:"gte=10s,lte=1h"`
+	// NotConfirmedInterval is the wait interval between verifications after an update request has been sent
+	NotConfirmedInterval time.Duration `yaml:"not_confirmed_interval" env:"NOT_CONFIRMED_INTERVAL" validate:"gte=10s,lte=1h"`
+	// UnconfirmableInterval is the wait interval after the DNS record could not be verified for MaxUnconfirmedDuration
+	UnconfirmableInterval time.Duration `yaml:"unconfirmable_interval" env:"UNCONFIRMABLE_INTERVAL" validate:"gte=10s,lte=24h"`
+	// MaxUnconfirmedDuration is the maximum duration to wait for the DNS record to be verified before giving up
+	// re-sending update requests. A value of 0 disables this limit.
+	MaxUnconfirmedDuration time.Duration `yaml:"max_unconfirmed_duration" env:"MAX_UNCONFIRMED_DURATION" validate:"gte=0"`
+	// ResendBackoff configures the delay between re-sending update requests while the DNS record is not verified
+	ResendBackoff BackoffConfig `yaml:"resend_backoff" envPrefix:"RESEND_BACKOFF_"`
+}
+
+// BackoffConfig configures an exponential backoff with jitter
+type BackoffConfig struct {
+	Initial    time.Duration `yaml:"initial" env:"INITIAL" validate:"gt=0"`
+	Max        time.Duration `yaml:"max" env:"MAX" validate:"gtefield=Initial"`
+	Multiplier float64       `yaml:"multiplier" env:"MULTIPLIER" validate:"gte=1"`
+	// Jitter is the fraction of the delay that is randomly added or subtracted, e.g. 0.2 for +/- 20%
+	Jitter float64 `yaml:"jitter" env:"JITTER" validate:"gte=0,lte=1"`
+}
+
+func DefaultStateMachineConfig() StateMachineConfig {
+	return StateMachineConfig{
+		InitialInterval:        45 * time.Second,
+		ConfirmedInterval:      45 * time.Second,
+		NotConfirmedInterval:   30 * time.Second,
+		UnconfirmableInterval:  5 * time.Minute,
+		MaxUnconfirmedDuration: 6 * time.Hour,
+		ResendBackoff: BackoffConfig{
+			Initial:    5 * time.Minute,
+			Max:        1 * time.Hour,
+			Multiplier: 2,
+			Jitter:     0.2,
+		},
+	}
+}
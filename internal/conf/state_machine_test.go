@@ -0,0 +1,78 @@
+package conf
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestStateMachineConfig_UnmarshalYAML(t *testing.T) {
+	input := `
+not_confirmed_interval: 1m
+max_unconfirmed_duration: 2h
+resend_backoff:
+  initial: 30s
+  multiplier: 1.5
+`
+	got := DefaultStateMachineConfig()
+	if err := yaml.Unmarshal([]byte(input), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := DefaultStateMachineConfig()
+	expected.NotConfirmedInterval = time.Minute
+	expected.MaxUnconfirmedDuration = 2 * time.Hour
+	expected.ResendBackoff.Initial = 30 * time.Second
+	expected.ResendBackoff.Multiplier = 1.5
+
+	if got != expected {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestStateMachineConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(conf *StateMachineConfig)
+		wantErr bool
+	}{
+		{
+			name:   "default",
+			mutate: func(conf *StateMachineConfig) {},
+		},
+		{
+			name:   "no max unconfirmed duration",
+			mutate: func(conf *StateMachineConfig) { conf.MaxUnconfirmedDuration = 0 },
+		},
+		{
+			name:    "interval too short",
+			mutate:  func(conf *StateMachineConfig) { conf.NotConfirmedInterval = time.Second },
+			wantErr: true,
+		},
+		{
+			name:    "max backoff smaller than initial",
+			mutate:  func(conf *StateMachineConfig) { conf.ResendBackoff.Max = time.Second },
+			wantErr: true,
+		},
+		{
+			name:    "multiplier too small",
+			mutate:  func(conf *StateMachineConfig) { conf.ResendBackoff.Multiplier = 0.5 },
+			wantErr: true,
+		},
+		{
+			name:    "jitter too big",
+			mutate:  func(conf *StateMachineConfig) { conf.ResendBackoff.Jitter = 1.5 },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := DefaultStateMachineConfig()
+			tt.mutate(&conf)
+			if err := ValidateConfig(conf); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
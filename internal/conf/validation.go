@@ -30,6 +30,9 @@ func ValidateConfig[T any](c T) error {
 		if err := validate.RegisterValidation("broker", validateBrokers); err != nil {
 			log.Fatal().Err(err).Msg("could not build custom validation 'validateBrokers'")
 		}
+		if err := validate.RegisterValidation("mqtt_url", validateMqttUrl); err != nil {
+			log.Fatal().Err(err).Msg("could not build custom validation 'mqtt_url'")
+		}
 		if err := validate.RegisterValidation("nats_url", validateNatsUrl); err != nil {
 			log.Fatal().Err(err).Msg("could not build custom validation 'nats_url'")
 		}
@@ -38,6 +41,7 @@ func ValidateConfig[T any](c T) error {
 		}
 
 		validate.RegisterStructValidation(EmailConfigStructLevelValidation, EmailConfig{})
+		validate.RegisterStructValidation(MqttConfigStructLevelValidation, MqttConfig{})
 	})
 
 	return validate.Struct(c)
@@ -87,6 +91,15 @@ func validateBrokers(fl validator.FieldLevel) bool {
 	return true
 }
 
+func validateMqttUrl(fl validator.FieldLevel) bool {
+	field := fl.Field()
+	if field.Kind() != reflect.String {
+		return false
+	}
+
+	return IsValidMqttUrl(field.String())
+}
+
 func IsValidMqttUrl(input string) bool {
 	_, err := url.ParseRequestURI(input)
 	if err != nil {
@@ -124,7 +137,7 @@ func IsValidNatsUrl(input string) bool {
 	}
 
 	u, err := url.Parse(input)
-	if err != nil || u.Scheme != "nats" || u.Host == "" {
+	if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
 		return false
 	}
 
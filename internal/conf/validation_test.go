@@ -18,6 +18,13 @@ func TestIsValidNatsUrl(t *testing.T) {
 			},
 			want: true,
 		},
+		{
+			name: "tls url",
+			args: args{
+				input: "tls://nats.nats:4222",
+			},
+			want: true,
+		},
 		{
 			name: "wrong protocol",
 			args: args{
@@ -2,6 +2,7 @@ package conf
 
 import (
 	"os"
+	"strings"
 )
 
 type VaultAuthStrategy string
@@ -37,3 +38,18 @@ func GetDefaultVaultConfig() VaultConfig {
 func (c *VaultConfig) UseVaultCredentialsProvider() bool {
 	return len(c.AuthStrategy) > 0
 }
+
+func (c *VaultConfig) String() string {
+	var sb strings.Builder
+
+	sb.WriteString("VaultConfig {")
+	appendIfNotEmpty(&sb, "VaultAddr", c.VaultAddr)
+	appendIfNotEmpty(&sb, "AuthStrategy", string(c.AuthStrategy))
+	appendIfNotEmpty(&sb, "AwsRoleName", c.AwsRoleName)
+	appendIfNotEmpty(&sb, "AwsMountPath", c.AwsMountPath)
+	appendIfNotEmpty(&sb, "AppRoleId", c.AppRoleId)
+	// Note: We deliberately exclude AppRoleSecretId and VaultToken from the output
+	sb.WriteString(" }")
+
+	return sb.String()
+}
@@ -2,7 +2,6 @@ package http
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -22,6 +21,7 @@ type HttpServer struct {
 	// optional
 	certFile string
 	keyFile  string
+	leader   common.Leader
 }
 
 type WebhookOpts func(*HttpServer) error
@@ -32,7 +32,8 @@ func New(address string, requestsChan chan common.UpdateRecordRequest, opts ...W
 	}
 
 	w := &HttpServer{
-		address: address,
+		address:  address,
+		requests: requestsChan,
 	}
 
 	var errs error
@@ -60,8 +61,13 @@ func (s *HttpServer) handle(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	payload := common.UpdateRecordRequest{}
-	if err := json.Unmarshal(data, &payload); err != nil {
+	payload, err := common.DecodeUpdateRecordRequest(data)
+	if err != nil {
+		return
+	}
+
+	if s.leader != nil && !s.leader.IsLeader() {
+		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
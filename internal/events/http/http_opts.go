@@ -2,6 +2,8 @@ package http
 
 import (
 	"errors"
+
+	"github.com/soerenschneider/dyndns/internal/common"
 )
 
 func WithTLS(certFile, keyFile string) func(s *HttpServer) error {
@@ -19,3 +21,16 @@ func WithTLS(certFile, keyFile string) func(s *HttpServer) error {
 		return nil
 	}
 }
+
+// WithLeader only accepts update requests while this server holds the leader lease. Followers respond with 503, so
+// the client retries instead of the update request being dropped.
+func WithLeader(leader common.Leader) func(s *HttpServer) error {
+	return func(s *HttpServer) error {
+		if leader == nil {
+			return errors.New("nil leader supplied")
+		}
+
+		s.leader = leader
+		return nil
+	}
+}
@@ -0,0 +1,76 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/common"
+)
+
+type fakeLeader struct {
+	leader bool
+}
+
+func (l *fakeLeader) IsLeader() bool {
+	return l.leader
+}
+
+func TestHttpServer_handle(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []WebhookOpts
+		wantStatus int
+		wantPassed bool
+	}{
+		{
+			name:       "no leader lease",
+			wantStatus: http.StatusOK,
+			wantPassed: true,
+		},
+		{
+			name:       "leader",
+			opts:       []WebhookOpts{WithLeader(&fakeLeader{leader: true})},
+			wantStatus: http.StatusOK,
+			wantPassed: true,
+		},
+		{
+			name:       "follower",
+			opts:       []WebhookOpts{WithLeader(&fakeLeader{})},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan common.UpdateRecordRequest, 1)
+			server, err := New("127.0.0.1:0", requests, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			payload, err := json.Marshal(common.UpdateRecordRequest{
+				PublicIp: common.DnsRecord{
+					IpV4:      "198.51.100.1",
+					Host:      "home.example.com",
+					Timestamp: time.Now(),
+				},
+				Signature: "signature",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			server.handle(recorder, httptest.NewRequest(http.MethodPost, "/update", bytes.NewReader(payload)))
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, recorder.Code)
+			}
+			if passed := len(requests) == 1; passed != tt.wantPassed {
+				t.Fatalf("expected update request passed = %v, got %v", tt.wantPassed, passed)
+			}
+		})
+	}
+}
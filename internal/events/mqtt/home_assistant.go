@@ -0,0 +1,307 @@
+//go:build client
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal"
+	"github.com/soerenschneider/dyndns/internal/client"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/util"
+)
+
+const (
+	// homeAssistantStateTopicTemplate is the topic the status of a host is published to, formatted using the host
+	homeAssistantStateTopicTemplate = "dyndns/status/%s"
+	// homeAssistantAvailabilityTopicTemplate is the topic the availability of the client is published to, formatted
+	// using the client id
+	homeAssistantAvailabilityTopicTemplate = "dyndns/availability/%s"
+
+	HomeAssistantPayloadOnline  = "online"
+	HomeAssistantPayloadOffline = "offline"
+)
+
+// homeAssistantRetryBackoff is the backoff failed publishes are retried with, unless a status change or a reconnect
+// triggers publishing earlier
+var homeAssistantRetryBackoff = conf.BackoffConfig{
+	Initial:    5 * time.Second,
+	Max:        5 * time.Minute,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+var invalidNodeIdChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// HomeAssistantBus is an MQTT client that the status of the client's hosts can be published with
+type HomeAssistantBus interface {
+	publish(ctx context.Context, topic string, retain bool, payload []byte) error
+	addOnConnect(callback func())
+}
+
+// HomeAssistant publishes the status of the client's hosts using Home Assistant's MQTT discovery. It implements
+// client.StatusListener, status changes are published in the background by Run.
+type HomeAssistant struct {
+	bus             HomeAssistantBus
+	clientId        string
+	discoveryPrefix string
+	retryBackoff    conf.BackoffConfig
+
+	mutex               sync.Mutex
+	statuses            map[string]client.HostStatus
+	pending             map[string]bool
+	discovered          map[string]bool
+	availabilityPending bool
+	wakeup              chan struct{}
+}
+
+type homeAssistantState struct {
+	IpV4            string    `json:"ipv4"`
+	IpV6            string    `json:"ipv6"`
+	State           string    `json:"state"`
+	LastStateChange time.Time `json:"last_state_change"`
+	Paused          bool      `json:"paused"`
+}
+
+type homeAssistantDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	SwVersion    string   `json:"sw_version,omitempty"`
+}
+
+type homeAssistantDiscovery struct {
+	Name              string              `json:"name"`
+	UniqueId          string              `json:"unique_id"`
+	StateTopic        string              `json:"state_topic"`
+	ValueTemplate     string              `json:"value_template"`
+	DeviceClass       string              `json:"device_class,omitempty"`
+	Icon              string              `json:"icon,omitempty"`
+	AvailabilityTopic string              `json:"availability_topic"`
+	Device            homeAssistantDevice `json:"device"`
+}
+
+type homeAssistantSensor struct {
+	object      string
+	name        string
+	deviceClass string
+	icon        string
+}
+
+var homeAssistantSensors = []homeAssistantSensor{
+	{object: "ipv4", name: "Public IPv4", icon: "mdi:ip-network"},
+	{object: "ipv6", name: "Public IPv6", icon: "mdi:ip-network"},
+	{object: "state", name: "State", icon: "mdi:state-machine"},
+	{object: "last_state_change", name: "Last state change", deviceClass: "timestamp"},
+}
+
+// HomeAssistantAvailabilityTopic returns the topic the availability of the client is published to, it should be used
+// as the topic of the client's will
+func HomeAssistantAvailabilityTopic(clientId string) string {
+	return fmt.Sprintf(homeAssistantAvailabilityTopicTemplate, clientId)
+}
+
+func NewHomeAssistant(bus HomeAssistantBus, clientId string, discoveryPrefix string) (*HomeAssistant, error) {
+	if bus == nil {
+		return nil, errors.New("nil bus provided")
+	}
+	if len(clientId) == 0 {
+		return nil, errors.New("empty client id provided")
+	}
+	if len(discoveryPrefix) == 0 {
+		return nil, errors.New("empty discovery prefix provided")
+	}
+
+	h := &HomeAssistant{
+		bus:             bus,
+		clientId:        clientId,
+		discoveryPrefix: discoveryPrefix,
+		retryBackoff:    homeAssistantRetryBackoff,
+		statuses:        map[string]client.HostStatus{},
+		pending:         map[string]bool{},
+		discovered:      map[string]bool{},
+		wakeup:          make(chan struct{}, 1),
+	}
+	bus.addOnConnect(h.onConnect)
+	return h, nil
+}
+
+// onConnect republishes everything, the broker may have lost retained messages and the will may have been published
+func (h *HomeAssistant) onConnect() {
+	h.mutex.Lock()
+	h.availabilityPending = true
+	h.discovered = map[string]bool{}
+	for host := range h.statuses {
+		h.pending[host] = true
+	}
+	h.mutex.Unlock()
+	h.wake()
+}
+
+func (h *HomeAssistant) StatusChanged(status client.HostStatus) {
+	h.mutex.Lock()
+	h.statuses[status.Host] = status
+	h.pending[status.Host] = true
+	h.mutex.Unlock()
+	h.wake()
+}
+
+func (h *HomeAssistant) wake() {
+	select {
+	case h.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Run publishes status changes until the context is cancelled, the client is marked as offline afterwards. Failed
+// publishes are retried with a backoff.
+func (h *HomeAssistant) Run(ctx context.Context) {
+	var retry *time.Timer
+	failedAttempts := 0
+	defer func() {
+		if retry != nil {
+			retry.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-h.wakeup:
+			if retry != nil {
+				retry.Stop()
+				retry = nil
+			}
+			if h.publishPending(ctx) {
+				failedAttempts = 0
+				continue
+			}
+			failedAttempts++
+			delay := util.BackoffDelay(h.retryBackoff, failedAttempts)
+			log.Debug().Str("component", "home-assistant").Dur("delay", delay).Msg("Retrying to publish pending messages")
+			retry = time.AfterFunc(delay, h.wake)
+		case <-ctx.Done():
+			offlineCtx, cancel := context.WithTimeout(context.Background(), publishWaitTimeout)
+			defer cancel()
+			if err := h.bus.publish(offlineCtx, HomeAssistantAvailabilityTopic(h.clientId), true, []byte(HomeAssistantPayloadOffline)); err != nil {
+				log.Warn().Err(err).Str("component", "home-assistant").Msg("Could not publish availability")
+			}
+			return
+		}
+	}
+}
+
+// publishPending publishes the availability and all pending statuses, it returns false if any of them could not be
+// published and has been marked as pending again
+func (h *HomeAssistant) publishPending(ctx context.Context) bool {
+	h.mutex.Lock()
+	availabilityPending := h.availabilityPending
+	h.availabilityPending = false
+	var pending []client.HostStatus
+	for host := range h.pending {
+		pending = append(pending, h.statuses[host])
+	}
+	h.pending = map[string]bool{}
+	h.mutex.Unlock()
+
+	ok := true
+	if availabilityPending {
+		if err := h.publish(ctx, HomeAssistantAvailabilityTopic(h.clientId), []byte(HomeAssistantPayloadOnline)); err != nil {
+			log.Warn().Err(err).Str("component", "home-assistant").Msg("Could not publish availability")
+			h.mutex.Lock()
+			h.availabilityPending = true
+			h.mutex.Unlock()
+			ok = false
+		}
+	}
+
+	for _, status := range pending {
+		if err := h.publishStatus(ctx, status); err != nil {
+			log.Warn().Err(err).Str("component", "home-assistant").Str("host", status.Host).Msg("Could not publish status")
+			h.mutex.Lock()
+			h.pending[status.Host] = true
+			h.mutex.Unlock()
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+func (h *HomeAssistant) publishStatus(ctx context.Context, status client.HostStatus) error {
+	h.mutex.Lock()
+	discovered := h.discovered[status.Host]
+	h.mutex.Unlock()
+
+	if !discovered {
+		if err := h.publishDiscovery(ctx, status.Host); err != nil {
+			return err
+		}
+		h.mutex.Lock()
+		h.discovered[status.Host] = true
+		h.mutex.Unlock()
+	}
+
+	state := homeAssistantState{
+		State:           status.State,
+		LastStateChange: status.LastStateChange,
+		Paused:          status.Paused,
+	}
+	if status.LastResolved != nil {
+		state.IpV4 = status.LastResolved.IpV4
+		state.IpV6 = status.LastResolved.IpV6
+	}
+
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("could not marshal state: %w", err)
+	}
+	return h.publish(ctx, fmt.Sprintf(homeAssistantStateTopicTemplate, status.Host), payload)
+}
+
+func (h *HomeAssistant) publishDiscovery(ctx context.Context, host string) error {
+	nodeId := "dyndns_" + invalidNodeIdChars.ReplaceAllString(host, "_")
+	device := homeAssistantDevice{
+		Identifiers:  []string{nodeId},
+		Name:         "dyndns " + host,
+		Manufacturer: "dyndns",
+		SwVersion:    internal.BuildVersion,
+	}
+
+	for _, sensor := range homeAssistantSensors {
+		config := homeAssistantDiscovery{
+			Name:              sensor.name,
+			UniqueId:          nodeId + "_" + sensor.object,
+			StateTopic:        fmt.Sprintf(homeAssistantStateTopicTemplate, host),
+			ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", sensor.object),
+			DeviceClass:       sensor.deviceClass,
+			Icon:              sensor.icon,
+			AvailabilityTopic: HomeAssistantAvailabilityTopic(h.clientId),
+			Device:            device,
+		}
+
+		payload, err := json.Marshal(config)
+		if err != nil {
+			return fmt.Errorf("could not marshal discovery config: %w", err)
+		}
+		topic := fmt.Sprintf("%s/sensor/%s/%s/config", h.discoveryPrefix, nodeId, sensor.object)
+		if err := h.publish(ctx, topic, payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publish publishes a retained message, so Home Assistant receives it after restarting
+func (h *HomeAssistant) publish(ctx context.Context, topic string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, publishWaitTimeout)
+	defer cancel()
+	return h.bus.publish(ctx, topic, true, payload)
+}
@@ -0,0 +1,200 @@
+//go:build client
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal"
+	"github.com/soerenschneider/dyndns/internal/client"
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+type fakeHomeAssistantBus struct {
+	mutex     sync.Mutex
+	messages  map[string][]byte
+	published chan string
+	failing   bool
+	onConnect func()
+}
+
+func newFakeHomeAssistantBus() *fakeHomeAssistantBus {
+	return &fakeHomeAssistantBus{
+		messages:  map[string][]byte{},
+		published: make(chan string, 100),
+	}
+}
+
+func (b *fakeHomeAssistantBus) publish(_ context.Context, topic string, retain bool, payload []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.failing {
+		return errors.New("not connected")
+	}
+	if !retain {
+		return errors.New("expected retained message")
+	}
+	b.messages[topic] = payload
+	b.published <- topic
+	return nil
+}
+
+func (b *fakeHomeAssistantBus) addOnConnect(callback func()) {
+	b.onConnect = callback
+}
+
+func (b *fakeHomeAssistantBus) setFailing(failing bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failing = failing
+}
+
+func (b *fakeHomeAssistantBus) message(t *testing.T, topic string) []byte {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		b.mutex.Lock()
+		payload, ok := b.messages[topic]
+		b.mutex.Unlock()
+		if ok {
+			return payload
+		}
+
+		select {
+		case <-b.published:
+		case <-timeout:
+			t.Fatalf("no message published to %s", topic)
+		}
+	}
+}
+
+func TestHomeAssistant(t *testing.T) {
+	bus := newFakeHomeAssistantBus()
+	ha, err := NewHomeAssistant(bus, "router", "homeassistant")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ha.Run(ctx)
+		close(done)
+	}()
+
+	bus.onConnect()
+	lastStateChange := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ha.StatusChanged(client.HostStatus{
+		Host:            "home.example.com",
+		State:           "ipConfirmedState",
+		LastStateChange: lastStateChange,
+		LastResolved:    &common.DnsRecord{Host: "home.example.com", IpV4: "198.51.100.1", IpV6: "2001:db8::1"},
+	})
+
+	if got := string(bus.message(t, "dyndns/availability/router")); got != HomeAssistantPayloadOnline {
+		t.Fatalf("expected availability %q, got %q", HomeAssistantPayloadOnline, got)
+	}
+
+	var discovery homeAssistantDiscovery
+	if err := json.Unmarshal(bus.message(t, "homeassistant/sensor/dyndns_home_example_com/last_state_change/config"), &discovery); err != nil {
+		t.Fatal(err)
+	}
+	wantDiscovery := homeAssistantDiscovery{
+		Name:              "Last state change",
+		UniqueId:          "dyndns_home_example_com_last_state_change",
+		StateTopic:        "dyndns/status/home.example.com",
+		ValueTemplate:     "{{ value_json.last_state_change }}",
+		DeviceClass:       "timestamp",
+		AvailabilityTopic: "dyndns/availability/router",
+		Device: homeAssistantDevice{
+			Identifiers:  []string{"dyndns_home_example_com"},
+			Name:         "dyndns home.example.com",
+			Manufacturer: "dyndns",
+			SwVersion:    internal.BuildVersion,
+		},
+	}
+	if !reflect.DeepEqual(discovery, wantDiscovery) {
+		t.Fatalf("expected discovery config %v, got %v", wantDiscovery, discovery)
+	}
+
+	var state homeAssistantState
+	if err := json.Unmarshal(bus.message(t, "dyndns/status/home.example.com"), &state); err != nil {
+		t.Fatal(err)
+	}
+	wantState := homeAssistantState{IpV4: "198.51.100.1", IpV6: "2001:db8::1", State: "ipConfirmedState", LastStateChange: lastStateChange}
+	if state != wantState {
+		t.Fatalf("expected state %v, got %v", wantState, state)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("home assistant publisher did not stop after context has been cancelled")
+	}
+	if got := string(bus.message(t, "dyndns/availability/router")); got != HomeAssistantPayloadOffline {
+		t.Fatalf("expected availability %q, got %q", HomeAssistantPayloadOffline, got)
+	}
+}
+
+func TestHomeAssistant_RepublishesAfterReconnect(t *testing.T) {
+	bus := newFakeHomeAssistantBus()
+	bus.setFailing(true)
+	ha, err := NewHomeAssistant(bus, "router", "homeassistant")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ha.Run(ctx)
+
+	ha.StatusChanged(client.HostStatus{Host: "home.example.com", State: "ipNotConfirmedState"})
+
+	bus.setFailing(false)
+	bus.onConnect()
+
+	bus.message(t, "homeassistant/sensor/dyndns_home_example_com/ipv4/config")
+	var state homeAssistantState
+	if err := json.Unmarshal(bus.message(t, "dyndns/status/home.example.com"), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.State != "ipNotConfirmedState" {
+		t.Fatalf("expected state ipNotConfirmedState, got %s", state.State)
+	}
+}
+
+func TestHomeAssistant_RetriesFailedPublish(t *testing.T) {
+	bus := newFakeHomeAssistantBus()
+	bus.setFailing(true)
+	ha, err := NewHomeAssistant(bus, "router", "homeassistant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ha.retryBackoff = conf.BackoffConfig{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ha.Run(ctx)
+
+	ha.StatusChanged(client.HostStatus{Host: "home.example.com", State: "ipNotConfirmedState"})
+	time.Sleep(100 * time.Millisecond)
+
+	// neither a status change nor a reconnect happens, the retry needs to publish the pending status
+	bus.setFailing(false)
+
+	var state homeAssistantState
+	if err := json.Unmarshal(bus.message(t, "dyndns/status/home.example.com"), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.State != "ipNotConfirmedState" {
+		t.Fatalf("expected state ipNotConfirmedState, got %s", state.State)
+	}
+}
@@ -0,0 +1,123 @@
+//go:build client && server
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/testutil"
+)
+
+// runBroker starts an embedded NATS server as a stand-in for a broker. Its MQTT listener requires client certificates
+// and credentials.
+func runBroker(t *testing.T, certs testutil.Certificates) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	opts := &natsserver.Options{
+		ServerName: "dyndns-test",
+		Host:       "127.0.0.1",
+		Port:       -1,
+		NoLog:      true,
+		NoSigs:     true,
+		JetStream:  true,
+		StoreDir:   t.TempDir(),
+		MQTT: natsserver.MQTTOpts{
+			Host:      "127.0.0.1",
+			Port:      port,
+			Username:  "dyndns",
+			Password:  "secret",
+			TLSConfig: certs.ServerTlsConfig(true),
+		},
+	}
+
+	srv, err := natsserver.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("broker not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+
+	return fmt.Sprintf("ssl://127.0.0.1:%d", port)
+}
+
+func TestMqtt_BrokerConfig(t *testing.T) {
+	certs := testutil.NewCertificates(t)
+	url := runBroker(t, certs)
+
+	broker := conf.MqttBrokerConfig{
+		Url:            url,
+		Username:       "dyndns",
+		Password:       "secret",
+		CaCertFile:     testutil.WriteFile(t, "ca.pem", certs.CaPem),
+		ClientCertFile: testutil.WriteFile(t, "client.pem", certs.ClientPem),
+		ClientKeyFile:  testutil.WriteFile(t, "client-key.pem", certs.ClientKeyPem),
+	}
+	tlsConfig, err := broker.TlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := make(chan common.UpdateRecordRequest, 1)
+	server, err := NewMqttServer(broker.Url, "dyndns-server", "dyndns/+", tlsConfig, requests, WithServerCredentials(broker.Username, broker.Password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Listen(context.Background(), &sync.WaitGroup{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Disconnect)
+
+	client, err := NewMqttClient(broker.Url, "dyndns-client", tlsConfig, common.PayloadFormatPlain, WithClientCredentials(broker.Username, broker.Password), WithRetain(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close(context.Background())
+	})
+	if !client.client.IsConnectionOpen() || !server.client.IsConnectionOpen() {
+		t.Fatal("could not connect to broker")
+	}
+
+	// the subscription is established asynchronously after connecting, publish until the server receives the request
+	req := &common.UpdateRecordRequest{
+		PublicIp: common.DnsRecord{
+			IpV4:      "198.51.100.1",
+			Host:      "home.example.com",
+			Timestamp: time.Now(),
+		},
+		Signature: "signature",
+	}
+	deadline := time.After(10 * time.Second)
+	for {
+		if err := client.Notify(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case received := <-requests:
+			if received.PublicIp.Host != req.PublicIp.Host {
+				t.Fatalf("expected update request for %s, got %s", req.PublicIp.Host, received.PublicIp.Host)
+			}
+			return
+		case <-time.After(200 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("update request has not been received")
+		}
+	}
+}
@@ -3,69 +3,265 @@
 package mqtt
 
 import (
+	"context"
 	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"slices"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rs/zerolog/log"
 	"github.com/soerenschneider/dyndns/internal/common"
+	"go.uber.org/multierr"
 )
 
-const publishWaitTimeout = 10 * time.Second
+const (
+	publishWaitTimeout = 10 * time.Second
+	disconnectQuiesce  = 5 * time.Second
+	// notificationTopicTemplate is the topic update requests are published to, formatted using the request's host
+	notificationTopicTemplate = "dyndns/%s"
+)
 
 type MqttClientBus struct {
-	client            mqtt.Client
-	notificationTopic string
+	clientSettings
+	connectCallbacks
+	client mqtt.Client
+	format string
+}
+
+// clientSettings are shared by the MQTT v3 and v5 clients
+type clientSettings struct {
+	qos           byte
+	retain        bool
+	username      string
+	password      string
+	messageExpiry time.Duration
+	awaitResponse bool
+	will          *will
+}
+
+// will is the message the broker publishes after the client disconnected ungracefully
+type will struct {
+	topic   string
+	payload []byte
+}
+
+// connectCallbacks runs callbacks whenever the connection to the broker has been established
+type connectCallbacks struct {
+	mutex     sync.Mutex
+	connected bool
+	callbacks []func()
+}
+
+// addOnConnect registers the callback, which is run right away if the client is already connected
+func (c *connectCallbacks) addOnConnect(callback func()) {
+	c.mutex.Lock()
+	c.callbacks = append(c.callbacks, callback)
+	connected := c.connected
+	c.mutex.Unlock()
+
+	if connected {
+		go callback()
+	}
+}
+
+func (c *connectCallbacks) connectionUp() {
+	c.mutex.Lock()
+	c.connected = true
+	callbacks := slices.Clone(c.callbacks)
+	c.mutex.Unlock()
+
+	for _, callback := range callbacks {
+		go callback()
+	}
 }
 
-func NewMqttClient(broker string, clientId, notificationTopic string, tlsConfig *tls.Config) (*MqttClientBus, error) {
+func (c *connectCallbacks) connectionLost() {
+	c.mutex.Lock()
+	c.connected = false
+	c.mutex.Unlock()
+}
+
+type MqttClientOpts func(settings *clientSettings) error
+
+func newClientSettings(clientOpts ...MqttClientOpts) (clientSettings, error) {
+	settings := clientSettings{
+		qos:    1,
+		retain: true,
+	}
+
+	var errs error
+	for _, opt := range clientOpts {
+		if err := opt(&settings); err != nil {
+			errs = multierr.Append(errs, err)
+		}
+	}
+
+	return settings, errs
+}
+
+func NewMqttClient(broker string, clientId string, tlsConfig *tls.Config, format string, clientOpts ...MqttClientOpts) (*MqttClientBus, error) {
+	settings, err := newClientSettings(clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.messageExpiry > 0 || settings.awaitResponse {
+		return nil, errors.New("message expiry and awaiting responses require MQTT v5")
+	}
+
+	bus := &MqttClientBus{
+		clientSettings: settings,
+		format:         format,
+	}
+
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(broker)
 	opts.SetClientID(clientId)
 	if tlsConfig != nil {
 		opts.SetTLSConfig(tlsConfig)
 	}
+	if len(settings.username) > 0 {
+		opts.SetUsername(settings.username)
+		opts.SetPassword(settings.password)
+	}
+	if settings.will != nil {
+		opts.SetBinaryWill(settings.will.topic, settings.will.payload, settings.qos, true)
+	}
 
 	opts.SetAutoReconnect(true)
 	opts.SetMaxReconnectInterval(60 * time.Second)
 	opts.SetConnectRetry(true)
 	opts.SetClientID(clientId)
 
-	opts.OnConnectionLost = connectLostHandler
+	opts.OnConnectionLost = func(client mqtt.Client, err error) {
+		bus.connectionLost()
+		connectLostHandler(client, err)
+	}
 	opts.OnConnectAttempt = onConnectAttemptHandler
-	opts.OnConnect = onConnectHandler
+	opts.OnConnect = func(client mqtt.Client) {
+		onConnectHandler(client)
+		bus.connectionUp()
+	}
 	opts.OnReconnecting = onReconnectHandler
 
-	client := mqtt.NewClient(opts)
-	token := client.Connect()
+	bus.client = mqtt.NewClient(opts)
+	token := bus.client.Connect()
 	finishedWithinTimeout := token.WaitTimeout(10 * time.Second)
 	if token.Error() != nil || !finishedWithinTimeout {
 		log.Error().Err(token.Error()).Str("component", "mqtt").Str("broker", broker).Msg("Connection to broker failed, continuing in background")
 	}
 
-	return &MqttClientBus{
-		client:            client,
-		notificationTopic: notificationTopic,
-	}, nil
+	return bus, nil
+}
+
+// WithPublishQos sets the quality of service level update requests are published with
+func WithPublishQos(qos byte) MqttClientOpts {
+	return func(settings *clientSettings) error {
+		if qos > 2 {
+			return fmt.Errorf("invalid qos %d", qos)
+		}
+		settings.qos = qos
+		return nil
+	}
+}
+
+// WithRetain sets whether the broker retains the last update request of the host
+func WithRetain(retain bool) MqttClientOpts {
+	return func(settings *clientSettings) error {
+		settings.retain = retain
+		return nil
+	}
+}
+
+// WithClientCredentials authenticates against the broker using username and password
+func WithClientCredentials(username, password string) MqttClientOpts {
+	return func(settings *clientSettings) error {
+		if len(username) == 0 {
+			return errors.New("empty username supplied")
+		}
+		settings.username = username
+		settings.password = password
+		return nil
+	}
+}
+
+// WithMessageExpiry lets the broker discard update requests that could not be delivered within the given duration,
+// requires MQTT v5
+func WithMessageExpiry(expiry time.Duration) MqttClientOpts {
+	return func(settings *clientSettings) error {
+		if expiry < time.Second || expiry.Seconds() > math.MaxUint32 {
+			return fmt.Errorf("invalid message expiry %v", expiry)
+		}
+		settings.messageExpiry = expiry
+		return nil
+	}
+}
+
+// WithWill lets the broker publish the retained payload to the topic after the client disconnected ungracefully
+func WithWill(topic string, payload []byte) MqttClientOpts {
+	return func(settings *clientSettings) error {
+		if len(topic) == 0 {
+			return errors.New("empty will topic supplied")
+		}
+		settings.will = &will{topic: topic, payload: payload}
+		return nil
+	}
+}
+
+// WithAwaitResponse lets the client wait for a server to reply with the result of processing the update request,
+// requires MQTT v5
+func WithAwaitResponse() MqttClientOpts {
+	return func(settings *clientSettings) error {
+		settings.awaitResponse = true
+		return nil
+	}
 }
 
-func (d *MqttClientBus) Notify(msg *common.UpdateRecordRequest) error {
-	payload, err := json.Marshal(msg)
+// Close disconnects from the broker, waiting for outstanding work to complete until the context's deadline, at most
+// for disconnectQuiesce
+func (d *MqttClientBus) Close(ctx context.Context) error {
+	quiesce := disconnectQuiesce
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < quiesce {
+		quiesce = max(time.Until(deadline), 0)
+	}
+
+	log.Info().Str("component", "mqtt").Msg("Disconnecting from mqtt broker")
+	d.client.Disconnect(uint(quiesce.Milliseconds())) //nolint G115
+	return nil
+}
+
+func (d *MqttClientBus) Notify(ctx context.Context, msg *common.UpdateRecordRequest) error {
+	payload, err := common.EncodeUpdateRecordRequest(msg, d.format)
 	if err != nil {
 		return fmt.Errorf("could not marshal envelope: %v", err)
 	}
 	opts := d.client.OptionsReader()
 	log.Debug().Msgf("Sending %v to %v", string(payload), opts.Servers())
 
-	token := d.client.Publish(d.notificationTopic, 1, true, payload)
-	ok := token.WaitTimeout(publishWaitTimeout)
-	if !ok {
-		return errors.New("received timeout when trying to publish the message")
+	topic := fmt.Sprintf(notificationTopicTemplate, msg.PublicIp.Host)
+	ctx, cancel := context.WithTimeout(ctx, publishWaitTimeout)
+	defer cancel()
+	if err := d.publish(ctx, topic, d.retain, payload); err != nil {
+		return err
 	}
 	log.Debug().Str("component", "mqtt").Any("brokers", opts.Servers()).Msg("Dispatched message")
 
 	return nil
 }
+
+func (d *MqttClientBus) publish(ctx context.Context, topic string, retain bool, payload []byte) error {
+	token := d.client.Publish(topic, d.qos, retain, payload)
+	select {
+	case <-token.Done():
+		if token.Error() != nil {
+			return fmt.Errorf("could not publish message: %w", token.Error())
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("received timeout when trying to publish the message: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,97 @@
+//go:build client
+
+package mqtt
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/soerenschneider/dyndns/internal/common"
+)
+
+func TestNewMqttClient_RequiresV5(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []MqttClientOpts
+	}{
+		{
+			name: "message expiry",
+			opts: []MqttClientOpts{WithMessageExpiry(time.Hour)},
+		},
+		{
+			name: "await response",
+			opts: []MqttClientOpts{WithAwaitResponse()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewMqttClient("tcp://127.0.0.1:1883", "dyndns-client", nil, common.PayloadFormatPlain, tt.opts...); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestMqttV5ClientBus_onResponse(t *testing.T) {
+	bus := &MqttV5ClientBus{
+		responseTopic: "dyndns/responses/client",
+		pending:       map[string]chan common.UpdateRecordReply{},
+	}
+	replies := make(chan common.UpdateRecordReply, 1)
+	bus.pending["correlation"] = replies
+
+	tests := []struct {
+		name            string
+		topic           string
+		correlationData string
+		wantHandled     bool
+		wantReply       bool
+	}{
+		{
+			name:            "other topic",
+			topic:           "dyndns/home.example.com",
+			correlationData: "correlation",
+		},
+		{
+			name:            "unknown correlation data",
+			topic:           "dyndns/responses/client",
+			correlationData: "unknown",
+			wantHandled:     true,
+		},
+		{
+			name:            "pending request",
+			topic:           "dyndns/responses/client",
+			correlationData: "correlation",
+			wantHandled:     true,
+			wantReply:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := json.Marshal(common.NewUpdateRecordReply(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handled, err := bus.onResponse(paho.PublishReceived{Packet: &paho.Publish{
+				Topic:      tt.topic,
+				Payload:    payload,
+				Properties: &paho.PublishProperties{CorrelationData: []byte(tt.correlationData)},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if handled != tt.wantHandled {
+				t.Fatalf("onResponse() handled = %v, want %v", handled, tt.wantHandled)
+			}
+			if gotReply := len(replies) == 1; gotReply != tt.wantReply {
+				t.Fatalf("expected reply = %v, got %v", tt.wantReply, gotReply)
+			}
+			if tt.wantReply && (<-replies).Err() != nil {
+				t.Fatal("expected successful reply")
+			}
+		})
+	}
+}
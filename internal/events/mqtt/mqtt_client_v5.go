@@ -0,0 +1,237 @@
+//go:build client
+
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/common"
+)
+
+const responseWaitTimeout = 60 * time.Second
+
+// MqttV5ClientBus publishes update requests using MQTT v5, which allows the broker to discard expired update requests
+// and servers to reply with the result of processing them
+type MqttV5ClientBus struct {
+	clientSettings
+	connectCallbacks
+	conn          *autopaho.ConnectionManager
+	cancel        context.CancelFunc
+	broker        string
+	format        string
+	responseTopic string
+
+	mutex   sync.Mutex
+	pending map[string]chan common.UpdateRecordReply
+}
+
+func NewMqttV5Client(broker string, clientId string, tlsConfig *tls.Config, format string, clientOpts ...MqttClientOpts) (*MqttV5ClientBus, error) {
+	settings, err := newClientSettings(clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	bus := &MqttV5ClientBus{
+		clientSettings: settings,
+		broker:         broker,
+		format:         format,
+		pending:        map[string]chan common.UpdateRecordReply{},
+	}
+	if settings.awaitResponse {
+		bus.responseTopic = responseTopic(clientId)
+		if !isResponseTopic(bus.responseTopic) {
+			return nil, fmt.Errorf("client id '%s' can not be used in the response topic", clientId)
+		}
+	}
+
+	config, err := newV5ClientConfig(broker, clientId, tlsConfig, settings.username, settings.password)
+	if err != nil {
+		return nil, err
+	}
+	config.OnConnectionUp = bus.onConnectionUp
+	config.OnPublishReceived = []func(paho.PublishReceived) (bool, error){bus.onResponse}
+	onClientError, onServerDisconnect := config.OnClientError, config.OnServerDisconnect
+	config.OnClientError = func(err error) {
+		bus.connectionLost()
+		onClientError(err)
+	}
+	config.OnServerDisconnect = func(disconnect *paho.Disconnect) {
+		bus.connectionLost()
+		onServerDisconnect(disconnect)
+	}
+	if settings.will != nil {
+		config.WillMessage = &paho.WillMessage{
+			Retain:  true,
+			QoS:     settings.qos,
+			Topic:   settings.will.topic,
+			Payload: settings.will.payload,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bus.cancel = cancel
+	bus.conn, err = autopaho.NewConnection(ctx, config)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("could not create connection to broker %s: %w", broker, err)
+	}
+
+	connectCtx, connectCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer connectCancel()
+	if err := bus.conn.AwaitConnection(connectCtx); err != nil {
+		log.Error().Err(err).Str("component", "mqtt").Str("broker", broker).Msg("Connection to broker failed, continuing in background")
+	}
+
+	return bus, nil
+}
+
+func (d *MqttV5ClientBus) onConnectionUp(conn *autopaho.ConnectionManager, _ *paho.Connack) {
+	onV5ConnectionUp(d.broker)
+	defer d.connectionUp()
+	if len(d.responseTopic) == 0 {
+		return
+	}
+
+	// the session ends with the connection, so the subscription needs to be renewed after reconnecting
+	ctx, cancel := context.WithTimeout(context.Background(), publishWaitTimeout)
+	defer cancel()
+	_, err := conn.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{Topic: d.responseTopic, QoS: d.qos},
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Str("component", "mqtt").Str("broker", d.broker).Str("topic", d.responseTopic).Msg("Could not subscribe to response topic")
+		return
+	}
+	log.Info().Str("component", "mqtt").Str("broker", d.broker).Str("topic", d.responseTopic).Msg("Subscribed to response topic")
+}
+
+// onResponse hands a server's reply to the pending update request with the same correlation data
+func (d *MqttV5ClientBus) onResponse(received paho.PublishReceived) (bool, error) {
+	msg := received.Packet
+	if msg.Topic != d.responseTopic || msg.Properties == nil || len(msg.Properties.CorrelationData) == 0 {
+		return false, nil
+	}
+
+	var reply common.UpdateRecordReply
+	if err := json.Unmarshal(msg.Payload, &reply); err != nil {
+		log.Warn().Err(err).Str("component", "mqtt").Str("broker", d.broker).Msg("Could not parse reply")
+		return true, nil
+	}
+
+	d.mutex.Lock()
+	replies, ok := d.pending[string(msg.Properties.CorrelationData)]
+	d.mutex.Unlock()
+	if ok {
+		select {
+		case replies <- reply:
+		default:
+		}
+	}
+
+	return true, nil
+}
+
+// Close disconnects from the broker, waiting for outstanding work to complete until the context's deadline, at most
+// for disconnectQuiesce
+func (d *MqttV5ClientBus) Close(ctx context.Context) error {
+	defer d.cancel()
+
+	ctx, cancel := context.WithTimeout(ctx, disconnectQuiesce)
+	defer cancel()
+
+	log.Info().Str("component", "mqtt").Msg("Disconnecting from mqtt broker")
+	return d.conn.Disconnect(ctx)
+}
+
+func (d *MqttV5ClientBus) Notify(ctx context.Context, msg *common.UpdateRecordRequest) error {
+	payload, err := common.EncodeUpdateRecordRequest(msg, d.format)
+	if err != nil {
+		return fmt.Errorf("could not marshal envelope: %v", err)
+	}
+	log.Debug().Msgf("Sending %v to %v", string(payload), d.broker)
+
+	publish := &paho.Publish{
+		QoS:     d.qos,
+		Retain:  d.retain,
+		Topic:   fmt.Sprintf(notificationTopicTemplate, msg.PublicIp.Host),
+		Payload: payload,
+		Properties: &paho.PublishProperties{
+			ContentType: jsonContentType,
+			User: paho.UserProperties{
+				{Key: userPropertyHost, Value: msg.PublicIp.Host},
+				{Key: userPropertyEventId, Value: msg.EventId()},
+			},
+		},
+	}
+	if d.messageExpiry > 0 {
+		expiry := uint32(d.messageExpiry.Seconds()) //nolint G115
+		publish.Properties.MessageExpiry = &expiry
+	}
+
+	var replies chan common.UpdateRecordReply
+	if len(d.responseTopic) > 0 {
+		// a retained update request would be answered by every server that subscribes later on
+		publish.Retain = false
+		publish.Properties.ResponseTopic = d.responseTopic
+		correlationData := msg.EventId() + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+		publish.Properties.CorrelationData = []byte(correlationData)
+
+		replies = make(chan common.UpdateRecordReply, 1)
+		d.mutex.Lock()
+		d.pending[correlationData] = replies
+		d.mutex.Unlock()
+		defer func() {
+			d.mutex.Lock()
+			delete(d.pending, correlationData)
+			d.mutex.Unlock()
+		}()
+	}
+
+	publishCtx, cancel := context.WithTimeout(ctx, publishWaitTimeout)
+	defer cancel()
+	if _, err := d.conn.Publish(publishCtx, publish); err != nil {
+		return fmt.Errorf("could not publish message: %w", err)
+	}
+	log.Debug().Str("component", "mqtt").Str("broker", d.broker).Msg("Dispatched message")
+
+	if replies == nil {
+		return nil
+	}
+
+	ctx, cancel = context.WithTimeout(ctx, responseWaitTimeout)
+	defer cancel()
+	select {
+	case reply := <-replies:
+		if err := reply.Err(); err != nil {
+			return err
+		}
+		log.Debug().Str("component", "mqtt").Str("host", msg.PublicIp.Host).Msg("Update request has been processed by server")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("no reply received: %w", ctx.Err())
+	}
+}
+
+func (d *MqttV5ClientBus) publish(ctx context.Context, topic string, retain bool, payload []byte) error {
+	_, err := d.conn.Publish(ctx, &paho.Publish{
+		QoS:     d.qos,
+		Retain:  retain,
+		Topic:   topic,
+		Payload: payload,
+	})
+	if err != nil {
+		return fmt.Errorf("could not publish message: %w", err)
+	}
+	return nil
+}
@@ -2,9 +2,14 @@ package mqtt
 
 import (
 	"crypto/tls"
+	"fmt"
 	"net/url"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rs/zerolog/log"
 	"github.com/soerenschneider/dyndns/internal/metrics"
@@ -44,3 +49,77 @@ var onConnectHandler = func(c mqtt.Client) {
 	metrics.MqttBrokersConnectedTotal.Add(1)
 	mutex.Unlock()
 }
+
+const (
+	// userPropertyHost is the MQTT v5 user property that carries the host of the update request, so brokers and
+	// bridges can route messages without parsing the payload
+	userPropertyHost = "host"
+	// userPropertyEventId is the MQTT v5 user property that carries the id of the update request
+	userPropertyEventId = "event-id"
+	jsonContentType     = "application/json"
+	// responseTopicPrefix is the prefix of the topics servers reply to, followed by the client id
+	responseTopicPrefix = "dyndns/responses/"
+)
+
+// responseTopic returns the topic servers reply to the client with the given id
+func responseTopic(clientId string) string {
+	return responseTopicPrefix + clientId
+}
+
+// isResponseTopic returns whether the topic is the response topic of a client. Servers only reply to these topics,
+// so update requests can not make them publish to arbitrary topics.
+func isResponseTopic(topic string) bool {
+	clientId, found := strings.CutPrefix(topic, responseTopicPrefix)
+	return found && len(clientId) > 0 && !strings.ContainsAny(clientId, "/+#")
+}
+
+// newV5ClientConfig builds the config of an MQTT v5 connection that reconnects in the background like the MQTT v3
+// clients and updates the same metrics
+func newV5ClientConfig(broker, clientId string, tlsConfig *tls.Config, username, password string) (autopaho.ClientConfig, error) {
+	brokerUrl, err := url.Parse(broker)
+	if err != nil {
+		return autopaho.ClientConfig{}, fmt.Errorf("invalid broker url '%s': %w", broker, err)
+	}
+
+	config := autopaho.ClientConfig{
+		ServerUrls:       []*url.URL{brokerUrl},
+		TlsCfg:           tlsConfig,
+		KeepAlive:        30,
+		ReconnectBackoff: autopaho.NewExponentialBackoff(time.Second, 60*time.Second, 5*time.Second, 2),
+		ConnectTimeout:   10 * time.Second,
+		ConnectUsername:  username,
+		ConnectPassword:  []byte(password),
+		OnConnectError: func(err error) {
+			log.Warn().Err(err).Str("component", "mqtt").Str("broker", brokerUrl.Host).Msg("Connection to broker failed, retrying")
+			mutex.Lock()
+			metrics.MqttReconnectionsTotal.Inc()
+			mutex.Unlock()
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: clientId,
+			OnClientError: func(err error) {
+				onV5ConnectionLost(brokerUrl.Host, err)
+			},
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				onV5ConnectionLost(brokerUrl.Host, fmt.Errorf("disconnected by broker, reason code %d", disconnect.ReasonCode))
+			},
+		},
+	}
+
+	return config, nil
+}
+
+func onV5ConnectionUp(broker string) {
+	log.Info().Str("component", "mqtt").Str("broker", broker).Msg("Successfully connected")
+	mutex.Lock()
+	metrics.MqttBrokersConnectedTotal.Add(1)
+	mutex.Unlock()
+}
+
+func onV5ConnectionLost(broker string, err error) {
+	log.Warn().Err(err).Str("component", "mqtt").Str("broker", broker).Msg("Connection lost")
+	metrics.MqttConnectionsLostTotal.Inc()
+	mutex.Lock()
+	defer mutex.Unlock()
+	metrics.MqttBrokersConnectedTotal.Sub(1)
+}
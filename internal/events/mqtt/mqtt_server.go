@@ -5,7 +5,9 @@ package mqtt
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,44 +15,173 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/soerenschneider/dyndns/internal/common"
 	"github.com/soerenschneider/dyndns/internal/metrics"
+	"go.uber.org/multierr"
 )
 
+const defaultSubscribeQos = 1
+
 type MqttBus struct {
-	client            mqtt.Client
-	notificationTopic string
-	broker            string
+	serverSettings
+	client mqtt.Client
+	broker string
 
 	requests chan common.UpdateRecordRequest
 }
 
-func NewMqttServer(broker string, clientId, notificationTopic string, tlsConfig *tls.Config, reqChan chan common.UpdateRecordRequest) (*MqttBus, error) {
-	bus := &MqttBus{
+// serverSettings are shared by the MQTT v3 and v5 servers
+type serverSettings struct {
+	notificationTopic string
+	qos               byte
+	sharedGroup       string
+	username          string
+	password          string
+	leader            common.Leader
+}
+
+type MqttServerOpts func(settings *serverSettings) error
+
+func newServerSettings(notificationTopic string, opts ...MqttServerOpts) (serverSettings, error) {
+	if strings.Count(notificationTopic, "+") != 1 {
+		return serverSettings{}, fmt.Errorf("notification topic '%s' must contain a single '+' wildcard for the host", notificationTopic)
+	}
+
+	settings := serverSettings{
 		notificationTopic: notificationTopic,
-		requests:          reqChan,
-		broker:            broker,
+		qos:               defaultSubscribeQos,
+	}
+
+	var errs error
+	for _, opt := range opts {
+		if err := opt(&settings); err != nil {
+			errs = multierr.Append(errs, err)
+		}
+	}
+
+	return settings, errs
+}
+
+// NewMqttServer subscribes to the notification topic, which must contain a single-level wildcard that matches the
+// host of the update request
+func NewMqttServer(broker string, clientId, notificationTopic string, tlsConfig *tls.Config, reqChan chan common.UpdateRecordRequest, opts ...MqttServerOpts) (*MqttBus, error) {
+	settings, err := newServerSettings(notificationTopic, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	bus := &MqttBus{
+		serverSettings: settings,
+		requests:       reqChan,
+		broker:         broker,
 	}
 
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(broker)
+	clientOpts := mqtt.NewClientOptions()
+	clientOpts.AddBroker(broker)
 	if tlsConfig != nil {
-		opts.SetTLSConfig(tlsConfig)
+		clientOpts.SetTLSConfig(tlsConfig)
+	}
+	if len(settings.username) > 0 {
+		clientOpts.SetUsername(settings.username)
+		clientOpts.SetPassword(settings.password)
 	}
 
-	opts.SetAutoReconnect(true)
-	opts.SetMaxReconnectInterval(60 * time.Second)
-	opts.SetConnectRetry(true)
-	opts.SetClientID(clientId)
+	clientOpts.SetAutoReconnect(true)
+	clientOpts.SetMaxReconnectInterval(60 * time.Second)
+	clientOpts.SetConnectRetry(true)
+	clientOpts.SetClientID(clientId)
 
-	opts.OnConnectionLost = connectLostHandler
-	opts.OnConnectAttempt = onConnectAttemptHandler
-	opts.OnConnect = bus.onConnect
-	opts.OnReconnecting = onReconnectHandler
+	clientOpts.OnConnectionLost = connectLostHandler
+	clientOpts.OnConnectAttempt = onConnectAttemptHandler
+	clientOpts.OnConnect = bus.onConnect
+	clientOpts.OnReconnecting = onReconnectHandler
 
-	bus.client = mqtt.NewClient(opts)
+	bus.client = mqtt.NewClient(clientOpts)
 
 	return bus, nil
 }
 
+// WithSubscribeQos sets the quality of service level of the subscription
+func WithSubscribeQos(qos byte) MqttServerOpts {
+	return func(settings *serverSettings) error {
+		if qos > 2 {
+			return fmt.Errorf("invalid qos %d", qos)
+		}
+		settings.qos = qos
+		return nil
+	}
+}
+
+// WithSharedSubscription subscribes using a shared subscription, so the broker delivers each update request to only
+// a single server of the group
+func WithSharedSubscription(group string) MqttServerOpts {
+	return func(settings *serverSettings) error {
+		if len(group) == 0 || strings.ContainsAny(group, "/+#") {
+			return fmt.Errorf("invalid shared subscription group '%s'", group)
+		}
+		settings.sharedGroup = group
+		return nil
+	}
+}
+
+// WithServerCredentials authenticates against the broker using username and password
+func WithServerCredentials(username, password string) MqttServerOpts {
+	return func(settings *serverSettings) error {
+		if len(username) == 0 {
+			return errors.New("empty username supplied")
+		}
+		settings.username = username
+		settings.password = password
+		return nil
+	}
+}
+
+// WithLeader only holds a shared subscription while this server holds the leader lease. The broker delivers each
+// update request to a single server of the group, so update requests delivered to followers would be lost.
+func WithLeader(leader common.Leader) MqttServerOpts {
+	return func(settings *serverSettings) error {
+		if leader == nil {
+			return errors.New("nil leader supplied")
+		}
+		settings.leader = leader
+		return nil
+	}
+}
+
+// followsLeader returns whether the subscription is only held by the leader. Without a shared subscription, every
+// server receives all update requests, so followers stay subscribed and leave the update requests to the leader.
+func (s *serverSettings) followsLeader() bool {
+	return s.leader != nil && len(s.sharedGroup) > 0
+}
+
+// wantsSubscription returns whether the server should currently be subscribed to the notification topic
+func (s *serverSettings) wantsSubscription() bool {
+	return !s.followsLeader() || s.leader.IsLeader()
+}
+
+// subscriptionTopic returns the topic filter the server subscribes to
+func (s *serverSettings) subscriptionTopic() string {
+	if len(s.sharedGroup) == 0 {
+		return s.notificationTopic
+	}
+	return fmt.Sprintf("$share/%s/%s", s.sharedGroup, s.notificationTopic)
+}
+
+// hostFromTopic returns the level of the topic that is matched by the notification topic's wildcard
+func (s *serverSettings) hostFromTopic(topic string) (string, error) {
+	filterLevels := strings.Split(s.notificationTopic, "/")
+	topicLevels := strings.Split(topic, "/")
+	if len(filterLevels) != len(topicLevels) {
+		return "", fmt.Errorf("topic '%s' does not match '%s'", topic, s.notificationTopic)
+	}
+
+	for index, level := range filterLevels {
+		if level == "+" {
+			return topicLevels[index], nil
+		}
+	}
+
+	return "", errors.New("notification topic does not contain a wildcard")
+}
+
 func (s *MqttBus) Listen(ctx context.Context, wg *sync.WaitGroup) error {
 	token := s.client.Connect()
 	finishedWithinTimeout := token.WaitTimeout(10 * time.Second)
@@ -58,9 +189,34 @@ func (s *MqttBus) Listen(ctx context.Context, wg *sync.WaitGroup) error {
 		log.Error().Err(token.Error()).Str("broker", s.broker).Msg("Connection to broker failed, continuing in background")
 	}
 
+	if s.followsLeader() {
+		go common.WatchLeader(ctx, s.leader, s.onLeaderChange)
+	}
+
 	return nil
 }
 
+// onLeaderChange subscribes after acquiring the leader lease and unsubscribes after losing it. While disconnected,
+// the subscription is decided after reconnecting.
+func (s *MqttBus) onLeaderChange(isLeader bool) {
+	if !s.client.IsConnectionOpen() {
+		return
+	}
+
+	if isLeader {
+		s.subscribe(s.client)
+		return
+	}
+
+	topic := s.subscriptionTopic()
+	token := s.client.Unsubscribe(topic)
+	if !token.WaitTimeout(60*time.Second) || token.Error() != nil {
+		log.Error().Err(token.Error()).Str("component", "mqtt").Str("broker", s.broker).Msgf("Could not unsubscribe from %s", topic)
+		return
+	}
+	log.Info().Str("component", "mqtt").Str("broker", s.broker).Str("topic", topic).Msg("Lost leader lease, unsubscribed from topic")
+}
+
 func (s *MqttBus) Disconnect() {
 	log.Info().Str("component", "mqtt").Str("broker", s.broker).Msg("Disconnecting from mqtt broker")
 	s.client.Disconnect(5000)
@@ -68,27 +224,54 @@ func (s *MqttBus) Disconnect() {
 
 func (s *MqttBus) onMessage(_ mqtt.Client, msg mqtt.Message) {
 	log.Info().Str("component", "mqtt").Str("broker", s.broker).Msg("Picked up message")
-	var env common.UpdateRecordRequest
-	err := json.Unmarshal(msg.Payload(), &env)
-	if err != nil {
-		metrics.MessageParsingFailed.Inc()
-		log.Warn().Err(err).Str("component", "mqtt").Str("broker", s.broker).Msg("Can't parse message")
+	env, ok := s.decodeUpdateRequest(s.broker, msg.Topic(), msg.Payload())
+	if !ok {
 		return
 	}
 
 	s.requests <- env
 }
 
+// decodeUpdateRequest parses the update request and makes sure it has been published to the topic of its host
+func (s *serverSettings) decodeUpdateRequest(broker, topic string, payload []byte) (common.UpdateRecordRequest, bool) {
+	env, err := common.DecodeUpdateRecordRequest(payload)
+	if err != nil {
+		metrics.MessageParsingFailed.Inc()
+		log.Warn().Err(err).Str("component", "mqtt").Str("broker", broker).Msg("Can't parse message")
+		return env, false
+	}
+
+	// only accept update requests for the host the topic belongs to, so brokers can restrict clients to their topic
+	host, err := s.hostFromTopic(topic)
+	if err != nil || host != env.PublicIp.Host {
+		metrics.MessageValidationsFailed.WithLabelValues(env.PublicIp.Host, "topic_mismatch").Inc()
+		log.Warn().Str("component", "mqtt").Str("broker", broker).Str("topic", topic).Str("host", env.PublicIp.Host).Msg("Host of update request does not match topic, ignoring")
+		return env, false
+	}
+
+	return env, true
+}
+
 func (s *MqttBus) onConnect(client mqtt.Client) {
 	log.Info().Str("component", "mqtt").Str("broker", s.broker).Msgf("Connected to broker")
-	token := client.Subscribe(s.notificationTopic, 1, s.onMessage)
+	mutex.Lock()
+	metrics.MqttBrokersConnectedTotal.Add(1)
+	mutex.Unlock()
+
+	if !s.wantsSubscription() {
+		log.Info().Str("component", "mqtt").Str("broker", s.broker).Msg("Not holding the leader lease, not subscribing")
+		return
+	}
+	s.subscribe(client)
+}
+
+func (s *MqttBus) subscribe(client mqtt.Client) {
+	topic := s.subscriptionTopic()
+	token := client.Subscribe(topic, s.qos, s.onMessage)
 	if !token.WaitTimeout(60 * time.Second) {
-		log.Error().Msgf("Could not re-subscribe to %s", s.notificationTopic)
+		log.Error().Msgf("Could not re-subscribe to %s", topic)
 		return
 	}
 
-	log.Info().Str("component", "mqtt").Str("broker", s.broker).Str("topic", s.notificationTopic).Msg("Subscribed to topic")
-	mutex.Lock()
-	defer mutex.Unlock()
-	metrics.MqttBrokersConnectedTotal.Add(1)
+	log.Info().Str("component", "mqtt").Str("broker", s.broker).Str("topic", topic).Msg("Subscribed to topic")
 }
@@ -0,0 +1,344 @@
+//go:build server
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/soerenschneider/dyndns/internal/common"
+)
+
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 1 }
+func (m *fakeMessage) Retained() bool    { return false }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 1 }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) Ack()              {}
+
+func TestMqttBus_onMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		topic      string
+		host       string
+		wantPassed bool
+	}{
+		{
+			name:       "host matches topic",
+			topic:      "dyndns/home.example.com",
+			host:       "home.example.com",
+			wantPassed: true,
+		},
+		{
+			name:  "host does not match topic",
+			topic: "dyndns/attacker.example.com",
+			host:  "home.example.com",
+		},
+		{
+			name:  "additional topic level",
+			topic: "dyndns/home.example.com/x",
+			host:  "home.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan common.UpdateRecordRequest, 1)
+			bus, err := NewMqttServer("tcp://127.0.0.1:1883", "dyndns-server", "dyndns/+", nil, requests)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			payload, err := json.Marshal(common.UpdateRecordRequest{
+				PublicIp: common.DnsRecord{
+					IpV4:      "198.51.100.1",
+					Host:      tt.host,
+					Timestamp: time.Now(),
+				},
+				Signature: "signature",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bus.onMessage(nil, &fakeMessage{topic: tt.topic, payload: payload})
+			if passed := len(requests) == 1; passed != tt.wantPassed {
+				t.Fatalf("expected update request passed = %v, got %v", tt.wantPassed, passed)
+			}
+		})
+	}
+}
+
+func TestMqttBus_subscriptionTopic(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []MqttServerOpts
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "default",
+			want: "dyndns/+",
+		},
+		{
+			name: "shared subscription",
+			opts: []MqttServerOpts{WithSharedSubscription("dyndns-servers")},
+			want: "$share/dyndns-servers/dyndns/+",
+		},
+		{
+			name:    "invalid group",
+			opts:    []MqttServerOpts{WithSharedSubscription("dyndns/servers")},
+			wantErr: true,
+		},
+		{
+			name:    "invalid qos",
+			opts:    []MqttServerOpts{WithSubscribeQos(3)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus, err := NewMqttServer("tcp://127.0.0.1:1883", "dyndns-server", "dyndns/+", nil, make(chan common.UpdateRecordRequest), tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewMqttServer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && bus.subscriptionTopic() != tt.want {
+				t.Fatalf("subscriptionTopic() = %s, want %s", bus.subscriptionTopic(), tt.want)
+			}
+		})
+	}
+}
+
+type recordingConnection struct {
+	published    chan *paho.Publish
+	subscribed   []string
+	unsubscribed []string
+}
+
+func (c *recordingConnection) Publish(_ context.Context, publish *paho.Publish) (*paho.PublishResponse, error) {
+	c.published <- publish
+	return &paho.PublishResponse{}, nil
+}
+
+func (c *recordingConnection) Subscribe(_ context.Context, subscribe *paho.Subscribe) (*paho.Suback, error) {
+	for _, subscription := range subscribe.Subscriptions {
+		c.subscribed = append(c.subscribed, subscription.Topic)
+	}
+	return &paho.Suback{}, nil
+}
+
+func (c *recordingConnection) Unsubscribe(_ context.Context, unsubscribe *paho.Unsubscribe) (*paho.Unsuback, error) {
+	c.unsubscribed = append(c.unsubscribed, unsubscribe.Topics...)
+	return &paho.Unsuback{}, nil
+}
+
+type fakeLeader struct {
+	leader atomic.Bool
+}
+
+func (l *fakeLeader) IsLeader() bool {
+	return l.leader.Load()
+}
+
+func TestMqttV5Bus_SubscribesAsLeader(t *testing.T) {
+	tests := []struct {
+		name           string
+		opts           []MqttServerOpts
+		wantSubscribed bool
+	}{
+		{
+			name:           "shared subscription without leader lease",
+			opts:           []MqttServerOpts{WithSharedSubscription("dyndns-servers")},
+			wantSubscribed: true,
+		},
+		{
+			name:           "follower without shared subscription",
+			opts:           []MqttServerOpts{WithLeader(&fakeLeader{})},
+			wantSubscribed: true,
+		},
+		{
+			name: "follower with shared subscription",
+			opts: []MqttServerOpts{WithSharedSubscription("dyndns-servers"), WithLeader(&fakeLeader{})},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus, err := NewMqttV5Server("tcp://127.0.0.1:1883", "dyndns-server", "dyndns/+", nil, make(chan common.UpdateRecordRequest), tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn := &recordingConnection{}
+			bus.connected(conn)
+			if subscribed := len(conn.subscribed) == 1; subscribed != tt.wantSubscribed {
+				t.Fatalf("expected subscribed = %v, got %v", tt.wantSubscribed, conn.subscribed)
+			}
+		})
+	}
+}
+
+func TestMqttV5Bus_onLeaderChange(t *testing.T) {
+	leader := &fakeLeader{}
+	bus, err := NewMqttV5Server("tcp://127.0.0.1:1883", "dyndns-server", "dyndns/+", nil, make(chan common.UpdateRecordRequest), WithSharedSubscription("dyndns-servers"), WithLeader(leader))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &recordingConnection{}
+	bus.connected(conn)
+	if len(conn.subscribed) != 0 {
+		t.Fatalf("expected follower not to subscribe, got %v", conn.subscribed)
+	}
+
+	leader.leader.Store(true)
+	bus.onLeaderChange(true)
+	if len(conn.subscribed) != 1 || conn.subscribed[0] != "$share/dyndns-servers/dyndns/+" {
+		t.Fatalf("expected leader to subscribe to shared subscription, got %v", conn.subscribed)
+	}
+
+	leader.leader.Store(false)
+	bus.onLeaderChange(false)
+	if len(conn.unsubscribed) != 1 || conn.unsubscribed[0] != "$share/dyndns-servers/dyndns/+" {
+		t.Fatalf("expected former leader to unsubscribe, got %v", conn.unsubscribed)
+	}
+}
+
+func TestMqttV5Bus_onPublishReceived(t *testing.T) {
+	tests := []struct {
+		name          string
+		topic         string
+		responseTopic string
+		result        error
+		wantPassed    bool
+		wantReply     *common.UpdateRecordReply
+	}{
+		{
+			name:       "host matches topic",
+			topic:      "dyndns/home.example.com",
+			wantPassed: true,
+		},
+		{
+			name:  "host does not match topic",
+			topic: "dyndns/attacker.example.com",
+		},
+		{
+			name:          "reply success",
+			topic:         "dyndns/home.example.com",
+			responseTopic: "dyndns/responses/client",
+			wantPassed:    true,
+			wantReply:     &common.UpdateRecordReply{Success: true},
+		},
+		{
+			name:          "reply permanent error",
+			topic:         "dyndns/home.example.com",
+			responseTopic: "dyndns/responses/client",
+			result:        common.Permanent(errors.New("message timestamp is too old")),
+			wantPassed:    true,
+			wantReply:     &common.UpdateRecordReply{Error: "message timestamp is too old", Permanent: true},
+		},
+		{
+			name:          "no reply to unverified request",
+			topic:         "dyndns/home.example.com",
+			responseTopic: "dyndns/responses/client",
+			result:        common.Permanent(common.Unverified(errors.New("verifying signature FAILED"))),
+			wantPassed:    true,
+		},
+		{
+			name:          "no reply from follower",
+			topic:         "dyndns/home.example.com",
+			responseTopic: "dyndns/responses/client",
+			result:        common.ErrNotLeader,
+			wantPassed:    true,
+		},
+		{
+			name:          "no reply to foreign topic",
+			topic:         "dyndns/home.example.com",
+			responseTopic: "dyndns/home.example.com",
+			wantPassed:    true,
+		},
+		{
+			name:          "no reply to nested response topic",
+			topic:         "dyndns/home.example.com",
+			responseTopic: "dyndns/responses/client/nested",
+			wantPassed:    true,
+		},
+		{
+			name:          "no reply to wildcard response topic",
+			topic:         "dyndns/home.example.com",
+			responseTopic: "dyndns/responses/#",
+			wantPassed:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan common.UpdateRecordRequest, 1)
+			bus, err := NewMqttV5Server("tcp://127.0.0.1:1883", "dyndns-server", "dyndns/+", nil, requests)
+			if err != nil {
+				t.Fatal(err)
+			}
+			publisher := &recordingConnection{published: make(chan *paho.Publish, 1)}
+			bus.conn = publisher
+
+			payload, err := json.Marshal(common.UpdateRecordRequest{
+				PublicIp: common.DnsRecord{
+					IpV4:      "198.51.100.1",
+					Host:      "home.example.com",
+					Timestamp: time.Now(),
+				},
+				Signature: "signature",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg := &paho.Publish{
+				Topic:   tt.topic,
+				Payload: payload,
+				Properties: &paho.PublishProperties{
+					ResponseTopic:   tt.responseTopic,
+					CorrelationData: []byte("correlation"),
+				},
+			}
+			if _, err := bus.onPublishReceived(paho.PublishReceived{Packet: msg}); err != nil {
+				t.Fatal(err)
+			}
+			if passed := len(requests) == 1; passed != tt.wantPassed {
+				t.Fatalf("expected update request passed = %v, got %v", tt.wantPassed, passed)
+			}
+			if !tt.wantPassed {
+				return
+			}
+
+			req := <-requests
+			req.Done(tt.result)
+			if tt.wantReply == nil {
+				if len(publisher.published) > 0 {
+					t.Fatal("expected no reply")
+				}
+				return
+			}
+
+			reply := <-publisher.published
+			if reply.Topic != tt.responseTopic || string(reply.Properties.CorrelationData) != "correlation" {
+				t.Fatalf("unexpected reply topic %s or correlation data %s", reply.Topic, reply.Properties.CorrelationData)
+			}
+			var got common.UpdateRecordReply
+			if err := json.Unmarshal(reply.Payload, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != *tt.wantReply {
+				t.Fatalf("expected reply %v, got %v", *tt.wantReply, got)
+			}
+		})
+	}
+}
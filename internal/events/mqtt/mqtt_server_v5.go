@@ -0,0 +1,213 @@
+//go:build server
+
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/common"
+)
+
+const replyTimeout = 10 * time.Second
+
+// connection subscribes to the notification topic and publishes replies, implemented by autopaho.ConnectionManager
+type connection interface {
+	Publish(ctx context.Context, publish *paho.Publish) (*paho.PublishResponse, error)
+	Subscribe(ctx context.Context, subscribe *paho.Subscribe) (*paho.Suback, error)
+	Unsubscribe(ctx context.Context, unsubscribe *paho.Unsubscribe) (*paho.Unsuback, error)
+}
+
+// MqttV5Bus receives update requests using MQTT v5. Update requests that carry a response topic are answered with
+// the result of processing them.
+type MqttV5Bus struct {
+	serverSettings
+	config autopaho.ClientConfig
+	broker string
+
+	mutex sync.Mutex
+	conn  connection
+
+	requests chan common.UpdateRecordRequest
+}
+
+// NewMqttV5Server subscribes to the notification topic, which must contain a single-level wildcard that matches the
+// host of the update request
+func NewMqttV5Server(broker string, clientId, notificationTopic string, tlsConfig *tls.Config, reqChan chan common.UpdateRecordRequest, opts ...MqttServerOpts) (*MqttV5Bus, error) {
+	settings, err := newServerSettings(notificationTopic, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	bus := &MqttV5Bus{
+		serverSettings: settings,
+		broker:         broker,
+		requests:       reqChan,
+	}
+
+	bus.config, err = newV5ClientConfig(broker, clientId, tlsConfig, settings.username, settings.password)
+	if err != nil {
+		return nil, err
+	}
+	bus.config.OnConnectionUp = bus.onConnectionUp
+	bus.config.OnPublishReceived = []func(paho.PublishReceived) (bool, error){bus.onPublishReceived}
+
+	return bus, nil
+}
+
+// Listen connects to the broker in the background, the connection is closed when the context is cancelled
+func (s *MqttV5Bus) Listen(ctx context.Context, wg *sync.WaitGroup) error {
+	conn, err := autopaho.NewConnection(ctx, s.config)
+	if err != nil {
+		return fmt.Errorf("could not create connection to broker %s: %w", s.broker, err)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-conn.Done()
+		log.Info().Str("component", "mqtt").Str("broker", s.broker).Msg("Disconnected from mqtt broker")
+	}()
+
+	if s.followsLeader() {
+		go common.WatchLeader(ctx, s.leader, s.onLeaderChange)
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := conn.AwaitConnection(connectCtx); err != nil {
+		log.Error().Err(err).Str("component", "mqtt").Str("broker", s.broker).Msg("Connection to broker failed, continuing in background")
+	}
+
+	return nil
+}
+
+func (s *MqttV5Bus) onConnectionUp(conn *autopaho.ConnectionManager, _ *paho.Connack) {
+	onV5ConnectionUp(s.broker)
+	s.connected(conn)
+}
+
+func (s *MqttV5Bus) connected(conn connection) {
+	s.mutex.Lock()
+	s.conn = conn
+	s.mutex.Unlock()
+
+	// the session ends with the connection, so the subscription needs to be renewed after reconnecting
+	if !s.wantsSubscription() {
+		log.Info().Str("component", "mqtt").Str("broker", s.broker).Msg("Not holding the leader lease, not subscribing")
+		return
+	}
+	s.subscribe(conn)
+}
+
+// onLeaderChange subscribes after acquiring the leader lease and unsubscribes after losing it. While disconnected,
+// the subscription is decided after reconnecting.
+func (s *MqttV5Bus) onLeaderChange(isLeader bool) {
+	s.mutex.Lock()
+	conn := s.conn
+	s.mutex.Unlock()
+	if conn == nil {
+		return
+	}
+
+	if isLeader {
+		s.subscribe(conn)
+		return
+	}
+
+	topic := s.subscriptionTopic()
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if _, err := conn.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{topic}}); err != nil {
+		log.Error().Err(err).Str("component", "mqtt").Str("broker", s.broker).Msgf("Could not unsubscribe from %s", topic)
+		return
+	}
+	log.Info().Str("component", "mqtt").Str("broker", s.broker).Str("topic", topic).Msg("Lost leader lease, unsubscribed from topic")
+}
+
+func (s *MqttV5Bus) subscribe(conn connection) {
+	topic := s.subscriptionTopic()
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	_, err := conn.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{Topic: topic, QoS: s.qos},
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Str("component", "mqtt").Str("broker", s.broker).Msgf("Could not subscribe to %s", topic)
+		return
+	}
+
+	log.Info().Str("component", "mqtt").Str("broker", s.broker).Str("topic", topic).Msg("Subscribed to topic")
+}
+
+func (s *MqttV5Bus) onPublishReceived(received paho.PublishReceived) (bool, error) {
+	msg := received.Packet
+	log.Info().Str("component", "mqtt").Str("broker", s.broker).Msg("Picked up message")
+	env, ok := s.decodeUpdateRequest(s.broker, msg.Topic, msg.Payload)
+	if !ok {
+		return true, nil
+	}
+
+	if msg.Properties != nil && len(msg.Properties.ResponseTopic) > 0 {
+		responseTopic := msg.Properties.ResponseTopic
+		if isResponseTopic(responseTopic) {
+			correlationData := msg.Properties.CorrelationData
+			host := env.PublicIp.Host
+			env = env.WithResultHandler(func(result error) {
+				s.reply(responseTopic, correlationData, host, result)
+			})
+		} else {
+			log.Warn().Str("component", "mqtt").Str("broker", s.broker).Str("topic", responseTopic).Msg("Ignoring invalid response topic")
+		}
+	}
+
+	s.requests <- env
+	return true, nil
+}
+
+// reply publishes the result of processing the update request to the response topic the client has chosen. Update
+// requests that could not be verified are not replied to, as anybody could have sent them, and servers that do not
+// hold the leader lease stay silent.
+func (s *MqttV5Bus) reply(responseTopic string, correlationData []byte, host string, result error) {
+	if common.IsUnverified(result) || errors.Is(result, common.ErrNotLeader) {
+		return
+	}
+
+	data, err := json.Marshal(common.NewUpdateRecordReply(result))
+	if err != nil {
+		log.Error().Err(err).Str("component", "mqtt").Msg("Could not marshal reply")
+		return
+	}
+
+	s.mutex.Lock()
+	conn := s.conn
+	s.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+	defer cancel()
+	_, err = conn.Publish(ctx, &paho.Publish{
+		QoS:     s.qos,
+		Topic:   responseTopic,
+		Payload: data,
+		Properties: &paho.PublishProperties{
+			ContentType:     jsonContentType,
+			CorrelationData: correlationData,
+			User: paho.UserProperties{
+				{Key: userPropertyHost, Value: host},
+			},
+		},
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("component", "mqtt").Str("broker", s.broker).Str("topic", responseTopic).Msg("Could not publish reply")
+	}
+}
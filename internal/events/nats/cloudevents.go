@@ -36,7 +36,7 @@ func NewNatsCloudevents(config *conf.NatsConfig, js jetstream.JetStream) (*Cloud
 		isInitialized: atomic.Bool{},
 	}
 
-	ret.isInitialized.Store(js == nil)
+	ret.isInitialized.Store(js != nil)
 
 	if js == nil {
 		go func() {
@@ -93,6 +93,11 @@ func (n *CloudeventsClient) NotifyUpdatedIpApplied(ip *common.DnsRecord) error {
 	return n.Accept(context.Background(), event)
 }
 
+// NotifyUpdatedIpUnconfirmable is a no-op, as there is no cloudevent for records that could not be verified.
+func (n *CloudeventsClient) NotifyUpdatedIpUnconfirmable(_ *common.DnsRecord) error {
+	return nil
+}
+
 func (n *CloudeventsClient) Accept(ctx context.Context, event cloudevents.Event) error {
 	if !n.isInitialized.Load() {
 		return ErrNotInitialized
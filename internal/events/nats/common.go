@@ -3,6 +3,7 @@ package nats
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -24,7 +25,7 @@ func Close(ctx context.Context, js jetstream.JetStream) error {
 	defer mutex.Unlock()
 
 	c := js.Conn()
-	if c != nil {
+	if c != nil && !c.IsClosed() {
 		err := c.FlushWithContext(ctx)
 		c.Close()
 		delete(connections, js.Conn().ConnectedUrl())
@@ -43,9 +44,14 @@ func Connect(config conf.NatsConfig) (jetstream.JetStream, error) {
 		return js, nil
 	}
 
-	nc, err := nats.Connect(config.Url,
+	authOpts, err := authOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := append([]nats.Option{
 		nats.MaxReconnects(-1),
-		nats.ReconnectWait(5*time.Second),
+		nats.ReconnectWait(5 * time.Second),
 		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
 			log.Warn().Str("component", "nats").Str("url", config.Url).Msg("Disconnected")
 			metrics.NatsConnectionStatus.WithLabelValues(config.Url, "connected").Set(0)
@@ -58,7 +64,10 @@ func Connect(config conf.NatsConfig) (jetstream.JetStream, error) {
 		}),
 		nats.ClosedHandler(func(nc *nats.Conn) {
 			log.Warn().Str("component", "nats").Str("url", config.Url).Msg("Connection closed")
-		}))
+		}),
+	}, authOpts...)
+
+	nc, err := nats.Connect(config.Url, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -75,3 +84,35 @@ func Connect(config conf.NatsConfig) (jetstream.JetStream, error) {
 	connections[config.Url] = js
 	return js, nil
 }
+
+// authOptions builds the options to authenticate against the NATS server and to secure the connection using TLS
+func authOptions(config conf.NatsConfig) ([]nats.Option, error) {
+	var opts []nats.Option
+
+	switch {
+	case len(config.CredsFile) > 0:
+		opts = append(opts, nats.UserCredentials(config.CredsFile))
+	case len(config.NkeySeedFile) > 0:
+		opt, err := nats.NkeyOptionFromSeed(config.NkeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read nkey seed: %w", err)
+		}
+		opts = append(opts, opt)
+	case len(config.Username) > 0:
+		opts = append(opts, nats.UserInfo(config.Username, config.Password))
+	case len(config.Token) > 0:
+		opts = append(opts, nats.Token(config.Token))
+	}
+
+	if len(config.TlsCaCertFile) > 0 {
+		opts = append(opts, nats.RootCAs(config.TlsCaCertFile))
+	}
+	if len(config.TlsClientCertFile) > 0 {
+		opts = append(opts, nats.ClientCert(config.TlsClientCertFile, config.TlsClientKeyFile))
+	}
+	if config.UsesTls() {
+		opts = append(opts, nats.Secure())
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,179 @@
+package nats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/testutil"
+)
+
+// runServer starts an embedded NATS server and returns its client url
+func runServer(t *testing.T, opts *natsserver.Options) string {
+	t.Helper()
+	opts.Host = "127.0.0.1"
+	opts.Port = -1
+	opts.NoLog = true
+	opts.NoSigs = true
+
+	srv, err := natsserver.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+
+	return srv.ClientURL()
+}
+
+func runJetStream(t *testing.T) jetstream.JetStream {
+	t.Helper()
+	url := runServer(t, &natsserver.Options{
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func assertConnect(t *testing.T, config conf.NatsConfig, wantErr bool) {
+	t.Helper()
+	js, err := Connect(config)
+	if (err != nil) != wantErr {
+		t.Fatalf("Connect() error = %v, wantErr %v", err, wantErr)
+	}
+	if js != nil {
+		js.Conn().Close()
+		mutex.Lock()
+		delete(connections, config.Url)
+		mutex.Unlock()
+	}
+}
+
+func TestConnect_UserPassword(t *testing.T) {
+	url := runServer(t, &natsserver.Options{
+		Username: "dyndns",
+		Password: "secret",
+	})
+
+	assertConnect(t, conf.NatsConfig{Url: url}, true)
+	assertConnect(t, conf.NatsConfig{Url: url, Username: "dyndns", Password: "wrong"}, true)
+	assertConnect(t, conf.NatsConfig{Url: url, Username: "dyndns", Password: "secret"}, false)
+}
+
+func TestConnect_Token(t *testing.T) {
+	url := runServer(t, &natsserver.Options{
+		Authorization: "secret-token",
+	})
+
+	assertConnect(t, conf.NatsConfig{Url: url, Token: "wrong"}, true)
+	assertConnect(t, conf.NatsConfig{Url: url, Token: "secret-token"}, false)
+}
+
+func TestConnect_Nkey(t *testing.T) {
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := user.PublicKey()
+	seed, _ := user.Seed()
+
+	url := runServer(t, &natsserver.Options{
+		Nkeys: []*natsserver.NkeyUser{{Nkey: pub}},
+	})
+
+	other, _ := nkeys.CreateUser()
+	otherSeed, _ := other.Seed()
+
+	assertConnect(t, conf.NatsConfig{Url: url, NkeySeedFile: testutil.WriteFile(t, "other.nk", otherSeed)}, true)
+	assertConnect(t, conf.NatsConfig{Url: url, NkeySeedFile: testutil.WriteFile(t, "user.nk", seed)}, false)
+}
+
+func TestConnect_CredsFile(t *testing.T) {
+	operator, _ := nkeys.CreateOperator()
+	operatorPub, _ := operator.PublicKey()
+	operatorClaims := jwt.NewOperatorClaims(operatorPub)
+	if _, err := operatorClaims.Encode(operator); err != nil {
+		t.Fatal(err)
+	}
+
+	account, _ := nkeys.CreateAccount()
+	accountPub, _ := account.PublicKey()
+	accountJwt, err := jwt.NewAccountClaims(accountPub).Encode(operator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, _ := nkeys.CreateUser()
+	userPub, _ := user.PublicKey()
+	userSeed, _ := user.Seed()
+	userJwt, err := jwt.NewUserClaims(userPub).Encode(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := jwt.FormatUserConfig(userJwt, userSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := &natsserver.MemAccResolver{}
+	if err := resolver.Store(accountPub, accountJwt); err != nil {
+		t.Fatal(err)
+	}
+	url := runServer(t, &natsserver.Options{
+		TrustedOperators: []*jwt.OperatorClaims{operatorClaims},
+		AccountResolver:  resolver,
+	})
+
+	assertConnect(t, conf.NatsConfig{Url: url}, true)
+	assertConnect(t, conf.NatsConfig{Url: url, CredsFile: testutil.WriteFile(t, "user.creds", creds)}, false)
+}
+
+func TestConnect_MutualTls(t *testing.T) {
+	certs := testutil.NewCertificates(t)
+	url := runServer(t, &natsserver.Options{
+		TLS:       true,
+		TLSVerify: true,
+		TLSConfig: certs.ServerTlsConfig(true),
+	})
+
+	caFile := testutil.WriteFile(t, "ca.pem", certs.CaPem)
+	assertConnect(t, conf.NatsConfig{Url: url}, true)
+	assertConnect(t, conf.NatsConfig{Url: url, TlsCaCertFile: caFile}, true)
+	assertConnect(t, conf.NatsConfig{
+		Url:               url,
+		TlsCaCertFile:     caFile,
+		TlsClientCertFile: testutil.WriteFile(t, "client.pem", certs.ClientPem),
+		TlsClientKeyFile:  testutil.WriteFile(t, "client-key.pem", certs.ClientKeyPem),
+	}, false)
+}
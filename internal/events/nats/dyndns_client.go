@@ -2,7 +2,6 @@ package nats
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	rand2 "math/rand"
@@ -21,9 +20,10 @@ type NatsDyndnsClient struct {
 
 	js            jetstream.JetStream
 	isInitialized atomic.Bool
+	format        string
 }
 
-func NewNatsDyndnsClient(config *conf.NatsConfig, js jetstream.JetStream) (*NatsDyndnsClient, error) {
+func NewNatsDyndnsClient(config *conf.NatsConfig, js jetstream.JetStream, format string) (*NatsDyndnsClient, error) {
 	if config == nil {
 		return nil, errors.New("nil config supplied")
 	}
@@ -32,9 +32,10 @@ func NewNatsDyndnsClient(config *conf.NatsConfig, js jetstream.JetStream) (*Nats
 		config:        config,
 		js:            js,
 		isInitialized: atomic.Bool{},
+		format:        format,
 	}
 
-	ret.isInitialized.Store(js == nil)
+	ret.isInitialized.Store(js != nil)
 
 	if js == nil {
 		go func() {
@@ -63,17 +64,16 @@ func (n *NatsDyndnsClient) Close(ctx context.Context) error {
 	return Close(ctx, n.js)
 }
 
-func (n *NatsDyndnsClient) Notify(msg *common.UpdateRecordRequest) error {
+func (n *NatsDyndnsClient) Notify(ctx context.Context, msg *common.UpdateRecordRequest) error {
 	if !n.isInitialized.Load() {
 		return ErrNotInitialized
 	}
 
-	data, err := json.Marshal(msg)
+	data, err := common.EncodeUpdateRecordRequest(msg, n.format)
 	if err != nil {
 		return fmt.Errorf("could not marshal envelope: %w", err)
 	}
 
-	ctx := context.Background()
 	ack, err := n.js.PublishMsg(ctx, &nats.Msg{
 		Data:    data,
 		Subject: n.config.DispatchUpdatesSubject,
@@ -4,19 +4,36 @@ package nats
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"log/slog"
+	"fmt"
 	rand2 "math/rand"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/rs/zerolog/log"
 	"github.com/soerenschneider/dyndns/internal/common"
 	"github.com/soerenschneider/dyndns/internal/conf"
 	"github.com/soerenschneider/dyndns/internal/metrics"
+	"go.uber.org/multierr"
+)
+
+const (
+	fetchBatchSize = 3
+	fetchMaxWait   = 1 * time.Second
+	// fetchBackoffMin and fetchBackoffMax limit the delay between fetch attempts after errors
+	fetchBackoffMin = 1 * time.Second
+	fetchBackoffMax = 30 * time.Second
+	// deadLetterTimeout is the maximum duration of publishing a message to the dead-letter subject
+	deadLetterTimeout = 5 * time.Second
+
+	HeaderDeadLetterReason  = "Dyndns-Dead-Letter-Reason"
+	HeaderOriginalSubject   = "Dyndns-Original-Subject"
+	HeaderNumDelivered      = "Dyndns-Num-Delivered"
+	HeaderOriginalStreamSeq = "Dyndns-Original-Stream-Sequence"
 )
 
 type NatsDyndnsServer struct {
@@ -25,20 +42,39 @@ type NatsDyndnsServer struct {
 	js             jetstream.JetStream
 	isOnlyListener bool
 	reqChan        chan common.UpdateRecordRequest
+	leader         common.Leader
 }
 
-func NewNatsDyndnsServer(config *conf.NatsConfig, js jetstream.JetStream, reqChan chan common.UpdateRecordRequest) (*NatsDyndnsServer, error) {
+type NatsDyndnsServerOpts func(s *NatsDyndnsServer) error
+
+func NewNatsDyndnsServer(config *conf.NatsConfig, js jetstream.JetStream, reqChan chan common.UpdateRecordRequest, opts ...NatsDyndnsServerOpts) (*NatsDyndnsServer, error) {
 	if config == nil {
 		return nil, errors.New("nil config supplied")
 	}
 
+	if reqChan == nil {
+		return nil, errors.New("nil channel supplied")
+	}
+
 	ret := &NatsDyndnsServer{
 		config:        config,
 		js:            js,
 		isInitialized: atomic.Bool{},
+		reqChan:       reqChan,
 	}
 
-	ret.isInitialized.Store(js == nil)
+	var errs error
+	for _, opt := range opts {
+		if err := opt(ret); err != nil {
+			errs = multierr.Append(errs, err)
+		}
+	}
+
+	if errs != nil {
+		return nil, errs
+	}
+
+	ret.isInitialized.Store(js != nil)
 
 	if js == nil {
 		go func() {
@@ -59,6 +95,18 @@ func NewNatsDyndnsServer(config *conf.NatsConfig, js jetstream.JetStream, reqCha
 	return ret, nil
 }
 
+// WithLeader lets the listener only fetch messages while the server holds the leader lease, so followers leave the
+// messages of the shared consumer to the leader
+func WithLeader(leader common.Leader) NatsDyndnsServerOpts {
+	return func(s *NatsDyndnsServer) error {
+		if leader == nil {
+			return errors.New("nil leader provided")
+		}
+		s.leader = leader
+		return nil
+	}
+}
+
 func (n *NatsDyndnsServer) Close(ctx context.Context) error {
 	if !n.isInitialized.Load() {
 		return nil
@@ -86,7 +134,9 @@ func (n *NatsDyndnsServer) waitUntilConnected(ctx context.Context) error {
 	return nil
 }
 
-// nolint cyclop
+// Listen fetches update requests from the stream and acknowledges them after they have been processed. Messages that
+// failed to be propagated are redelivered after the configured delay, invalid messages are terminated and published
+// to the dead-letter subject. If a leader has been configured, messages are only fetched while holding the lease.
 func (n *NatsDyndnsServer) Listen(ctx context.Context, wg *sync.WaitGroup) error {
 	wg.Add(1)
 	defer wg.Done()
@@ -95,45 +145,156 @@ func (n *NatsDyndnsServer) Listen(ctx context.Context, wg *sync.WaitGroup) error
 		return err
 	}
 
+	if ctx.Err() != nil {
+		return nil
+	}
+
 	cons, err := n.buildConsumer(ctx)
 	if err != nil {
 		return err
 	}
 
+	backoff := fetchBackoffMin
 	for {
-		msgs, err := cons.Fetch(3, jetstream.FetchMaxWait(1*time.Second))
-		if err != nil {
-			slog.Error("failed to fetch messages from nats stream", "err", err)
-			continue
-		}
-
 		select {
 		case <-ctx.Done():
 			if err := n.js.Conn().FlushTimeout(3 * time.Second); err != nil {
-				slog.Error("could not flush nats connection", "err", err)
+				log.Error().Err(err).Str("component", "nats").Msg("could not flush nats connection")
 			}
 			n.js.Conn().Close()
 			return nil
 		default:
-			for msg := range msgs.Messages() {
-				var env common.UpdateRecordRequest
-				if err := json.Unmarshal(msg.Data(), &env); err != nil {
-					metrics.MessageParsingFailed.Inc()
-					log.Warn().Msgf("Can't parse message: %v", err)
-					continue
-				}
+		}
 
-				n.reqChan <- env
+		if err := common.WaitUntilLeader(ctx, n.leader); err != nil {
+			continue
+		}
+
+		msgs, err := cons.Fetch(fetchBatchSize, jetstream.FetchMaxWait(fetchMaxWait))
+		if err == nil {
+			for msg := range msgs.Messages() {
+				n.handleMessage(ctx, msg)
 			}
+			err = msgs.Error()
+		}
+
+		if err == nil || errors.Is(err, nats.ErrTimeout) {
+			backoff = fetchBackoffMin
+			continue
 		}
 
-		if err := msgs.Error(); err != nil {
-			slog.Error("error while consuming", "err", err)
-			metrics.NatsErrors.WithLabelValues(n.config.Url, "consuming").Inc()
+		log.Error().Err(err).Str("component", "nats").Dur("backoff", backoff).Msg("failed to fetch messages from nats stream")
+		metrics.NatsErrors.WithLabelValues(n.config.Url, "consuming").Inc()
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
 		}
+		backoff = min(2*backoff, fetchBackoffMax)
 	}
 }
 
+// handleMessage passes the update request to the server and settles the message according to the result. If the
+// context is cancelled before the result is known, the message is left unacknowledged and redelivered after AckWait.
+func (n *NatsDyndnsServer) handleMessage(ctx context.Context, msg jetstream.Msg) {
+	env, err := common.DecodeUpdateRecordRequest(msg.Data())
+	if err != nil {
+		metrics.MessageParsingFailed.Inc()
+		log.Warn().Err(err).Str("component", "nats").Msg("Can't parse message")
+		n.settle(ctx, msg, common.Permanent(err))
+		return
+	}
+
+	result := make(chan error, 1)
+	env = env.WithResultHandler(func(err error) {
+		result <- err
+	})
+
+	select {
+	case n.reqChan <- env:
+	case <-ctx.Done():
+		return
+	}
+
+	select {
+	case err := <-result:
+		n.settle(ctx, msg, err)
+	case <-ctx.Done():
+	}
+}
+
+func (n *NatsDyndnsServer) settle(ctx context.Context, msg jetstream.Msg, result error) {
+	var err error
+	var outcome string
+	switch {
+	case result == nil:
+		outcome = "acked"
+		err = msg.Ack()
+	case errors.Is(result, common.ErrNotLeader):
+		// the lease has been lost while processing the message, hand it over to the new leader right away. This is
+		// not a failed delivery attempt, so the message is never dead-lettered.
+		outcome = "released"
+		err = msg.Nak()
+	case common.IsPermanent(result) || n.isLastDelivery(msg):
+		outcome = "terminated"
+		n.deadLetter(ctx, msg, result)
+		err = msg.TermWithReason(result.Error())
+	default:
+		outcome = "nacked"
+		err = msg.NakWithDelay(n.config.RedeliveryDelay)
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("component", "nats").Str("outcome", outcome).Msg("Could not settle message")
+		metrics.NatsErrors.WithLabelValues(n.config.Url, "settling").Inc()
+		return
+	}
+	metrics.NatsMessagesSettled.WithLabelValues(outcome).Inc()
+}
+
+// isLastDelivery returns whether the message will not be redelivered by the consumer anymore
+func (n *NatsDyndnsServer) isLastDelivery(msg jetstream.Msg) bool {
+	if n.config.MaxDeliver <= 0 {
+		return false
+	}
+
+	meta, err := msg.Metadata()
+	if err != nil {
+		return false
+	}
+
+	return meta.NumDelivered >= uint64(n.config.MaxDeliver) //nolint G115
+}
+
+// deadLetter publishes the message to the dead-letter subject, if configured. The subject must be bound to a stream.
+func (n *NatsDyndnsServer) deadLetter(ctx context.Context, msg jetstream.Msg, reason error) {
+	if len(n.config.DeadLetterSubject) == 0 {
+		return
+	}
+
+	header := nats.Header{}
+	header.Set(HeaderDeadLetterReason, reason.Error())
+	header.Set(HeaderOriginalSubject, msg.Subject())
+	if meta, err := msg.Metadata(); err == nil {
+		header.Set(HeaderNumDelivered, strconv.FormatUint(meta.NumDelivered, 10))
+		header.Set(HeaderOriginalStreamSeq, strconv.FormatUint(meta.Sequence.Stream, 10))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, deadLetterTimeout)
+	defer cancel()
+
+	_, err := n.js.PublishMsg(ctx, &nats.Msg{
+		Subject: n.config.DeadLetterSubject,
+		Data:    msg.Data(),
+		Header:  header,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("component", "nats").Str("subject", n.config.DeadLetterSubject).Msg("Could not publish message to dead-letter subject")
+		metrics.NatsErrors.WithLabelValues(n.config.Url, "dead_letter").Inc()
+		return
+	}
+	metrics.NatsMessagesSettled.WithLabelValues("dead_lettered").Inc()
+}
+
 func (n *NatsDyndnsServer) buildConsumer(ctx context.Context) (jetstream.Consumer, error) {
 	stream, err := n.js.CreateStream(ctx, jetstream.StreamConfig{
 		Name:     n.config.StreamName,
@@ -145,12 +306,14 @@ func (n *NatsDyndnsServer) buildConsumer(ctx context.Context) (jetstream.Consume
 
 	var cons jetstream.Consumer
 	cons, err = stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
-		Name:      n.config.ConsumerName,
-		Durable:   n.config.ConsumerName,
-		AckPolicy: jetstream.AckNonePolicy,
+		Name:       n.config.ConsumerName,
+		Durable:    n.config.ConsumerName,
+		AckPolicy:  jetstream.AckExplicitPolicy,
+		AckWait:    n.config.AckWait,
+		MaxDeliver: n.config.MaxDeliver,
 	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("could not create consumer '%s': %w", n.config.ConsumerName, err)
 	}
 
 	return cons, nil
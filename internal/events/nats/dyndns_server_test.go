@@ -0,0 +1,304 @@
+//go:build server
+
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+// scriptedServer plays the dyndns server, reporting the scripted results for each host in order
+type scriptedServer struct {
+	mutex    sync.Mutex
+	results  map[string][]error
+	attempts map[string]int
+}
+
+func (s *scriptedServer) run(requests chan common.UpdateRecordRequest) {
+	for req := range requests {
+		s.mutex.Lock()
+		host := req.PublicIp.Host
+		var result error
+		if attempt := s.attempts[host]; attempt < len(s.results[host]) {
+			result = s.results[host][attempt]
+		}
+		s.attempts[host]++
+		s.mutex.Unlock()
+		req.Done(result)
+	}
+}
+
+func (s *scriptedServer) getAttempts() map[string]int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ret := make(map[string]int, len(s.attempts))
+	for host, attempts := range s.attempts {
+		ret[host] = attempts
+	}
+	return ret
+}
+
+type fakeLeader struct {
+	leader atomic.Bool
+}
+
+func (l *fakeLeader) IsLeader() bool {
+	return l.leader.Load()
+}
+
+func TestNatsDyndnsServer_Listen(t *testing.T) {
+	ctx := context.Background()
+	js := runJetStream(t)
+
+	dlq, err := js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:     "dyndns-dlq",
+		Subjects: []string{"dyndns.dlq"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &conf.NatsConfig{
+		StreamName:            "dyndns",
+		ListenUpdatesSubjects: []string{"dyndns.updates.>"},
+		ConsumerName:          "dyndns-server",
+		AckWait:               5 * time.Second,
+		MaxDeliver:            3,
+		RedeliveryDelay:       50 * time.Millisecond,
+		DeadLetterSubject:     "dyndns.dlq",
+	}
+
+	transient := errors.New("route53 unavailable")
+	server := &scriptedServer{
+		results: map[string][]error{
+			"ok":        {nil},
+			"retry":     {transient, nil},
+			"invalid":   {common.Permanent(errors.New("verifying signature FAILED"))},
+			"exhausted": {transient, transient, transient},
+		},
+		attempts: map[string]int{},
+	}
+
+	requests := make(chan common.UpdateRecordRequest)
+	go server.run(requests)
+	defer close(requests)
+
+	listener, err := NewNatsDyndnsServer(config, js, requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listenCtx, cancel := context.WithCancel(ctx)
+	wg := &sync.WaitGroup{}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- listener.Listen(listenCtx, wg)
+	}()
+	defer func() {
+		cancel()
+		if err := <-listenErr; err != nil {
+			t.Error(err)
+		}
+		wg.Wait()
+	}()
+
+	// wait until the listener created the stream
+	waitFor(t, func() bool {
+		_, err := js.Stream(ctx, "dyndns")
+		return err == nil
+	})
+
+	for _, host := range []string{"ok", "retry", "invalid", "exhausted"} {
+		payload, err := json.Marshal(common.UpdateRecordRequest{
+			PublicIp: common.DnsRecord{
+				IpV4:      "198.51.100.1",
+				Host:      host,
+				Timestamp: time.Now(),
+			},
+			Signature: "signature-" + host,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := js.Publish(ctx, "dyndns.updates."+host, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := js.Publish(ctx, "dyndns.updates.garbage", []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+
+	wantAttempts := map[string]int{"ok": 1, "retry": 2, "invalid": 1, "exhausted": 3}
+	waitFor(t, func() bool {
+		info, err := dlq.Info(ctx)
+		if err != nil || info.State.Msgs != 3 {
+			return false
+		}
+		attempts := server.getAttempts()
+		for host, want := range wantAttempts {
+			if attempts[host] != want {
+				return false
+			}
+		}
+		return true
+	})
+
+	cons, err := js.Consumer(ctx, "dyndns", "dyndns-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		info, err := cons.Info(ctx)
+		return err == nil && info.NumAckPending == 0 && info.NumPending == 0
+	})
+
+	dlqCons, err := dlq.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := dlqCons.FetchNoWait(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var subjects []string
+	for msg := range batch.Messages() {
+		if len(msg.Headers().Get(HeaderDeadLetterReason)) == 0 {
+			t.Errorf("dead-lettered message is missing reason")
+		}
+		subjects = append(subjects, msg.Headers().Get(HeaderOriginalSubject))
+	}
+	sort.Strings(subjects)
+
+	want := []string{"dyndns.updates.exhausted", "dyndns.updates.garbage", "dyndns.updates.invalid"}
+	if len(subjects) != len(want) {
+		t.Fatalf("expected dead-lettered subjects %v, got %v", want, subjects)
+	}
+	for i := range want {
+		if subjects[i] != want[i] {
+			t.Fatalf("expected dead-lettered subjects %v, got %v", want, subjects)
+		}
+	}
+
+	// no further redeliveries after the messages have been settled
+	time.Sleep(200 * time.Millisecond)
+	attempts := server.getAttempts()
+	for host, want := range wantAttempts {
+		if attempts[host] != want {
+			t.Fatalf("expected %d attempts for host %s, got %d", want, host, attempts[host])
+		}
+	}
+}
+
+func TestNatsDyndnsServer_ListenAsFollower(t *testing.T) {
+	ctx := context.Background()
+	js := runJetStream(t)
+
+	dlq, err := js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:     "dyndns-dlq",
+		Subjects: []string{"dyndns.dlq"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &conf.NatsConfig{
+		StreamName:            "dyndns",
+		ListenUpdatesSubjects: []string{"dyndns.updates.>"},
+		ConsumerName:          "dyndns-server",
+		AckWait:               5 * time.Second,
+		MaxDeliver:            2,
+		RedeliveryDelay:       50 * time.Millisecond,
+		DeadLetterSubject:     "dyndns.dlq",
+	}
+
+	server := &scriptedServer{
+		results: map[string][]error{
+			// the lease is lost while processing the message twice, which must not be counted as failed delivery
+			"handover": {common.ErrNotLeader, common.ErrNotLeader},
+		},
+		attempts: map[string]int{},
+	}
+
+	requests := make(chan common.UpdateRecordRequest)
+	go server.run(requests)
+	defer close(requests)
+
+	leader := &fakeLeader{}
+	listener, err := NewNatsDyndnsServer(config, js, requests, WithLeader(leader))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listenCtx, cancel := context.WithCancel(ctx)
+	wg := &sync.WaitGroup{}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- listener.Listen(listenCtx, wg)
+	}()
+	defer func() {
+		cancel()
+		if err := <-listenErr; err != nil {
+			t.Error(err)
+		}
+		wg.Wait()
+	}()
+
+	waitFor(t, func() bool {
+		_, err := js.Consumer(ctx, "dyndns", "dyndns-server")
+		return err == nil
+	})
+
+	payload, err := json.Marshal(common.UpdateRecordRequest{
+		PublicIp: common.DnsRecord{
+			IpV4:      "198.51.100.1",
+			Host:      "handover",
+			Timestamp: time.Now(),
+		},
+		Signature: "signature-handover",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.Publish(ctx, "dyndns.updates.handover", payload); err != nil {
+		t.Fatal(err)
+	}
+
+	// followers must not consume the message
+	time.Sleep(1500 * time.Millisecond)
+	if attempts := server.getAttempts()["handover"]; attempts != 0 {
+		t.Fatalf("expected follower not to consume messages, got %d attempts", attempts)
+	}
+
+	leader.leader.Store(true)
+	waitFor(t, func() bool {
+		return server.getAttempts()["handover"] == 2
+	})
+
+	cons, err := js.Consumer(ctx, "dyndns", "dyndns-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		info, err := cons.Info(ctx)
+		return err == nil && info.NumAckPending == 0
+	})
+
+	info, err := dlq.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 0 {
+		t.Fatalf("expected messages handed over to the leader not to be dead-lettered, got %d", info.State.Msgs)
+	}
+}
@@ -0,0 +1,125 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+// recordLookupTimeout is the maximum duration of looking up a record in the bucket
+const recordLookupTimeout = 5 * time.Second
+
+// NatsRecordStore keeps the last record that has been applied by a server for each host in a NATS KV bucket. Servers
+// write records after propagating a change, clients look up and watch their hosts' records instead of querying DNS.
+type NatsRecordStore struct {
+	kv jetstream.KeyValue
+}
+
+// NewNatsRecordStore binds to the bucket, which is created if it does not exist yet
+func NewNatsRecordStore(ctx context.Context, js jetstream.JetStream, bucket string) (*NatsRecordStore, error) {
+	if js == nil {
+		return nil, errors.New("nil jetstream supplied")
+	}
+
+	kv, err := js.KeyValue(ctx, bucket)
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
+			Bucket:      bucket,
+			Description: "Records applied by dyndns servers",
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not bind kv bucket %s: %w", bucket, err)
+	}
+
+	return &NatsRecordStore{kv: kv}, nil
+}
+
+// Put stores the record that has been applied for its host
+func (s *NatsRecordStore) Put(ctx context.Context, record common.DnsRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("could not marshal record: %w", err)
+	}
+
+	if _, err := s.kv.Put(ctx, record.Host, data); err != nil {
+		return fmt.Errorf("could not store record for host %s: %w", record.Host, err)
+	}
+	return nil
+}
+
+// Get returns the record that has been applied for the host, nil if no record has been applied yet
+func (s *NatsRecordStore) Get(ctx context.Context, host string) (*common.DnsRecord, error) {
+	entry, err := s.kv.Get(ctx, host)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get record for host %s: %w", host, err)
+	}
+
+	var record common.DnsRecord
+	if err := json.Unmarshal(entry.Value(), &record); err != nil {
+		return nil, fmt.Errorf("could not parse record for host %s: %w", host, err)
+	}
+	return &record, nil
+}
+
+// Lookup implements util.RecordVerifier by returning the address of the applied record for the address family
+func (s *NatsRecordStore) Lookup(host string, addressFamily string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), recordLookupTimeout)
+	defer cancel()
+
+	record, err := s.Get(ctx, host)
+	if err != nil || record == nil {
+		return []string{}, err
+	}
+
+	ip := record.IpV4
+	if addressFamily == conf.AddrFamilyIpv6 {
+		ip = record.IpV6
+	}
+	if len(ip) == 0 {
+		return []string{}, nil
+	}
+	return []string{ip}, nil
+}
+
+// Watch invokes the callback for each record of the given hosts that is applied until the context is done
+func (s *NatsRecordStore) Watch(ctx context.Context, hosts []string, onApplied func(record common.DnsRecord)) error {
+	watcher, err := s.kv.WatchFiltered(ctx, hosts, jetstream.UpdatesOnly(), jetstream.IgnoreDeletes())
+	if err != nil {
+		return fmt.Errorf("could not watch records: %w", err)
+	}
+	defer func() {
+		_ = watcher.Stop()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return errors.New("watcher stopped")
+			}
+			if entry == nil {
+				continue
+			}
+
+			var record common.DnsRecord
+			if err := json.Unmarshal(entry.Value(), &record); err != nil {
+				log.Warn().Err(err).Str("component", "nats").Str("key", entry.Key()).Msg("Could not parse applied record")
+				continue
+			}
+			onApplied(record)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package nats
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+func TestNatsRecordStore(t *testing.T) {
+	ctx := context.Background()
+	js := runJetStream(t)
+
+	server, err := NewNatsRecordStore(ctx, js, "dyndns-records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewNatsRecordStore(ctx, js, "dyndns-records")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips, err := client.Lookup("home.example.com", conf.AddrFamilyIpv4)
+	if err != nil || len(ips) != 0 {
+		t.Fatalf("expected no record before it has been applied, got %v, %v", ips, err)
+	}
+
+	var mutex sync.Mutex
+	var applied []string
+	watchCtx, cancel := context.WithCancel(ctx)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- client.Watch(watchCtx, []string{"home.example.com"}, func(record common.DnsRecord) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			applied = append(applied, record.Host)
+		})
+	}()
+	defer func() {
+		cancel()
+		if err := <-watchErr; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// give the watcher time to subscribe, updates before are not reported
+	time.Sleep(100 * time.Millisecond)
+
+	records := []common.DnsRecord{
+		{Host: "other.example.com", IpV4: "198.51.100.2", Timestamp: time.Now()},
+		{Host: "home.example.com", IpV4: "198.51.100.1", IpV6: "2001:db8::1", Timestamp: time.Now()},
+	}
+	for _, record := range records {
+		if err := server.Put(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(applied) > 0
+	})
+	mutex.Lock()
+	if !slices.Equal(applied, []string{"home.example.com"}) {
+		t.Fatalf("expected only watched host to be reported, got %v", applied)
+	}
+	mutex.Unlock()
+
+	tests := []struct {
+		addressFamily string
+		want          string
+	}{
+		{addressFamily: conf.AddrFamilyIpv4, want: "198.51.100.1"},
+		{addressFamily: conf.AddrFamilyIpv6, want: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		ips, err := client.Lookup("home.example.com", tt.addressFamily)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(ips, []string{tt.want}) {
+			t.Fatalf("Lookup(%s) = %v, want %v", tt.addressFamily, ips, tt.want)
+		}
+	}
+}
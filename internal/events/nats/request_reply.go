@@ -0,0 +1,69 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+// NatsRequestReplyClient sends update requests using NATS request-reply. Other than publishing to a stream, the
+// update request is only considered delivered after a server has verified and propagated it.
+type NatsRequestReplyClient struct {
+	config *conf.NatsConfig
+	js     jetstream.JetStream
+	format string
+}
+
+func NewNatsRequestReplyClient(config *conf.NatsConfig, js jetstream.JetStream, format string) (*NatsRequestReplyClient, error) {
+	if config == nil {
+		return nil, errors.New("nil config supplied")
+	}
+
+	if js == nil {
+		return nil, errors.New("nil jetstream supplied")
+	}
+
+	return &NatsRequestReplyClient{
+		config: config,
+		js:     js,
+		format: format,
+	}, nil
+}
+
+func (n *NatsRequestReplyClient) Close(ctx context.Context) error {
+	return Close(ctx, n.js)
+}
+
+func (n *NatsRequestReplyClient) Notify(ctx context.Context, msg *common.UpdateRecordRequest) error {
+	data, err := common.EncodeUpdateRecordRequest(msg, n.format)
+	if err != nil {
+		return fmt.Errorf("could not marshal envelope: %w", err)
+	}
+
+	resp, err := n.js.Conn().RequestMsgWithContext(ctx, &nats.Msg{
+		Data:    data,
+		Subject: n.config.RequestReplySubject,
+	})
+	if err != nil {
+		return fmt.Errorf("no reply received: %w", err)
+	}
+
+	var reply common.UpdateRecordReply
+	if err := json.Unmarshal(resp.Data, &reply); err != nil {
+		return fmt.Errorf("could not parse reply: %w", err)
+	}
+
+	if err := reply.Err(); err != nil {
+		return err
+	}
+
+	log.Debug().Str("component", "nats").Str("host", msg.PublicIp.Host).Msg("Update request has been processed by server")
+	return nil
+}
@@ -0,0 +1,114 @@
+//go:build server
+
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/metrics"
+)
+
+// requestReplyQueueGroup makes sure each update request is only processed by a single server
+const requestReplyQueueGroup = "dyndns-server"
+
+// NatsRequestReplyServer receives update requests via NATS request-reply and replies with the outcome of processing
+// them
+type NatsRequestReplyServer struct {
+	config  *conf.NatsConfig
+	js      jetstream.JetStream
+	reqChan chan common.UpdateRecordRequest
+}
+
+func NewNatsRequestReplyServer(config *conf.NatsConfig, js jetstream.JetStream, reqChan chan common.UpdateRecordRequest) (*NatsRequestReplyServer, error) {
+	if config == nil {
+		return nil, errors.New("nil config supplied")
+	}
+
+	if js == nil {
+		return nil, errors.New("nil jetstream supplied")
+	}
+
+	if reqChan == nil {
+		return nil, errors.New("nil channel supplied")
+	}
+
+	return &NatsRequestReplyServer{
+		config:  config,
+		js:      js,
+		reqChan: reqChan,
+	}, nil
+}
+
+func (n *NatsRequestReplyServer) Listen(ctx context.Context, wg *sync.WaitGroup) error {
+	wg.Add(1)
+	defer wg.Done()
+
+	sub, err := n.js.Conn().QueueSubscribe(n.config.RequestReplySubject, requestReplyQueueGroup, func(msg *nats.Msg) {
+		n.handleRequest(ctx, msg)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("component", "nats").Str("subject", n.config.RequestReplySubject).Msg("Listening for update requests")
+	<-ctx.Done()
+	if err := sub.Drain(); err != nil {
+		log.Error().Err(err).Str("component", "nats").Msg("could not drain subscription")
+	}
+
+	return nil
+}
+
+func (n *NatsRequestReplyServer) handleRequest(ctx context.Context, msg *nats.Msg) {
+	env, err := common.DecodeUpdateRecordRequest(msg.Data)
+	if err != nil {
+		metrics.MessageParsingFailed.Inc()
+		log.Warn().Err(err).Str("component", "nats").Msg("Can't parse message")
+		n.reply(msg, common.Permanent(err))
+		return
+	}
+
+	result := make(chan error, 1)
+	env = env.WithResultHandler(func(err error) {
+		result <- err
+	})
+
+	select {
+	case n.reqChan <- env:
+	case <-ctx.Done():
+		return
+	}
+
+	select {
+	case err := <-result:
+		n.reply(msg, err)
+	case <-ctx.Done():
+	}
+}
+
+// reply sends the outcome of processing the update request to the requester. Servers that do not hold the leader
+// lease stay silent, the requester retries after its timeout and may reach the leader.
+func (n *NatsRequestReplyServer) reply(msg *nats.Msg, result error) {
+	if len(msg.Reply) == 0 || errors.Is(result, common.ErrNotLeader) {
+		return
+	}
+
+	data, err := json.Marshal(common.NewUpdateRecordReply(result))
+	if err != nil {
+		log.Error().Err(err).Str("component", "nats").Msg("could not marshal reply")
+		return
+	}
+
+	if err := msg.Respond(data); err != nil {
+		log.Error().Err(err).Str("component", "nats").Msg("could not reply to update request")
+		metrics.NatsErrors.WithLabelValues(n.config.Url, "reply").Inc()
+	}
+}
@@ -0,0 +1,137 @@
+//go:build server
+
+package nats
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+func TestNatsRequestReply(t *testing.T) {
+	nc, err := nats.Connect(runServer(t, &natsserver.Options{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &conf.NatsConfig{
+		RequestReplySubject: "dyndns.requests",
+	}
+
+	client, err := NewNatsRequestReplyClient(config, js, common.PayloadFormatCloudEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &common.UpdateRecordRequest{
+		PublicIp: common.DnsRecord{
+			IpV4:      "198.51.100.1",
+			Host:      "ok",
+			Timestamp: time.Now(),
+		},
+		Signature: "signature",
+	}
+
+	// no server is listening yet
+	if err := client.Notify(context.Background(), req); !errors.Is(err, nats.ErrNoResponders) {
+		t.Fatalf("expected ErrNoResponders, got %v", err)
+	}
+
+	server := &scriptedServer{
+		results: map[string][]error{
+			"ok":       {nil},
+			"retry":    {errors.New("route53 unavailable")},
+			"invalid":  {common.Permanent(errors.New("verifying signature FAILED"))},
+			"follower": {common.ErrNotLeader},
+		},
+		attempts: map[string]int{},
+	}
+	requests := make(chan common.UpdateRecordRequest)
+	go server.run(requests)
+	defer close(requests)
+
+	listener, err := NewNatsRequestReplyServer(config, js, requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- listener.Listen(ctx, wg)
+	}()
+	defer func() {
+		cancel()
+		if err := <-listenErr; err != nil {
+			t.Error(err)
+		}
+		wg.Wait()
+	}()
+
+	// wait until the listener subscribed
+	waitFor(t, func() bool {
+		return client.Notify(context.Background(), req) == nil
+	})
+
+	tests := []struct {
+		host          string
+		wantErr       bool
+		wantPermanent bool
+		wantNoReply   bool
+	}{
+		{
+			host: "ok",
+		},
+		{
+			host:    "retry",
+			wantErr: true,
+		},
+		{
+			host:          "invalid",
+			wantErr:       true,
+			wantPermanent: true,
+		},
+		{
+			host:        "follower",
+			wantErr:     true,
+			wantNoReply: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			req := *req
+			req.PublicIp.Host = tt.host
+			timeout := 5 * time.Second
+			if tt.wantNoReply {
+				timeout = 500 * time.Millisecond
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			err := client.Notify(ctx, &req)
+			if tt.wantNoReply && !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expected no reply, got %v", err)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Notify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if common.IsPermanent(err) != tt.wantPermanent {
+				t.Fatalf("Notify() permanent = %v, want %v", common.IsPermanent(err), tt.wantPermanent)
+			}
+		})
+	}
+}
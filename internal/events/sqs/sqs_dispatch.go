@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -18,27 +20,61 @@ import (
 	"go.uber.org/multierr"
 )
 
-const defaultWaitTimeSeconds = 20
+const (
+	defaultWaitTimeSeconds   = 20
+	defaultVisibilityTimeout = 30 * time.Second
+	maxNumberOfMessages      = 10
+	// receiveBackoffMin and receiveBackoffMax limit the delay between receive attempts after errors
+	receiveBackoffMin = 1 * time.Second
+	receiveBackoffMax = 30 * time.Second
+	// settleTimeout is the maximum duration of deleting processed and releasing unprocessed messages, which is done
+	// even after the context has been cancelled, as the messages would be processed again or stay hidden otherwise
+	settleTimeout = 10 * time.Second
+)
 
 type SqsListener struct {
 	client   *sqs.SQS
 	queueUrl string
 	requests chan common.UpdateRecordRequest
 
-	waitTimeSeconds int64
+	waitTimeSeconds   int64
+	visibilityTimeout time.Duration
+	// maxReceiveCount is the number of receives after which SQS moves a message to the dead-letter queue, 0 if the
+	// queue has no redrive policy
+	maxReceiveCount int64
+	leader          common.Leader
 }
 
+// settlement is what happens to a message after it has been handled
+type settlement int
+
+const (
+	// settlementDelete deletes the message, it has been processed or can never be processed
+	settlementDelete settlement = iota
+	// settlementRedeliver leaves the message in the queue, it's redelivered after its visibility timeout expired
+	settlementRedeliver
+	// settlementRelease makes the message visible again right away, so another server can process it
+	settlementRelease
+)
+
 type SqsOpts func(consumer *SqsListener) error
 
+// redrivePolicy is the queue attribute that configures the dead-letter queue
+type redrivePolicy struct {
+	DeadLetterTargetArn string      `json:"deadLetterTargetArn"`
+	MaxReceiveCount     json.Number `json:"maxReceiveCount"`
+}
+
 func NewSqsConsumer(sqsConf conf.SqsConfig, provider credentials.Provider, reqChan chan common.UpdateRecordRequest, opts ...SqsOpts) (*SqsListener, error) {
 	if reqChan == nil {
 		return nil, errors.New("empty chan provided")
 	}
 
 	ret := &SqsListener{
-		queueUrl:        sqsConf.SqsQueue,
-		requests:        reqChan,
-		waitTimeSeconds: defaultWaitTimeSeconds,
+		queueUrl:          sqsConf.SqsQueue,
+		requests:          reqChan,
+		waitTimeSeconds:   defaultWaitTimeSeconds,
+		visibilityTimeout: defaultVisibilityTimeout,
 	}
 
 	var errs error
@@ -55,6 +91,9 @@ func NewSqsConsumer(sqsConf conf.SqsConfig, provider credentials.Provider, reqCh
 	awsConf := &aws.Config{
 		Region: aws.String(sqsConf.Region),
 	}
+	if len(sqsConf.Endpoint) > 0 {
+		awsConf.Endpoint = aws.String(sqsConf.Endpoint)
+	}
 
 	if provider != nil {
 		log.Info().Str("component", "sqs").Msg("Building AWS client using given credentials provider")
@@ -66,87 +105,399 @@ func NewSqsConsumer(sqsConf conf.SqsConfig, provider credentials.Provider, reqCh
 	return ret, nil
 }
 
+// WithWaitTime sets the maximum duration a receive call waits for messages to arrive
+func WithWaitTime(waitTime time.Duration) SqsOpts {
+	return func(consumer *SqsListener) error {
+		if waitTime < 0 || waitTime > 20*time.Second {
+			return fmt.Errorf("wait time must be between 0s and 20s, got %v", waitTime)
+		}
+		consumer.waitTimeSeconds = int64(waitTime.Seconds())
+		return nil
+	}
+}
+
+// WithVisibilityTimeout sets the duration received messages are hidden from other consumers. The visibility timeout
+// is extended while a message is being processed, messages that failed to be processed are redelivered after it
+// expired.
+func WithVisibilityTimeout(timeout time.Duration) SqsOpts {
+	return func(consumer *SqsListener) error {
+		if timeout < 2*time.Second || timeout > 12*time.Hour {
+			return fmt.Errorf("visibility timeout must be between 2s and 12h, got %v", timeout)
+		}
+		consumer.visibilityTimeout = timeout
+		return nil
+	}
+}
+
+// WithLeader lets the listener only poll the queue while the server holds the leader lease, so followers leave the
+// messages to the leader instead of increasing their receive count
+func WithLeader(leader common.Leader) SqsOpts {
+	return func(consumer *SqsListener) error {
+		if leader == nil {
+			return errors.New("nil leader provided")
+		}
+		consumer.leader = leader
+		return nil
+	}
+}
+
+// Listen continuously long-polls the queue until the context is cancelled. Messages are deleted after they have been
+// processed successfully or failed permanently, other messages are redelivered by SQS after their visibility timeout
+// expired and are moved to the dead-letter queue by SQS after exceeding the queue's maxReceiveCount. If a leader has
+// been configured, the queue is only polled while holding the lease.
 func (h *SqsListener) Listen(ctx context.Context, wg *sync.WaitGroup) error {
 	wg.Add(1)
-	ticker := time.NewTicker(1 * time.Minute)
-	if err := h.fetchMessages(ctx); err != nil {
-		log.Error().Err(err).Str("component", "sqs").Msg("Fetching messages failed")
-	}
+	defer wg.Done()
+
+	h.readRedrivePolicy(ctx)
 
+	backoff := receiveBackoffMin
 	for {
-		select {
-		case <-ctx.Done():
+		if ctx.Err() != nil {
 			log.Info().Str("component", "sqs").Msg("Received signal, stopping listener")
-			wg.Done()
 			return nil
-		case <-ticker.C:
-			if err := h.fetchMessages(ctx); err != nil {
-				log.Error().Err(err).Str("component", "sqs").Msg("Fetching messages failed")
-			}
 		}
+
+		if err := common.WaitUntilLeader(ctx, h.leader); err != nil {
+			continue
+		}
+
+		err := h.fetchMessages(ctx)
+		if err == nil || ctx.Err() != nil {
+			backoff = receiveBackoffMin
+			continue
+		}
+
+		log.Error().Err(err).Str("component", "sqs").Dur("backoff", backoff).Msg("Fetching messages failed")
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, receiveBackoffMax)
 	}
 }
 
+// readRedrivePolicy reads the queue's dead-letter queue configuration, which is only used for logging
+func (h *SqsListener) readRedrivePolicy(ctx context.Context) {
+	metrics.SqsApiCalls.WithLabelValues("get_queue_attributes").Inc()
+	result, err := h.client.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(h.queueUrl),
+		AttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameRedrivePolicy}),
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("component", "sqs").Msg("Could not read redrive policy of queue")
+		return
+	}
+
+	policy, ok := result.Attributes[sqs.QueueAttributeNameRedrivePolicy]
+	if !ok || policy == nil {
+		log.Warn().Str("component", "sqs").Msg("Queue has no dead-letter queue configured, messages that can not be processed are retried until they expire")
+		return
+	}
+
+	var redrive redrivePolicy
+	if err := json.Unmarshal([]byte(*policy), &redrive); err != nil {
+		log.Warn().Err(err).Str("component", "sqs").Msg("Could not parse redrive policy of queue")
+		return
+	}
+	maxReceiveCount, err := redrive.MaxReceiveCount.Int64()
+	if err != nil {
+		log.Warn().Err(err).Str("component", "sqs").Msg("Could not parse maxReceiveCount of redrive policy")
+		return
+	}
+
+	h.maxReceiveCount = maxReceiveCount
+	log.Info().Str("component", "sqs").Str("dlq", redrive.DeadLetterTargetArn).Int64("max_receive_count", maxReceiveCount).Msg("Messages that can not be processed are moved to the dead-letter queue")
+}
+
 func (h *SqsListener) fetchMessages(ctx context.Context) error {
 	log.Debug().Str("component", "sqs").Msg("Trying to receive messages")
 	metrics.SqsApiCalls.WithLabelValues("receive_message").Inc()
 	result, err := h.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
-		QueueUrl:            aws.String(h.queueUrl),
-		MaxNumberOfMessages: aws.Int64(10),
-		VisibilityTimeout:   aws.Int64(30),
-		WaitTimeSeconds:     aws.Int64(h.waitTimeSeconds),
+		QueueUrl:                    aws.String(h.queueUrl),
+		MaxNumberOfMessages:         aws.Int64(maxNumberOfMessages),
+		VisibilityTimeout:           aws.Int64(int64(h.visibilityTimeout.Seconds())),
+		WaitTimeSeconds:             aws.Int64(h.waitTimeSeconds),
+		MessageSystemAttributeNames: aws.StringSlice([]string{sqs.MessageSystemAttributeNameApproximateReceiveCount, sqs.MessageSystemAttributeNameMessageGroupId}),
+		MessageAttributeNames:       aws.StringSlice([]string{common.MetadataHost, common.MetadataSchemaVersion}),
 	})
 	if err != nil {
 		return err
 	}
 
-	var errs error
-	for _, message := range result.Messages {
-		if err := h.handleMessage(message); err != nil {
-			errs = multierr.Append(errs, err)
+	if len(result.Messages) > 0 {
+		h.handleMessages(ctx, result.Messages)
+	}
+	return nil
+}
+
+// handleMessages processes the messages in the order they have been received, extending their visibility timeout
+// until they have been settled, and deletes all messages that do not need to be redelivered in a single batch. If the
+// leader lease is lost, the remaining messages are released to the new leader without processing them. Messages of a
+// FIFO message group that follow a message that is going to be redelivered are released without processing them as
+// well, otherwise the record could regress to a stale IP once the failed message is redelivered.
+func (h *SqsListener) handleMessages(ctx context.Context, messages []*sqs.Message) {
+	inFlight := newInFlightMessages(messages)
+
+	extendCtx, cancel := context.WithCancel(ctx)
+	extenderDone := make(chan struct{})
+	go func() {
+		defer close(extenderDone)
+		h.extendVisibility(extendCtx, inFlight)
+	}()
+
+	var processed, released []*sqs.Message
+	failedGroups := map[string]bool{}
+	for index, message := range messages {
+		groupId := aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+		if failedGroups[groupId] {
+			log.Info().Str("component", "sqs").Str("message_id", aws.StringValue(message.MessageId)).Str("group_id", groupId).Msg("Earlier message of group is going to be redelivered, releasing message")
+			released = append(released, message)
+			continue
+		}
+
+		settlement := h.handleMessage(ctx, message)
+		if settlement == settlementRelease {
+			released = append(released, messages[index:]...)
+			break
+		}
+
+		if settlement == settlementDelete {
+			processed = append(processed, message)
+		} else {
+			inFlight.remove(message)
+			if len(groupId) > 0 {
+				failedGroups[groupId] = true
+			}
 		}
 	}
 
-	return errs
+	// stop extending before settling, otherwise released messages could be hidden again
+	cancel()
+	<-extenderDone
+
+	settleCtx, settleCancel := context.WithTimeout(context.WithoutCancel(ctx), settleTimeout)
+	defer settleCancel()
+	if err := h.deleteMessages(settleCtx, processed); err != nil {
+		log.Error().Err(err).Str("component", "sqs").Msg("Could not delete messages from queue")
+	}
+	if err := h.releaseMessages(settleCtx, released); err != nil {
+		log.Error().Err(err).Str("component", "sqs").Msg("Could not release messages")
+	}
 }
 
-func (h *SqsListener) handleMessage(message *sqs.Message) error {
-	defer func() {
-		// the client is not going to stop ip update requests as long the ip has not been updated, so we have the luxury
-		// to not care about edge cases too much and delete the message after receiving it.
-		log.Debug().Str("component", "sqs").Str("message_id", *message.MessageId).Msg("Deleting message from queue")
-		_, err := h.client.DeleteMessage(&sqs.DeleteMessageInput{
-			QueueUrl:      aws.String(h.queueUrl),
-			ReceiptHandle: message.ReceiptHandle,
-		})
-		if err != nil {
-			log.Error().Err(err).Str("component", "sqs").Str("message_id", *message.MessageId).Msg("Could not delete message from queue")
+// handleMessage passes the update request to the server and returns how the message should be settled
+func (h *SqsListener) handleMessage(ctx context.Context, message *sqs.Message) settlement {
+	if message.Body == nil {
+		log.Warn().Str("component", "sqs").Msg("Received empty message")
+		return h.settle(message, common.Permanent(errors.New("empty message")))
+	}
+
+	// messages sent by older clients do not carry a schema version
+	if version := messageAttribute(message, common.MetadataSchemaVersion); len(version) > 0 && version != common.UpdateRecordRequestSchemaVersion {
+		log.Warn().Str("component", "sqs").Str("schema_version", version).Msg("Received message with unsupported schema version")
+		return h.settle(message, common.Permanent(fmt.Errorf("unsupported schema version '%s'", version)))
+	}
+
+	env, err := common.DecodeUpdateRecordRequest([]byte(*message.Body))
+	if err != nil {
+		metrics.MessageParsingFailed.Inc()
+		log.Warn().Str("component", "sqs").Err(err).Msg("Message parsing failed")
+		return h.settle(message, common.Permanent(err))
+	}
+
+	result := make(chan error, 1)
+	env = env.WithResultHandler(func(err error) {
+		result <- err
+	})
+
+	select {
+	case h.requests <- env:
+	case <-ctx.Done():
+		return settlementRedeliver
+	}
+
+	select {
+	case err := <-result:
+		return h.settle(message, err)
+	case <-ctx.Done():
+		return settlementRedeliver
+	}
+}
+
+// settle returns how the message should be settled according to the result of processing it
+func (h *SqsListener) settle(message *sqs.Message, result error) settlement {
+	messageId := aws.StringValue(message.MessageId)
+	switch {
+	case result == nil:
+		metrics.SqsMessagesSettled.WithLabelValues("deleted").Inc()
+		return settlementDelete
+	case errors.Is(result, common.ErrNotLeader):
+		log.Info().Str("component", "sqs").Str("message_id", messageId).Msg("Lost the leader lease, releasing message to the leader")
+		metrics.SqsMessagesSettled.WithLabelValues("released").Inc()
+		return settlementRelease
+	case common.IsPermanent(result):
+		log.Warn().Err(result).Str("component", "sqs").Str("message_id", messageId).Msg("Message can never be processed, deleting it")
+		metrics.SqsMessagesSettled.WithLabelValues("rejected").Inc()
+		return settlementDelete
+	case h.isLastReceive(message):
+		log.Warn().Err(result).Str("component", "sqs").Str("message_id", messageId).Msg("Message could not be processed, it is going to be moved to the dead-letter queue")
+		metrics.SqsMessagesSettled.WithLabelValues("dead_lettered").Inc()
+		return settlementRedeliver
+	default:
+		log.Warn().Err(result).Str("component", "sqs").Str("message_id", messageId).Msg("Message could not be processed, it is going to be redelivered")
+		metrics.SqsMessagesSettled.WithLabelValues("redelivered").Inc()
+		return settlementRedeliver
+	}
+}
+
+func messageAttribute(message *sqs.Message, name string) string {
+	attribute, ok := message.MessageAttributes[name]
+	if !ok || attribute == nil {
+		return ""
+	}
+	return aws.StringValue(attribute.StringValue)
+}
+
+// isLastReceive returns whether SQS moves the message to the dead-letter queue instead of redelivering it
+func (h *SqsListener) isLastReceive(message *sqs.Message) bool {
+	if h.maxReceiveCount <= 0 {
+		return false
+	}
+
+	receiveCount, err := strconv.ParseInt(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]), 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return receiveCount >= h.maxReceiveCount
+}
+
+// extendVisibility periodically extends the visibility timeout of the messages that are in flight, so slow
+// propagations do not lead to messages being redelivered while they are still being processed
+func (h *SqsListener) extendVisibility(ctx context.Context, inFlight *inFlightMessages) {
+	ticker := time.NewTicker(h.visibilityTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			entries := inFlight.visibilityEntries(int64(h.visibilityTimeout.Seconds()))
+			if len(entries) == 0 {
+				continue
+			}
+
+			metrics.SqsApiCalls.WithLabelValues("change_message_visibility_batch").Inc()
+			result, err := h.client.ChangeMessageVisibilityBatchWithContext(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+				QueueUrl: aws.String(h.queueUrl),
+				Entries:  entries,
+			})
+			if err != nil {
+				log.Warn().Err(err).Str("component", "sqs").Msg("Could not extend visibility timeout of messages")
+				continue
+			}
+			for _, failed := range result.Failed {
+				log.Warn().Str("component", "sqs").Str("message_id", aws.StringValue(failed.Id)).Str("error", aws.StringValue(failed.Message)).Msg("Could not extend visibility timeout of message")
+			}
 		}
-		metrics.SqsApiCalls.WithLabelValues("delete_message").Inc()
-	}()
+	}
+}
 
-	if message == nil || message.Body == nil {
-		log.Warn().Str("component", "sqs").Msg("Received empty message")
+func (h *SqsListener) deleteMessages(ctx context.Context, messages []*sqs.Message) error {
+	if len(messages) == 0 {
 		return nil
 	}
 
-	err := h.dispatch([]byte(*message.Body))
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, 0, len(messages))
+	for _, message := range messages {
+		log.Debug().Str("component", "sqs").Str("message_id", aws.StringValue(message.MessageId)).Msg("Deleting message from queue")
+		entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            message.MessageId,
+			ReceiptHandle: message.ReceiptHandle,
+		})
+	}
+
+	metrics.SqsApiCalls.WithLabelValues("delete_message_batch").Inc()
+	result, err := h.client.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(h.queueUrl),
+		Entries:  entries,
+	})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	var errs error
+	for _, failed := range result.Failed {
+		errs = multierr.Append(errs, fmt.Errorf("could not delete message %s: %s", aws.StringValue(failed.Id), aws.StringValue(failed.Message)))
+	}
+	return errs
 }
 
-func (h *SqsListener) dispatch(msg []byte) error {
-	var env common.UpdateRecordRequest
-	err := json.Unmarshal(msg, &env)
+// releaseMessages makes the messages visible again right away, so they can be received by another server
+func (h *SqsListener) releaseMessages(ctx context.Context, messages []*sqs.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, 0, len(messages))
+	for _, message := range messages {
+		log.Debug().Str("component", "sqs").Str("message_id", aws.StringValue(message.MessageId)).Msg("Releasing message")
+		entries = append(entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                message.MessageId,
+			ReceiptHandle:     message.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(0),
+		})
+	}
+
+	metrics.SqsApiCalls.WithLabelValues("change_message_visibility_batch").Inc()
+	result, err := h.client.ChangeMessageVisibilityBatchWithContext(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+		QueueUrl: aws.String(h.queueUrl),
+		Entries:  entries,
+	})
 	if err != nil {
-		metrics.MessageParsingFailed.Inc()
-		log.Warn().Str("component", "sqs").Err(err).Msg("Message parsing failed")
 		return err
 	}
 
-	h.requests <- env
-	return nil
+	var errs error
+	for _, failed := range result.Failed {
+		errs = multierr.Append(errs, fmt.Errorf("could not release message %s: %s", aws.StringValue(failed.Id), aws.StringValue(failed.Message)))
+	}
+	return errs
+}
+
+// inFlightMessages are the messages of a batch whose visibility timeout needs to be extended
+type inFlightMessages struct {
+	mutex    sync.Mutex
+	messages map[string]*sqs.Message
+}
+
+func newInFlightMessages(messages []*sqs.Message) *inFlightMessages {
+	inFlight := &inFlightMessages{messages: make(map[string]*sqs.Message, len(messages))}
+	for _, message := range messages {
+		inFlight.messages[aws.StringValue(message.MessageId)] = message
+	}
+	return inFlight
+}
+
+func (m *inFlightMessages) remove(message *sqs.Message) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.messages, aws.StringValue(message.MessageId))
+}
+
+func (m *inFlightMessages) visibilityEntries(visibilityTimeout int64) []*sqs.ChangeMessageVisibilityBatchRequestEntry {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, 0, len(m.messages))
+	for id, message := range m.messages {
+		entries = append(entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(id),
+			ReceiptHandle:     message.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(visibilityTimeout),
+		})
+	}
+	return entries
 }
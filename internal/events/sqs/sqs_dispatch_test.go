@@ -0,0 +1,246 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"github.com/soerenschneider/dyndns/internal/server"
+	"github.com/soerenschneider/dyndns/internal/testutil"
+)
+
+func encodedRequest(t *testing.T) string {
+	t.Helper()
+	req := &common.UpdateRecordRequest{
+		PublicIp: common.DnsRecord{Host: "home.example.com", IpV4: "198.51.100.1"},
+	}
+	data, err := common.EncodeUpdateRecordRequest(req, common.PayloadFormatPlain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// runListener runs the listener against the fake queue, update requests are processed by the given handler
+func runListener(t *testing.T, queue *testutil.Sqs, handler func(attempt int) error, opts ...SqsOpts) {
+	t.Helper()
+	requests := make(chan common.UpdateRecordRequest)
+	config := conf.SqsConfig{SqsQueue: queue.QueueUrl, Region: "us-east-1", Endpoint: queue.Endpoint}
+	listener, err := NewSqsConsumer(config, testutil.SqsCredentials, requests, append([]SqsOpts{WithWaitTime(time.Second)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		attempt := 0
+		for {
+			select {
+			case req := <-requests:
+				attempt++
+				req.Done(handler(attempt))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		if err := listener.Listen(ctx, wg); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		wg.Wait()
+	})
+}
+
+func deleted(messages []testutil.SqsMessage) bool {
+	for _, message := range messages {
+		if !message.Deleted {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSqsListener_Listen(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		attributes map[string]string
+		// fifoMessages is the number of messages sent to the same message group of a FIFO queue, a single message is
+		// sent to a standard queue otherwise
+		fifoMessages     int
+		handler          func(attempt int) error
+		wantReceiveCount int
+	}{
+		{
+			name:             "processed",
+			body:             encodedRequest(t),
+			handler:          func(int) error { return nil },
+			wantReceiveCount: 1,
+		},
+		{
+			name:             "unparsable message",
+			body:             "invalid",
+			handler:          func(int) error { return nil },
+			wantReceiveCount: 1,
+		},
+		{
+			name:             "current schema version",
+			body:             encodedRequest(t),
+			attributes:       map[string]string{common.MetadataHost: "home.example.com", common.MetadataSchemaVersion: common.UpdateRecordRequestSchemaVersion},
+			handler:          func(int) error { return nil },
+			wantReceiveCount: 1,
+		},
+		{
+			name:             "unsupported schema version",
+			body:             encodedRequest(t),
+			attributes:       map[string]string{common.MetadataSchemaVersion: "2"},
+			handler:          func(int) error { return errors.New("must not be processed") },
+			wantReceiveCount: 1,
+		},
+		{
+			name:             "permanent error",
+			body:             encodedRequest(t),
+			handler:          func(int) error { return common.Permanent(errors.New("invalid signature")) },
+			wantReceiveCount: 1,
+		},
+		{
+			name: "redelivered after transient error",
+			body: encodedRequest(t),
+			handler: func(attempt int) error {
+				if attempt == 1 {
+					return errors.New("provider unavailable")
+				}
+				return nil
+			},
+			wantReceiveCount: 2,
+		},
+		{
+			// the second message must not be processed before the first one, so it's released and received again
+			name:         "fifo group not processed after transient error",
+			body:         encodedRequest(t),
+			fifoMessages: 2,
+			handler: func(attempt int) error {
+				if attempt == 1 {
+					return errors.New("provider unavailable")
+				}
+				return nil
+			},
+			wantReceiveCount: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queue *testutil.Sqs
+			if tt.fifoMessages > 0 {
+				queue = testutil.NewFifoSqs(t)
+				for range tt.fifoMessages {
+					queue.SendToGroup("home.example.com", tt.body, tt.attributes)
+				}
+			} else {
+				queue = testutil.NewSqs(t)
+				queue.Send(tt.body, tt.attributes)
+			}
+			runListener(t, queue, tt.handler, WithVisibilityTimeout(2*time.Second))
+
+			messages := queue.WaitFor(t, 10*time.Second, deleted)
+			for _, message := range messages {
+				if message.ReceiveCount != tt.wantReceiveCount {
+					t.Fatalf("expected %d receives of %s, got %d", tt.wantReceiveCount, message.Id, message.ReceiveCount)
+				}
+			}
+		})
+	}
+}
+
+func TestSqsListener_ExtendsVisibility(t *testing.T) {
+	queue := testutil.NewSqs(t)
+	queue.Send(encodedRequest(t), nil)
+	runListener(t, queue, func(int) error {
+		time.Sleep(3 * time.Second)
+		return nil
+	}, WithVisibilityTimeout(2*time.Second))
+
+	messages := queue.WaitFor(t, 10*time.Second, deleted)
+	if messages[0].ReceiveCount != 1 {
+		t.Fatalf("expected message to be received once while being processed, got %d receives", messages[0].ReceiveCount)
+	}
+	if messages[0].VisibilityChanges == 0 {
+		t.Fatal("expected visibility timeout to be extended")
+	}
+}
+
+func TestSqsListener_KeepsFailedMessagesForDeadLetterQueue(t *testing.T) {
+	queue := testutil.NewSqs(t)
+	queue.SetRedrivePolicy(2)
+	queue.Send(encodedRequest(t), nil)
+	runListener(t, queue, func(int) error {
+		return errors.New("provider unavailable")
+	}, WithVisibilityTimeout(2*time.Second))
+
+	messages := queue.WaitFor(t, 10*time.Second, func(messages []testutil.SqsMessage) bool {
+		return messages[0].ReceiveCount >= 2
+	})
+	if messages[0].Deleted {
+		t.Fatal("expected failed message to be left for the dead-letter queue")
+	}
+}
+
+type fakeLeader struct {
+	leader atomic.Bool
+}
+
+func (l *fakeLeader) IsLeader() bool {
+	return l.leader.Load()
+}
+
+func TestSqsListener_LeavesMessagesToLeader(t *testing.T) {
+	queue := testutil.NewSqs(t)
+	queue.SetRedrivePolicy(2)
+	queue.Send(encodedRequest(t), nil)
+	queue.Send(encodedRequest(t), nil)
+
+	leader := &fakeLeader{}
+	var attempts atomic.Int32
+	runListener(t, queue, func(attempt int) error {
+		attempts.Add(1)
+		// the lease is lost while processing the first message
+		if attempt == 1 {
+			return server.ErrNotLeader
+		}
+		return nil
+	}, WithLeader(leader))
+
+	// followers must not receive messages, as every receive counts towards the dead-letter queue's maxReceiveCount
+	time.Sleep(1500 * time.Millisecond)
+	for _, message := range queue.Messages() {
+		if message.ReceiveCount != 0 {
+			t.Fatalf("expected follower not to receive messages, got %d receives", message.ReceiveCount)
+		}
+	}
+
+	// the released messages are received again right away instead of after the default visibility timeout of 30s
+	leader.leader.Store(true)
+	messages := queue.WaitFor(t, 10*time.Second, deleted)
+	for _, message := range messages {
+		if message.ReceiveCount != 2 {
+			t.Fatalf("expected message to be received twice, got %d receives", message.ReceiveCount)
+		}
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Fatalf("expected the second message not to be processed after losing the lease, got %d attempts", got)
+	}
+}
@@ -26,6 +26,12 @@ var (
 		Name:      "reconcilers_pending_changes_total",
 	}, []string{"host"})
 
+	OutboxExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: client,
+		Name:      "outbox_expired_total",
+	}, []string{"host"})
+
 	ReconcilerTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: client,
@@ -44,6 +50,12 @@ var (
 		Name:      "ip_resolves_success_total",
 	}, []string{"host", "resolver"})
 
+	ChainResolverAnswers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: client,
+		Name:      "chain_resolver_answers_total",
+	}, []string{"host", "resolver", "address_family"})
+
 	LastCheck = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Subsystem: client,
@@ -74,6 +86,18 @@ var (
 		Name:      "current_state_bool",
 	}, []string{"host", "state"})
 
+	RecordVerifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: client,
+		Name:      "record_verifications_total",
+	}, []string{"host", "address_family", "result"})
+
+	PartiallyConfirmedRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: client,
+		Name:      "record_partially_confirmed_total",
+	}, []string{"host", "unconfirmed_address_family"})
+
 	ResponseTime = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: namespace,
 		Subsystem: client,
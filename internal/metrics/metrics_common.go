@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"time"
@@ -16,6 +17,8 @@ const (
 	client          = "client"
 	server          = "server"
 	DefaultListener = "0.0.0.0:9191"
+
+	metricsShutdownTimeout = 5 * time.Second
 )
 
 var (
@@ -81,11 +84,23 @@ var (
 		Help:      "The total amount of SQS API calls",
 		Name:      "api_calls_total",
 	}, []string{"operation"})
+
+	SqsMessagesSettled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "sqs",
+		Help:      "The total amount of SQS messages that have been deleted or left for redelivery",
+		Name:      "messages_settled_total",
+	}, []string{"result"})
 )
 
-func StartMetricsServer(addr string) {
+// StartMetricsServer starts the metrics server and serves until the context is cancelled. Additional handlers, keyed
+// by their patterns, are served as well.
+func StartMetricsServer(ctx context.Context, addr string, handlers map[string]http.Handler) {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	for pattern, handler := range handlers {
+		mux.Handle(pattern, handler)
+	}
 
 	server := http.Server{
 		Addr:              addr,
@@ -96,6 +111,16 @@ func StartMetricsServer(addr string) {
 		Handler:           mux,
 	}
 
+	go func() {
+		<-ctx.Done()
+		log.Info().Msg("Stopping metrics server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Error().Err(err).Msg("could not gracefully shutdown metrics server")
+		}
+	}()
+
 	err := server.ListenAndServe()
 	if !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal().Err(err).Msg("can not start metrics server")
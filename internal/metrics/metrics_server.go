@@ -65,6 +65,20 @@ var (
 		Name:      "public_keys_missing_total",
 	}, []string{"host"})
 
+	LeaderLeaseHeld = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: server,
+		Name:      "leader_lease_held",
+		Help:      "Whether this server holds the leader lease and propagates changes",
+	})
+
+	NatsMessagesSettled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: server,
+		Name:      "nats_messages_settled_total",
+		Help:      "Total count of NATS messages that have been acked, nacked, terminated or dead-lettered",
+	}, []string{"result"})
+
 	IgnoredMessage = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Subsystem: server,
@@ -7,6 +7,7 @@ import (
 type Notification interface {
 	NotifyUpdatedIpDetected(ip *common.DnsRecord) error
 	NotifyUpdatedIpApplied(ip *common.DnsRecord) error
+	NotifyUpdatedIpUnconfirmable(ip *common.DnsRecord) error
 }
 
 type DummyNotification struct{}
@@ -18,3 +19,7 @@ func (d *DummyNotification) NotifyUpdatedIpDetected(ip *common.DnsRecord) error
 func (d *DummyNotification) NotifyUpdatedIpApplied(ip *common.DnsRecord) error {
 	return nil
 }
+
+func (d *DummyNotification) NotifyUpdatedIpUnconfirmable(ip *common.DnsRecord) error {
+	return nil
+}
@@ -0,0 +1,59 @@
+//go:build server
+
+package dedup
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store remembers the update requests that have been processed, so update requests that are received multiple times
+// are only propagated once
+type Store interface {
+	// Claim atomically marks the key as processed. It returns false if the key has been claimed before.
+	Claim(ctx context.Context, key string) (bool, error)
+	// Release removes the claim of the key, so the update request can be processed again
+	Release(ctx context.Context, key string) error
+}
+
+// MemoryStore is a Store that de-duplicates update requests within a single server
+type MemoryStore struct {
+	ttl    time.Duration
+	mutex  sync.Mutex
+	claims map[string]time.Time
+}
+
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		ttl:    ttl,
+		claims: map[string]time.Time{},
+	}
+}
+
+func (s *MemoryStore) Claim(_ context.Context, key string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for claimed, expiry := range s.claims {
+		if now.After(expiry) {
+			delete(s.claims, claimed)
+		}
+	}
+
+	if _, ok := s.claims[key]; ok {
+		return false, nil
+	}
+
+	s.claims[key] = now.Add(s.ttl)
+	return true, nil
+}
+
+func (s *MemoryStore) Release(_ context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.claims, key)
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build server
+
+package dedup
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(50 * time.Millisecond)
+
+	assertClaim(t, store, "home.example.com.a", true)
+	assertClaim(t, store, "home.example.com.a", false)
+	assertClaim(t, store, "home.example.com.b", true)
+
+	if err := store.Release(ctx, "home.example.com.a"); err != nil {
+		t.Fatal(err)
+	}
+	assertClaim(t, store, "home.example.com.a", true)
+
+	time.Sleep(100 * time.Millisecond)
+	assertClaim(t, store, "home.example.com.b", true)
+}
+
+func assertClaim(t *testing.T, store Store, key string, want bool) {
+	t.Helper()
+	got, err := store.Claim(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("Claim(%s) got = %v, want %v", key, got, want)
+	}
+}
@@ -0,0 +1,118 @@
+//go:build server
+
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/metrics"
+)
+
+const leaderKey = "leader"
+
+// NatsLease is a leader lease that is stored in a NATS KV bucket. The holder renews the lease periodically, if it
+// stops doing so the lease expires after the bucket's TTL and is acquired by another server.
+type NatsLease struct {
+	kv       jetstream.KeyValue
+	id       string
+	ttl      time.Duration
+	revision uint64
+	isLeader atomic.Bool
+}
+
+func NewNatsLease(ctx context.Context, js jetstream.JetStream, bucket string, ttl time.Duration, id string) (*NatsLease, error) {
+	if js == nil {
+		return nil, errors.New("nil jetstream supplied")
+	}
+
+	if len(id) == 0 {
+		return nil, errors.New("empty id supplied")
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      bucket,
+		Description: "Leader lease of dyndns servers",
+		TTL:         ttl,
+		History:     1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create kv bucket %s: %w", bucket, err)
+	}
+
+	return &NatsLease{
+		kv:  kv,
+		id:  id,
+		ttl: ttl,
+	}, nil
+}
+
+// IsLeader returns whether this server currently holds the lease
+func (l *NatsLease) IsLeader() bool {
+	return l.isLeader.Load()
+}
+
+// Run tries to acquire and renews the lease until the context is cancelled. The lease is released afterwards.
+func (l *NatsLease) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	l.refresh(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			l.release()
+			return
+		case <-ticker.C:
+			l.refresh(ctx)
+		}
+	}
+}
+
+// refresh renews the lease if this server holds it or tries to acquire it otherwise
+func (l *NatsLease) refresh(ctx context.Context) {
+	var revision uint64
+	var err error
+	if l.isLeader.Load() {
+		revision, err = l.kv.Update(ctx, leaderKey, []byte(l.id), l.revision)
+	} else {
+		revision, err = l.kv.Create(ctx, leaderKey, []byte(l.id))
+	}
+
+	if err != nil {
+		if l.isLeader.Swap(false) {
+			log.Warn().Err(err).Str("component", "lease").Str("id", l.id).Msg("Lost leader lease")
+		} else if !errors.Is(err, jetstream.ErrKeyExists) {
+			log.Error().Err(err).Str("component", "lease").Str("id", l.id).Msg("Could not acquire leader lease")
+		}
+		metrics.LeaderLeaseHeld.Set(0)
+		return
+	}
+
+	l.revision = revision
+	if !l.isLeader.Swap(true) {
+		log.Info().Str("component", "lease").Str("id", l.id).Msg("Acquired leader lease")
+	}
+	metrics.LeaderLeaseHeld.Set(1)
+}
+
+// release deletes the lease if this server holds it, so another server can acquire it without waiting for it to expire
+func (l *NatsLease) release() {
+	if !l.isLeader.Swap(false) {
+		return
+	}
+
+	metrics.LeaderLeaseHeld.Set(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := l.kv.Delete(ctx, leaderKey, jetstream.LastRevision(l.revision)); err != nil {
+		log.Warn().Err(err).Str("component", "lease").Str("id", l.id).Msg("Could not release leader lease")
+		return
+	}
+	log.Info().Str("component", "lease").Str("id", l.id).Msg("Released leader lease")
+}
@@ -0,0 +1,55 @@
+//go:build server
+
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NatsKvStore is a Store that shares processed update requests between multiple servers using a NATS KV bucket.
+// Entries expire after the bucket's TTL.
+type NatsKvStore struct {
+	kv jetstream.KeyValue
+}
+
+func NewNatsKvStore(ctx context.Context, js jetstream.JetStream, bucket string, ttl time.Duration) (*NatsKvStore, error) {
+	if js == nil {
+		return nil, errors.New("nil jetstream supplied")
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      bucket,
+		Description: "Update requests processed by dyndns servers",
+		TTL:         ttl,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create kv bucket %s: %w", bucket, err)
+	}
+
+	return &NatsKvStore{kv: kv}, nil
+}
+
+func (s *NatsKvStore) Claim(ctx context.Context, key string) (bool, error) {
+	_, err := s.kv.Create(ctx, key, []byte(time.Now().UTC().Format(time.RFC3339)))
+	if err == nil {
+		return true, nil
+	}
+
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return false, nil
+	}
+
+	return false, fmt.Errorf("could not claim key %s: %w", key, err)
+}
+
+func (s *NatsKvStore) Release(ctx context.Context, key string) error {
+	if err := s.kv.Delete(ctx, key); err != nil {
+		return fmt.Errorf("could not release key %s: %w", key, err)
+	}
+	return nil
+}
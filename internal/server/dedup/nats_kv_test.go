@@ -0,0 +1,119 @@
+//go:build server
+
+package dedup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func runJetStream(t *testing.T) jetstream.JetStream {
+	t.Helper()
+	srv, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+func TestNatsKvStore(t *testing.T) {
+	ctx := context.Background()
+	js := runJetStream(t)
+
+	// stores of two servers sharing the same bucket
+	first, err := NewNatsKvStore(ctx, js, "dyndns-dedup", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewNatsKvStore(ctx, js, "dyndns-dedup", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertClaim(t, first, "home.example.com.a", true)
+	assertClaim(t, second, "home.example.com.a", false)
+
+	if err := first.Release(ctx, "home.example.com.a"); err != nil {
+		t.Fatal(err)
+	}
+	assertClaim(t, second, "home.example.com.a", true)
+}
+
+func TestNatsLease(t *testing.T) {
+	js := runJetStream(t)
+	ttl := 900 * time.Millisecond
+
+	first, err := NewNatsLease(context.Background(), js, "dyndns-leader", ttl, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewNatsLease(context.Background(), js, "dyndns-leader", ttl, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstDone := make(chan struct{})
+	go func() {
+		first.Run(firstCtx)
+		close(firstDone)
+	}()
+	waitFor(t, first.IsLeader)
+
+	secondCtx, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	go second.Run(secondCtx)
+
+	// the lease is renewed by the first server, so it's never acquired by the second one
+	time.Sleep(2 * ttl)
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatalf("expected first to remain leader, first: %v, second: %v", first.IsLeader(), second.IsLeader())
+	}
+
+	cancelFirst()
+	<-firstDone
+	waitFor(t, second.IsLeader)
+	if first.IsLeader() {
+		t.Fatal("expected first to have released the lease")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -11,15 +12,28 @@ import (
 	conf2 "github.com/soerenschneider/dyndns/internal/conf"
 	"github.com/soerenschneider/dyndns/internal/metrics"
 	"github.com/soerenschneider/dyndns/internal/notification"
+	"github.com/soerenschneider/dyndns/internal/server/dedup"
 	"github.com/soerenschneider/dyndns/internal/server/dns"
 	"github.com/soerenschneider/dyndns/internal/util"
 	"github.com/soerenschneider/dyndns/internal/verification"
+	"go.uber.org/multierr"
 )
 
-// timestampGracePeriod must be a negative number
-const timestampGracePeriod = -24 * time.Hour
+const (
+	// timestampGracePeriod must be a negative number
+	timestampGracePeriod = -24 * time.Hour
+	// dedupStoreTimeout is the maximum duration of a single operation on the de-duplication store
+	dedupStoreTimeout = 5 * time.Second
+	// recordStoreTimeout is the maximum duration of storing an applied record
+	recordStoreTimeout = 5 * time.Second
+)
 
-var ErrorMessageTooOld = errors.New("message timestamp is too old")
+var (
+	ErrorMessageTooOld = errors.New("message timestamp is too old")
+	// ErrNotLeader is returned for update requests that are not processed because another server holds the leader
+	// lease
+	ErrNotLeader = common.ErrNotLeader
+)
 
 type DyndnsServer struct {
 	knownHosts       map[string][]verification.VerificationKey
@@ -27,11 +41,26 @@ type DyndnsServer struct {
 	propagator       dns.Propagator
 	cache            map[string]common.DnsRecord
 	notificationImpl notification.Notification
+	verifier         util.RecordVerifier
+	dedup            dedup.Store
+	leader           Leader
+	records          RecordStore
 
 	lock sync.RWMutex
 }
 
-func NewServer(config conf2.ServerConf, propagator dns.Propagator, requests chan common.UpdateRecordRequest, notifyImpl notification.Notification) (*DyndnsServer, error) {
+// Leader decides whether this server propagates changes, if multiple servers process the same update requests
+type Leader = common.Leader
+
+// RecordStore keeps the last applied record of each host, so clients can learn about applied changes without
+// querying DNS
+type RecordStore interface {
+	Put(ctx context.Context, record common.DnsRecord) error
+}
+
+type ServerOpts func(s *DyndnsServer) error
+
+func NewServer(config conf2.ServerConf, propagator dns.Propagator, requests chan common.UpdateRecordRequest, notifyImpl notification.Notification, opts ...ServerOpts) (*DyndnsServer, error) {
 	err := conf2.ValidateConfig(config)
 	if err != nil {
 		return nil, fmt.Errorf("invalid conf passed: %v", err)
@@ -54,15 +83,63 @@ func NewServer(config conf2.ServerConf, propagator dns.Propagator, requests chan
 		return nil, err
 	}
 
+	verifier, err := util.NewRecordVerifier(config.DnsVerification)
+	if err != nil {
+		return nil, fmt.Errorf("could not build dns verifier: %w", err)
+	}
+
 	server := DyndnsServer{
 		knownHosts:       decoded,
 		requests:         requests,
 		propagator:       propagator,
 		cache:            make(map[string]common.DnsRecord, len(config.KnownHosts)),
 		notificationImpl: notifyImpl,
+		verifier:         verifier,
+		dedup:            dedup.NewMemoryStore(config.Dedup.Ttl),
+	}
+
+	var errs error
+	for _, opt := range opts {
+		if err := opt(&server); err != nil {
+			errs = multierr.Append(errs, err)
+		}
 	}
 
-	return &server, nil
+	return &server, errs
+}
+
+// WithDedupStore sets the store that is used to de-duplicate update requests, by default update requests are
+// de-duplicated in memory
+func WithDedupStore(store dedup.Store) ServerOpts {
+	return func(s *DyndnsServer) error {
+		if store == nil {
+			return errors.New("nil dedup store provided")
+		}
+		s.dedup = store
+		return nil
+	}
+}
+
+// WithLeader lets the server only propagate changes while it's the leader
+func WithLeader(leader Leader) ServerOpts {
+	return func(s *DyndnsServer) error {
+		if leader == nil {
+			return errors.New("nil leader provided")
+		}
+		s.leader = leader
+		return nil
+	}
+}
+
+// WithRecordStore writes each applied record to the store
+func WithRecordStore(store RecordStore) ServerOpts {
+	return func(s *DyndnsServer) error {
+		if store == nil {
+			return errors.New("nil record store provided")
+		}
+		s.records = store
+		return nil
+	}
 }
 
 func (server *DyndnsServer) isCached(env common.UpdateRecordRequest) bool {
@@ -97,16 +174,22 @@ func (server *DyndnsServer) verifyMessage(env common.UpdateRecordRequest) error
 func (server *DyndnsServer) HandlePropagateRequest(env common.UpdateRecordRequest) error {
 	if err := env.Validate(); err != nil {
 		metrics.MessageValidationsFailed.WithLabelValues(env.PublicIp.Host, "invalid_fields").Inc()
-		return fmt.Errorf("invalid envelope received: %v", err)
+		return common.Permanent(common.Unverified(fmt.Errorf("invalid envelope received: %v", err)))
 	}
 
 	if err := server.verifyMessage(env); err != nil {
-		return err
+		return common.Permanent(common.Unverified(err))
 	}
 
 	if env.PublicIp.Timestamp.Before(time.Now().Add(timestampGracePeriod)) {
 		metrics.IgnoredMessage.WithLabelValues(env.PublicIp.Host, "message_too_old").Inc()
-		return ErrorMessageTooOld
+		return common.Permanent(ErrorMessageTooOld)
+	}
+
+	if server.leader != nil && !server.leader.IsLeader() {
+		metrics.IgnoredMessage.WithLabelValues(env.PublicIp.Host, "not_leader").Inc()
+		log.Info().Str("component", "server").Str("host", env.PublicIp.Host).Msg("Not holding the leader lease, not performing changes")
+		return ErrNotLeader
 	}
 
 	if server.isCached(env) {
@@ -114,14 +197,28 @@ func (server *DyndnsServer) HandlePropagateRequest(env common.UpdateRecordReques
 		return nil
 	}
 
-	if util.HostnameMatchesIp(env.PublicIp.Host, env.PublicIp.IpV4, env.PublicIp.IpV6) {
+	claimed, dedupKey, err := server.claim(env)
+	if err != nil {
+		// propagating the change multiple times is preferred over not propagating it at all
+		log.Warn().Err(err).Str("component", "server").Str("host", env.PublicIp.Host).Msg("Could not de-duplicate request")
+	} else if !claimed {
+		metrics.IgnoredMessage.WithLabelValues(env.PublicIp.Host, "duplicate").Inc()
+		log.Info().Str("component", "server").Str("host", env.PublicIp.Host).Str("event_id", env.EventId()).Msg("Request has already been processed, not performing changes")
+		return nil
+	}
+
+	if util.HostnameMatchesIp(server.verifier, env.PublicIp.Host, env.PublicIp.IpV4, env.PublicIp.IpV6) {
 		log.Info().Str("component", "server").Str("host", env.PublicIp.Host).Str("ipv4", env.PublicIp.IpV4).Str("ipv6", env.PublicIp.IpV6).Msg("host already has desired address, not updating")
+		server.storeRecord(env.PublicIp)
 		return nil
 	}
 
-	log.Info().Str("component", "server").Str("host", env.PublicIp.Host).Str("ipv4", env.PublicIp.IpV4).Str("ipv6", env.PublicIp.IpV6).Msg("Verifying signature succeeded, updating host")
+	log.Info().Str("component", "server").Str("host", env.PublicIp.Host).Str("event_id", env.EventId()).Str("ipv4", env.PublicIp.IpV4).Str("ipv6", env.PublicIp.IpV6).Msg("Verifying signature succeeded, updating host")
 	if err := server.propagator.PropagateChange(env.PublicIp); err != nil {
 		metrics.DnsPropagationErrors.WithLabelValues(env.PublicIp.Host).Inc()
+		if claimed {
+			server.release(dedupKey)
+		}
 		return fmt.Errorf("could not propagate dns change for domain '%s': %v", env.PublicIp.Host, err)
 	}
 
@@ -134,12 +231,50 @@ func (server *DyndnsServer) HandlePropagateRequest(env common.UpdateRecordReques
 	}
 	log.Info().Str("component", "server").Str("host", env.PublicIp.Host).Str("ipv4", env.PublicIp.IpV4).Str("ipv6", env.PublicIp.IpV6).Msg("Successfully propagated change")
 	metrics.SuccessfulDnsPropagationsTotal.WithLabelValues(env.PublicIp.Host).Inc()
+	server.storeRecord(env.PublicIp)
 
 	// Add to cache
+	server.lock.Lock()
 	server.cache[env.PublicIp.Host] = env.PublicIp
+	server.lock.Unlock()
 	return nil
 }
 
+// claim marks the update request as processed in the de-duplication store. The key consists of the host and a hash
+// of the signature, which covers the record's ips and timestamp.
+func (server *DyndnsServer) claim(env common.UpdateRecordRequest) (bool, string, error) {
+	key := fmt.Sprintf("%s.%s", env.PublicIp.Host, env.Hash())
+	ctx, cancel := context.WithTimeout(context.Background(), dedupStoreTimeout)
+	defer cancel()
+
+	claimed, err := server.dedup.Claim(ctx, key)
+	return claimed, key, err
+}
+
+// release removes the claim of an update request that could not be propagated, so it can be processed again
+func (server *DyndnsServer) release(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dedupStoreTimeout)
+	defer cancel()
+
+	if err := server.dedup.Release(ctx, key); err != nil {
+		log.Error().Err(err).Str("component", "server").Str("key", key).Msg("Could not release de-duplication claim")
+	}
+}
+
+// storeRecord writes the applied record to the record store, if configured
+func (server *DyndnsServer) storeRecord(record common.DnsRecord) {
+	if server.records == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), recordStoreTimeout)
+	defer cancel()
+
+	if err := server.records.Put(ctx, record); err != nil {
+		log.Error().Err(err).Str("component", "server").Str("host", record.Host).Msg("Could not store applied record")
+	}
+}
+
 func (server *DyndnsServer) Listen() {
 	for request := range server.requests {
 		metrics.MessagesReceivedTotal.Inc()
@@ -147,8 +282,9 @@ func (server *DyndnsServer) Listen() {
 
 		log.Info().Str("component", "server").Msg("Picked up a new change request")
 		err := server.HandlePropagateRequest(request)
-		if err != nil && !errors.Is(err, ErrorMessageTooOld) {
+		if err != nil && !errors.Is(err, ErrorMessageTooOld) && !errors.Is(err, ErrNotLeader) {
 			log.Error().Err(err).Str("component", "server").Msg("Change has not been propagated")
 		}
+		request.Done(err)
 	}
 }
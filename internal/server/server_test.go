@@ -1,10 +1,14 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/soerenschneider/dyndns/internal/common"
+	"github.com/soerenschneider/dyndns/internal/notification"
+	"github.com/soerenschneider/dyndns/internal/server/dedup"
 	"github.com/soerenschneider/dyndns/internal/server/dns"
 	"github.com/soerenschneider/dyndns/internal/verification"
 )
@@ -133,3 +137,184 @@ func TestServer_verifyMessage(t *testing.T) {
 		})
 	}
 }
+
+type countingPropagator struct {
+	calls int
+	err   error
+}
+
+func (p *countingPropagator) PropagateChange(_ common.DnsRecord) error {
+	p.calls++
+	return p.err
+}
+
+// emptyVerifier never finds a dns record, so every request needs to be propagated
+type emptyVerifier struct{}
+
+func (v emptyVerifier) Lookup(_, _ string) ([]string, error) {
+	return nil, nil
+}
+
+type staticLeader bool
+
+func (l staticLeader) IsLeader() bool {
+	return bool(l)
+}
+
+func buildDedupServer(propagator dns.Propagator, leader Leader) *DyndnsServer {
+	return &DyndnsServer{
+		knownHosts: map[string][]verification.VerificationKey{
+			"my-host.tld": {&SimpleVerifier{true}},
+		},
+		propagator:       propagator,
+		cache:            map[string]common.DnsRecord{},
+		notificationImpl: &notification.DummyNotification{},
+		verifier:         emptyVerifier{},
+		dedup:            dedup.NewMemoryStore(time.Hour),
+		leader:           leader,
+	}
+}
+
+func dedupRequest() common.UpdateRecordRequest {
+	return common.UpdateRecordRequest{
+		PublicIp: common.DnsRecord{
+			IpV4:      "8.8.4.4",
+			Host:      "my-host.tld",
+			Timestamp: time.Now(),
+		},
+		Signature: "dummy-value",
+	}
+}
+
+func TestServer_HandlePropagateRequest_Dedup(t *testing.T) {
+	propagator := &countingPropagator{}
+	server := buildDedupServer(propagator, nil)
+
+	env := dedupRequest()
+	for i := 0; i < 2; i++ {
+		if err := server.HandlePropagateRequest(env); err != nil {
+			t.Fatal(err)
+		}
+		// clear the cache to simulate another server sharing the dedup store
+		server.cache = map[string]common.DnsRecord{}
+	}
+
+	if propagator.calls != 1 {
+		t.Fatalf("expected change to be propagated once, got %d", propagator.calls)
+	}
+}
+
+func TestServer_HandlePropagateRequest_ReleaseOnError(t *testing.T) {
+	propagator := &countingPropagator{err: errors.New("route53 unavailable")}
+	server := buildDedupServer(propagator, nil)
+
+	env := dedupRequest()
+	if err := server.HandlePropagateRequest(env); err == nil {
+		t.Fatal("expected error")
+	}
+
+	propagator.err = nil
+	if err := server.HandlePropagateRequest(env); err != nil {
+		t.Fatal(err)
+	}
+	if propagator.calls != 2 {
+		t.Fatalf("expected failed change to be propagated again, got %d calls", propagator.calls)
+	}
+}
+
+func TestServer_HandlePropagateRequest_NotLeader(t *testing.T) {
+	propagator := &countingPropagator{}
+	server := buildDedupServer(propagator, staticLeader(false))
+
+	if err := server.HandlePropagateRequest(dedupRequest()); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("expected ErrNotLeader, got %v", err)
+	}
+	if propagator.calls != 0 {
+		t.Fatal("expected change not to be propagated by follower")
+	}
+}
+
+func TestServer_Listen_ReportsResult(t *testing.T) {
+	tests := []struct {
+		name           string
+		host           string
+		propagateErr   error
+		wantErr        bool
+		wantPermanent  bool
+		wantUnverified bool
+	}{
+		{
+			name: "propagated",
+			host: "my-host.tld",
+		},
+		{
+			name:         "propagation failed",
+			host:         "my-host.tld",
+			propagateErr: errors.New("route53 unavailable"),
+			wantErr:      true,
+		},
+		{
+			name:           "unknown host",
+			host:           "unknown-host.tld",
+			wantErr:        true,
+			wantPermanent:  true,
+			wantUnverified: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := buildDedupServer(&countingPropagator{err: tt.propagateErr}, nil)
+			server.requests = make(chan common.UpdateRecordRequest)
+			go server.Listen()
+			defer close(server.requests)
+
+			results := make(chan error, 1)
+			env := dedupRequest()
+			env.PublicIp.Host = tt.host
+			server.requests <- env.WithResultHandler(func(err error) {
+				results <- err
+			})
+
+			select {
+			case err := <-results:
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("Done() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if common.IsPermanent(err) != tt.wantPermanent {
+					t.Fatalf("Done() permanent = %v, want %v", common.IsPermanent(err), tt.wantPermanent)
+				}
+				if common.IsUnverified(err) != tt.wantUnverified {
+					t.Fatalf("Done() unverified = %v, want %v", common.IsUnverified(err), tt.wantUnverified)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("result has not been reported")
+			}
+		})
+	}
+}
+
+type recordingStore struct {
+	records []common.DnsRecord
+}
+
+func (s *recordingStore) Put(_ context.Context, record common.DnsRecord) error {
+	s.records = append(s.records, record)
+	return nil
+}
+
+func TestServer_HandlePropagateRequest_StoresRecord(t *testing.T) {
+	store := &recordingStore{}
+	server := buildDedupServer(&countingPropagator{}, nil)
+	if err := WithRecordStore(store)(server); err != nil {
+		t.Fatal(err)
+	}
+
+	env := dedupRequest()
+	if err := server.HandlePropagateRequest(env); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.records) != 1 || !store.records[0].Equals(&env.PublicIp) {
+		t.Fatalf("expected applied record to be stored, got %v", store.records)
+	}
+}
@@ -0,0 +1,128 @@
+// Package testutil contains helpers shared by tests of multiple packages
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Certificates holds a CA and a server and client certificate for 127.0.0.1 that are signed by the CA
+type Certificates struct {
+	CaPool *x509.CertPool
+	CaPem  []byte
+
+	ServerKeyPair tls.Certificate
+	ServerPem     []byte
+	ServerKeyPem  []byte
+
+	ClientPem    []byte
+	ClientKeyPem []byte
+}
+
+// NewCertificates creates a CA and a server and client certificate signed by it
+func NewCertificates(t testing.TB) Certificates {
+	t.Helper()
+	ca, caKey, caPem := NewCertificate(t, nil, nil, true)
+	_, serverKey, serverPem := NewCertificate(t, ca, caKey, false)
+	_, clientKey, clientPem := NewCertificate(t, ca, caKey, false)
+
+	serverKeyPem := EncodeKey(t, serverKey)
+	serverKeyPair, err := tls.X509KeyPair(serverPem, serverKeyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	return Certificates{
+		CaPool:        pool,
+		CaPem:         caPem,
+		ServerKeyPair: serverKeyPair,
+		ServerPem:     serverPem,
+		ServerKeyPem:  serverKeyPem,
+		ClientPem:     clientPem,
+		ClientKeyPem:  EncodeKey(t, clientKey),
+	}
+}
+
+// ServerTlsConfig returns the TLS config of a server that presents the server certificate and, if requested,
+// requires clients to present a certificate signed by the CA
+func (c Certificates) ServerTlsConfig(requireClientCert bool) *tls.Config {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{c.ServerKeyPair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = c.CaPool
+	}
+	return config
+}
+
+// NewCertificate creates a CA certificate if no parent is given, otherwise a certificate for 127.0.0.1 signed by the
+// parent
+func NewCertificate(t testing.TB, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCa bool) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "dyndns-test"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if isCa {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// EncodeKey encodes the private key as PEM
+func EncodeKey(t testing.TB, key *ecdsa.PrivateKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// WriteFile writes the content to a file in a temporary directory and returns its path
+func WriteFile(t testing.TB, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
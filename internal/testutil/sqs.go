@@ -0,0 +1,391 @@
+package testutil
+
+import (
+	"crypto/md5" //nolint G501
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// SqsCredentials are accepted by the fake SQS service
+var SqsCredentials = &credentials.StaticProvider{Value: credentials.Value{AccessKeyID: "test", SecretAccessKey: "test"}}
+
+// SqsMessage is a message stored by the fake SQS service
+type SqsMessage struct {
+	Id                string
+	Body              string
+	Attributes        map[string]SqsMessageAttribute
+	GroupId           string
+	DeduplicationId   string
+	ReceiveCount      int
+	VisibilityChanges int
+	Deleted           bool
+
+	receiptHandle  string
+	invisibleUntil time.Time
+}
+
+// SqsMessageAttribute is a message attribute as sent by the AWS SDK
+type SqsMessageAttribute struct {
+	DataType    string `json:"DataType"`
+	StringValue string `json:"StringValue,omitempty"`
+}
+
+// Sqs is an in-memory stand-in for a single SQS queue that speaks the AWS JSON protocol. It implements the subset of
+// the API the SQS listener and dispatcher use.
+type Sqs struct {
+	Endpoint string
+	QueueUrl string
+
+	mutex         sync.Mutex
+	fifo          bool
+	messages      []*SqsMessage
+	redrivePolicy string
+	changed       chan struct{}
+}
+
+// NewSqs starts the fake SQS service, which is stopped when the test finishes
+func NewSqs(t testing.TB) *Sqs {
+	t.Helper()
+	fake := &Sqs{changed: make(chan struct{})}
+	server := httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	t.Cleanup(server.Close)
+
+	fake.Endpoint = server.URL
+	fake.QueueUrl = server.URL + "/000000000000/dyndns"
+	return fake
+}
+
+// NewFifoSqs starts the fake SQS service with a FIFO queue, which requires message group ids and drops messages with
+// duplicate deduplication ids
+func NewFifoSqs(t testing.TB) *Sqs {
+	t.Helper()
+	fake := NewSqs(t)
+	fake.fifo = true
+	fake.QueueUrl += ".fifo"
+	return fake
+}
+
+// SetRedrivePolicy configures the queue to move messages to a dead-letter queue after maxReceiveCount receives
+func (s *Sqs) SetRedrivePolicy(maxReceiveCount int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.redrivePolicy = fmt.Sprintf(`{"deadLetterTargetArn":"arn:aws:sqs:us-east-1:000000000000:dyndns-dlq","maxReceiveCount":"%d"}`, maxReceiveCount)
+}
+
+// Send adds a message with the given string attributes to the queue
+func (s *Sqs) Send(body string, attributes map[string]string) *SqsMessage {
+	return s.SendToGroup("", body, attributes)
+}
+
+// SendToGroup adds a message with the given string attributes to a message group of a FIFO queue
+func (s *Sqs) SendToGroup(groupId string, body string, attributes map[string]string) *SqsMessage {
+	message := &SqsMessage{Body: body, Attributes: map[string]SqsMessageAttribute{}, GroupId: groupId}
+	for name, value := range attributes {
+		message.Attributes[name] = SqsMessageAttribute{DataType: "String", StringValue: value}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.add(message)
+}
+
+// Messages returns a copy of all messages that have been sent to the queue, including deleted ones
+func (s *Sqs) Messages() []SqsMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	messages := make([]SqsMessage, 0, len(s.messages))
+	for _, message := range s.messages {
+		messages = append(messages, *message)
+	}
+	return messages
+}
+
+// WaitFor waits until the condition is met for the messages of the queue
+func (s *Sqs) WaitFor(t testing.TB, timeout time.Duration, condition func(messages []SqsMessage) bool) []SqsMessage {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		s.mutex.Lock()
+		changed := s.changed
+		s.mutex.Unlock()
+
+		messages := s.Messages()
+		if condition(messages) {
+			return messages
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("condition not met within %v, messages: %+v", timeout, messages)
+		}
+	}
+}
+
+// add stores the message, the mutex needs to be held by the caller
+func (s *Sqs) add(message *SqsMessage) *SqsMessage {
+	message.Id = fmt.Sprintf("message-%d", len(s.messages)+1)
+	s.messages = append(s.messages, message)
+	s.notify()
+	return message
+}
+
+// notify wakes up everybody waiting for changes, the mutex needs to be held by the caller
+func (s *Sqs) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Sqs) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSQS.")
+
+	var resp any
+	var err error
+	switch action {
+	case "ReceiveMessage":
+		resp, err = s.receiveMessage(r)
+	case "DeleteMessageBatch":
+		resp, err = s.deleteMessageBatch(r)
+	case "ChangeMessageVisibilityBatch":
+		resp, err = s.changeMessageVisibilityBatch(r)
+	case "GetQueueAttributes":
+		resp, err = s.getQueueAttributes()
+	case "SendMessage":
+		resp, err = s.sendMessage(r)
+	default:
+		err = fmt.Errorf("unsupported action %q", action)
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"__type": "InvalidParameterValue", "message": err.Error()})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+type sqsBatchResult struct {
+	Successful []map[string]string `json:"Successful"`
+	Failed     []map[string]any    `json:"Failed"`
+}
+
+func (r *sqsBatchResult) add(id string, ok bool) {
+	if ok {
+		r.Successful = append(r.Successful, map[string]string{"Id": id})
+		return
+	}
+	r.Failed = append(r.Failed, map[string]any{"Id": id, "Code": "ReceiptHandleIsInvalid", "Message": "invalid receipt handle", "SenderFault": true})
+}
+
+func (s *Sqs) receiveMessage(r *http.Request) (any, error) {
+	var req struct {
+		MaxNumberOfMessages int
+		VisibilityTimeout   int
+		WaitTimeSeconds     int
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	deadline := time.After(time.Duration(req.WaitTimeSeconds) * time.Second)
+	for {
+		s.mutex.Lock()
+		messages := s.receive(max(req.MaxNumberOfMessages, 1), time.Duration(req.VisibilityTimeout)*time.Second)
+		changed := s.changed
+		s.mutex.Unlock()
+		if len(messages) > 0 {
+			return map[string]any{"Messages": messages}, nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return map[string]any{}, nil
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-time.After(100 * time.Millisecond):
+			// messages become visible again without any change
+		}
+	}
+}
+
+// receive returns the visible messages and hides them for the visibility timeout. Like SQS, messages of a FIFO
+// message group are not returned while an earlier message of the group is in flight. The mutex needs to be held by
+// the caller.
+func (s *Sqs) receive(maxMessages int, visibilityTimeout time.Duration) []map[string]any {
+	var messages []map[string]any
+	blockedGroups := map[string]bool{}
+	now := time.Now()
+	for _, message := range s.messages {
+		if len(messages) == maxMessages {
+			break
+		}
+		if message.Deleted || blockedGroups[message.GroupId] {
+			continue
+		}
+		if now.Before(message.invisibleUntil) {
+			if len(message.GroupId) > 0 {
+				blockedGroups[message.GroupId] = true
+			}
+			continue
+		}
+
+		message.ReceiveCount++
+		message.receiptHandle = fmt.Sprintf("%s-%d", message.Id, message.ReceiveCount)
+		message.invisibleUntil = now.Add(visibilityTimeout)
+		attributes := map[string]string{
+			"ApproximateReceiveCount": strconv.Itoa(message.ReceiveCount),
+		}
+		if len(message.GroupId) > 0 {
+			attributes["MessageGroupId"] = message.GroupId
+		}
+		messages = append(messages, map[string]any{
+			"MessageId":         message.Id,
+			"ReceiptHandle":     message.receiptHandle,
+			"Body":              message.Body,
+			"MD5OfBody":         bodyMd5(message.Body),
+			"Attributes":        attributes,
+			"MessageAttributes": message.Attributes,
+		})
+	}
+	if len(messages) > 0 {
+		s.notify()
+	}
+	return messages
+}
+
+// find returns the message with the receipt handle of its latest receive, the mutex needs to be held by the caller
+func (s *Sqs) find(receiptHandle string) *SqsMessage {
+	for _, message := range s.messages {
+		if !message.Deleted && message.receiptHandle == receiptHandle {
+			return message
+		}
+	}
+	return nil
+}
+
+func (s *Sqs) deleteMessageBatch(r *http.Request) (any, error) {
+	var req struct {
+		Entries []struct {
+			Id            string
+			ReceiptHandle string
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := &sqsBatchResult{}
+	for _, entry := range req.Entries {
+		message := s.find(entry.ReceiptHandle)
+		if message != nil {
+			message.Deleted = true
+		}
+		result.add(entry.Id, message != nil)
+	}
+	s.notify()
+	return result, nil
+}
+
+func (s *Sqs) changeMessageVisibilityBatch(r *http.Request) (any, error) {
+	var req struct {
+		Entries []struct {
+			Id                string
+			ReceiptHandle     string
+			VisibilityTimeout int
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := &sqsBatchResult{}
+	for _, entry := range req.Entries {
+		message := s.find(entry.ReceiptHandle)
+		if message != nil {
+			message.VisibilityChanges++
+			message.invisibleUntil = time.Now().Add(time.Duration(entry.VisibilityTimeout) * time.Second)
+		}
+		result.add(entry.Id, message != nil)
+	}
+	s.notify()
+	return result, nil
+}
+
+func (s *Sqs) getQueueAttributes() (any, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	attributes := map[string]string{}
+	if len(s.redrivePolicy) > 0 {
+		attributes["RedrivePolicy"] = s.redrivePolicy
+	}
+	return map[string]any{"Attributes": attributes}, nil
+}
+
+func (s *Sqs) sendMessage(r *http.Request) (any, error) {
+	var req struct {
+		MessageBody            string
+		MessageAttributes      map[string]SqsMessageAttribute
+		MessageGroupId         string
+		MessageDeduplicationId string
+		DelaySeconds           *int
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.fifo {
+		if len(req.MessageGroupId) == 0 || len(req.MessageDeduplicationId) == 0 {
+			return nil, errors.New("fifo queues require a message group id and a deduplication id")
+		}
+		if req.DelaySeconds != nil {
+			return nil, errors.New("fifo queues do not support per-message delays")
+		}
+		for _, message := range s.messages {
+			if message.DeduplicationId == req.MessageDeduplicationId {
+				return sendMessageResult(message), nil
+			}
+		}
+	} else if len(req.MessageGroupId) > 0 || len(req.MessageDeduplicationId) > 0 {
+		return nil, errors.New("standard queues do not support message group ids and deduplication ids")
+	}
+
+	message := s.add(&SqsMessage{
+		Body:            req.MessageBody,
+		Attributes:      req.MessageAttributes,
+		GroupId:         req.MessageGroupId,
+		DeduplicationId: req.MessageDeduplicationId,
+	})
+	return sendMessageResult(message), nil
+}
+
+func sendMessageResult(message *SqsMessage) map[string]string {
+	return map[string]string{
+		"MessageId":        message.Id,
+		"MD5OfMessageBody": bodyMd5(message.Body),
+	}
+}
+
+func bodyMd5(body string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(body))) //nolint G401
+}
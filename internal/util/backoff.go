@@ -0,0 +1,28 @@
+package util
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+// BackoffDelay returns the delay before the given attempt, starting at 1, using an exponential backoff with jitter
+func BackoffDelay(backoff conf.BackoffConfig, attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	delay := float64(backoff.Initial) * math.Pow(backoff.Multiplier, float64(attempt-1))
+	if delay > float64(backoff.Max) {
+		delay = float64(backoff.Max)
+	}
+
+	if backoff.Jitter > 0 {
+		// #nosec G404
+		delay *= 1 + (rand.Float64()*2-1)*backoff.Jitter
+	}
+
+	return time.Duration(delay)
+}
@@ -0,0 +1,24 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := conf.BackoffConfig{
+		Initial:    time.Second,
+		Max:        5 * time.Second,
+		Multiplier: 2,
+		Jitter:     0.5,
+	}
+
+	for attempt, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		got := BackoffDelay(backoff, attempt+1)
+		if got < expected/2 || got > expected*3/2 {
+			t.Fatalf("attempt %d: expected %v +/- 50%%, got %v", attempt+1, expected, got)
+		}
+	}
+}
@@ -1,38 +1,96 @@
 package util
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/rs/zerolog/log"
 	"net"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/conf"
 )
 
-func HostnameMatchesIp(host, ipv4, ipv6 string) bool {
-	ips, err := LookupDns(host)
-	if err != nil {
-		log.Info().Msgf("Error looking up dns record %s: %v", host, err)
-		return false
-	}
+const dnsLookupTimeout = 5 * time.Second
 
-	for _, hostIp := range ips {
-		if hostIp == ipv4 || hostIp == ipv6 {
-			log.Info().Msgf("DNS record %s verified", host)
-			return true
-		}
+// RecordVerifier looks up DNS records to verify they contain the expected addresses
+type RecordVerifier interface {
+	// Lookup returns the addresses of the host's record for the given address family, either "ip4" or "ip6". A
+	// non-existing record is not an error and returns an empty slice.
+	Lookup(host string, addressFamily string) ([]string, error)
+}
+
+func NewRecordVerifier(verificationConf conf.DnsVerificationConfig) (RecordVerifier, error) {
+	switch verificationConf.Type {
+	case conf.DnsVerificationSystem, "":
+		return &SystemVerifier{}, nil
+	case conf.DnsVerificationAuthoritative:
+		return NewAuthoritativeVerifier(verificationConf.Nameservers, verificationConf.RequireAll)
+	default:
+		return nil, fmt.Errorf("unknown dns verification type '%s'", verificationConf.Type)
 	}
+}
 
-	return false
+// SystemVerifier looks up records using the system's resolver
+type SystemVerifier struct{}
+
+func (v *SystemVerifier) Lookup(host string, addressFamily string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+
+	return lookupIps(ctx, net.DefaultResolver, host, addressFamily)
 }
 
-func LookupDns(host string) ([]string, error) {
-	response, err := net.LookupIP(host)
+func lookupIps(ctx context.Context, resolver *net.Resolver, host string, addressFamily string) ([]string, error) {
+	response, err := resolver.LookupIP(ctx, addressFamily, host)
 	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return []string{}, nil
+		}
 		return nil, fmt.Errorf("could not resolve host %s: %v", host, err)
 	}
 
-	var ips []string
+	ips := make([]string, 0, len(response))
 	for _, ip := range response {
 		ips = append(ips, ip.String())
 	}
 
 	return ips, nil
 }
+
+// HostnameMatchesIp returns whether the records of the host contain the given ipv4 and ipv6 addresses. Each non-empty
+// address is checked against the record of its address family.
+func HostnameMatchesIp(verifier RecordVerifier, host, ipv4, ipv6 string) bool {
+	expected := []struct {
+		addressFamily string
+		ip            string
+	}{
+		{addressFamily: conf.AddrFamilyIpv4, ip: ipv4},
+		{addressFamily: conf.AddrFamilyIpv6, ip: ipv6},
+	}
+
+	verified := false
+	for _, family := range expected {
+		if len(family.ip) == 0 {
+			continue
+		}
+
+		ips, err := verifier.Lookup(host, family.addressFamily)
+		if err != nil {
+			log.Info().Msgf("Error looking up dns record %s: %v", host, err)
+			return false
+		}
+
+		if !slices.Contains(ips, family.ip) {
+			return false
+		}
+		verified = true
+	}
+
+	if verified {
+		log.Info().Msgf("DNS record %s verified", host)
+	}
+	return verified
+}
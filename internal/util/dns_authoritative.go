@@ -0,0 +1,212 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+const (
+	dnsPort            = "53"
+	nameserverCacheTtl = 1 * time.Hour
+	dnsQueryTimeout    = 2 * time.Second
+)
+
+// nameserver holds the addresses of a single nameserver. The nameserver has answered if any of its addresses answers.
+type nameserver struct {
+	host  string
+	addrs []string
+}
+
+type cachedNameservers struct {
+	nameservers []nameserver
+	expiry      time.Time
+}
+
+// AuthoritativeVerifier looks up records by querying the authoritative nameservers of the record's zone directly,
+// bypassing any caches of the system's resolver.
+type AuthoritativeVerifier struct {
+	nameservers []nameserver
+	requireAll  bool
+	// resolver is used to discover the authoritative nameservers
+	resolver *net.Resolver
+	// queryTimeout limits each query sent to a single nameserver address
+	queryTimeout time.Duration
+
+	mutex sync.Mutex
+	cache map[string]cachedNameservers
+}
+
+// NewAuthoritativeVerifier returns a verifier that queries the given nameservers. If no nameservers are given, the
+// authoritative nameservers of the zone are looked up. If requireAll is set, all nameservers need to agree on the
+// addresses of a record.
+func NewAuthoritativeVerifier(nameservers []string, requireAll bool) (*AuthoritativeVerifier, error) {
+	verifier := &AuthoritativeVerifier{
+		requireAll:   requireAll,
+		resolver:     net.DefaultResolver,
+		queryTimeout: dnsQueryTimeout,
+		cache:        map[string]cachedNameservers{},
+	}
+
+	for _, host := range nameservers {
+		if len(host) == 0 {
+			return nil, errors.New("empty nameserver provided")
+		}
+		addr := withDnsPort(host)
+		verifier.nameservers = append(verifier.nameservers, nameserver{host: addr, addrs: []string{addr}})
+	}
+
+	return verifier, nil
+}
+
+func withDnsPort(nameserver string) string {
+	if _, _, err := net.SplitHostPort(nameserver); err == nil {
+		return nameserver
+	}
+	return net.JoinHostPort(nameserver, dnsPort)
+}
+
+func (v *AuthoritativeVerifier) Lookup(host string, addressFamily string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	nameservers, err := v.getNameservers(ctx, host)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs error
+	var answer []string
+	for _, nameserver := range nameservers {
+		ips, err := v.query(nameserver, host, addressFamily)
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("nameserver %s: %w", nameserver.host, err))
+			continue
+		}
+
+		slices.Sort(ips)
+		if !v.requireAll {
+			return ips, nil
+		}
+
+		if answer == nil {
+			answer = ips
+		} else if !slices.Equal(answer, ips) {
+			return nil, fmt.Errorf("nameservers disagree on record %s: %v != %v", host, answer, ips)
+		}
+	}
+
+	if errs != nil {
+		return nil, errs
+	}
+
+	return answer, nil
+}
+
+// query tries the addresses of the nameserver one after another and returns the first answer. Each query is limited
+// by its own timeout, so unreachable addresses, e.g. ipv6 addresses on ipv4-only hosts, do not delay the others.
+func (v *AuthoritativeVerifier) query(nameserver nameserver, host string, addressFamily string) ([]string, error) {
+	var errs error
+	for _, addr := range nameserver.addrs {
+		ctx, cancel := context.WithTimeout(context.Background(), v.queryTimeout)
+		ips, err := lookupIps(ctx, nameserverResolver(addr), fqdn(host), addressFamily)
+		cancel()
+		if err == nil {
+			return ips, nil
+		}
+		errs = multierr.Append(errs, fmt.Errorf("%s: %w", addr, err))
+	}
+
+	return nil, errs
+}
+
+// getNameservers returns the configured nameservers or the authoritative nameservers of the host's zone
+func (v *AuthoritativeVerifier) getNameservers(ctx context.Context, host string) ([]nameserver, error) {
+	if len(v.nameservers) > 0 {
+		return v.nameservers, nil
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	cached, ok := v.cache[host]
+	if ok && time.Now().Before(cached.expiry) {
+		return cached.nameservers, nil
+	}
+
+	nameservers, err := v.discoverNameservers(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	v.cache[host] = cachedNameservers{
+		nameservers: nameservers,
+		expiry:      time.Now().Add(nameserverCacheTtl),
+	}
+	return nameservers, nil
+}
+
+// discoverNameservers walks up the labels of the host until a zone with NS records is found and returns the
+// addresses of its nameservers.
+func (v *AuthoritativeVerifier) discoverNameservers(ctx context.Context, host string) ([]nameserver, error) {
+	name := strings.TrimSuffix(host, ".")
+	for strings.Contains(name, ".") {
+		records, err := v.resolver.LookupNS(ctx, name)
+		if err == nil && len(records) > 0 {
+			return v.resolveNameservers(ctx, records)
+		}
+
+		_, name, _ = strings.Cut(name, ".")
+	}
+
+	return nil, fmt.Errorf("could not find authoritative nameservers for %s", host)
+}
+
+// resolveNameservers returns the addresses of each nameserver, grouped by nameserver
+func (v *AuthoritativeVerifier) resolveNameservers(ctx context.Context, records []*net.NS) ([]nameserver, error) {
+	var errs error
+	var nameservers []nameserver
+	for _, record := range records {
+		addrs, err := v.resolver.LookupHost(ctx, record.Host)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+
+		resolved := nameserver{host: record.Host}
+		for _, addr := range addrs {
+			resolved.addrs = append(resolved.addrs, net.JoinHostPort(addr, dnsPort))
+		}
+		nameservers = append(nameservers, resolved)
+	}
+
+	if len(nameservers) == 0 {
+		return nil, fmt.Errorf("could not resolve authoritative nameservers: %w", errs)
+	}
+
+	return nameservers, nil
+}
+
+// nameserverResolver returns a resolver that sends all queries to the given nameserver
+func nameserverResolver(nameserver string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dialer := net.Dialer{}
+			return dialer.DialContext(ctx, network, nameserver)
+		},
+	}
+}
+
+func fqdn(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+	return host + "."
+}
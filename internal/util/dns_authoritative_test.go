@@ -0,0 +1,209 @@
+package util
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soerenschneider/dyndns/internal/conf"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeNameserver answers A queries for all names with the given address. If no address is given, it answers with
+// NXDOMAIN.
+func fakeNameserver(t *testing.T, ipv4 string) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) == 0 {
+				continue
+			}
+
+			resp := dnsmessage.Message{
+				Header: dnsmessage.Header{
+					ID:            query.ID,
+					Response:      true,
+					Authoritative: true,
+				},
+				Questions: query.Questions,
+			}
+
+			question := query.Questions[0]
+			if len(ipv4) == 0 {
+				resp.RCode = dnsmessage.RCodeNameError
+			} else if question.Type == dnsmessage.TypeA {
+				resp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{
+						Name:  question.Name,
+						Type:  dnsmessage.TypeA,
+						Class: dnsmessage.ClassINET,
+						TTL:   60,
+					},
+					Body: &dnsmessage.AResource{A: [4]byte(net.ParseIP(ipv4).To4())},
+				}}
+			}
+
+			packed, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(packed, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestAuthoritativeVerifier_Lookup(t *testing.T) {
+	first := fakeNameserver(t, "192.0.2.1")
+	agreeing := fakeNameserver(t, "192.0.2.1")
+	disagreeing := fakeNameserver(t, "192.0.2.2")
+	nxdomain := fakeNameserver(t, "")
+
+	tests := []struct {
+		name        string
+		nameservers []string
+		requireAll  bool
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name:        "single nameserver",
+			nameservers: []string{first},
+			want:        []string{"192.0.2.1"},
+		},
+		{
+			name:        "first answer wins",
+			nameservers: []string{first, disagreeing},
+			want:        []string{"192.0.2.1"},
+		},
+		{
+			name:        "all agree",
+			nameservers: []string{first, agreeing},
+			requireAll:  true,
+			want:        []string{"192.0.2.1"},
+		},
+		{
+			name:        "nameservers disagree",
+			nameservers: []string{first, disagreeing},
+			requireAll:  true,
+			wantErr:     true,
+		},
+		{
+			name:        "non-existing record",
+			nameservers: []string{nxdomain},
+			want:        []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier, err := NewAuthoritativeVerifier(tt.nameservers, tt.requireAll)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := verifier.Lookup("my.host.tld", conf.AddrFamilyIpv4)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Lookup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lookup() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// silentNameserver returns the address of a nameserver that never answers
+func silentNameserver(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn.LocalAddr().String()
+}
+
+func TestAuthoritativeVerifier_LookupNameserverAddresses(t *testing.T) {
+	silent := silentNameserver(t)
+	answering := fakeNameserver(t, "192.0.2.1")
+
+	tests := []struct {
+		name        string
+		nameservers []nameserver
+		wantErr     bool
+	}{
+		{
+			name: "any address answers",
+			nameservers: []nameserver{
+				{host: "ns1.host.tld", addrs: []string{silent, answering}},
+				{host: "ns2.host.tld", addrs: []string{answering}},
+			},
+		},
+		{
+			name: "no address answers",
+			nameservers: []nameserver{
+				{host: "ns1.host.tld", addrs: []string{answering}},
+				{host: "ns2.host.tld", addrs: []string{silent}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier, err := NewAuthoritativeVerifier(nil, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifier.queryTimeout = 200 * time.Millisecond
+			verifier.cache["my.host.tld"] = cachedNameservers{
+				nameservers: tt.nameservers,
+				expiry:      time.Now().Add(time.Minute),
+			}
+
+			got, err := verifier.Lookup("my.host.tld", conf.AddrFamilyIpv4)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Lookup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, []string{"192.0.2.1"}) {
+				t.Errorf("Lookup() got = %v", got)
+			}
+		})
+	}
+}
+
+func TestWithDnsPort(t *testing.T) {
+	tests := []struct {
+		nameserver string
+		want       string
+	}{
+		{nameserver: "ns1.example.com", want: "ns1.example.com:53"},
+		{nameserver: "192.0.2.1:5353", want: "192.0.2.1:5353"},
+		{nameserver: "2001:db8::1", want: "[2001:db8::1]:53"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.nameserver, func(t *testing.T) {
+			if got := withDnsPort(tt.nameserver); got != tt.want {
+				t.Errorf("withDnsPort() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+type staticVerifier map[string][]string
+
+func (v staticVerifier) Lookup(_ string, addressFamily string) ([]string, error) {
+	return v[addressFamily], nil
+}
+
+func TestHostnameMatchesIp(t *testing.T) {
+	verifier := staticVerifier{
+		conf.AddrFamilyIpv4: {"192.0.2.1"},
+		conf.AddrFamilyIpv6: {"2001:db8::1"},
+	}
+
+	tests := []struct {
+		name string
+		ipv4 string
+		ipv6 string
+		want bool
+	}{
+		{name: "ipv4 only", ipv4: "192.0.2.1", want: true},
+		{name: "dual stack", ipv4: "192.0.2.1", ipv6: "2001:db8::1", want: true},
+		{name: "stale ipv6", ipv4: "192.0.2.1", ipv6: "2001:db8::2", want: false},
+		{name: "stale ipv4", ipv4: "192.0.2.2", ipv6: "2001:db8::1", want: false},
+		{name: "no addresses", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HostnameMatchesIp(verifier, "my.host.tld", tt.ipv4, tt.ipv6); got != tt.want {
+				t.Errorf("HostnameMatchesIp() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
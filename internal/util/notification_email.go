@@ -77,3 +77,18 @@ func (e *EmailNotification) NotifyUpdatedIpApplied(ip *common.DnsRecord) error {
 
 	return d.DialAndSend(m)
 }
+
+func (e *EmailNotification) NotifyUpdatedIpUnconfirmable(ip *common.DnsRecord) error {
+	m := gomail.NewMessage()
+	m.SetHeader("From", e.From)
+	m.SetHeader("To", e.To...)
+	subject := fmt.Sprintf("DynDNS could not verify IP for host %s", ip.Host)
+	m.SetHeader("Subject", subject)
+
+	body := fmt.Sprintf("DNS record could not be verified, update requests are not re-sent anymore: %s", ip)
+	m.SetBody("text/plain", body)
+
+	d := gomail.NewDialer(e.SmtpHost, e.SmtpPort, e.smtpUsername, e.smtpPassword)
+
+	return d.DialAndSend(m)
+}
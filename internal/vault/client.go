@@ -66,7 +66,7 @@ func (m *VaultCredentialProvider) Retrieve() (credentials.Value, error) {
 }
 
 func (m *VaultCredentialProvider) IsExpired() bool {
-	return time.Now().Before(m.expiry)
+	return !time.Now().Before(m.expiry)
 }
 
 func (m *VaultCredentialProvider) readAwsCredentials() (*api.Secret, error) {
@@ -0,0 +1,79 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/api/auth/approle"
+	"github.com/rs/zerolog/log"
+	"github.com/soerenschneider/dyndns/internal/conf"
+)
+
+// NewAwsCredentialsProvider builds a provider that acquires dynamic AWS credentials using Vault's AWS secret engine. It
+// returns nil if Vault is not configured, so the default credentials chain of the AWS SDK is used.
+func NewAwsCredentialsProvider(config *conf.VaultConfig) (credentials.Provider, error) {
+	if config == nil {
+		return nil, errors.New("nil config provided")
+	}
+
+	if !config.UseVaultCredentialsProvider() {
+		return nil, nil
+	}
+
+	client, err := buildVaultClient(config)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := buildVaultAuth(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildAwsVaultCredentialProvider(config, client, auth)
+}
+
+func buildVaultClient(conf *conf.VaultConfig) (*api.Client, error) {
+	config := api.DefaultConfig()
+	config.Address = conf.VaultAddr
+	config.Timeout = 30 * time.Second
+
+	return api.NewClient(config)
+}
+
+// buildAwsVaultCredentialProvider returns the vault credentials provider, but only if it succeeds to login at vault
+// otherwise the default credentials provider by AWS is used, trying to be resilient
+func buildAwsVaultCredentialProvider(config *conf.VaultConfig, client *api.Client, auth Auth) (credentials.Provider, error) {
+	provider, err := NewVaultCredentialProvider(client, auth, config)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("component", "vault").Msg("Testing authentication against vault")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err = client.Auth().Login(ctx, auth)
+	if err != nil {
+		return nil, fmt.Errorf("could not authenticate against vault: %w", err)
+	}
+
+	return provider, nil
+}
+
+func buildVaultAuth(config *conf.VaultConfig) (Auth, error) {
+	switch config.AuthStrategy {
+	case conf.VaultAuthStrategyToken:
+		return NewTokenAuth(config.VaultToken)
+	case conf.VaultAuthStrategyApprole:
+		secretId := &approle.SecretID{
+			FromString: config.AppRoleSecretId,
+		}
+		return approle.NewAppRoleAuth(config.AppRoleId, secretId)
+	default:
+		return nil, errors.New("can't build vault auth")
+	}
+}